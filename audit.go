@@ -0,0 +1,428 @@
+package etcd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/client"
+)
+
+// Operations recorded in the audit log
+const (
+	AuditStore        = "store"
+	AuditDelete       = "delete"
+	AuditLockTakeover = "lock-takeover"
+	AuditPublish      = "publish"
+	AuditRestore      = "restore"
+	AuditRepair       = "repair"
+	AuditMigrate      = "migrate"
+	AuditUpload       = "upload"
+	AuditPurge        = "purge"
+	AuditCopy         = "copy"
+	AuditRename       = "rename"
+	AuditPrune        = "prune"
+)
+
+// AuditEntry records one change made to etcd through the plugin.  OldHash and NewHash are the SHA1 hashes of the
+// value before and after the change, and are zero when there was no value.  Hash covers every other field,
+// including PrevHash, the hash of the entry before it, so that removing or editing an entry breaks the chain.
+type AuditEntry struct {
+	Seq       int
+	Timestamp time.Time
+	Instance  string
+	Operation string
+	Key       string
+	OldHash   [20]byte
+	NewHash   [20]byte
+	Detail    string `json:",omitempty"`
+	PrevHash  [32]byte
+	Hash      [32]byte
+}
+
+// chainHash returns the hash of the entry, which is stored in Hash and in PrevHash of the next entry
+func (a AuditEntry) chainHash() [32]byte {
+	s := fmt.Sprintf("%d\n%s\n%q\n%q\n%q\n%x\n%x\n%q\n%x", a.Seq, a.Timestamp.UTC().Format(time.RFC3339Nano), a.Instance, a.Operation, a.Key, a.OldHash, a.NewHash, a.Detail, a.PrevHash)
+	return sha256.Sum256([]byte(s))
+}
+
+// auditMark points at an entry of the audit log by sequence number and hash
+type auditMark struct {
+	Seq  int
+	Hash [32]byte
+}
+
+// Audit is the tamper-evident log of changes kept under `<KeyPrefix>/audit`.  Entries are numbered in the order
+// they were appended and chained by hash.  The oldest entries past the configured retention are removed, and the
+// last removed entry is remembered so that the remaining chain can still be verified.  Each removal is recorded
+// by a prune entry in the chain, so the remembered entry cannot be moved without breaking it.
+type Audit struct {
+	cfg       *ClusterConfig
+	prefix    string
+	retention int
+}
+
+// NewAudit returns the audit log of the cluster
+func NewAudit(c *ClusterConfig) *Audit {
+	return &Audit{
+		cfg:       c,
+		prefix:    path.Join(c.KeyPrefix, "audit"),
+		retention: c.AuditRetention,
+	}
+}
+
+// Append records a change.  The sequence number, timestamp, instance, and hashes of e are filled in.  Entries
+// appended concurrently by other instances are never overwritten; the append moves on to the next free
+// sequence number instead.
+func (a *Audit) Append(e AuditEntry) (*AuditEntry, error) {
+	return a.appendEntry(context.Background(), e)
+}
+
+// appendEntry appends e and prunes the entries past the retention, giving up when ctx is done
+func (a *Audit) appendEntry(ctx context.Context, e AuditEntry) (*AuditEntry, error) {
+	cli, err := getClient(a.cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "audit: failed to get client")
+	}
+	appended, pruned, err := a.add(ctx, cli, e)
+	if err != nil {
+		return nil, err
+	}
+	a.prune(ctx, cli, appended.Seq, pruned)
+	return appended, nil
+}
+
+// add appends e after the newest entry and moves the head to it.  It returns the appended entry and the pruned mark.
+func (a *Audit) add(ctx context.Context, cli client.KeysAPI, e AuditEntry) (*AuditEntry, auditMark, error) {
+	head, err := a.mark(ctx, cli, "head")
+	if err != nil {
+		return nil, auditMark{}, err
+	}
+	pruned, err := a.mark(ctx, cli, "pruned")
+	if err != nil {
+		return nil, auditMark{}, err
+	}
+	if pruned.Seq > head.Seq {
+		head = pruned
+	}
+	e.Timestamp = time.Now().UTC()
+	e.Instance = a.cfg.InstanceID
+	add := func() error {
+		// the head is only a hint, so catch up with entries appended since it was written, including one appended
+		// by another instance after the previous attempt caught up
+		for {
+			next, err := a.entry(ctx, cli, head.Seq+1)
+			if IsNotExistError(err) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			head = auditMark{Seq: next.Seq, Hash: next.Hash}
+		}
+		e.Seq = head.Seq + 1
+		e.PrevHash = head.Hash
+		e.Hash = e.chainHash()
+		b, err := json.Marshal(e)
+		if err != nil {
+			return backoff.Permanent(errors.Wrap(err, "audit: failed to marshal entry"))
+		}
+		_, err = cli.Set(ctx, a.entryKey(e.Seq), base64.StdEncoding.EncodeToString(b), &client.SetOptions{PrevExist: client.PrevNoExist})
+		if err != nil {
+			return errors.Wrap(err, "audit: failed to append entry")
+		}
+		return nil
+	}
+	appended := func() error {
+		for {
+			err := add()
+			if e, ok := errors.Cause(err).(client.Error); ok && e.Code == client.ErrorCodeNodeExist {
+				continue
+			}
+			return err
+		}
+	}
+	if err := backoff.Retry(appended, backoff.WithContext(backoff.NewExponentialBackOff(), ctx)); err != nil {
+		return nil, auditMark{}, err
+	}
+	if err := a.setMark(ctx, cli, "head", auditMark{Seq: e.Seq, Hash: e.Hash}); err != nil {
+		a.cfg.log(LevelWarn, "failed to update audit head", F("seq", e.Seq), F(FieldError, err))
+	}
+	return &e, pruned, nil
+}
+
+// List returns the retained entries in order
+func (a *Audit) List() ([]AuditEntry, error) {
+	cli, err := getClient(a.cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "audit: failed to get client")
+	}
+	return a.list(cli)
+}
+
+// Verify checks that the retained entries form an unbroken chain from the last pruned entry to the newest one, and
+// that the last pruned entry is the one recorded by a prune entry in the chain.  A `TamperedAudit` error names the
+// first entry that is missing, was modified, or does not follow the entry before it.
+func (a *Audit) Verify() error {
+	cli, err := getClient(a.cfg)
+	if err != nil {
+		return errors.Wrap(err, "audit: failed to get client")
+	}
+	pruned, err := a.mark(context.Background(), cli, "pruned")
+	if err != nil {
+		return err
+	}
+	head, err := a.mark(context.Background(), cli, "head")
+	if err != nil {
+		return err
+	}
+	entries, err := a.list(cli)
+	if err != nil {
+		return err
+	}
+	prev := pruned
+	// the pruned mark is only trusted if a prune entry in the chain moved it there; an interrupted prune leaves it
+	// at the mark of the prune entry before
+	recorded := pruned.Seq == 0
+	for _, e := range entries {
+		// entries at or before the pruned mark are left over from an interrupted prune
+		if e.Seq <= pruned.Seq {
+			continue
+		}
+		switch {
+		case e.Seq != prev.Seq+1:
+			return TamperedAudit{Seq: prev.Seq + 1, Reason: "entry is missing"}
+		case e.PrevHash != prev.Hash:
+			return TamperedAudit{Seq: e.Seq, Reason: "entry does not follow the entry before it"}
+		case e.chainHash() != e.Hash:
+			return TamperedAudit{Seq: e.Seq, Reason: "entry was modified"}
+		}
+		if m, ok := prunedMark(e); ok && m == pruned {
+			recorded = true
+		}
+		prev = auditMark{Seq: e.Seq, Hash: e.Hash}
+	}
+	if !recorded {
+		return TamperedAudit{Seq: pruned.Seq, Reason: "entries were removed without a prune entry"}
+	}
+	switch {
+	case head.Seq > prev.Seq:
+		return TamperedAudit{Seq: prev.Seq + 1, Reason: fmt.Sprintf("entries %d to %d are missing", prev.Seq+1, head.Seq)}
+	case head.Seq == prev.Seq && head.Hash != prev.Hash:
+		return TamperedAudit{Seq: head.Seq, Reason: "entry was modified"}
+	}
+	return nil
+}
+
+// prune removes the entries before the newest retention entries once a tenth of the retention has built up past
+// it, so that prune entries do not crowd out other entries.  The prune is recorded by a prune entry, which counts
+// towards the retention, and then the pruned mark is moved, so that an interrupted prune never looks like a missing
+// entry.  A retention of 0 keeps every entry.
+func (a *Audit) prune(ctx context.Context, cli client.KeysAPI, newest int, pruned auditMark) {
+	last := newest - a.retention + 1
+	if a.retention <= 0 || last-pruned.Seq < pruneBatch(a.retention) {
+		return
+	}
+	e, err := a.entry(ctx, cli, last)
+	if err != nil {
+		a.cfg.log(LevelWarn, "failed to prune audit log", F("seq", last), F(FieldError, err))
+		return
+	}
+	m := auditMark{Seq: e.Seq, Hash: e.Hash}
+	if _, _, err := a.add(ctx, cli, AuditEntry{Operation: AuditPrune, Detail: fmt.Sprintf(pruneDetail, m.Seq, m.Hash[:])}); err != nil {
+		a.cfg.log(LevelWarn, "failed to prune audit log", F("seq", last), F(FieldError, err))
+		return
+	}
+	if err := a.setMark(ctx, cli, "pruned", m); err != nil {
+		a.cfg.log(LevelWarn, "failed to prune audit log", F("seq", last), F(FieldError, err))
+		return
+	}
+	for seq := pruned.Seq + 1; seq <= last; seq++ {
+		if _, err := cli.Delete(ctx, a.entryKey(seq), nil); err != nil && !client.IsKeyNotFound(err) {
+			a.cfg.log(LevelWarn, "failed to prune audit entry", F("seq", seq), F(FieldError, err))
+		}
+	}
+}
+
+// pruneDetail is the detail of a prune entry, naming the last entry that was removed and its hash
+const pruneDetail = "entries up to %d removed, last hash %x"
+
+// pruneBatch returns how many entries past the retention are pruned at once
+func pruneBatch(retention int) int {
+	if retention < 10 {
+		return 1
+	}
+	return retention / 10
+}
+
+// prunedMark returns the pruned mark recorded by a prune entry
+func prunedMark(e AuditEntry) (auditMark, bool) {
+	var m auditMark
+	var hash []byte
+	if e.Operation != AuditPrune {
+		return m, false
+	}
+	if _, err := fmt.Sscanf(e.Detail, pruneDetail, &m.Seq, &hash); err != nil || len(hash) != len(m.Hash) {
+		return m, false
+	}
+	copy(m.Hash[:], hash)
+	return m, true
+}
+
+func (a *Audit) list(cli client.KeysAPI) ([]AuditEntry, error) {
+	nodes, err := list(cli, path.Join(a.prefix, "entries"))
+	if err != nil {
+		return nil, errors.Wrap(err, "audit: failed to list entries")
+	}
+	var entries []AuditEntry
+	for _, n := range filter(nodes, FilterRemoveDirectories()) {
+		var e AuditEntry
+		if err := decodeAudit(n.Value, &e); err != nil {
+			seq, _ := strconv.Atoi(path.Base(n.Key))
+			return nil, TamperedAudit{Seq: seq, Reason: err.Error()}
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+	return entries, nil
+}
+
+func (a *Audit) entry(ctx context.Context, cli client.KeysAPI, seq int) (*AuditEntry, error) {
+	resp, err := cli.Get(ctx, a.entryKey(seq), nil)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return nil, NotExist{a.entryKey(seq)}
+		}
+		return nil, errors.Wrap(err, "audit: failed to get entry")
+	}
+	e := new(AuditEntry)
+	if err := decodeAudit(resp.Node.Value, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// mark returns the mark stored at name, or the zero mark if there is none
+func (a *Audit) mark(ctx context.Context, cli client.KeysAPI, name string) (auditMark, error) {
+	var m auditMark
+	resp, err := cli.Get(ctx, path.Join(a.prefix, name), nil)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return m, nil
+		}
+		return m, errors.Wrapf(err, "audit: failed to get %s", name)
+	}
+	if err := decodeAudit(resp.Node.Value, &m); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+func (a *Audit) setMark(ctx context.Context, cli client.KeysAPI, name string, m auditMark) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrapf(err, "audit: failed to marshal %s", name)
+	}
+	_, err = cli.Set(ctx, path.Join(a.prefix, name), base64.StdEncoding.EncodeToString(b), nil)
+	return errors.Wrapf(err, "audit: failed to set %s", name)
+}
+
+func (a *Audit) entryKey(seq int) string {
+	return path.Join(a.prefix, "entries", fmt.Sprintf("%020d", seq))
+}
+
+func decodeAudit(value string, dst interface{}) error {
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return errors.Wrap(err, "audit: failed to decode entry")
+	}
+	return errors.Wrap(json.Unmarshal(b, dst), "audit: failed to unmarshal entry")
+}
+
+// auditTimeout bounds how long the background appender tries to record one change
+const auditTimeout = 10 * time.Second
+
+// auditQueue holds the changes made by this process that are waiting to be appended to the audit log.  Changes
+// are appended in the background, in order, so that storage operations do not wait for the audit log unless the
+// queue is full.
+var auditQueue = struct {
+	once    sync.Once
+	changes chan queuedChange
+}{changes: make(chan queuedChange, 1024)}
+
+// queuedChange is a change waiting to be recorded, or a flush waiting for the changes before it when done is set
+type queuedChange struct {
+	cfg   *ClusterConfig
+	entry AuditEntry
+	done  chan struct{}
+}
+
+// audit queues an entry for a change, unless the audit log is disabled.  When too many changes are waiting to be
+// recorded, it blocks until there is room rather than drop the entry.  A change that was made but could not be
+// recorded is logged rather than undone.
+func audit(c *ClusterConfig, op string, key string, oldHash [20]byte, newHash [20]byte, detail string) {
+	if c.DisableAudit {
+		return
+	}
+	auditQueue.once.Do(startAudit)
+	q := queuedChange{cfg: c, entry: AuditEntry{Operation: op, Key: key, OldHash: oldHash, NewHash: newHash, Detail: detail}}
+	select {
+	case auditQueue.changes <- q:
+	default:
+		c.log(LevelWarn, "audit log is behind, waiting to record change", F(FieldOperation, op), F(FieldKey, key))
+		auditQueue.changes <- q
+	}
+}
+
+// startAudit starts appending queued changes to the audit log
+func startAudit() {
+	go func() {
+		for q := range auditQueue.changes {
+			if q.done != nil {
+				close(q.done)
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+			if _, err := NewAudit(q.cfg).appendEntry(ctx, q.entry); err != nil {
+				q.cfg.log(LevelError, "failed to record change in audit log", F(FieldOperation, q.entry.Operation), F(FieldKey, q.entry.Key), F(FieldError, err))
+			}
+			cancel()
+		}
+	}()
+}
+
+// FlushAudit waits until the changes made by this process so far are recorded in the audit log, or timeout passes.
+// Changes are recorded in the background, so a program that exits after changing etcd calls it first.  Caddy calls
+// it when it exits.
+func FlushAudit(timeout time.Duration) error {
+	auditQueue.once.Do(startAudit)
+	done := make(chan struct{})
+	deadline := time.After(timeout)
+	select {
+	case auditQueue.changes <- queuedChange{done: done}:
+	case <-deadline:
+		return errors.New("audit: timed out waiting for changes to be recorded")
+	}
+	select {
+	case <-done:
+		return nil
+	case <-deadline:
+		return errors.New("audit: timed out waiting for changes to be recorded")
+	}
+}
+
+// flushAuditOnExit records the changes still waiting in the queue before Caddy exits
+func flushAuditOnExit() {
+	if err := FlushAudit(auditTimeout); err != nil {
+		defaultLogger.Log(LevelError, "failed to record changes in audit log before exiting", F(FieldError, err))
+	}
+}
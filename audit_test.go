@@ -0,0 +1,160 @@
+package etcd
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// operations returns the operation and key of each entry
+func operations(entries []AuditEntry) []string {
+	var out []string
+	for _, e := range entries {
+		out = append(out, e.Operation+" "+e.Key)
+	}
+	return out
+}
+
+func TestAudit(t *testing.T) {
+	cfg, cli, done := testPrefix(t, "audit")
+	defer done()
+	cfg.LockTimeout = time.Second
+	cfg.InstanceID = "web-1"
+	srv := NewService(cfg)
+	a := NewAudit(cfg)
+
+	assert.NoError(t, srv.Store("certs/one", []byte("12345")))
+	assert.NoError(t, srv.Store("certs/one", []byte("123")))
+	assert.NoError(t, srv.Delete("certs/one"))
+	// a lock held by another client past the lock timeout is taken over
+	other := &etcdsrv{lockKey: path.Join(cfg.KeyPrefix, "lock"), cfg: cfg}
+	assert.NoError(t, other.lock(&operation{name: "lock"}, "other", "certs/two"))
+	time.Sleep(cfg.LockTimeout)
+	assert.NoError(t, srv.Lock("certs/two"))
+	_, err := NewHistory(cfg, "http").Publish([]byte("audit.cluster.local {\n\tproxy test:123\n}"), "alice")
+	assert.NoError(t, err)
+
+	assert.NoError(t, FlushAudit(time.Minute))
+	entries, err := a.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"store certs/one",
+		"store certs/one",
+		"delete certs/one",
+		"lock-takeover certs/two",
+		"store history/caddyfiles/http/0000000001",
+		"store caddyfiles/http",
+		"publish caddyfiles/http",
+	}, operations(entries))
+	assert.Equal(t, [20]byte{}, entries[0].OldHash)
+	assert.Equal(t, sha1.Sum([]byte("12345")), entries[0].NewHash)
+	assert.Equal(t, sha1.Sum([]byte("12345")), entries[1].OldHash)
+	assert.Equal(t, sha1.Sum([]byte("123")), entries[2].OldHash)
+	assert.Equal(t, [20]byte{}, entries[2].NewHash)
+	assert.Contains(t, entries[3].Detail, "was abandoned")
+	assert.Equal(t, "revision 1 by alice", entries[6].Detail)
+	for i, e := range entries {
+		assert.Equal(t, i+1, e.Seq)
+		assert.Equal(t, "web-1", e.Instance)
+	}
+	assert.NoError(t, a.Verify())
+
+	raw := func(seq int) *AuditEntry {
+		e, err := a.entry(context.Background(), cli, seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	put := func(e *AuditEntry) {
+		b, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cli.Set(context.Background(), a.entryKey(e.Seq), base64.StdEncoding.EncodeToString(b), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// editing an entry without fixing its hash
+	e2 := raw(2)
+	edited := *e2
+	edited.NewHash = sha1.Sum([]byte("forged"))
+	put(&edited)
+	err = a.Verify()
+	assert.True(t, IsTamperedAuditError(err))
+	assert.Equal(t, TamperedAudit{Seq: 2, Reason: "entry was modified"}, err)
+
+	// editing an entry and its hash breaks the link from the next entry
+	edited.Hash = edited.chainHash()
+	put(&edited)
+	assert.Equal(t, TamperedAudit{Seq: 3, Reason: "entry does not follow the entry before it"}, a.Verify())
+	put(e2)
+	assert.NoError(t, a.Verify())
+
+	// removing an entry in the middle
+	e4 := raw(4)
+	_, err = cli.Delete(context.Background(), a.entryKey(4), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, TamperedAudit{Seq: 4, Reason: "entry is missing"}, a.Verify())
+	put(e4)
+
+	// removing the newest entry
+	_, err = cli.Delete(context.Background(), a.entryKey(7), nil)
+	assert.NoError(t, err)
+	err = a.Verify()
+	assert.True(t, IsTamperedAuditError(err))
+	assert.Equal(t, 7, err.(TamperedAudit).Seq)
+}
+
+func TestAuditRetention(t *testing.T) {
+	cfg, cli, done := testPrefix(t, "auditretention")
+	defer done()
+	cfg.AuditRetention = 3
+	a := NewAudit(cfg)
+	for i := 0; i < 5; i++ {
+		_, err := a.Append(AuditEntry{Operation: AuditStore, Key: "certs/one"})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, FlushAudit(time.Minute))
+	entries, err := a.List()
+	assert.NoError(t, err)
+	// each prune is recorded in the chain and counts towards the retention
+	assert.Equal(t, []string{"prune ", "store certs/one", "prune "}, operations(entries))
+	if assert.Len(t, entries, 3) {
+		assert.Equal(t, 6, entries[0].Seq)
+		m, ok := prunedMark(entries[2])
+		assert.True(t, ok)
+		assert.Equal(t, 5, m.Seq)
+	}
+	assert.NoError(t, a.Verify())
+
+	// an entry appended by an instance whose head is behind continues the chain
+	_, err = cli.Delete(context.Background(), path.Join(a.prefix, "head"), nil)
+	assert.NoError(t, err)
+	e, err := a.Append(AuditEntry{Operation: AuditDelete, Key: "certs/one"})
+	assert.NoError(t, err)
+	assert.Equal(t, 9, e.Seq)
+	assert.NoError(t, a.Verify())
+
+	// moving the pruned mark past entries without a prune entry that records it
+	pruned, err := a.mark(context.Background(), cli, "pruned")
+	assert.NoError(t, err)
+	assert.Equal(t, 7, pruned.Seq)
+	assert.NoError(t, a.setMark(context.Background(), cli, "pruned", auditMark{Seq: e.Seq, Hash: e.Hash}))
+	assert.Equal(t, TamperedAudit{Seq: 9, Reason: "entries were removed without a prune entry"}, a.Verify())
+	assert.NoError(t, a.setMark(context.Background(), cli, "pruned", pruned))
+	assert.NoError(t, a.Verify())
+
+	cfg.DisableAudit = true
+	assert.NoError(t, NewService(cfg).Store("certs/two", []byte("123")))
+	entries, err = a.List()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, entries[len(entries)-1].Seq)
+}
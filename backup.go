@@ -0,0 +1,354 @@
+package etcd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/client"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Files of a backup archive.  Values are stored under data/ and secrets under secrets/ as they are stored in etcd.
+// Version 1 archives have no secrets.
+const (
+	backupManifest  = "manifest.json"
+	backupSignature = "manifest.sig"
+	backupData      = "data"
+	backupSecrets   = "secrets"
+	backupVersion   = 2
+)
+
+// BackupManifest lists every key in a backup with the SHA256 hash of its value.  Index is the etcd index the backup
+// was read at, so every key reflects the same point in time.  Secrets lists the secrets stored under SecretsPrefix,
+// which are read separately at SecretsIndex.
+type BackupManifest struct {
+	Version       int
+	Prefix        string
+	Index         uint64
+	Created       time.Time
+	Instance      string
+	Entries       []BackupEntry
+	SecretsPrefix string
+	SecretsIndex  uint64
+	Secrets       []BackupEntry
+}
+
+// BackupEntry is one key of a backup, relative to the key prefix, or a secret, relative to the secrets prefix
+type BackupEntry struct {
+	Key  string
+	Size int
+	Hash [32]byte
+}
+
+// RestoreOptions controls a restore
+type RestoreOptions struct {
+	// Prefix is the key prefix to restore to, which defaults to the key prefix of the configuration
+	Prefix string
+	// SecretsPrefix is the prefix to restore secrets to.  It defaults to Prefix with "-secrets" appended when Prefix
+	// is set, and to the secrets prefix of the configuration otherwise.
+	SecretsPrefix string
+	// Overwrite allows restoring to a prefix that already holds keys.  Keys that are not in the backup are left
+	// in place.
+	Overwrite bool
+}
+
+// Backup writes a gzip compressed tar archive of every value, metadata node, and Caddyfile under the key prefix, and
+// of every secret under the secrets prefix, to w, with a manifest signed by priv.  All keys under the key prefix
+// are read in a single request, so the archive is a consistent copy of the prefix at one etcd index, and secrets
+// are read in a second one.  Secrets are archived as they are stored in etcd, so they are only encrypted if a
+// secrets key is configured.  Locks and the audit log belong to the running cluster and are not backed up.
+func Backup(c *ClusterConfig, w io.Writer, priv ed25519.PrivateKey) (*BackupManifest, error) {
+	if len(priv) != ed25519.PrivateKeySize {
+		return nil, errors.New("backup: a private key is required to sign the manifest")
+	}
+	cli, err := getClient(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "backup: failed to get client")
+	}
+	var resp *client.Response
+	read := func() error {
+		var err error
+		resp, err = cli.Get(context.Background(), c.KeyPrefix, &client.GetOptions{Recursive: true, Quorum: true})
+		if err != nil && client.IsKeyNotFound(err) {
+			return backoff.Permanent(NotExist{c.KeyPrefix})
+		}
+		return errors.Wrap(err, "backup: failed to read key prefix")
+	}
+	if err := backoff.Retry(read, backoff.NewExponentialBackOff()); err != nil {
+		return nil, err
+	}
+	var nodes []client.Node
+	walkNodes(resp.Node, &nodes)
+	values := make(map[string]string)
+	m := &BackupManifest{
+		Version:  backupVersion,
+		Prefix:   c.KeyPrefix,
+		Index:    resp.Index,
+		Created:  time.Now().UTC(),
+		Instance: c.InstanceID,
+	}
+	for _, n := range filter(nodes, FilterRemoveDirectories()) {
+		key := strings.TrimPrefix(n.Key, strings.TrimSuffix(c.KeyPrefix, "/")+"/")
+		if !backedUp(key) {
+			continue
+		}
+		values[key] = n.Value
+	}
+	m.Entries = backupEntries(values)
+	// secrets under the key prefix are already in the backup
+	var secrets map[string]string
+	switch {
+	case len(c.SecretsPrefix) == 0 || strings.HasPrefix(strings.TrimSuffix(c.SecretsPrefix, "/")+"/", strings.TrimSuffix(c.KeyPrefix, "/")+"/"):
+	case nested(c.KeyPrefix, c.SecretsPrefix):
+		return nil, errors.Errorf("backup: secrets prefix %s holds key prefix %s", c.SecretsPrefix, c.KeyPrefix)
+	default:
+		secrets, m.SecretsIndex, err = snapshot(context.Background(), cli, c.SecretsPrefix, func(string) bool { return true })
+		if err != nil {
+			return nil, errors.Wrap(err, "backup: failed to read secrets")
+		}
+		m.SecretsPrefix = c.SecretsPrefix
+		m.Secrets = backupEntries(secrets)
+	}
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.Wrap(err, "backup: failed to marshal manifest")
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	write := func(name string, b []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(b)), ModTime: m.Created, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return errors.Wrapf(err, "backup: failed to write %s", name)
+		}
+		_, err := tw.Write(b)
+		return errors.Wrapf(err, "backup: failed to write %s", name)
+	}
+	// the manifest comes first so that it can be read without unpacking the rest of the archive
+	if err := write(backupManifest, manifest); err != nil {
+		return nil, err
+	}
+	if err := write(backupSignature, ed25519.Sign(priv, manifest)); err != nil {
+		return nil, err
+	}
+	for _, e := range m.Entries {
+		if err := write(path.Join(backupData, e.Key), []byte(values[e.Key])); err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range m.Secrets {
+		if err := write(path.Join(backupSecrets, e.Key), []byte(secrets[e.Key])); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, errors.Wrap(err, "backup: failed to write archive")
+	}
+	if err := gz.Close(); err != nil {
+		return nil, errors.Wrap(err, "backup: failed to compress archive")
+	}
+	return m, nil
+}
+
+// ReadBackup reads a backup archive and checks that its manifest is signed by one of keys and that every value and
+// secret matches the manifest.  It returns the manifest, the values by key, and the secrets by name.  A backup that
+// fails the checks is an `InvalidBackup` error.
+func ReadBackup(r io.Reader, keys []ed25519.PublicKey) (*BackupManifest, map[string]string, map[string]string, error) {
+	if len(keys) == 0 {
+		return nil, nil, nil, errors.New("restore: trusted keys are required to verify the backup")
+	}
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, nil, InvalidBackup{Reason: fmt.Sprintf("not a gzip archive: %s", err)}
+	}
+	tr := tar.NewReader(gz)
+	var manifest, sig []byte
+	values := make(map[string]string)
+	secrets := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, InvalidBackup{Reason: fmt.Sprintf("not a tar archive: %s", err)}
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, nil, InvalidBackup{Reason: fmt.Sprintf("failed to read %s: %s", hdr.Name, err)}
+		}
+		var dst map[string]string
+		switch {
+		case hdr.Name == backupManifest:
+			manifest = b
+			continue
+		case hdr.Name == backupSignature:
+			sig = b
+			continue
+		case strings.HasPrefix(hdr.Name, backupData+"/"):
+			dst = values
+		case strings.HasPrefix(hdr.Name, backupSecrets+"/"):
+			dst = secrets
+		default:
+			return nil, nil, nil, InvalidBackup{Reason: fmt.Sprintf("unexpected file %s", hdr.Name)}
+		}
+		key := hdr.Name[strings.Index(hdr.Name, "/")+1:]
+		if path.Clean("/"+key) != "/"+key {
+			return nil, nil, nil, InvalidBackup{Reason: fmt.Sprintf("%s is not a valid key", key)}
+		}
+		dst[key] = string(b)
+	}
+	if manifest == nil || sig == nil {
+		return nil, nil, nil, InvalidBackup{Reason: "manifest or signature is missing"}
+	}
+	verified := false
+	for _, pub := range keys {
+		if ed25519.Verify(pub, manifest, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, nil, nil, InvalidBackup{Reason: "manifest signature does not match any trusted key"}
+	}
+	m := new(BackupManifest)
+	if err := json.Unmarshal(manifest, m); err != nil {
+		return nil, nil, nil, InvalidBackup{Reason: fmt.Sprintf("failed to unmarshal manifest: %s", err)}
+	}
+	if m.Version < 1 || m.Version > backupVersion {
+		return nil, nil, nil, InvalidBackup{Reason: fmt.Sprintf("unsupported backup version %d", m.Version)}
+	}
+	if err := checkBackup("keys", m.Entries, values); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := checkBackup("secrets", m.Secrets, secrets); err != nil {
+		return nil, nil, nil, err
+	}
+	return m, values, secrets, nil
+}
+
+// backupEntries returns the manifest entries of values, sorted by key
+func backupEntries(values map[string]string) []BackupEntry {
+	var out []BackupEntry
+	for k, v := range values {
+		out = append(out, BackupEntry{Key: k, Size: len(v), Hash: sha256.Sum256([]byte(v))})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// checkBackup returns an `InvalidBackup` error unless values holds exactly the entries of a manifest section
+func checkBackup(section string, entries []BackupEntry, values map[string]string) error {
+	if len(values) != len(entries) {
+		return InvalidBackup{Reason: fmt.Sprintf("manifest lists %d %s but archive holds %d", len(entries), section, len(values))}
+	}
+	for _, e := range entries {
+		v, ok := values[e.Key]
+		switch {
+		case !ok:
+			return InvalidBackup{Reason: fmt.Sprintf("%s is missing", e.Key)}
+		case sha256.Sum256([]byte(v)) != e.Hash:
+			return InvalidBackup{Reason: fmt.Sprintf("%s does not match the manifest", e.Key)}
+		}
+	}
+	return nil
+}
+
+// Restore verifies a backup archive against the trusted keys of the configuration and writes its keys back to
+// etcd, under opts.Prefix if it is set, and its secrets under opts.SecretsPrefix.  Unless opts.Overwrite is set, the
+// destination prefix must not hold any keys apart from locks and the audit log, and the secrets prefix must not
+// hold any secrets.  The restore is recorded in the audit log.
+func Restore(c *ClusterConfig, r io.Reader, opts RestoreOptions) (*BackupManifest, error) {
+	m, values, secrets, err := ReadBackup(r, c.TrustedKeys)
+	if err != nil {
+		return nil, err
+	}
+	prefix, secretsPrefix := c.KeyPrefix, c.SecretsPrefix
+	if len(opts.Prefix) > 0 {
+		prefix, secretsPrefix = opts.Prefix, strings.TrimSuffix(opts.Prefix, "/")+"-secrets"
+	}
+	if len(opts.SecretsPrefix) > 0 {
+		secretsPrefix = opts.SecretsPrefix
+	}
+	if len(m.Secrets) > 0 && len(secretsPrefix) == 0 {
+		return nil, errors.New("restore: the backup holds secrets but no secrets prefix is configured")
+	}
+	cli, err := getClient(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "restore: failed to get client")
+	}
+	if !opts.Overwrite {
+		nodes, err := list(cli, prefix)
+		if err != nil {
+			return nil, errors.Wrap(err, "restore: failed to list destination")
+		}
+		for _, n := range filter(nodes, FilterRemoveDirectories()) {
+			if backedUp(strings.TrimPrefix(n.Key, strings.TrimSuffix(prefix, "/")+"/")) {
+				return nil, errors.Errorf("restore: %s already holds keys, such as %s", prefix, n.Key)
+			}
+		}
+		if len(m.Secrets) > 0 {
+			nodes, err := list(cli, secretsPrefix)
+			if err != nil {
+				return nil, errors.Wrap(err, "restore: failed to list destination secrets")
+			}
+			if nodes = filter(nodes, FilterRemoveDirectories()); len(nodes) > 0 {
+				return nil, errors.Errorf("restore: %s already holds secrets, such as %s", secretsPrefix, nodes[0].Key)
+			}
+		}
+	}
+	restore := func(prefix string, entries []BackupEntry, values map[string]string) error {
+		for _, e := range entries {
+			k := path.Join(prefix, e.Key)
+			set := func() error {
+				_, err := cli.Set(context.Background(), k, values[e.Key], nil)
+				return errors.Wrapf(err, "restore: failed to set %s", k)
+			}
+			if err := backoff.Retry(set, backoff.NewExponentialBackOff()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := restore(prefix, m.Entries, values); err != nil {
+		return nil, err
+	}
+	if err := restore(secretsPrefix, m.Secrets, secrets); err != nil {
+		return nil, err
+	}
+	dst := *c
+	dst.KeyPrefix = prefix
+	audit(&dst, AuditRestore, "", [20]byte{}, [20]byte{}, fmt.Sprintf("%d keys and %d secrets from backup of %s at index %d", len(m.Entries), len(m.Secrets), m.Prefix, m.Index))
+	return m, nil
+}
+
+// backedUp returns false for keys of the running cluster, locks and the audit log, which are not backed up
+func backedUp(key string) bool {
+	for _, dir := range []string{"lock", "audit"} {
+		if key == dir || strings.HasPrefix(key, dir+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// String summarizes the manifest
+func (m *BackupManifest) String() string {
+	var size int
+	for _, e := range m.Entries {
+		size += e.Size
+	}
+	return fmt.Sprintf("%d keys (%d bytes) of %s at index %d and %d secrets, created %s by %s", len(m.Entries), size, m.Prefix, m.Index, len(m.Secrets), m.Created.Format(time.RFC3339), m.Instance)
+}
@@ -0,0 +1,136 @@
+package etcd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+// rewrite returns a copy of a backup archive with the files in replace substituted
+func rewrite(t *testing.T, archive []byte, replace map[string][]byte) []byte {
+	gr, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	var out bytes.Buffer
+	gw := gzip.NewWriter(&out)
+	tw := tar.NewWriter(gw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r, ok := replace[hdr.Name]; ok {
+			b = r
+		}
+		hdr.Size = int64(len(b))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	gw.Close()
+	return out.Bytes()
+}
+
+func TestBackupRestore(t *testing.T) {
+	cfg, _, done := testPrefix(t, "backup")
+	defer done()
+	_, _, doneRestore := testPrefix(t, "restore")
+	defer doneRestore()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.TrustedKeys = []ed25519.PublicKey{pub}
+	srv := NewService(cfg)
+	assert.NoError(t, srv.Store("acme/sites/example.com/example.com.crt", []byte("cert")))
+	assert.NoError(t, srv.Store("caddyfiles/http", []byte("example.com {\n\tproxy / backend:8080\n}")))
+	assert.NoError(t, srv.Lock("acme/sites/example.com/example.com.crt"))
+	assert.NoError(t, NewSecrets(cfg).Put("dns/token", []byte("hunter2")))
+
+	var buf bytes.Buffer
+	m, err := Backup(cfg, &buf, priv)
+	assert.NoError(t, err)
+	assert.NotZero(t, m.Index)
+	var keys []string
+	for _, e := range m.Entries {
+		keys = append(keys, e.Key)
+	}
+	assert.Equal(t, []string{"acme/sites/example.com/example.com.crt", "caddyfiles/http", "md/acme/sites/example.com/example.com.crt", "md/caddyfiles/http"}, keys)
+	assert.Equal(t, cfg.SecretsPrefix, m.SecretsPrefix)
+	if assert.Len(t, m.Secrets, 1) {
+		assert.Equal(t, "dns/token", m.Secrets[0].Key)
+	}
+	archive := buf.Bytes()
+
+	// restoring over existing keys needs overwrite
+	_, err = Restore(cfg, bytes.NewReader(archive), RestoreOptions{})
+	assert.Error(t, err)
+	_, err = Restore(cfg, bytes.NewReader(archive), RestoreOptions{Overwrite: true})
+	assert.NoError(t, err)
+
+	_, err = Restore(cfg, bytes.NewReader(archive), RestoreOptions{Prefix: "/testrestore"})
+	assert.NoError(t, err)
+	restored := *cfg
+	restored.KeyPrefix = "/testrestore"
+	restored.SecretsPrefix = "/testrestore-secrets"
+	value, err := NewService(&restored).Load("caddyfiles/http")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("example.com {\n\tproxy / backend:8080\n}"), value)
+	secret, err := NewSecrets(&restored).Get("dns/token")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hunter2"), secret)
+	// secrets are not restored over existing secrets without overwrite
+	_, err = Restore(cfg, bytes.NewReader(archive), RestoreOptions{Prefix: "/testrestore2", SecretsPrefix: "/testrestore-secrets"})
+	assert.Error(t, err)
+	locks, err := ListLocks(&restored)
+	assert.NoError(t, err)
+	assert.Empty(t, locks)
+	assert.NoError(t, FlushAudit(time.Minute))
+	entries, err := NewAudit(&restored).List()
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, AuditRestore, entries[0].Operation)
+	}
+
+	other, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcs := []struct {
+		Name    string
+		Archive []byte
+		Keys    []ed25519.PublicKey
+	}{
+		{Name: "untrusted key", Archive: archive, Keys: []ed25519.PublicKey{other}},
+		{Name: "modified value", Archive: rewrite(t, archive, map[string][]byte{"data/caddyfiles/http": []byte("ZXZpbA==")}), Keys: []ed25519.PublicKey{pub}},
+		{Name: "modified secret", Archive: rewrite(t, archive, map[string][]byte{"secrets/dns/token": []byte("ZXZpbA==")}), Keys: []ed25519.PublicKey{pub}},
+		{Name: "modified manifest", Archive: rewrite(t, archive, map[string][]byte{"manifest.json": []byte(`{"Version":1}`)}), Keys: []ed25519.PublicKey{pub}},
+		{Name: "not an archive", Archive: []byte("backup"), Keys: []ed25519.PublicKey{pub}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			_, _, _, err := ReadBackup(bytes.NewReader(tc.Archive), tc.Keys)
+			assert.True(t, IsInvalidBackupError(err), "%v", err)
+		})
+	}
+}
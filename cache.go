@@ -0,0 +1,143 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cachedCaddyfile is the last Caddyfile this instance loaded, kept on disk so that it can start from a known good
+// configuration when etcd is unavailable.  Body is the Caddyfile with imports and sites resolved.  Secrets are never
+// cached in plain text: a Caddyfile with secrets is encrypted with the secrets key when one is configured, and is
+// otherwise cached with its `{etcd.secret:name}` placeholders, which are resolved again when it is loaded.  Hash is
+// the hash of Body as it is stored.
+type cachedCaddyfile struct {
+	Path       string
+	ServerType string
+	Hash       [20]byte
+	Timestamp  time.Time
+	Body       []byte
+	// Sealed is set when Body is encrypted with the secrets key
+	Sealed bool
+	// Unresolved is set when Body still holds the placeholders of its secrets
+	Unresolved bool
+}
+
+// cachePath returns the cache file for servertype, or an empty string if the cache is disabled
+func cachePath(c *ClusterConfig, servertype string) string {
+	if len(c.CacheDir) == 0 {
+		return ""
+	}
+	return filepath.Join(c.CacheDir, "caddyfile-"+servertype+".json")
+}
+
+// writeCache replaces the cached Caddyfile for servertype.  body is the Caddyfile that was served and unresolved the
+// same Caddyfile before its secrets were substituted.  The file is written to a temporary file first and renamed, so
+// a crash never leaves a partial cache behind.
+func writeCache(c *ClusterConfig, servertype string, p string, body []byte, unresolved []byte) error {
+	f := cachePath(c, servertype)
+	if len(f) == 0 {
+		return nil
+	}
+	cf := cachedCaddyfile{
+		Path:       p,
+		ServerType: servertype,
+		Timestamp:  time.Now().UTC(),
+		Body:       body,
+	}
+	if unresolved != nil && !bytes.Equal(body, unresolved) {
+		switch {
+		case len(c.SecretsKey) > 0:
+			sealed, err := NewSecrets(c).seal(body)
+			if err != nil {
+				return errors.Wrap(err, "cache: failed to encrypt caddyfile")
+			}
+			cf.Body, cf.Sealed = sealed, true
+		default:
+			cf.Body, cf.Unresolved = unresolved, true
+		}
+	}
+	cf.Hash = sha1.Sum(cf.Body)
+	b, err := json.Marshal(cf)
+	if err != nil {
+		return errors.Wrap(err, "cache: failed to marshal caddyfile")
+	}
+	if err := os.MkdirAll(c.CacheDir, 0700); err != nil {
+		return errors.Wrap(err, "cache: failed to create cache directory")
+	}
+	tmp, err := ioutil.TempFile(c.CacheDir, ".caddyfile")
+	if err != nil {
+		return errors.Wrap(err, "cache: failed to create cache file")
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "cache: failed to set cache file permissions")
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "cache: failed to write cache file")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "cache: failed to write cache file")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), f), "cache: failed to replace cache file")
+}
+
+// readCache returns the cached Caddyfile for servertype, decrypted if it was encrypted with the secrets key.  If there
+// is no cache, a `NotExist` error is returned, and a cache whose body does not match its hash is a `FailedChecksum`
+// error.  The placeholders of a Caddyfile cached without its secrets are left for the caller to resolve.
+func readCache(c *ClusterConfig, servertype string) (*cachedCaddyfile, error) {
+	f := cachePath(c, servertype)
+	if len(f) == 0 {
+		return nil, NotExist{servertype}
+	}
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, NotExist{f}
+		}
+		return nil, errors.Wrap(err, "cache: failed to read cache file")
+	}
+	cf := new(cachedCaddyfile)
+	if err := json.Unmarshal(b, cf); err != nil {
+		return nil, errors.Wrap(err, "cache: failed to unmarshal cache file")
+	}
+	if sha1.Sum(cf.Body) != cf.Hash {
+		return nil, FailedChecksum{f}
+	}
+	if cf.Sealed {
+		if len(c.SecretsKey) == 0 {
+			return nil, errors.New("cache: cached caddyfile is encrypted but no secrets key is configured")
+		}
+		body, err := NewSecrets(c).open(cf.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "cache: failed to decrypt cached caddyfile")
+		}
+		cf.Body, cf.Sealed = body, false
+	}
+	return cf, nil
+}
+
+// resolveCache substitutes the secrets of a Caddyfile that was cached without them.  Since the cache is only loaded
+// when etcd is unavailable, this usually fails, and it gives up when ctx is done.
+func resolveCache(ctx context.Context, c *ClusterConfig, cf *cachedCaddyfile) (*cachedCaddyfile, error) {
+	cli, err := getClient(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "cache: unable to get etcd client")
+	}
+	body, err := NewSecrets(c).resolve(ctx, cli, cf.Body, cf.Path)
+	if err != nil {
+		return nil, errors.Wrap(err, "cache: unable to resolve secrets of cached caddyfile, configure a secrets key to cache them encrypted")
+	}
+	resolved := *cf
+	resolved.Body, resolved.Unresolved = body, false
+	return &resolved, nil
+}
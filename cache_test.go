@@ -0,0 +1,233 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/client"
+)
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &ClusterConfig{CacheDir: dir}
+	cf := []byte("cf1.cluster.local {\n\tproxy test:123\n}")
+
+	_, err = readCache(c, "http")
+	assert.True(t, IsNotExistError(err))
+
+	assert.NoError(t, writeCache(c, "http", "/caddy/caddyfiles/http", cf, nil))
+	fi, err := os.Stat(cachePath(c, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	cached, err := readCache(c, "http")
+	assert.NoError(t, err)
+	assert.Equal(t, cf, cached.Body)
+	assert.Equal(t, "/caddy/caddyfiles/http", cached.Path)
+	_, err = readCache(c, "dns")
+	assert.True(t, IsNotExistError(err))
+
+	// a corrupted cache is never served
+	b, _ := ioutil.ReadFile(cachePath(c, "http"))
+	b[len(b)-3] ^= 0x01
+	assert.NoError(t, ioutil.WriteFile(cachePath(c, "http"), b, 0600))
+	_, err = readCache(c, "http")
+	assert.Error(t, err)
+
+	// disabled
+	assert.NoError(t, writeCache(&ClusterConfig{}, "http", "/caddy/caddyfiles/http", cf, nil))
+	_, err = readCache(&ClusterConfig{}, "http")
+	assert.True(t, IsNotExistError(err))
+}
+
+func TestCacheSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := make([]byte, 32)
+	unresolved := []byte("example.com {\n\tbasicauth / admin {etcd.secret:password}\n}")
+	body := []byte("example.com {\n\tbasicauth / admin hunter2\n}")
+	tcs := []struct {
+		Name       string
+		Key        []byte
+		ReadKey    []byte
+		Unresolved []byte
+		Expect     []byte
+		ShouldErr  bool
+	}{
+		{Name: "no secrets", Unresolved: body, Expect: body},
+		{Name: "sealed with secrets key", Key: key, ReadKey: key, Unresolved: unresolved, Expect: body},
+		{Name: "sealed without secrets key to read it", Key: key, Unresolved: unresolved, ShouldErr: true},
+		{Name: "placeholders without secrets key", Unresolved: unresolved, Expect: unresolved},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			assert.NoError(t, writeCache(&ClusterConfig{CacheDir: dir, SecretsKey: tc.Key}, "http", "/caddy/caddyfiles/http", body, tc.Unresolved))
+			b, err := ioutil.ReadFile(cachePath(&ClusterConfig{CacheDir: dir}, "http"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.NotContains(t, string(b), "hunter2")
+			assert.NotContains(t, string(b), base64.StdEncoding.EncodeToString([]byte("hunter2")))
+
+			cached, err := readCache(&ClusterConfig{CacheDir: dir, SecretsKey: tc.ReadKey}, "http")
+			if tc.ShouldErr {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.Expect, cached.Body)
+				assert.Equal(t, !bytes.Equal(tc.Expect, body), cached.Unresolved)
+			}
+		})
+	}
+
+	// placeholders are resolved again from etcd, and the cache cannot be used while etcd is unavailable
+	cached, err := readCache(&ClusterConfig{CacheDir: dir}, "http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err = resolveCache(ctx, &ClusterConfig{ServerIP: []string{"http://127.0.0.1:1"}, SecretsPrefix: "/caddy-secrets"}, cached)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+	if !shouldRunIntegration() {
+		return
+	}
+	cfg, _, done := testPrefix(t, "cachesecrets")
+	defer done()
+	assert.NoError(t, NewSecrets(cfg).Put("password", []byte("hunter2")))
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resolved, err := resolveCache(ctx, cfg, cached)
+	if assert.NoError(t, err) {
+		assert.Equal(t, body, resolved.Body)
+		assert.False(t, resolved.Unresolved)
+	}
+}
+
+func TestLoadFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	env := map[string]string{
+		"CADDY_CLUSTERING_ETCD_SERVERS":        "http://127.0.0.1:1",
+		"CADDY_CLUSTERING_ETCD_LOADER_TIMEOUT": "500ms",
+		"CADDY_CLUSTERING_ETCD_CACHE_DIR":      dir,
+	}
+	for k, v := range env {
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Unsetenv(k)
+	}
+	if err := os.Unsetenv("CADDY_CLUSTERING_ETCD_CADDYFILE_LOADER"); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = Load("http")
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	cf := []byte("cf1.cluster.local {\n\tproxy test:123\n}")
+	assert.NoError(t, writeCache(&ClusterConfig{CacheDir: dir}, "http", "/caddy/caddyfiles/http", cf, nil))
+	l, err := Load("http")
+	if !assert.NoError(t, err) || !assert.NotNil(t, l) {
+		return
+	}
+	assert.Equal(t, cf, l.Body())
+	assert.True(t, l.(loader).fallback)
+
+	// a cache with secrets that cannot be resolved is neither served with its placeholders nor replaced by the
+	// bootstrap caddyfile, and both share the loader timeout
+	unresolved := []byte("cf1.cluster.local {\n\tbasicauth / admin {etcd.secret:password}\n}")
+	assert.NoError(t, writeCache(&ClusterConfig{CacheDir: dir}, "http", "/caddy/caddyfiles/http", []byte("resolved"), unresolved))
+	bootstrap := filepath.Join(dir, "Caddyfile")
+	assert.NoError(t, ioutil.WriteFile(bootstrap, []byte("bootstrap.cluster.local {\n\tproxy / test:123\n}"), 0600))
+	assert.NoError(t, os.Setenv("CADDY_CLUSTERING_ETCD_CADDYFILE", bootstrap))
+	defer os.Unsetenv("CADDY_CLUSTERING_ETCD_CADDYFILE")
+	start = time.Now()
+	_, err = Load("http")
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 2*time.Second)
+
+	// the bootstrap caddyfile is not started from with the placeholders of its secrets either
+	assert.NoError(t, os.Remove(cachePath(&ClusterConfig{CacheDir: dir}, "http")))
+	assert.NoError(t, ioutil.WriteFile(bootstrap, unresolved, 0600))
+	_, err = Load("http")
+	assert.Error(t, err)
+}
+
+func TestLoadNoFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	env := map[string]string{
+		"CADDY_CLUSTERING_ETCD_SERVERS":   "http://127.0.0.1:2379",
+		"CADDY_CLUSTERING_ETCD_PREFIX":    "/testnofallback",
+		"CADDY_CLUSTERING_ETCD_CACHE_DIR": dir,
+	}
+	for k, v := range env {
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Unsetenv(k)
+	}
+	if err := os.Unsetenv("CADDY_CLUSTERING_ETCD_CADDYFILE_LOADER"); err != nil {
+		t.Fatal(err)
+	}
+	cfg, cli, done := testPrefix(t, "nofallback")
+	defer done()
+	prefix := cfg.KeyPrefix
+	assert.NoError(t, set(cli, path.Join(prefix, caddyfileKey("http")), []byte("example.com {\n\tbasicauth / admin {etcd.secret:missing}\n}"))())
+	assert.NoError(t, writeCache(&ClusterConfig{CacheDir: dir}, "http", path.Join(prefix, caddyfileKey("http")), []byte("cached.example.com"), nil))
+
+	// a missing secret is an error in the caddyfile, not a reason to start from the cache
+	_, err = Load("http")
+	assert.Error(t, err)
+	assert.True(t, IsNotExistError(errors.Cause(err)))
+}
+
+func TestUnavailable(t *testing.T) {
+	tcs := []struct {
+		Name   string
+		Err    error
+		Expect bool
+	}{
+		{Name: "cluster", Err: errors.Wrap(&client.ClusterError{}, "get"), Expect: true},
+		{Name: "timeout", Err: context.DeadlineExceeded, Expect: true},
+		{Name: "no endpoints", Err: client.ErrNoEndpoints, Expect: true},
+		{Name: "leader election", Err: client.Error{Code: client.ErrorCodeLeaderElect}, Expect: true},
+		{Name: "not exist", Err: errors.Wrap(NotExist{"missing"}, "secret"), Expect: false},
+		{Name: "etcd", Err: client.Error{Code: client.ErrorCodeKeyNotFound}, Expect: false},
+		{Name: "other", Err: errors.New("import snippets/missing: not found"), Expect: false},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			assert.Equal(t, tc.Expect, unavailable(tc.Err))
+		})
+	}
+}
@@ -3,7 +3,9 @@
 package etcd
 
 import (
-	"log"
+	"path"
+	"sort"
+	"strings"
 
 	"github.com/mholt/caddy"
 	"github.com/mholt/caddy/caddytls"
@@ -17,6 +19,8 @@ var _ certmagic.Storage = Cluster{}
 func init() {
 	caddytls.RegisterClusterPlugin("etcd", NewCluster)
 	caddy.RegisterCaddyfileLoader("etcd", caddy.LoaderFunc(Load))
+	caddy.RegisterEventHook("etcd", reloadFromEtcd)
+	caddy.OnProcessExit = append(caddy.OnProcessExit, flushAuditOnExit)
 }
 
 // Cluster implements the certmagic.Storage interface as a cluster plugin
@@ -26,12 +30,17 @@ type Cluster struct {
 
 // NewCluster returns a cluster plugin that reads from the environment to configure itself
 func NewCluster() (certmagic.Storage, error) {
-	log.Printf("Activating etcd clustering")
 	opts := ConfigOptsFromEnvironment()
 	c, err := NewClusterConfig(opts...)
 	if err != nil {
 		return Cluster{}, err
 	}
+	c.log(LevelInfo, "activating etcd clustering", F("prefix", c.KeyPrefix), F("servers", strings.Join(c.ServerIP, ",")))
+	registerStorageMetrics(c)
+	listen(c)
+	scrub(c)
+	monitorExpiry(c)
+	watchPurges(c)
 	return Cluster{
 		srv: NewService(c),
 	}, nil
@@ -39,15 +48,109 @@ func NewCluster() (certmagic.Storage, error) {
 
 // Lock fulfills the certmagic.Storage Locker interface.  Each etcd operation gets a lock
 // scoped to the key it is updating with a customizable timeout.  Locks that persist past
-// the timeout are assumed to be abandoned.
+// the timeout are assumed to be abandoned.  The lock certmagic takes to obtain or renew a
+// certificate is renamed, see siteLock, and is also taken under its original name, see lockNames.
 func (c Cluster) Lock(key string) error {
-	return c.srv.Lock(key)
+	names := lockNames(key)
+	for i, name := range names {
+		if err := c.srv.Lock(name); err != nil {
+			for _, held := range names[:i] {
+				c.srv.Unlock(held)
+			}
+			return err
+		}
+	}
+	return nil
 }
 
 // Unlock fulfills the certmagic.Storage Locker interface.  Locks are cleared on a per
 // path basis.
 func (c Cluster) Unlock(key string) error {
-	return c.srv.Unlock(key)
+	var err error
+	for _, name := range lockNames(key) {
+		if e := c.srv.Unlock(name); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// siteLockPrefix starts the name of the lock certmagic holds while it obtains or renews a certificate
+const siteLockPrefix = "cert_acme_"
+
+// siteLock returns the name of the lock held while the certificate for domain is obtained or renewed.  certmagic
+// names it `cert_acme_<domain>_<CA URL>`, but a site directory only keeps the host of its CA, so the CA is dropped
+// and tools that change a site directory can take the same lock.  Obtaining a certificate for one domain from two
+// CAs is serialized as a result.
+func siteLock(domain string) string {
+	return siteLockPrefix + strings.ToLower(domain)
+}
+
+// KeyLocks returns the names of the locks to take, in order, before keys are written or deleted outside of
+// certmagic: the site lock of each site directory `acme/<ca>/sites/<domain>` that holds a key, see siteLock, and
+// then each key, once.  Both are sorted, so writers of overlapping keys take their locks in the same order.
+func KeyLocks(keys ...string) []string {
+	seen := make(map[string]bool)
+	var sites, locks []string
+	for _, k := range keys {
+		if l, ok := keySiteLock(k); ok && !seen[l] {
+			seen[l] = true
+			sites = append(sites, l)
+		}
+		if !seen[k] {
+			seen[k] = true
+			locks = append(locks, k)
+		}
+	}
+	sort.Strings(sites)
+	sort.Strings(locks)
+	return append(sites, locks...)
+}
+
+// lockSite takes the site lock of domain, see siteLock, and then each of keys.  Caddy holds the site lock while it
+// obtains or renews the certificate of domain, so a tool that deletes or replaces the certificate waits for a renewal
+// in progress, and a renewal cannot write in the meantime.  The returned func releases the locks in reverse order.
+func lockSite(srv Service, domain string, keys []string) (unlock func(), err error) {
+	locks := append([]string{siteLock(domain)}, keys...)
+	for i, l := range locks {
+		if err := srv.Lock(l); err != nil {
+			unlockAll(srv, locks[:i])
+			return nil, err
+		}
+	}
+	return func() { unlockAll(srv, locks) }, nil
+}
+
+// keySiteLock returns the site lock of the site directory that holds key, if key is in one
+func keySiteLock(key string) (string, bool) {
+	parts := strings.Split(strings.Trim(path.Clean("/"+key), "/"), "/")
+	if len(parts) != 5 || parts[0] != "acme" || parts[2] != "sites" {
+		return "", false
+	}
+	return siteLock(siteDomain(parts[3])), true
+}
+
+// lockNames returns the names of the locks taken for the certmagic lock key, in the order they are taken.  Earlier
+// versions took the lock certmagic uses to obtain or renew a certificate under certmagic's name, so it is taken
+// under that name too, after the site lock, until every instance of a cluster has been upgraded.
+func lockNames(key string) []string {
+	if name := lockName(key); name != key {
+		return []string{name, key}
+	}
+	return []string{key}
+}
+
+// lockName returns the name of the lock taken for the certmagic lock key, see siteLock
+func lockName(key string) string {
+	if !strings.HasPrefix(key, siteLockPrefix) {
+		return key
+	}
+	domain := strings.TrimPrefix(key, siteLockPrefix)
+	// a certificate cannot be obtained for a name with an underscore, so the first one separates it from the CA
+	if i := strings.Index(domain, "_"); i >= 0 {
+		domain = domain[:i]
+	}
+	return siteLock(domain)
 }
 
 // Store fulfills the certmagic.Storage interface.  Each storage operation results in two nodes
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	etcd "github.com/BTBurke/caddy-etcd"
+)
+
+const auditUsage = `usage: caddy-etcd audit <subcommand>
+
+subcommands:
+  ls                       list retained entries of the audit log
+  verify                   check that no entry was removed or modified`
+
+func audit(c *etcd.ClusterConfig, args []string) error {
+	if len(args) != 1 {
+		return errors.New(auditUsage)
+	}
+	a := etcd.NewAudit(c)
+	switch args[0] {
+	case "ls":
+		entries, err := a.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SEQ\tTIMESTAMP\tINSTANCE\tOPERATION\tKEY\tOLD SHA1\tNEW SHA1\tDETAIL")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Seq, e.Timestamp.Format(time.RFC3339), e.Instance, e.Operation, e.Key, hash(e.OldHash), hash(e.NewHash), e.Detail)
+		}
+		return w.Flush()
+	case "verify":
+		if err := a.Verify(); err != nil {
+			return err
+		}
+		fmt.Println("audit log is intact")
+		return nil
+	default:
+		return errors.New(auditUsage)
+	}
+}
+
+// hash formats a SHA1 hash, or - for the zero hash of a value that did not exist
+func hash(h [20]byte) string {
+	if h == [20]byte{} {
+		return "-"
+	}
+	return fmt.Sprintf("%x", h)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	etcd "github.com/BTBurke/caddy-etcd"
+)
+
+// backup writes a signed archive of the key prefix to a file
+func backup(c *etcd.ClusterConfig, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	keyfile := fs.String("sign", "", "private key file used to sign the manifest")
+	fs.Parse(args)
+	if fs.NArg() != 1 || len(*keyfile) == 0 {
+		return errors.New("usage: caddy-etcd backup -sign keyfile <archive.tar.gz>")
+	}
+	priv, err := etcd.ReadPrivateKey(*keyfile)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fs.Arg(0), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	m, err := etcd.Backup(c, f, priv)
+	if err != nil {
+		f.Close()
+		os.Remove(fs.Arg(0))
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s: %s\n", fs.Arg(0), m)
+	return nil
+}
+
+// restore writes the keys of a backup archive back to etcd after verifying it
+func restore(c *etcd.ClusterConfig, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "key prefix to restore to, instead of CADDY_CLUSTERING_ETCD_PREFIX")
+	secretsPrefix := fs.String("secrets-prefix", "", "prefix to restore secrets to, defaults to <prefix>-secrets with -prefix and CADDY_CLUSTERING_ETCD_SECRETS_PREFIX otherwise")
+	overwrite := fs.Bool("overwrite", false, "restore to a prefix that already holds keys")
+	trusted := fs.String("trusted", "", "file of public keys to verify the manifest with, instead of CADDY_CLUSTERING_ETCD_TRUSTED_KEYS")
+	verify := fs.Bool("verify", false, "only verify the archive")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: caddy-etcd restore [-verify] [-prefix prefix] [-secrets-prefix prefix] [-overwrite] [-trusted file] <archive.tar.gz>")
+	}
+	if len(*trusted) > 0 {
+		b, err := ioutil.ReadFile(*trusted)
+		if err != nil {
+			return err
+		}
+		keys, err := etcd.ParsePublicKeys(b)
+		if err != nil {
+			return err
+		}
+		c.TrustedKeys = keys
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if *verify {
+		m, _, _, err := etcd.ReadBackup(f, c.TrustedKeys)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s is valid: %s\n", fs.Arg(0), m)
+		return nil
+	}
+	m, err := etcd.Restore(c, f, etcd.RestoreOptions{Prefix: *prefix, SecretsPrefix: *secretsPrefix, Overwrite: *overwrite})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored %s\n", m)
+	return nil
+}
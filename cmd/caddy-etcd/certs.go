@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	etcd "github.com/BTBurke/caddy-etcd"
+)
+
+// certs lists the certificates in storage with their expiry as a table, JSON, or CSV
+func certs(c *etcd.ClusterConfig, args []string) error {
+	fs := flag.NewFlagSet("certs", flag.ExitOnError)
+	format := fs.String("format", "table", "output format, table, json, or csv")
+	expires := fs.Duration("expires", 0, "list only certificates that expire within this duration")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("usage: caddy-etcd certs [-format table|json|csv] [-expires duration]")
+	}
+	switch *format {
+	case "table", "json", "csv":
+	default:
+		return fmt.Errorf("%s is not an output format, must be one of table, json, or csv", *format)
+	}
+	list, err := etcd.Inventory(c, etcd.InventoryOptions{ExpiresWithin: *expires})
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "DOMAIN\tNAMES\tISSUER\tEXPIRES\tIN\tKEY TYPE\tMODIFIED")
+		for _, cert := range list {
+			if cert.Err != nil {
+				fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\tunreadable: %s\n", cert.Domain, cert.Err)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", cert.Domain, dash(strings.Join(cert.Names, ",")), cert.Issuer, date(cert.NotAfter), expiresIn(cert.NotAfter), cert.KeyType, date(cert.Modified))
+		}
+		return w.Flush()
+	case "json":
+		type entry struct {
+			etcd.StoredCertificate
+			Error string `json:"error,omitempty"`
+		}
+		out := make([]entry, 0, len(list))
+		for _, cert := range list {
+			e := entry{StoredCertificate: cert}
+			if cert.Err != nil {
+				e.Error = cert.Err.Error()
+			}
+			out = append(out, e)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"domain", "names", "issuer", "ca", "serial", "not_before", "not_after", "key_type", "modified", "key", "error"})
+		for _, cert := range list {
+			var e string
+			if cert.Err != nil {
+				e = cert.Err.Error()
+			}
+			w.Write([]string{cert.Domain, strings.Join(cert.Names, " "), cert.Issuer, cert.CA, cert.Serial, timestamp(cert.NotBefore), timestamp(cert.NotAfter), cert.KeyType, timestamp(cert.Modified), cert.Key, e})
+		}
+		w.Flush()
+		return w.Error()
+	}
+	return nil
+}
+
+// expiresIn returns the time left until t in days, or how long ago it expired
+func expiresIn(t time.Time) string {
+	d := time.Until(t)
+	switch {
+	case d < 0:
+		return fmt.Sprintf("expired %dd ago", int(-d.Hours()/24))
+	case d < 24*time.Hour:
+		return d.Round(time.Minute).String()
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
+
+func timestamp(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/mholt/caddy"
+)
+
+// httpDirectives are the directives of the http server type of Caddy 0.11.4, in the order of its
+// httpserver/plugin.go, including those of the plugins it lists.  Caddy refuses any other directive.
+var httpDirectives = []string{
+	"root", "index", "bind", "limits", "timeouts", "tls",
+	"startup", "shutdown", "on", "supervisor", "request_id", "realip", "git",
+	"proxyprotocol",
+	"locale", "log", "cache", "rewrite", "ext", "minify", "gzip", "header", "geoip", "errors", "authz", "filter",
+	"ipfilter", "ratelimit", "recaptcha", "expires", "forwardproxy", "basicauth", "redir", "status", "cors",
+	"s3browser", "nobots", "mime", "login", "reauth", "extauth", "jwt", "permission", "jsonp", "upload",
+	"multipass", "internal", "pprof", "expvar", "push", "datadog", "prometheus", "templates", "proxy", "pubsub",
+	"fastcgi", "cgi", "websocket", "filebrowser", "webdav", "markdown", "browse", "mailout", "awses",
+	"awslambda", "grpc", "gopkg", "restic", "wkd", "dyndns",
+}
+
+// The http server type itself is not a dependency of the tool, so only its directive names are plugged in.  That
+// is all ValidateCaddyfile needs to check a Caddyfile before it is published.
+func init() {
+	caddy.RegisterServerType("http", caddy.ServerType{
+		Directives:   func() []string { return httpDirectives },
+		DefaultInput: func() caddy.Input { return nil },
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	etcd "github.com/BTBurke/caddy-etcd"
+	"github.com/mholt/caddy"
+	"github.com/mholt/certmagic"
+)
+
+// importFiles copies the keys of a FileStorage directory into etcd
+func importFiles(c *etcd.ClusterConfig, args []string) error {
+	return transfer("import", args, func(root string, opts etcd.TransferOptions) ([]etcd.Transfer, error) {
+		return etcd.ImportFileStorage(c, root, opts)
+	})
+}
+
+// exportFiles copies the keys stored in etcd into a FileStorage directory
+func exportFiles(c *etcd.ClusterConfig, args []string) error {
+	return transfer("export", args, func(root string, opts etcd.TransferOptions) ([]etcd.Transfer, error) {
+		return etcd.ExportFileStorage(c, root, opts)
+	})
+}
+
+func transfer(name string, args []string, f func(root string, opts etcd.TransferOptions) ([]etcd.Transfer, error)) error {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report what would be copied without copying")
+	overwrite := fs.Bool("overwrite", false, "overwrite keys that exist with a different value")
+	ca := fs.String("ca", certmagic.CA, "comma separated ACME directory URLs of the CAs of the certificates")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		return fmt.Errorf("usage: caddy-etcd %s [-dry-run] [-overwrite] [-ca url,...] [dir]\n\ndir defaults to %s", name, caddy.AssetsPath())
+	}
+	root := caddy.AssetsPath()
+	if fs.NArg() == 1 {
+		root = fs.Arg(0)
+	}
+	opts := etcd.TransferOptions{DryRun: *dryRun, Existing: etcd.SkipExisting, CA: strings.Split(*ca, ",")}
+	if *overwrite {
+		opts.Existing = etcd.OverwriteExisting
+	}
+	ts, err := f(root, opts)
+	if ts == nil && err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tRESULT\tSIZE\tMODIFIED\tERROR")
+	counts := make(map[string]int)
+	for _, t := range ts {
+		counts[t.Result]++
+		var msg string
+		if t.Err != nil {
+			msg = t.Err.Error()
+		}
+		modified := "-"
+		if !t.Modified.IsZero() {
+			modified = t.Modified.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", t.Key, t.Result, t.Size, modified, msg)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	summary := fmt.Sprintf("%d copied, %d overwritten, %d unchanged, %d skipped, %d failed", counts[etcd.TransferCopied], counts[etcd.TransferOverwritten], counts[etcd.TransferUnchanged], counts[etcd.TransferSkipped], counts[etcd.TransferFailed])
+	if *dryRun {
+		summary += " (dry run, nothing was written)"
+	}
+	fmt.Println(summary)
+	return err
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	etcd "github.com/BTBurke/caddy-etcd"
+)
+
+// ls lists the files under a directory, or every file below it with -r
+func ls(c *etcd.ClusterConfig, args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	recursive := fs.Bool("r", false, "list files in subdirectories")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		return errors.New("usage: caddy-etcd ls [-r] [dir]")
+	}
+	dir := strings.Trim(fs.Arg(0), "/")
+	keys, err := etcd.NewService(c).List(dir, etcd.FilterRemoveDirectories())
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	var out []string
+	for _, k := range keys {
+		k = strings.TrimPrefix(k, "/")
+		if etcd.IsReserved(k) {
+			continue
+		}
+		if !*recursive {
+			// show the files in dir and each subdirectory once, like ls
+			rest := strings.TrimPrefix(strings.TrimPrefix(k, dir), "/")
+			if i := strings.Index(rest, "/"); i >= 0 {
+				k = path.Join(dir, rest[:i]) + "/"
+			}
+		}
+		if !seen[k] {
+			seen[k] = true
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	for _, k := range out {
+		fmt.Println(k)
+	}
+	return nil
+}
+
+// cat prints the value of a file after checking it against the checksum in its metadata
+func cat(c *etcd.ClusterConfig, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: caddy-etcd cat <key>")
+	}
+	value, err := etcd.NewService(c).Load(args[0])
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(value)
+	return err
+}
+
+// stat prints the metadata of a file and whether its value matches the checksum
+func stat(c *etcd.ClusterConfig, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: caddy-etcd stat <key>")
+	}
+	srv := etcd.NewService(c)
+	md, err := srv.Metadata(args[0])
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Key:\t%s\n", md.Path)
+	if md.IsDir {
+		fmt.Fprintf(w, "Type:\tdirectory\n")
+	} else {
+		fmt.Fprintf(w, "Type:\tfile\n")
+	}
+	fmt.Fprintf(w, "Size:\t%d\n", md.Size)
+	fmt.Fprintf(w, "Modified:\t%s\n", md.Timestamp.Format(time.RFC3339))
+	fmt.Fprintf(w, "SHA1:\t%x\n", md.Hash)
+	if md.IsDir {
+		return w.Flush()
+	}
+	_, err = srv.Load(args[0])
+	switch {
+	case err == nil:
+		fmt.Fprintf(w, "Checksum:\tok\n")
+	case etcd.IsFailedChecksumError(err):
+		fmt.Fprintf(w, "Checksum:\tFAILED\n")
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return err
+}
+
+// put stores the contents of a file, or of standard input, at key.  The key is locked while it is written, see
+// lockKeys.
+func put(c *etcd.ClusterConfig, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: caddy-etcd put <key> [file]")
+	}
+	if etcd.IsReserved(args[0]) {
+		return fmt.Errorf("put: %s is in a directory used by the plugin", args[0])
+	}
+	if etcd.IsCaddyfile(args[0]) {
+		return fmt.Errorf("put: %s is a Caddyfile, site, or signature, use publish, site, or sign instead", args[0])
+	}
+	var value []byte
+	var err error
+	switch {
+	case len(args) == 1 || args[1] == "-":
+		value, err = ioutil.ReadAll(os.Stdin)
+	default:
+		value, err = ioutil.ReadFile(args[1])
+	}
+	if err != nil {
+		return err
+	}
+	srv := etcd.NewService(c)
+	unlock, err := lockKeys(srv, args[0])
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := srv.Store(args[0], value); err != nil {
+		return err
+	}
+	fmt.Printf("stored %d bytes at %s\n", len(value), args[0])
+	return nil
+}
+
+// rm deletes a file and its metadata.  The key is locked while it is deleted, see lockKeys.
+func rm(c *etcd.ClusterConfig, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: caddy-etcd rm <key>")
+	}
+	if etcd.IsReserved(args[0]) {
+		return fmt.Errorf("rm: %s is in a directory used by the plugin", args[0])
+	}
+	if etcd.IsCaddyfile(args[0]) {
+		return fmt.Errorf("rm: %s is a Caddyfile, site, or signature, use publish, site, or sign instead", args[0])
+	}
+	srv := etcd.NewService(c)
+	if _, err := srv.Metadata(args[0]); err != nil {
+		return err
+	}
+	unlock, err := lockKeys(srv, args[0])
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := srv.Delete(args[0]); err != nil {
+		return err
+	}
+	fmt.Printf("removed %s\n", args[0])
+	return nil
+}
+
+// cp copies a file, or every file below a directory, keeping its metadata
+func cp(c *etcd.ClusterConfig, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: caddy-etcd cp <src> <dst>")
+	}
+	srv := etcd.NewService(c)
+	n, err := moveLocked(srv, args[0], args[1], srv.Copy)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("copied %d files from %s to %s\n", n, args[0], args[1])
+	return nil
+}
+
+// mv renames a file, or every file below a directory, keeping its metadata
+func mv(c *etcd.ClusterConfig, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: caddy-etcd mv <src> <dst>")
+	}
+	srv := etcd.NewService(c)
+	n, err := moveLocked(srv, args[0], args[1], srv.Rename)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("moved %d files from %s to %s\n", n, args[0], args[1])
+	return nil
+}
+
+// moveLocked locks each file below src and the key it is copied to, see lockKeys, while f copies or renames src to
+// dst.  Caddy only locks the keys of a site while it obtains or renews its certificate, so a file Caddy changes
+// otherwise during a rename is caught by Rename, which only deletes files that are unchanged.  It returns the number
+// of files.
+func moveLocked(srv etcd.Service, src string, dst string, f func(src string, dst string) error) (int, error) {
+	src, dst = strings.Trim(src, "/"), strings.Trim(dst, "/")
+	keys, err := srv.List(src, etcd.FilterRemoveDirectories())
+	if err != nil {
+		return 0, err
+	}
+	var files []string
+	for _, k := range keys {
+		k = strings.TrimPrefix(k, "/")
+		if etcd.IsReserved(k) {
+			continue
+		}
+		files = append(files, k, path.Join(dst, strings.TrimPrefix(k, src)))
+	}
+	unlock, err := lockKeys(srv, files...)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	if err := f(src, dst); err != nil {
+		return 0, err
+	}
+	return len(files) / 2, nil
+}
+
+// lockKeys locks keys before they are written or deleted.  A key in a certificate's site directory is written under
+// the site lock Caddy holds while it obtains or renews the certificate, so that Caddy and the tool wait for each
+// other.  unlock releases the locks in reverse order.
+func lockKeys(srv etcd.Service, keys ...string) (unlock func(), err error) {
+	locks := etcd.KeyLocks(keys...)
+	unlock = func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			srv.Unlock(locks[i])
+		}
+	}
+	for i, l := range locks {
+		if err := srv.Lock(l); err != nil {
+			locks = locks[:i]
+			unlock()
+			return nil, err
+		}
+	}
+	return unlock, nil
+}
+
+const lockUsage = `usage: caddy-etcd lock <subcommand>
+
+subcommands:
+  ls                       list held locks and whether they are past the lock timeout
+  unlock <key>             release the lock on key, whoever holds it`
+
+// lock lists and releases the locks Caddy instances hold while they write keys
+func lock(c *etcd.ClusterConfig, args []string) error {
+	if len(args) < 1 {
+		return errors.New(lockUsage)
+	}
+	locks, err := etcd.ListLocks(c)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "ls":
+		if len(args) != 1 {
+			return errors.New(lockUsage)
+		}
+		sort.Slice(locks, func(i, j int) bool { return locks[i].Key < locks[j].Key })
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tOBTAINED\tAGE\tSTATUS")
+		for _, l := range locks {
+			var obtained time.Time
+			if err := obtained.UnmarshalText([]byte(l.Obtained)); err != nil {
+				fmt.Fprintf(w, "%s\t%s\t-\tinvalid\n", l.Key, l.Obtained)
+				continue
+			}
+			age := time.Since(obtained).Round(time.Second)
+			status := "held"
+			if age >= c.LockTimeout {
+				status = "abandoned"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", l.Key, obtained.Format(time.RFC3339), age, status)
+		}
+		return w.Flush()
+	case "unlock":
+		if len(args) != 2 {
+			return errors.New(lockUsage)
+		}
+		key := strings.Trim(args[1], "/")
+		found := false
+		for _, l := range locks {
+			if l.Key == key {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s is not locked", key)
+		}
+		if err := etcd.NewService(c).Unlock(key); err != nil {
+			return err
+		}
+		fmt.Printf("released lock on %s\n", key)
+		return nil
+	default:
+		return errors.New(lockUsage)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	etcd "github.com/BTBurke/caddy-etcd"
+)
+
+// fsck reports, and optionally repairs, inconsistencies under the key prefix
+func fsck(c *etcd.ClusterConfig, args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "repair the problems that are found")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("usage: caddy-etcd fsck [-repair]")
+	}
+	problems, err := etcd.Fsck(c, etcd.FsckOptions{Repair: *repair})
+	if err != nil {
+		return err
+	}
+	if len(problems) == 0 {
+		fmt.Println("no problems found")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tPROBLEM\tDETAIL\tREPAIR")
+	var failed int
+	for _, p := range problems {
+		r := p.Repair
+		if p.Err != nil {
+			failed++
+			r = "failed: " + p.Err.Error()
+		}
+		if len(r) == 0 {
+			r = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Key, p.Kind, p.Detail, r)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	switch {
+	case failed > 0:
+		return fmt.Errorf("%d of %d problems could not be repaired", failed, len(problems))
+	case !*repair:
+		return fmt.Errorf("%d problems found, run with -repair to fix them", len(problems))
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	etcd "github.com/BTBurke/caddy-etcd"
+)
+
+// gc deletes the certificates of sites that expired or are no longer served, or lists them with -dry-run
+func gc(c *etcd.ClusterConfig, args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "list the sites that would be deleted without deleting them")
+	grace := fs.Duration("grace", 30*24*time.Hour, "how long to keep certificates after they expire or their site is no longer served")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("usage: caddy-etcd gc [-dry-run] [-grace duration]")
+	}
+	sites, err := etcd.CollectGarbage(c, etcd.GCOptions{DryRun: *dryRun, Grace: *grace})
+	if err != nil {
+		return err
+	}
+	if len(sites) == 0 {
+		fmt.Println("no sites to collect")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SITE\tNAMES\tEXPIRES\tMODIFIED\tRESULT")
+	var collected, failed int
+	for _, s := range sites {
+		var result string
+		switch {
+		case s.Err != nil:
+			failed++
+			result = "failed: " + s.Err.Error()
+		case *dryRun:
+			collected++
+			result = fmt.Sprintf("%s, would delete %d keys", s.Reason, len(s.Keys))
+		default:
+			collected++
+			result = fmt.Sprintf("%s, deleted %d keys", s.Reason, len(s.Keys))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.Dir, dash(strings.Join(s.Names, ",")), date(s.NotAfter), date(s.Modified), result)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	verb := "collected"
+	if *dryRun {
+		verb = "would collect"
+	}
+	fmt.Printf("%s %d sites\n", verb, collected)
+	if failed > 0 {
+		return fmt.Errorf("%d sites could not be collected", failed)
+	}
+	return nil
+}
+
+func dash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+func date(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
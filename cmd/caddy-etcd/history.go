@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	etcd "github.com/BTBurke/caddy-etcd"
+)
+
+const historyUsage = `usage: caddy-etcd history <subcommand>
+
+subcommands:
+  ls                       list retained revisions of the Caddyfile
+  show <id>                print the Caddyfile at revision id
+  diff <from> <to>         show the changes between two revisions
+  rollback [-author name] <id>
+                           make revision id the current Caddyfile`
+
+func history(c *etcd.ClusterConfig, args []string) error {
+	if len(args) < 1 {
+		return errors.New(historyUsage)
+	}
+	h := etcd.NewHistory(c, *serverType)
+	switch args[0] {
+	case "ls":
+		revs, err := h.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tTIMESTAMP\tAUTHOR\tSIZE\tSHA1\tNOTE")
+		for _, r := range revs {
+			var note string
+			if r.RollbackFrom > 0 {
+				note = fmt.Sprintf("rollback to %d", r.RollbackFrom)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%x\t%s\n", r.ID, r.Timestamp.Format(time.RFC3339), r.Author, r.Size, r.Hash, note)
+		}
+		return w.Flush()
+	case "show":
+		ids, err := revisionIDs(args[1:], 1)
+		if err != nil {
+			return err
+		}
+		r, err := h.Get(ids[0])
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(r.Body)
+		return err
+	case "diff":
+		ids, err := revisionIDs(args[1:], 2)
+		if err != nil {
+			return err
+		}
+		d, err := h.Diff(ids[0], ids[1])
+		if err != nil {
+			return err
+		}
+		fmt.Print(d)
+		return nil
+	case "rollback":
+		fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+		name := fs.String("author", author(), "author recorded for the new revision")
+		fs.Parse(args[1:])
+		ids, err := revisionIDs(fs.Args(), 1)
+		if err != nil {
+			return err
+		}
+		r, err := h.Rollback(ids[0], *name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("revision %d is now current (restored from revision %d)\n", r.ID, r.RollbackFrom)
+		return nil
+	default:
+		return errors.New(historyUsage)
+	}
+}
+
+// revisionIDs parses exactly n revision IDs from args
+func revisionIDs(args []string, n int) ([]int, error) {
+	if len(args) != n {
+		return nil, errors.New(historyUsage)
+	}
+	var ids []int
+	for _, a := range args {
+		id, err := strconv.Atoi(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid revision %s", a)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,106 @@
+// Command caddy-etcd manages the Caddy configuration stored in etcd by the caddy-etcd clustering plugin.  It
+// is configured with the same CADDY_CLUSTERING_ETCD_* environment variables as the plugin.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"time"
+
+	etcd "github.com/BTBurke/caddy-etcd"
+)
+
+// command runs a subcommand with the remaining command line arguments
+type command func(c *etcd.ClusterConfig, args []string) error
+
+var commands = map[string]command{
+	"audit":    audit,
+	"backup":   backup,
+	"cat":      cat,
+	"certs":    certs,
+	"cp":       cp,
+	"export":   exportFiles,
+	"fsck":     fsck,
+	"gc":       gc,
+	"history":  history,
+	"import":   importFiles,
+	"lock":     lock,
+	"migrate":  migrate,
+	"mv":       mv,
+	"ls":       ls,
+	"publish":  publish,
+	"purge":    purge,
+	"put":      put,
+	"restore":  restore,
+	"rm":       rm,
+	"secret":   secret,
+	"sign":     sign,
+	"site":     site,
+	"stat":     stat,
+	"upload":   upload,
+	"validate": validate,
+}
+
+var serverType = flag.String("type", "http", "Caddy server type of the Caddyfile")
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "caddy-etcd: unknown command %s\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	c, err := etcd.NewClusterConfig(etcd.ConfigOptsFromEnvironment()...)
+	if err != nil {
+		fatal(err)
+	}
+	err = cmd(c, flag.Args()[1:])
+	// changes are recorded in the audit log in the background, so wait for them before exiting
+	if err := etcd.FlushAudit(time.Minute); err != nil {
+		fmt.Fprintf(os.Stderr, "caddy-etcd: %s\n", err)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func usage() {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "usage: caddy-etcd [flags] <command> [arguments]\n\ncommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", name)
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "caddy-etcd: %s\n", err)
+	os.Exit(1)
+}
+
+// author identifies the operator making a change as user@host
+func author() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return name
+	}
+	return name + "@" + host
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	etcd "github.com/BTBurke/caddy-etcd"
+)
+
+// migrate copies the key prefix to another prefix or etcd cluster, and with -follow keeps copying changes until
+// it is interrupted
+func migrate(c *etcd.ClusterConfig, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	servers := fs.String("servers", strings.Join(c.ServerIP, ","), "comma separated etcd endpoints of the destination")
+	prefix := fs.String("prefix", "", "key prefix of the destination")
+	secrets := fs.String("secrets-prefix", "", "secrets prefix of the destination, the key prefix followed by -secrets by default")
+	follow := fs.Bool("follow", false, "keep copying changes to the source until interrupted")
+	overwrite := fs.Bool("overwrite", false, "replace the keys of a destination that is not empty")
+	interval := fs.Duration("interval", 30*time.Second, "how often to verify the destination while following")
+	fs.Parse(args)
+	if fs.NArg() != 0 || len(*prefix) == 0 {
+		return errors.New("usage: caddy-etcd migrate -prefix prefix [-secrets-prefix prefix] [-servers urls] [-follow] [-overwrite] [-interval duration]")
+	}
+	dst := *c
+	dst.ServerIP = nil
+	for _, opt := range []etcd.ConfigOption{etcd.WithServers(*servers), etcd.WithPrefix(*prefix)} {
+		if err := opt(&dst); err != nil {
+			return err
+		}
+	}
+	// the secrets prefix defaults to one derived from the key prefix of the destination, not the one of the source
+	if len(*secrets) == 0 {
+		*secrets = dst.KeyPrefix + "-secrets"
+	}
+	if err := etcd.WithSecretsPrefix(*secrets)(&dst); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+	to := strings.Join(dst.ServerIP, ",") + dst.KeyPrefix
+	progress := func(s etcd.MigrationStatus) {
+		switch {
+		case s.InSync && s.Phase == etcd.MigrateFollow:
+			fmt.Printf("%s  in sync at index %d: %d keys match, safe to repoint instances to %s\n", s.Verified.Format(time.RFC3339), s.Index, s.Keys, to)
+		case s.InSync:
+			fmt.Printf("%s  copied at index %d: %d keys match\n", s.Verified.Format(time.RFC3339), s.Index, s.Keys)
+		default:
+			fmt.Printf("%s  index %d: %d of %d keys differ, such as %s\n", s.Verified.Format(time.RFC3339), s.Index, len(s.Differences), s.Keys, s.Differences[0])
+		}
+	}
+	status, err := etcd.Migrate(ctx, c, &dst, etcd.MigrateOptions{
+		Overwrite:      *overwrite,
+		Follow:         *follow,
+		VerifyInterval: *interval,
+		Progress:       progress,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("copied %d and deleted %d keys up to index %d\n", status.Copied, status.Deleted, status.Index)
+	if !status.InSync {
+		return fmt.Errorf("%d keys differ at the last verification", len(status.Differences))
+	}
+	return nil
+}
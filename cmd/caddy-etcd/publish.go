@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	etcd "github.com/BTBurke/caddy-etcd"
+)
+
+// validate checks a Caddyfile on disk with the directives of its server type without publishing it
+func validate(c *etcd.ClusterConfig, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: caddy-etcd validate <caddyfile>")
+	}
+	body, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	if err := etcd.ValidateCaddyfile(body, args[0], *serverType); err != nil {
+		return err
+	}
+	fmt.Printf("%s is valid\n", args[0])
+	return nil
+}
+
+// publish validates a Caddyfile on disk and makes it the current Caddyfile for the cluster, optionally signed
+func publish(c *etcd.ClusterConfig, args []string) error {
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	name := fs.String("author", author(), "author recorded for the new revision")
+	keyfile := fs.String("sign", "", "private key file used to sign the caddyfile")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: caddy-etcd publish [-author name] [-sign keyfile] <caddyfile>")
+	}
+	body, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	h := etcd.NewHistory(c, *serverType)
+	var sig []byte
+	if len(*keyfile) > 0 {
+		priv, err := etcd.ReadPrivateKey(*keyfile)
+		if err != nil {
+			return err
+		}
+		sig = etcd.Sign(priv, h.Key(), body)
+	}
+	r, err := h.PublishSigned(body, sig, *name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("published %s as revision %d (sha1 %x)\n", fs.Arg(0), r.ID, r.Hash)
+	return nil
+}
+
+const siteUsage = `usage: caddy-etcd site <subcommand>
+
+subcommands:
+  put [-sign keyfile] <name> <caddyfile>
+                           validate a site and store it as the per-site key name
+  rm <name>                remove the per-site key name and its signature`
+
+// site validates and stores, or removes, the per-site keys of the server type
+func site(c *etcd.ClusterConfig, args []string) error {
+	if len(args) < 1 {
+		return errors.New(siteUsage)
+	}
+	h := etcd.NewHistory(c, *serverType)
+	switch args[0] {
+	case "put":
+		fs := flag.NewFlagSet("site put", flag.ExitOnError)
+		keyfile := fs.String("sign", "", "private key file used to sign the site")
+		fs.Parse(args[1:])
+		if fs.NArg() != 2 {
+			return errors.New(siteUsage)
+		}
+		key, err := h.SiteKey(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		body, err := ioutil.ReadFile(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		var sig []byte
+		if len(*keyfile) > 0 {
+			priv, err := etcd.ReadPrivateKey(*keyfile)
+			if err != nil {
+				return err
+			}
+			sig = etcd.Sign(priv, key, body)
+		}
+		if err := h.PublishSite(fs.Arg(0), body, sig); err != nil {
+			return err
+		}
+		fmt.Printf("published %s as %s\n", fs.Arg(1), key)
+		return nil
+	case "rm":
+		if len(args) != 2 {
+			return errors.New(siteUsage)
+		}
+		if err := h.RemoveSite(args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("removed site %s\n", args[1])
+		return nil
+	default:
+		return errors.New(siteUsage)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	etcd "github.com/BTBurke/caddy-etcd"
+)
+
+// purge deletes every certificate stored for a domain and tells running instances to drop it from memory
+func purge(c *etcd.ClusterConfig, args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	reason := fs.String("reason", "", "why the certificate is purged, recorded in the tombstone and audit log")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: caddy-etcd purge [-reason text] <domain>")
+	}
+	t, err := etcd.PurgeCertificate(c, fs.Arg(0), etcd.PurgeOptions{Reason: *reason})
+	if err != nil {
+		return err
+	}
+	for _, k := range t.Keys {
+		fmt.Printf("deleted %s\n", k)
+	}
+	switch {
+	case len(t.Keys) == 0:
+		fmt.Printf("no certificate is stored for %s\n", t.Domain)
+	case len(t.Serials) > 0:
+		fmt.Printf("purged serials %s\n", strings.Join(t.Serials, ","))
+	}
+	fmt.Printf("running instances will restart to drop the certificate for %s and obtain a new one\n", t.Domain)
+	return nil
+}
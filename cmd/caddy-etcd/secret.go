@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	etcd "github.com/BTBurke/caddy-etcd"
+)
+
+const secretUsage = `usage: caddy-etcd secret <subcommand>
+
+subcommands:
+  ls                       list secret names
+  get <name>               print a secret
+  put <name> [value]       store a secret, reading the value from stdin if it is not given
+  rm <name>                delete a secret
+  keygen                   print a new key for CADDY_CLUSTERING_ETCD_SECRETS_KEYFILE`
+
+func secret(c *etcd.ClusterConfig, args []string) error {
+	if len(args) < 1 {
+		return errors.New(secretUsage)
+	}
+	s := etcd.NewSecrets(c)
+	switch {
+	case args[0] == "ls" && len(args) == 1:
+		names, err := s.List()
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			fmt.Println(n)
+		}
+		return nil
+	case args[0] == "get" && len(args) == 2:
+		val, err := s.Get(args[1])
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(val)
+		return err
+	case args[0] == "put" && len(args) == 2:
+		val, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		return s.Put(args[1], val)
+	case args[0] == "put" && len(args) == 3:
+		return s.Put(args[1], []byte(args[2]))
+	case args[0] == "rm" && len(args) == 2:
+		return s.Delete(args[1])
+	case args[0] == "keygen" && len(args) == 1:
+		key, err := etcd.NewSecretsKey()
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+	default:
+		return errors.New(secretUsage)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	etcd "github.com/BTBurke/caddy-etcd"
+)
+
+const signUsage = `usage: caddy-etcd sign <subcommand>
+
+subcommands:
+  keygen <name>            write a new key pair to <name>.key and <name>.pub
+  key <keyfile> <key>      sign the value stored at an etcd key, such as sites/example.com`
+
+func sign(c *etcd.ClusterConfig, args []string) error {
+	switch {
+	case len(args) == 2 && args[0] == "keygen":
+		pub, priv, err := etcd.NewSigningKey()
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(args[1]+".key", []byte(priv+"\n"), 0600); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(args[1]+".pub", []byte(pub+"\n"), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("wrote %s.key and %s.pub\n", args[1], args[1])
+		return nil
+	case len(args) == 3 && args[0] == "key":
+		priv, err := etcd.ReadPrivateKey(args[1])
+		if err != nil {
+			return err
+		}
+		if err := etcd.SignKey(c, priv, args[2]); err != nil {
+			return err
+		}
+		fmt.Printf("signed %s\n", args[2])
+		return nil
+	default:
+		return errors.New(signUsage)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	etcd "github.com/BTBurke/caddy-etcd"
+)
+
+// upload stores a certificate and private key obtained outside of Caddy where every instance finds them
+func upload(c *etcd.ClusterConfig, args []string) error {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	ca := fs.String("ca", "", "ACME directory URL of the CA Caddy uses, Let's Encrypt by default")
+	domain := fs.String("domain", "", "site to store the certificate for, the first name on the certificate by default")
+	force := fs.Bool("force", false, "overwrite a certificate that Caddy obtained from the CA")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("usage: caddy-etcd upload [-ca url] [-domain name] [-force] <chain.pem> <key.pem>")
+	}
+	chain, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	key, err := ioutil.ReadFile(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	u, err := etcd.UploadCertificate(c, chain, key, etcd.UploadOptions{CA: *ca, Domain: *domain, Force: *force})
+	if err != nil {
+		return err
+	}
+	verb := "stored"
+	if u.Replaced {
+		verb = "replaced"
+	}
+	fmt.Printf("%s certificate for %s (%s), expires %s\n", verb, u.Domain, strings.Join(u.Names, ","), u.NotAfter.Format(time.RFC3339))
+	for _, k := range u.Keys {
+		fmt.Printf("  %s\n", k)
+	}
+	return nil
+}
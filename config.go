@@ -1,16 +1,21 @@
 package etcd
 
 import (
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/mholt/caddy"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
 )
 
 // ClusterConfig maintains configuration information for cluster
@@ -22,6 +27,27 @@ type ClusterConfig struct {
 	CaddyFile        []byte
 	CaddyFilePath    string
 	DisableCaddyLoad bool
+	HistoryRetention int
+	Labels           map[string]string
+	SecretsPrefix    string
+	SecretsKey       []byte
+	TrustedKeys      []ed25519.PublicKey
+	LoaderTimeout    time.Duration
+	CacheDir         string
+	BootstrapPolicy  BootstrapPolicy
+	ListenAddr       string
+	Logger           Logger
+	LogLevel         Level
+	RedactKeyNames   bool
+	Tracer           *Tracer
+	InstanceID       string
+	DisableAudit     bool
+	AuditRetention   int
+	ScrubInterval    time.Duration
+	ScrubRepair      bool
+	ExpiryInterval   time.Duration
+	ExpiryWindow     time.Duration
+	ExpiryNotifier   ExpiryNotifier
 	// TODO: Add roles, auth, and mutual TLS
 }
 
@@ -32,8 +58,16 @@ type ConfigOption func(c *ClusterConfig) error
 // options
 func NewClusterConfig(opts ...ConfigOption) (*ClusterConfig, error) {
 	c := &ClusterConfig{
-		KeyPrefix:   "/caddy",
-		LockTimeout: 5 * time.Minute,
+		KeyPrefix:        "/caddy",
+		LockTimeout:      5 * time.Minute,
+		HistoryRetention: 10,
+		LoaderTimeout:    30 * time.Second,
+		CacheDir:         filepath.Join(caddy.AssetsPath(), "etcd"),
+		BootstrapPolicy:  PreferEtcd,
+		Logger:           NewLogger(LogfmtFormat),
+		LogLevel:         LevelInfo,
+		AuditRetention:   1000,
+		ExpiryWindow:     14 * 24 * time.Hour,
 	}
 	for _, opt := range opts {
 		if err := opt(c); err != nil {
@@ -43,6 +77,17 @@ func NewClusterConfig(opts ...ConfigOption) (*ClusterConfig, error) {
 	if len(c.ServerIP) == 0 {
 		c.ServerIP = []string{"http://127.0.0.1:2379"}
 	}
+	if len(c.SecretsPrefix) == 0 {
+		c.SecretsPrefix = c.KeyPrefix + "-secrets"
+	}
+	if len(c.InstanceID) == 0 {
+		c.InstanceID, _ = os.Hostname()
+	}
+	// the default logger names the instance in every entry
+	if l, ok := c.Logger.(stdLogger); ok {
+		l.instance = c.InstanceID
+		c.Logger = l
+	}
 
 	if len(c.CaddyFile) == 0 {
 
@@ -51,19 +96,44 @@ func NewClusterConfig(opts ...ConfigOption) (*ClusterConfig, error) {
 }
 
 // ConfigOptsFromEnvironment reads environment variables and returns options that can be applied via
-// NewClusterConfig
+// NewClusterConfig.  The options are returned in a fixed order, logging options first, so that the options after
+// them log in the configured format and level.
 func ConfigOptsFromEnvironment() (opts []ConfigOption) {
-	var env = map[string]func(s string) ConfigOption{
-		"CADDY_CLUSTERING_ETCD_SERVERS":          WithServers,
-		"CADDY_CLUSTERING_ETCD_PREFIX":           WithPrefix,
-		"CADDY_CLUSTERING_ETCD_TIMEOUT":          WithTimeout,
-		"CADDY_CLUSTERING_ETCD_CADDYFILE":        WithCaddyFile,
-		"CADDY_CLUSTERING_ETCD_CADDYFILE_LOADER": WithDisableCaddyfileLoad,
-	}
-	for e, f := range env {
-		val := os.Getenv(e)
+	var env = []struct {
+		name string
+		opt  func(s string) ConfigOption
+	}{
+		{"CADDY_CLUSTERING_ETCD_LOG_FORMAT", WithLogFormat},
+		{"CADDY_CLUSTERING_ETCD_LOG_LEVEL", WithLogLevel},
+		{"CADDY_CLUSTERING_ETCD_LOG_REDACT_KEYS", WithRedactKeyNames},
+		{"CADDY_CLUSTERING_ETCD_SERVERS", WithServers},
+		{"CADDY_CLUSTERING_ETCD_PREFIX", WithPrefix},
+		{"CADDY_CLUSTERING_ETCD_TIMEOUT", WithTimeout},
+		{"CADDY_CLUSTERING_ETCD_CADDYFILE", WithCaddyFile},
+		{"CADDY_CLUSTERING_ETCD_CADDYFILE_LOADER", WithDisableCaddyfileLoad},
+		{"CADDY_CLUSTERING_ETCD_HISTORY", WithHistoryRetention},
+		{"CADDY_CLUSTERING_ETCD_LABELS", WithLabels},
+		{"CADDY_CLUSTERING_ETCD_SECRETS_PREFIX", WithSecretsPrefix},
+		{"CADDY_CLUSTERING_ETCD_SECRETS_KEYFILE", WithSecretsKeyFile},
+		{"CADDY_CLUSTERING_ETCD_TRUSTED_KEYS", WithTrustedKeysFile},
+		{"CADDY_CLUSTERING_ETCD_LOADER_TIMEOUT", WithLoaderTimeout},
+		{"CADDY_CLUSTERING_ETCD_CACHE_DIR", WithCacheDir},
+		{"CADDY_CLUSTERING_ETCD_BOOTSTRAP_POLICY", WithBootstrapPolicy},
+		{"CADDY_CLUSTERING_ETCD_LISTEN", WithListenAddr},
+		{"CADDY_CLUSTERING_ETCD_TRACE", WithTraceExporter},
+		{"CADDY_CLUSTERING_ETCD_INSTANCE", WithInstanceID},
+		{"CADDY_CLUSTERING_ETCD_AUDIT", WithDisableAudit},
+		{"CADDY_CLUSTERING_ETCD_AUDIT_RETENTION", WithAuditRetention},
+		{"CADDY_CLUSTERING_ETCD_SCRUB", WithScrubInterval},
+		{"CADDY_CLUSTERING_ETCD_SCRUB_REPAIR", WithScrubRepair},
+		{"CADDY_CLUSTERING_ETCD_EXPIRY_MONITOR", WithExpiryMonitor},
+		{"CADDY_CLUSTERING_ETCD_EXPIRY_WINDOW", WithExpiryWindow},
+		{"CADDY_CLUSTERING_ETCD_EXPIRY_NOTIFY", WithExpiryNotifier},
+	}
+	for _, e := range env {
+		val := os.Getenv(e.name)
 		if len(val) != 0 {
-			opts = append(opts, f(val))
+			opts = append(opts, e.opt(val))
 		}
 	}
 	return opts
@@ -120,6 +190,34 @@ func WithTimeout(s string) ConfigOption {
 	}
 }
 
+// WithLoaderTimeout sets how long the Caddyfile loader waits for etcd before starting from the last known good
+// Caddyfile.  The default is 30 seconds.  This option takes standard Go duration formats such as 30s, 2m, etc.
+func WithLoaderTimeout(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return errors.New("CADDY_CLUSTERING_ETCD_LOADER_TIMEOUT is an invalid format: must be a positive go standard time duration")
+		}
+		c.LoaderTimeout = d
+		return nil
+	}
+}
+
+// WithCacheDir sets the directory where the last Caddyfile loaded from etcd is kept so that Caddy can start when
+// etcd is unavailable.  The default is `etcd` in the Caddy assets path, usually `$HOME/.caddy/etcd`.  Set to
+// "disable" to turn off the cache.
+func WithCacheDir(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		switch strings.ToLower(strings.TrimSpace(s)) {
+		case "disable":
+			c.CacheDir = ""
+		default:
+			c.CacheDir = filepath.Clean(s)
+		}
+		return nil
+	}
+}
+
 // WithCaddyFile sets the path to the bootstrap Caddyfile to load on initial start if configuration
 // information is not already present in etcd.  The first cluster instance will load this
 // file and store it in etcd.  Subsequent members of the cluster will prioritize configuration
@@ -133,14 +231,14 @@ func WithCaddyFile(s string) ConfigOption {
 			// assume a relative directory
 			cwd, err := os.Getwd()
 			if err != nil {
-				log.Print("[WARN] etcd: could not ready configured caddyfile source, this may not indicate a problem if another cluster member has stored this data in etcd")
+				c.log(LevelWarn, "could not read configured caddyfile source, this may not indicate a problem if another cluster member has stored this data in etcd", F("path", p), F(FieldError, err))
 				return nil
 			}
 			p = path.Join(cwd, p)
 		}
 		r, err := ioutil.ReadFile(p)
 		if err != nil {
-			log.Print("[WARN] etcd: could not ready configured caddyfile source, this may not indicate a problem if another cluster member has stored this data in etcd")
+			c.log(LevelWarn, "could not read configured caddyfile source, this may not indicate a problem if another cluster member has stored this data in etcd", F("path", p), F(FieldError, err))
 			return nil
 		}
 		c.CaddyFilePath = p
@@ -149,6 +247,126 @@ func WithCaddyFile(s string) ConfigOption {
 	}
 }
 
+// WithListenAddr sets the address, such as `:9180`, of the built-in HTTP listener that serves Prometheus metrics
+// at /metrics.  The listener is disabled by default.
+func WithListenAddr(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		if _, _, err := net.SplitHostPort(strings.TrimSpace(s)); err != nil {
+			return errors.Wrap(err, "CADDY_CLUSTERING_ETCD_LISTEN is an invalid format: must be host:port or :port")
+		}
+		c.ListenAddr = strings.TrimSpace(s)
+		return nil
+	}
+}
+
+// WithLogLevel sets the lowest level that is logged, one of debug, info, warn, or error.  The default is info.
+func WithLogLevel(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		switch strings.ToLower(strings.TrimSpace(s)) {
+		case "debug":
+			c.LogLevel = LevelDebug
+		case "info":
+			c.LogLevel = LevelInfo
+		case "warn", "warning":
+			c.LogLevel = LevelWarn
+		case "error":
+			c.LogLevel = LevelError
+		default:
+			return errors.New(fmt.Sprintf("CADDY_CLUSTERING_ETCD_LOG_LEVEL is an invalid format: %s is an unknown level", s))
+		}
+		return nil
+	}
+}
+
+// WithLogFormat sets the format of the default logger, either logfmt or json.  The default is logfmt.
+func WithLogFormat(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		f := LogFormat(strings.ToLower(strings.TrimSpace(s)))
+		switch f {
+		case LogfmtFormat, JSONFormat:
+			c.Logger = NewLogger(f)
+			return nil
+		default:
+			return errors.New(fmt.Sprintf("CADDY_CLUSTERING_ETCD_LOG_FORMAT is an invalid format: %s is an unknown format", f))
+		}
+	}
+}
+
+// WithRedactKeyNames replaces the storage keys of private keys in log entries with a short hash when set to true.
+// Values and credentials are always redacted.  The default is false.
+func WithRedactKeyNames(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		b, err := strconv.ParseBool(strings.TrimSpace(s))
+		if err != nil {
+			return errors.New("CADDY_CLUSTERING_ETCD_LOG_REDACT_KEYS is an invalid format: must be true or false")
+		}
+		c.RedactKeyNames = b
+		return nil
+	}
+}
+
+// WithLogger replaces the default logger.  Entries below the configured level are not passed to l, and entries
+// are redacted before they are.
+func WithLogger(l Logger) ConfigOption {
+	return func(c *ClusterConfig) error {
+		c.Logger = l
+		return nil
+	}
+}
+
+// WithTraceExporter traces storage operations and sends the spans to the exporter registered as s with
+// RegisterTraceExporter.  The exporter `log` writes each span to the plugin log.  Tracing is disabled by default.
+func WithTraceExporter(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		f, err := traceExporter(strings.TrimSpace(s))
+		if err != nil {
+			return errors.Wrap(err, "CADDY_CLUSTERING_ETCD_TRACE is an invalid format")
+		}
+		e, err := f(c)
+		if err != nil {
+			return errors.Wrap(err, "CADDY_CLUSTERING_ETCD_TRACE could not be configured")
+		}
+		c.Tracer = NewTracer(e)
+		return nil
+	}
+}
+
+// WithTracer traces storage operations with t
+func WithTracer(t *Tracer) ConfigOption {
+	return func(c *ClusterConfig) error {
+		c.Tracer = t
+		return nil
+	}
+}
+
+// BootstrapPolicy decides which Caddyfile an instance runs when the bootstrap Caddyfile on disk differs from the
+// Caddyfile in etcd
+type BootstrapPolicy string
+
+const (
+	// PreferEtcd runs the Caddyfile from etcd and ignores the bootstrap Caddyfile
+	PreferEtcd BootstrapPolicy = "prefer-etcd"
+	// PreferDiskAndPublish runs the bootstrap Caddyfile and publishes it to etcd for the rest of the cluster
+	PreferDiskAndPublish BootstrapPolicy = "prefer-disk-and-publish"
+	// FailOnDivergence refuses to load either Caddyfile
+	FailOnDivergence BootstrapPolicy = "fail-on-divergence"
+)
+
+// WithBootstrapPolicy sets what happens when the bootstrap Caddyfile set with CADDY_CLUSTERING_ETCD_CADDYFILE
+// differs from the Caddyfile in etcd.  The default is prefer-etcd.
+func WithBootstrapPolicy(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		p := BootstrapPolicy(strings.ToLower(strings.TrimSpace(s)))
+		switch p {
+		case PreferEtcd, PreferDiskAndPublish, FailOnDivergence:
+			c.BootstrapPolicy = p
+			return nil
+		default:
+			return errors.New(fmt.Sprintf("CADDY_CLUSTERING_ETCD_BOOTSTRAP_POLICY is an invalid format: %s is an unknown policy", p))
+		}
+	}
+}
+
 // WithDisableCaddyfileLoad will skip all attempts at loading the caddyfile from etcd and force caddy to fall back
 // to other enabled caddyfile loader plugins or the default loader
 func WithDisableCaddyfileLoad(s string) ConfigOption {
@@ -165,3 +383,191 @@ func WithDisableCaddyfileLoad(s string) ConfigOption {
 		}
 	}
 }
+
+// WithHistoryRetention sets how many published revisions of the Caddyfile are kept in etcd.  Older
+// revisions are removed when a new one is published.  Set to 0 to keep every revision.  The default is 10.
+func WithHistoryRetention(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 0 {
+			return errors.New("CADDY_CLUSTERING_ETCD_HISTORY is an invalid format: must be a number of revisions greater than or equal to 0")
+		}
+		c.HistoryRetention = n
+		return nil
+	}
+}
+
+// WithInstanceID sets the name of this instance that is recorded in the audit log and in log entries.  The default
+// is the host name.
+func WithInstanceID(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		c.InstanceID = strings.TrimSpace(s)
+		return nil
+	}
+}
+
+// WithDisableAudit turns off the audit log of changes under `<KeyPrefix>/audit` when set to "disable"
+func WithDisableAudit(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		val := strings.ToLower(strings.TrimSpace(s))
+		switch val {
+		case "disable":
+			c.DisableAudit = true
+			return nil
+		case "enable", "":
+			return nil
+		default:
+			return errors.New(fmt.Sprintf("CADDY_CLUSTERING_ETCD_AUDIT is an invalid format: %s is an unknown option", val))
+		}
+	}
+}
+
+// WithAuditRetention sets how many entries of the audit log are kept in etcd.  Older entries are removed in batches
+// of a tenth of the retention as new ones are appended.  Set to 0 to keep every entry.  The default is 1000.
+func WithAuditRetention(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 0 {
+			return errors.New("CADDY_CLUSTERING_ETCD_AUDIT_RETENTION is an invalid format: must be a number of entries greater than or equal to 0")
+		}
+		c.AuditRetention = n
+		return nil
+	}
+}
+
+// WithLabels sets the labels of this instance as comma separated key=value pairs, such as `region=eu,pool=api`.
+// Site blocks in the Caddyfile that declare a selector are only served by instances whose labels match it.
+func WithLabels(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		labels, err := ParseLabels(s)
+		if err != nil {
+			return errors.Wrap(err, "CADDY_CLUSTERING_ETCD_LABELS is an invalid format")
+		}
+		c.Labels = labels
+		return nil
+	}
+}
+
+// WithSecretsPrefix sets the etcd namespace for secrets referenced by `{etcd.secret:name}` placeholders in the
+// Caddyfile.  The default is the key prefix followed by `-secrets`, e.g. `/caddy-secrets`, which is outside of
+// the key prefix so that access to secrets can be restricted separately.
+func WithSecretsPrefix(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		c.SecretsPrefix = path.Clean("/" + strings.Trim(strings.Replace(s, "\\", "/", -1), "/"))
+		return nil
+	}
+}
+
+// WithSecretsKeyFile reads a base64 encoded 256 bit key from the file at path s.  When set, secrets are
+// encrypted with this key before they are stored in etcd and decrypted when the Caddyfile is loaded.
+func WithSecretsKeyFile(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		b, err := ioutil.ReadFile(s)
+		if err != nil {
+			return errors.Wrap(err, "CADDY_CLUSTERING_ETCD_SECRETS_KEYFILE could not be read")
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(key) != 32 {
+			return errors.New("CADDY_CLUSTERING_ETCD_SECRETS_KEYFILE is an invalid format: must contain a base64 encoded 32 byte key")
+		}
+		c.SecretsKey = key
+		return nil
+	}
+}
+
+// WithTrustedKeysFile reads base64 encoded Ed25519 public keys, one per line, from the file at path s.  When set,
+// Caddyfiles loaded from etcd must carry a signature from one of these keys or they are refused.
+func WithTrustedKeysFile(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		b, err := ioutil.ReadFile(s)
+		if err != nil {
+			return errors.Wrap(err, "CADDY_CLUSTERING_ETCD_TRUSTED_KEYS could not be read")
+		}
+		keys, err := ParsePublicKeys(b)
+		if err != nil {
+			return errors.Wrap(err, "CADDY_CLUSTERING_ETCD_TRUSTED_KEYS is an invalid format")
+		}
+		if len(keys) == 0 {
+			return errors.New("CADDY_CLUSTERING_ETCD_TRUSTED_KEYS is an invalid format: no public keys found")
+		}
+		c.TrustedKeys = keys
+		return nil
+	}
+}
+
+// WithScrubInterval sets how often each instance checks the key prefix for inconsistencies in the background, see
+// Fsck.  Scrubbing is disabled by default.  This option takes standard Go duration formats such as 1h, 30m, etc.
+func WithScrubInterval(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil || d <= 0 {
+			return errors.New("CADDY_CLUSTERING_ETCD_SCRUB is an invalid format: must be a positive go standard time duration")
+		}
+		c.ScrubInterval = d
+		return nil
+	}
+}
+
+// WithScrubRepair sets whether the background scrub repairs the problems it finds.  By default it only reports
+// them.
+func WithScrubRepair(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		b, err := strconv.ParseBool(strings.TrimSpace(s))
+		if err != nil {
+			return errors.New("CADDY_CLUSTERING_ETCD_SCRUB_REPAIR is an invalid format: must be true or false")
+		}
+		c.ScrubRepair = b
+		return nil
+	}
+}
+
+// WithExpiryMonitor sets how often the instance elected to monitor certificate expiry scans the stored
+// certificates.  The monitor is disabled by default.  This option takes standard Go duration formats such as 1h,
+// 30m, etc.
+func WithExpiryMonitor(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil || d <= 0 {
+			return errors.New("CADDY_CLUSTERING_ETCD_EXPIRY_MONITOR is an invalid format: must be a positive go standard time duration")
+		}
+		c.ExpiryInterval = d
+		return nil
+	}
+}
+
+// WithExpiryWindow sets how close to expiry a certificate must be for the expiry monitor to report it.  The
+// default is 14 days, half of the window in which certmagic renews certificates.  This option takes standard Go
+// duration formats such as 336h.
+func WithExpiryWindow(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil || d <= 0 {
+			return errors.New("CADDY_CLUSTERING_ETCD_EXPIRY_WINDOW is an invalid format: must be a positive go standard time duration")
+		}
+		c.ExpiryWindow = d
+		return nil
+	}
+}
+
+// WithExpiryNotifier sets the notifier the expiry monitor alerts, as `name` or `name:arg` where name was
+// registered with RegisterExpiryNotifier.  `log` writes an error to the plugin log and is the default,
+// `command:/path/to/command args` runs a command with the alert as JSON on standard input, and
+// `webhook:https://example.com/hook` posts the alert as JSON to the URL.
+func WithExpiryNotifier(s string) ConfigOption {
+	return func(c *ClusterConfig) error {
+		name, arg := strings.TrimSpace(s), ""
+		if i := strings.Index(name, ":"); i >= 0 {
+			name, arg = name[:i], strings.TrimSpace(name[i+1:])
+		}
+		f, err := expiryNotifier(name)
+		if err != nil {
+			return errors.Wrap(err, "CADDY_CLUSTERING_ETCD_EXPIRY_NOTIFY is an invalid format")
+		}
+		n, err := f(c, arg)
+		if err != nil {
+			return errors.Wrap(err, "CADDY_CLUSTERING_ETCD_EXPIRY_NOTIFY is an invalid format")
+		}
+		c.ExpiryNotifier = n
+		return nil
+	}
+}
@@ -3,9 +3,11 @@ package etcd
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/mholt/caddy"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -116,6 +118,160 @@ func TestTimeout(t *testing.T) {
 	}
 }
 
+func TestHistoryRetention(t *testing.T) {
+	tcs := []struct {
+		Name      string
+		Input     string
+		Expected  int
+		ShouldErr bool
+	}{
+		{Name: "ok", Input: "20", Expected: 20, ShouldErr: false},
+		{Name: "keep all", Input: "0", Expected: 0, ShouldErr: false},
+		{Name: "negative", Input: "-1", ShouldErr: true},
+		{Name: "not a number", Input: "ten", ShouldErr: true},
+	}
+	for _, tc := range tcs {
+		c, err := NewClusterConfig(WithHistoryRetention(tc.Input))
+		switch {
+		case tc.ShouldErr:
+			assert.Nil(t, c)
+			assert.Error(t, err)
+		default:
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Expected, c.HistoryRetention)
+		}
+	}
+}
+
+func TestSecretsKeyFile(t *testing.T) {
+	key, err := NewSecretsKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(key + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClusterConfig(WithSecretsKeyFile(f.Name()))
+	assert.NoError(t, err)
+	assert.Len(t, c.SecretsKey, 32)
+	assert.Equal(t, "/caddy-secrets", c.SecretsPrefix)
+
+	_, err = NewClusterConfig(WithSecretsKeyFile("/does/not/exist"))
+	assert.Error(t, err)
+}
+
+func TestTrustedKeysFile(t *testing.T) {
+	pub, _, err := NewSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "trusted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("# release signing key\n" + pub + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewClusterConfig(WithTrustedKeysFile(f.Name()))
+	assert.NoError(t, err)
+	assert.Len(t, c.TrustedKeys, 1)
+
+	_, err = NewClusterConfig(WithTrustedKeysFile("/does/not/exist"))
+	assert.Error(t, err)
+}
+
+func TestCacheDir(t *testing.T) {
+	c, err := NewClusterConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(caddy.AssetsPath(), "etcd"), c.CacheDir)
+	c, err = NewClusterConfig(WithCacheDir("disable"))
+	assert.NoError(t, err)
+	assert.Equal(t, "", c.CacheDir)
+	_, err = NewClusterConfig(WithLoaderTimeout("0s"))
+	assert.Error(t, err)
+}
+
+func TestBootstrapPolicy(t *testing.T) {
+	tcs := []struct {
+		Name      string
+		Input     string
+		Expected  BootstrapPolicy
+		ShouldErr bool
+	}{
+		{Name: "prefer etcd", Input: "prefer-etcd", Expected: PreferEtcd},
+		{Name: "prefer disk", Input: "Prefer-Disk-And-Publish", Expected: PreferDiskAndPublish},
+		{Name: "fail", Input: "fail-on-divergence", Expected: FailOnDivergence},
+		{Name: "unknown", Input: "prefer-disk", ShouldErr: true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			c, err := NewClusterConfig(WithBootstrapPolicy(tc.Input))
+			switch tc.ShouldErr {
+			case true:
+				assert.Error(t, err)
+			default:
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Expected, c.BootstrapPolicy)
+			}
+		})
+	}
+}
+
+func TestLogOptions(t *testing.T) {
+	tcs := []struct {
+		Name      string
+		Opt       ConfigOption
+		ShouldErr bool
+	}{
+		{Name: "level", Opt: WithLogLevel("Warning")},
+		{Name: "unknown level", Opt: WithLogLevel("verbose"), ShouldErr: true},
+		{Name: "format", Opt: WithLogFormat("JSON")},
+		{Name: "unknown format", Opt: WithLogFormat("xml"), ShouldErr: true},
+		{Name: "redact keys", Opt: WithRedactKeyNames("true")},
+		{Name: "redact keys not bool", Opt: WithRedactKeyNames("sometimes"), ShouldErr: true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			_, err := NewClusterConfig(tc.Opt)
+			switch tc.ShouldErr {
+			case true:
+				assert.Error(t, err)
+			default:
+				assert.NoError(t, err)
+			}
+		})
+	}
+	c, err := NewClusterConfig(WithLogLevel("warn"), WithLogFormat("json"))
+	assert.NoError(t, err)
+	assert.Equal(t, LevelWarn, c.LogLevel)
+	assert.Equal(t, NewLogger(JSONFormat), c.Logger)
+}
+
+func TestAuditOptions(t *testing.T) {
+	c, err := NewClusterConfig()
+	assert.NoError(t, err)
+	host, _ := os.Hostname()
+	assert.Equal(t, host, c.InstanceID)
+	assert.False(t, c.DisableAudit)
+	assert.Equal(t, 1000, c.AuditRetention)
+	_, err = NewClusterConfig(WithAuditRetention("-1"))
+	assert.Error(t, err)
+	_, err = NewClusterConfig(WithDisableAudit("off"))
+	assert.Error(t, err)
+}
+
 func TestConfigOpts(t *testing.T) {
 	caddyfile := []byte("example.com {\n\tproxy http://127.0.0.1:8080\n}")
 	f, err := ioutil.TempFile("", "Caddyfile")
@@ -152,6 +308,23 @@ func TestConfigOpts(t *testing.T) {
 		"CADDY_CLUSTERING_ETCD_TIMEOUT":          "30m",
 		"CADDY_CLUSTERING_ETCD_CADDYFILE":        f.Name(),
 		"CADDY_CLUSTERING_ETCD_CADDYFILE_LOADER": "disable",
+		"CADDY_CLUSTERING_ETCD_HISTORY":          "5",
+		"CADDY_CLUSTERING_ETCD_LABELS":           "region=eu,pool=api",
+		"CADDY_CLUSTERING_ETCD_LOADER_TIMEOUT":   "10s",
+		"CADDY_CLUSTERING_ETCD_CACHE_DIR":        "/var/cache/caddy-etcd",
+		"CADDY_CLUSTERING_ETCD_BOOTSTRAP_POLICY": "fail-on-divergence",
+		"CADDY_CLUSTERING_ETCD_LISTEN":           ":9180",
+		"CADDY_CLUSTERING_ETCD_LOG_LEVEL":        "debug",
+		"CADDY_CLUSTERING_ETCD_LOG_FORMAT":       "json",
+		"CADDY_CLUSTERING_ETCD_LOG_REDACT_KEYS":  "true",
+		"CADDY_CLUSTERING_ETCD_INSTANCE":         "web-1",
+		"CADDY_CLUSTERING_ETCD_AUDIT":            "disable",
+		"CADDY_CLUSTERING_ETCD_AUDIT_RETENTION":  "50",
+		"CADDY_CLUSTERING_ETCD_SCRUB":            "1h",
+		"CADDY_CLUSTERING_ETCD_SCRUB_REPAIR":     "true",
+		"CADDY_CLUSTERING_ETCD_EXPIRY_MONITOR":   "6h",
+		"CADDY_CLUSTERING_ETCD_EXPIRY_WINDOW":    "240h",
+		"CADDY_CLUSTERING_ETCD_EXPIRY_NOTIFY":    "webhook:https://alerts.example.com/caddy",
 	}
 	env2 := map[string]string{
 		"CADDY_CLUSTERING_ETCD_SERVERS":   "http://127.0.0.1:2379",
@@ -165,7 +338,7 @@ func TestConfigOpts(t *testing.T) {
 		Expect    ClusterConfig
 		ShouldErr bool
 	}{
-		{Name: "ok", Input: env, Expect: ClusterConfig{ServerIP: []string{"http://127.0.0.1:2379"}, LockTimeout: 30 * time.Minute, KeyPrefix: "/test", CaddyFile: caddyfile, CaddyFilePath: f.Name(), DisableCaddyLoad: true}, ShouldErr: false},
+		{Name: "ok", Input: env, Expect: ClusterConfig{ServerIP: []string{"http://127.0.0.1:2379"}, LockTimeout: 30 * time.Minute, KeyPrefix: "/test", CaddyFile: caddyfile, CaddyFilePath: f.Name(), DisableCaddyLoad: true, HistoryRetention: 5, Labels: map[string]string{"region": "eu", "pool": "api"}, SecretsPrefix: "/test-secrets", LoaderTimeout: 10 * time.Second, CacheDir: "/var/cache/caddy-etcd", BootstrapPolicy: FailOnDivergence, ListenAddr: ":9180", Logger: stdLogger{format: JSONFormat, instance: "web-1"}, LogLevel: LevelDebug, RedactKeyNames: true, InstanceID: "web-1", DisableAudit: true, AuditRetention: 50, ScrubInterval: time.Hour, ScrubRepair: true, ExpiryInterval: 6 * time.Hour, ExpiryWindow: 10 * 24 * time.Hour, ExpiryNotifier: webhookNotifier{url: "https://alerts.example.com/caddy"}}, ShouldErr: false},
 		{Name: "should err", Input: env2, Expect: ClusterConfig{}, ShouldErr: true},
 	}
 	for _, tc := range tcs {
@@ -0,0 +1,127 @@
+package etcd
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+// diff returns a unified diff of the lines in a and b.  An empty string is returned if they are identical.
+func diff(nameA string, nameB string, a []byte, b []byte) string {
+	la := splitLines(a)
+	lb := splitLines(b)
+	ops := diffOps(la, lb)
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", nameA, nameB)
+	changed := false
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		changed = true
+		// expand the hunk while changes are within two context windows of each other
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j
+				continue
+			}
+			if j-end > 2*diffContext {
+				break
+			}
+		}
+		end += diffContext + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+		var na, nb int
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				na++
+			}
+			if op.kind != '-' {
+				nb++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(ops[start].a, na), hunkRange(ops[start].b, nb))
+		for _, op := range ops[start:end] {
+			fmt.Fprintf(&out, "%c%s\n", op.kind, op.line)
+		}
+		i = end
+	}
+	if !changed {
+		return ""
+	}
+	return out.String()
+}
+
+// hunkRange formats the lines of one side of a hunk that starts at offset and spans n lines.  An empty range is
+// given by the line before it, as in diff and patch.
+func hunkRange(offset int, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", offset)
+	}
+	return fmt.Sprintf("%d,%d", offset+1, n)
+}
+
+type diffOp struct {
+	kind rune
+	line string
+	// line offsets in a and b when the op is applied
+	a int
+	b int
+}
+
+// diffOps computes the shortest edit script between a and b from their longest common subsequence
+func diffOps(a []string, b []string) []diffOp {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{kind: ' ', line: a[i], a: i, b: j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{kind: '-', line: a[i], a: i, b: j})
+			i++
+		default:
+			ops = append(ops, diffOp{kind: '+', line: b[j], a: i, b: j})
+			j++
+		}
+	}
+	return ops
+}
+
+func splitLines(b []byte) []string {
+	s := strings.TrimSuffix(string(b), "\n")
+	if len(s) == 0 {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
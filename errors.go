@@ -40,3 +40,107 @@ func IsFailedChecksumError(e error) bool {
 		return false
 	}
 }
+
+// InvalidCaddyfile is returned when a Caddyfile fails validation and is not published.  The underlying
+// parse or directive error includes the file and line number of the problem.
+type InvalidCaddyfile struct {
+	Err error
+}
+
+func (e InvalidCaddyfile) Error() string {
+	return fmt.Sprintf("invalid caddyfile: %s", e.Err)
+}
+
+// IsInvalidCaddyfileError checks to see if error is of type InvalidCaddyfile
+func IsInvalidCaddyfileError(e error) bool {
+	switch e.(type) {
+	case InvalidCaddyfile:
+		return true
+	default:
+		return false
+	}
+}
+
+// InvalidSignature is returned when signatures are required and a Caddyfile loaded from etcd has no signature
+// or one that does not verify against any of the trusted keys
+type InvalidSignature struct {
+	Key    string
+	Reason string
+}
+
+func (e InvalidSignature) Error() string {
+	return fmt.Sprintf("key %s has an invalid signature: %s", e.Key, e.Reason)
+}
+
+// IsInvalidSignatureError checks to see if error is of type InvalidSignature
+func IsInvalidSignatureError(e error) bool {
+	switch e.(type) {
+	case InvalidSignature:
+		return true
+	default:
+		return false
+	}
+}
+
+// DivergentCaddyfile is returned by the loader when the bootstrap policy is fail-on-divergence and the bootstrap
+// Caddyfile on disk differs from the Caddyfile in etcd
+type DivergentCaddyfile struct {
+	EtcdKey  string
+	EtcdHash [20]byte
+	DiskPath string
+	DiskHash [20]byte
+}
+
+func (e DivergentCaddyfile) Error() string {
+	return fmt.Sprintf("caddyfile %s (sha1 %x) differs from caddyfile %s in etcd (sha1 %x)", e.DiskPath, e.DiskHash, e.EtcdKey, e.EtcdHash)
+}
+
+// IsDivergentCaddyfileError checks to see if error is of type DivergentCaddyfile
+func IsDivergentCaddyfileError(e error) bool {
+	switch e.(type) {
+	case DivergentCaddyfile:
+		return true
+	default:
+		return false
+	}
+}
+
+// TamperedAudit is returned when verifying the audit log finds an entry that is missing, was modified, or does not
+// follow the entry before it
+type TamperedAudit struct {
+	Seq    int
+	Reason string
+}
+
+func (e TamperedAudit) Error() string {
+	return fmt.Sprintf("audit entry %d: %s", e.Seq, e.Reason)
+}
+
+// IsTamperedAuditError checks to see if error is of type TamperedAudit
+func IsTamperedAuditError(e error) bool {
+	switch e.(type) {
+	case TamperedAudit:
+		return true
+	default:
+		return false
+	}
+}
+
+// InvalidBackup is returned when a backup archive is not signed by a trusted key or does not match its manifest
+type InvalidBackup struct {
+	Reason string
+}
+
+func (e InvalidBackup) Error() string {
+	return fmt.Sprintf("invalid backup: %s", e.Reason)
+}
+
+// IsInvalidBackupError checks to see if error is of type InvalidBackup
+func IsInvalidBackupError(e error) bool {
+	switch e.(type) {
+	case InvalidBackup:
+		return true
+	default:
+		return false
+	}
+}
@@ -1,6 +1,7 @@
 package etcd
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -9,6 +10,16 @@ import (
 func TestErrors(t *testing.T) {
 	e1 := NotExist{"/test/path"}
 	e2 := FailedChecksum{"/test/path"}
+	e3 := InvalidCaddyfile{errors.New("/test/path:1 - Error during parsing")}
+	e4 := InvalidSignature{"/test/path", "no signature found"}
+	e5 := DivergentCaddyfile{EtcdKey: "/test/path", DiskPath: "/test/Caddyfile"}
+	e6 := TamperedAudit{Seq: 3, Reason: "entry is missing"}
+	e7 := InvalidBackup{Reason: "manifest or signature is missing"}
 	assert.True(t, IsNotExistError(e1))
 	assert.True(t, IsFailedChecksumError(e2))
+	assert.True(t, IsInvalidCaddyfileError(e3))
+	assert.True(t, IsInvalidSignatureError(e4))
+	assert.True(t, IsDivergentCaddyfileError(e5))
+	assert.True(t, IsTamperedAuditError(e6))
+	assert.True(t, IsInvalidBackupError(e7))
 }
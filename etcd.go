@@ -7,8 +7,10 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"log"
 	"path"
+	"sort"
 	"strings"
 	"time"
 
@@ -63,10 +65,13 @@ type Service interface {
 	Store(key string, value []byte) error
 	Load(key string) ([]byte, error)
 	Delete(key string) error
+	Copy(src string, dst string) error
+	Rename(src string, dst string) error
 	Metadata(key string) (*Metadata, error)
 	Lock(key string) error
 	Unlock(key string) error
 	List(path string, filters ...func(client.Node) bool) ([]string, error)
+	create(key string, value []byte) error
 	prefix() string
 }
 
@@ -93,19 +98,35 @@ func NewService(c *ClusterConfig) Service {
 }
 
 // Lock acquires a lock with a maximum lifetime specified by the ClusterConfig
-func (e *etcdsrv) Lock(key string) error {
-	return e.lock(token, key)
+func (e *etcdsrv) Lock(key string) (err error) {
+	o := e.begin("lock", key)
+	defer o.end(&err)
+	err = e.lock(o, token, key)
+	lockWait.Observe(time.Since(o.start).Seconds())
+	if err != nil {
+		return err
+	}
+	lockHeld(path.Join(e.lockKey, key), time.Now())
+	return nil
 }
 
-// Lock acquires a lock with a maximum lifetime specified by the ClusterConfig
-func (e *etcdsrv) lock(tok string, key string) error {
+// lock acquires the lock on key for tok with a maximum lifetime specified by the ClusterConfig.  The lock is
+// created only if it does not exist, and extended or taken over only if it is unchanged since it was read, so
+// clients racing for the same lock cannot both get it.
+func (e *etcdsrv) lock(o *operation, tok string, key string) error {
 	c, err := getClient(e.cfg)
 	if err != nil {
 		return errors.Wrap(err, "failed to create etcd client while getting lock")
 	}
+	// an abandoned lock held by another client is recorded in the audit log when it is taken over
+	var abandoned, held []byte
+	var abandonedAt string
 	acquire := func() error {
 		var okToSet bool
-		resp, err := c.Get(context.Background(), path.Join(e.lockKey, key), nil)
+		abandoned = nil
+		// the lock is written only if it is unchanged since it was read, so two clients cannot both take it
+		opts := &client.SetOptions{PrevExist: client.PrevNoExist}
+		resp, err := c.Get(o.context(), path.Join(e.lockKey, key), nil)
 		if err != nil {
 			switch {
 			// no existing lock
@@ -117,6 +138,7 @@ func (e *etcdsrv) lock(tok string, key string) error {
 			}
 		}
 		if resp != nil {
+			opts = &client.SetOptions{PrevIndex: resp.Node.ModifiedIndex}
 			var l Lock
 			b, err := base64.StdEncoding.DecodeString(resp.Node.Value)
 			if err != nil {
@@ -137,6 +159,7 @@ func (e *etcdsrv) lock(tok string, key string) error {
 			// orphaned locks that are past lock timeout allow new lock
 			case time.Now().UTC().Sub(lockTime) >= e.cfg.LockTimeout:
 				okToSet = true
+				abandoned, abandonedAt = b, l.Obtained
 				break
 			default:
 			}
@@ -155,18 +178,31 @@ func (e *etcdsrv) lock(tok string, key string) error {
 			if err != nil {
 				return errors.Wrap(err, "lock: failed to marshal new lock")
 			}
-			if _, err := c.Set(context.Background(), path.Join(e.lockKey, key), base64.StdEncoding.EncodeToString(b), nil); err != nil {
+			_, err = c.Set(o.context(), path.Join(e.lockKey, key), base64.StdEncoding.EncodeToString(b), opts)
+			switch {
+			case isChanged(err):
+				return errors.New("lock: failed to obtain lock, taken by another client")
+			case err != nil:
 				return errors.Wrap(err, "failed to get lock")
 			}
+			held = b
 			return nil
 		}
 		return errors.New("lock: failed to obtain lock, already exists")
 	}
-	return e.execute(acquire)
+	if err := e.execute(o, "acquire", path.Join(e.lockKey, key), acquire); err != nil {
+		return err
+	}
+	if abandoned != nil {
+		audit(e.cfg, AuditLockTakeover, key, sha1.Sum(abandoned), sha1.Sum(held), fmt.Sprintf("lock obtained at %s was abandoned", abandonedAt))
+	}
+	return nil
 }
 
 // Unlock releases the current lock
-func (e *etcdsrv) Unlock(key string) error {
+func (e *etcdsrv) Unlock(key string) (err error) {
+	o := e.begin("unlock", key)
+	defer o.end(&err)
 	c, err := getClient(e.cfg)
 	if err != nil {
 		return errors.Wrap(err, "failed to create etcd client while getting lock")
@@ -177,22 +213,137 @@ func (e *etcdsrv) Unlock(key string) error {
 		}
 		return nil
 	}
-	return e.execute(release)
+	if err := e.execute(o, "release", path.Join(e.lockKey, key), release); err != nil {
+		return err
+	}
+	lockReleased(path.Join(e.lockKey, key))
+	return nil
+}
+
+// ListLocks returns the locks currently held under `<KeyPrefix>/lock`, including abandoned locks that are past
+// the lock timeout but have not been taken over yet
+func ListLocks(c *ClusterConfig) ([]Lock, error) {
+	cli, err := getClient(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "locks: failed to get client")
+	}
+	lockKey := path.Join(c.KeyPrefix, "lock")
+	nodes, err := list(cli, lockKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "locks: could not get locks")
+	}
+	var out []Lock
+	for _, n := range filter(nodes, FilterRemoveDirectories()) {
+		var l Lock
+		b, err := base64.StdEncoding.DecodeString(n.Value)
+		if err != nil {
+			return nil, errors.Wrap(err, "locks: failed to decode base64 lock representation")
+		}
+		if err := json.Unmarshal(b, &l); err != nil {
+			return nil, errors.Wrap(err, "locks: failed to unmarshal lock")
+		}
+		// the key of the lock node is authoritative, since the key in the lock is whatever the client asked for
+		l.Key = strings.TrimPrefix(n.Key, lockKey+"/")
+		out = append(out, l)
+	}
+	return out, nil
 }
 
-// execute will use exponential backoff when configured
-func (e *etcdsrv) execute(o backoff.Operation) error {
+// execute makes the etcd request f for operation o, using exponential backoff when configured.  Each attempt is
+// traced as a step of o on the etcd key.
+func (e *etcdsrv) execute(o *operation, step string, key string, f backoff.Operation) error {
+	f = o.step(step, key, f)
 	switch e.noBackoff {
 	case true:
-		return o()
+		return f()
 	default:
-		return backoff.Retry(o, backoff.NewExponentialBackOff())
+		return backoff.RetryNotify(f, backoff.WithContext(backoff.NewExponentialBackOff(), o.context()), o.retry())
+	}
+}
+
+// operation is a storage operation in progress.  It records the metrics, log entries, and spans of the operation
+// and of the etcd requests it makes.
+type operation struct {
+	cfg   *ClusterConfig
+	name  string
+	key   string
+	start time.Time
+	span  *span
+	// ctx bounds the etcd requests and retries of the operation, when set
+	ctx context.Context
+}
+
+// context returns the context of the etcd requests of the operation
+func (o *operation) context() context.Context {
+	if o.ctx == nil {
+		return context.Background()
+	}
+	return o.ctx
+}
+
+// begin starts operation name on key
+func (e *etcdsrv) begin(name string, key string) *operation {
+	return &operation{
+		cfg:   e.cfg,
+		name:  name,
+		key:   key,
+		start: time.Now(),
+		span:  e.cfg.Tracer.start(name, e.cfg.RedactKeyNames, F(FieldOperation, name), F(FieldKey, key)),
+	}
+}
+
+// end records the metrics of the operation, logs its outcome, and ends its span
+func (o *operation) end(err *error) {
+	observe(o.name, o.start, err)
+	o.span.end(*err)
+	fields := []Field{F(FieldOperation, o.name), F(FieldKey, o.key), F(FieldDuration, time.Since(o.start))}
+	switch {
+	case *err == nil:
+		o.cfg.log(LevelDebug, "storage operation complete", fields...)
+	// certmagic checks for keys that do not exist yet as a matter of course
+	case errorType(*err) == "not_exist":
+		o.cfg.log(LevelDebug, "storage operation complete", append(fields, F(FieldError, *err))...)
+	default:
+		o.cfg.log(LevelWarn, "storage operation failed", append(fields, F(FieldError, *err))...)
+	}
+}
+
+// step wraps the etcd request f on key so that each attempt is traced as a child span of the operation
+func (o *operation) step(name string, key string, f backoff.Operation) backoff.Operation {
+	if o.span == nil {
+		return f
+	}
+	attempt := 0
+	return func() error {
+		attempt++
+		s := o.span.child(name, F(FieldKey, key), F(FieldAttempt, attempt))
+		err := f()
+		s.end(err)
+		return err
+	}
+}
+
+// retry is a backoff notification that counts, logs, and traces each retry of an etcd request of the operation
+func (o *operation) retry() backoff.Notify {
+	attempt := 0
+	return func(err error, d time.Duration) {
+		attempt++
+		retryCount.WithLabelValues(o.name).Inc()
+		o.cfg.log(LevelDebug, "retrying etcd request", F(FieldOperation, o.name), F(FieldKey, o.key), F(FieldAttempt, attempt), F("wait", d), F(FieldError, err))
+		o.span.child("backoff", F(FieldAttempt, attempt)).endAfter(d, err)
 	}
 }
 
 // Store stores a value at key. This function attempts to rollback to a prior value
 // if there is an error in the transaction.
 func (e *etcdsrv) Store(key string, value []byte) error {
+	return e.storeAt(key, value, time.Now())
+}
+
+// storeAt stores a value at key like Store, recording modified as its modification time in the metadata
+func (e *etcdsrv) storeAt(key string, value []byte, modified time.Time) (err error) {
+	o := e.begin("store", key)
+	defer o.end(&err)
 	cli, err := getClient(e.cfg)
 	if err != nil {
 		return errors.Wrap(err, "store: failed to get client")
@@ -200,30 +351,59 @@ func (e *etcdsrv) Store(key string, value []byte) error {
 	storageKey := path.Join(e.cfg.KeyPrefix, key)
 	storageKeyMD := path.Join(e.mdPrefix, key)
 	md := NewMetadata(key, value)
+	md.Timestamp = modified.UTC()
 
 	ex := new(bool)
-	if err := e.execute(exists(cli, storageKeyMD, ex)); err != nil {
+	if err := e.execute(o, "exists", storageKeyMD, exists(cli, storageKeyMD, ex)); err != nil {
 		return errors.Wrap(err, "store: failed to get old metadata")
 	}
 	var commits []backoff.Operation
 	var rollbacks []backoff.Operation
+	mdPrev := new(Metadata)
 	switch *ex {
 	case true:
-		mdPrev := new(Metadata)
 		valPrev := new(bytes.Buffer)
-		commits = tx(get(cli, storageKey, valPrev), getMD(cli, storageKeyMD, mdPrev), set(cli, storageKey, value), setMD(cli, storageKeyMD, md))
-		rollbacks = tx(noop(), noop(), set(cli, storageKey, valPrev.Bytes()), setMD(cli, storageKeyMD, *mdPrev))
+		commits = tx(o.step("get", storageKey, get(cli, storageKey, valPrev)), o.step("getMD", storageKeyMD, getMD(cli, storageKeyMD, mdPrev)), o.step("set", storageKey, set(cli, storageKey, value)), o.step("setMD", storageKeyMD, setMD(cli, storageKeyMD, md)))
+		rollbacks = tx(noop(), noop(), o.step("rollback.set", storageKey, set(cli, storageKey, valPrev.Bytes())), o.step("rollback.setMD", storageKeyMD, setMD(cli, storageKeyMD, *mdPrev)))
 	default:
-		commits = tx(set(cli, storageKey, value), setMD(cli, storageKeyMD, md))
-		rollbacks = tx(del(cli, storageKey), del(cli, storageKeyMD))
+		commits = tx(o.step("set", storageKey, set(cli, storageKey, value)), o.step("setMD", storageKeyMD, setMD(cli, storageKeyMD, md)))
+		rollbacks = tx(o.step("rollback.del", storageKey, del(cli, storageKey)), o.step("rollback.del", storageKeyMD, del(cli, storageKeyMD)))
 	}
-	return pipeline(commits, rollbacks, backoff.NewExponentialBackOff())
+	if err := pipeline(o, commits, rollbacks, backoff.NewExponentialBackOff()); err != nil {
+		return err
+	}
+	audit(e.cfg, AuditStore, key, mdPrev.Hash, md.Hash, "")
+	return nil
+}
+
+// create stores a value at key like Store, but only if key does not exist.  A key that exists is an error for which
+// isChanged is true.
+func (e *etcdsrv) create(key string, value []byte) (err error) {
+	o := e.begin("create", key)
+	defer o.end(&err)
+	cli, err := getClient(e.cfg)
+	if err != nil {
+		return errors.Wrap(err, "create: failed to get client")
+	}
+	storageKey := path.Join(e.cfg.KeyPrefix, key)
+	storageKeyMD := path.Join(e.mdPrefix, key)
+	md := NewMetadata(key, value)
+	// the metadata is created first, as it is what marks a key as existing
+	commits := tx(o.step("createMD", storageKeyMD, createMD(cli, storageKeyMD, md)), o.step("create", storageKey, create(cli, storageKey, value)))
+	rollbacks := tx(o.step("rollback.del", storageKeyMD, del(cli, storageKeyMD)))
+	if err := pipeline(o, commits, rollbacks, backoff.NewExponentialBackOff()); err != nil {
+		return err
+	}
+	audit(e.cfg, AuditStore, key, [20]byte{}, md.Hash, "")
+	return nil
 }
 
 // Load will load the value at key.  If the key does not exist, `NotExist` error is returned.
 // Checksums of the value loaded are checked against the SHA1 hash in the metadata.  If they do not
 // match, a `FailedChecksum` error is returned.
-func (e *etcdsrv) Load(key string) ([]byte, error) {
+func (e *etcdsrv) Load(key string) (value []byte, err error) {
+	o := e.begin("load", key)
+	defer o.end(&err)
 	cli, err := getClient(e.cfg)
 	if err != nil {
 		return nil, errors.Wrap(err, "load: failed to get client")
@@ -231,7 +411,7 @@ func (e *etcdsrv) Load(key string) ([]byte, error) {
 	storageKey := path.Join(e.cfg.KeyPrefix, key)
 	storageKeyMD := path.Join(e.mdPrefix, key)
 	ex := new(bool)
-	if err := e.execute(exists(cli, storageKeyMD, ex)); err != nil {
+	if err := e.execute(o, "exists", storageKeyMD, exists(cli, storageKeyMD, ex)); err != nil {
 		return nil, errors.Wrap(err, "load: could not get existence of key")
 	}
 	switch *ex {
@@ -240,42 +420,231 @@ func (e *etcdsrv) Load(key string) ([]byte, error) {
 	default:
 	}
 	md := new(Metadata)
-	if err := e.execute(getMD(cli, storageKeyMD, md)); err != nil {
+	if err := e.execute(o, "getMD", storageKeyMD, getMD(cli, storageKeyMD, md)); err != nil {
 		return nil, errors.Wrap(err, "load: could not get metadata")
 	}
 	dst := new(bytes.Buffer)
-	if err := e.execute(get(cli, storageKey, dst)); err != nil {
+	if err := e.execute(o, "get", storageKey, get(cli, storageKey, dst)); err != nil {
 		return nil, errors.Wrap(err, "load: could not get data")
 	}
-	value := dst.Bytes()
+	value = dst.Bytes()
 	if sha1.Sum(value) != md.Hash {
+		checksumFailures.Inc()
 		return nil, FailedChecksum{key}
 	}
 	return value, nil
 }
 
 // Delete will remove nodes associated with the file at key
-func (e *etcdsrv) Delete(key string) error {
+func (e *etcdsrv) Delete(key string) (err error) {
+	o := e.begin("delete", key)
+	defer o.end(&err)
 	cli, err := getClient(e.cfg)
 	if err != nil {
 		return errors.Wrap(err, "load: failed to get client")
 	}
 	storageKey := path.Join(e.cfg.KeyPrefix, key)
 	storageKeyMD := path.Join(e.mdPrefix, key)
-	commits := tx(del(cli, storageKey), del(cli, storageKeyMD))
-	return pipeline(commits, nil, backoff.NewExponentialBackOff())
+	// the hash of the deleted value is only needed for the audit log, so a failure to read it is not an error
+	mdPrev := new(Metadata)
+	if !e.cfg.DisableAudit {
+		_ = o.step("getMD", storageKeyMD, getMD(cli, storageKeyMD, mdPrev))()
+	}
+	commits := tx(o.step("del", storageKey, del(cli, storageKey)), o.step("del", storageKeyMD, del(cli, storageKeyMD)))
+	if err := pipeline(o, commits, nil, backoff.NewExponentialBackOff()); err != nil {
+		return err
+	}
+	audit(e.cfg, AuditDelete, key, mdPrev.Hash, [20]byte{}, "")
+	return nil
+}
+
+// Copy copies the file at src, or every file below the directory src, to dst.  The metadata is copied with each
+// value, so a copy keeps the modification time of the original.  dst must not exist, and a value that does not
+// match its checksum is not copied.  The files are written in one transaction that is rolled back if a write
+// fails.  Like Store, Copy does not lock the keys it reads and writes.
+func (e *etcdsrv) Copy(src string, dst string) (err error) {
+	o := e.begin("copy", src)
+	defer o.end(&err)
+	return e.move(o, src, dst, false)
+}
+
+// Rename moves the file at src, or every file below the directory src, to dst, along with its metadata.  Every file
+// is written at dst before any is deleted from src, so each file can be found in at least one place while it is
+// moved, and the rename is rolled back if a write or delete fails.  Otherwise it behaves like Copy.
+func (e *etcdsrv) Rename(src string, dst string) (err error) {
+	o := e.begin("rename", src)
+	defer o.end(&err)
+	return e.move(o, src, dst, true)
+}
+
+// movedFile is a file copied or renamed by move.  md is its metadata at the destination and prev its metadata at
+// the source.  index and mdIndex are the etcd indexes its value and metadata were read at.
+type movedFile struct {
+	from    string
+	to      string
+	value   []byte
+	md      Metadata
+	prev    Metadata
+	index   uint64
+	mdIndex uint64
+}
+
+// move copies the files at src to dst, then deletes them from src if rename is true, as one transaction.  A file
+// is only deleted from src if its value and metadata are unchanged since they were read, otherwise the rename is
+// rolled back.
+func (e *etcdsrv) move(o *operation, src string, dst string, rename bool) error {
+	src, dst = strings.Trim(path.Clean("/"+src), "/"), strings.Trim(path.Clean("/"+dst), "/")
+	switch {
+	case len(src) == 0 || len(dst) == 0:
+		return errors.Errorf("%s: source and destination must not be the root", o.name)
+	case src == dst || strings.HasPrefix(dst+"/", src+"/") || strings.HasPrefix(src+"/", dst+"/"):
+		return errors.Errorf("%s: %s and %s overlap", o.name, src, dst)
+	case isReserved(src) || isReserved(dst):
+		return errors.Errorf("%s: %s and %s must not be in a directory used by the plugin", o.name, src, dst)
+	case isCaddyfile(src) || isCaddyfile(dst):
+		return errors.Errorf("%s: %s and %s must not be Caddyfiles, sites, or signatures", o.name, src, dst)
+	}
+	cli, err := getClient(e.cfg)
+	if err != nil {
+		return errors.Wrapf(err, "%s: failed to get client", o.name)
+	}
+	mds, err := list(cli, path.Join(e.mdPrefix, src))
+	if err != nil {
+		return errors.Wrapf(err, "%s: could not get metadata", o.name)
+	}
+	nodes, err := list(cli, path.Join(e.cfg.KeyPrefix, src))
+	if err != nil {
+		return errors.Wrapf(err, "%s: could not get values", o.name)
+	}
+	values := make(map[string]client.Node)
+	for _, n := range filter(nodes, FilterRemoveDirectories()) {
+		values[n.Key] = n
+	}
+	var files []movedFile
+	for _, n := range filter(mds, FilterRemoveDirectories()) {
+		key := strings.TrimPrefix(n.Key, e.mdPrefix+"/")
+		f := movedFile{from: key, to: path.Join(dst, strings.TrimPrefix(key, src)), mdIndex: n.ModifiedIndex}
+		// a signature covers the key it is stored beside, so it cannot move with a directory
+		if isCaddyfile(f.from) || isCaddyfile(f.to) {
+			return errors.Errorf("%s: %s must not be a Caddyfile, site, or signature", o.name, f.from)
+		}
+		if err := unmarshalMD(&n, &f.prev); err != nil {
+			return errors.Wrapf(err, "%s: invalid metadata for %s", o.name, key)
+		}
+		v, ok := values[path.Join(e.cfg.KeyPrefix, key)]
+		if !ok {
+			return errors.Errorf("%s: %s has metadata but no value", o.name, key)
+		}
+		delete(values, v.Key)
+		f.index = v.ModifiedIndex
+		if f.value, err = base64.StdEncoding.DecodeString(v.Value); err != nil {
+			return errors.Wrapf(err, "%s: %s is not base64 encoded", o.name, key)
+		}
+		if sha1.Sum(f.value) != f.prev.Hash {
+			checksumFailures.Inc()
+			return FailedChecksum{key}
+		}
+		f.md = f.prev
+		f.md.Path = f.to
+		files = append(files, f)
+	}
+	// a value without metadata was not written through the plugin, and would be left behind or copied without it
+	if len(values) > 0 {
+		var keys []string
+		for k := range values {
+			keys = append(keys, strings.TrimPrefix(k, e.cfg.KeyPrefix+"/"))
+		}
+		sort.Strings(keys)
+		return errors.Errorf("%s: %s has no metadata", o.name, keys[0])
+	}
+	if len(files) == 0 {
+		return NotExist{src}
+	}
+	for _, k := range []string{path.Join(e.cfg.KeyPrefix, dst), path.Join(e.mdPrefix, dst)} {
+		ex := new(bool)
+		if err := e.execute(o, "exists", k, exists(cli, k, ex)); err != nil {
+			return errors.Wrapf(err, "%s: could not get existence of destination", o.name)
+		}
+		if *ex {
+			return errors.Errorf("%s: %s already exists", o.name, dst)
+		}
+	}
+
+	var commits []backoff.Operation
+	var rollbacks []backoff.Operation
+	for _, f := range files {
+		k, kMD := path.Join(e.cfg.KeyPrefix, f.to), path.Join(e.mdPrefix, f.to)
+		commits = append(commits, o.step("create", k, create(cli, k, f.value)), o.step("createMD", kMD, createMD(cli, kMD, f.md)))
+		rollbacks = append(rollbacks, o.step("rollback.del", k, del(cli, k)), o.step("rollback.del", kMD, del(cli, kMD)))
+	}
+	if rename {
+		for _, f := range files {
+			k, kMD := path.Join(e.cfg.KeyPrefix, f.from), path.Join(e.mdPrefix, f.from)
+			commits = append(commits, o.step("del", k, remove(cli, k, f.index)), o.step("del", kMD, remove(cli, kMD, f.mdIndex)))
+			// a file written at src since it was deleted is newer, so it is not put back over
+			rollbacks = append(rollbacks, o.step("rollback.create", k, create(cli, k, f.value)), o.step("rollback.createMD", kMD, createMD(cli, kMD, f.prev)))
+		}
+	}
+	if err := pipeline(o, commits, rollbacks, backoff.NewExponentialBackOff()); err != nil {
+		return err
+	}
+	op := AuditCopy
+	if rename {
+		op = AuditRename
+	}
+	for _, f := range files {
+		audit(e.cfg, op, f.to, [20]byte{}, f.md.Hash, "from "+f.from)
+	}
+	return nil
+}
+
+// IsReserved returns true if key is in a directory used by the plugin itself, such as the metadata or the locks.
+// Values there are not certmagic's and must not be written or deleted through the storage.
+func IsReserved(key string) bool {
+	return isReserved(strings.Trim(path.Clean("/"+key), "/"))
+}
+
+// isReserved returns true if key is in a directory that holds the metadata, locks, audit log, Caddyfile history,
+// quarantined values, or tombstones of the plugin
+func isReserved(key string) bool {
+	switch strings.SplitN(key, "/", 2)[0] {
+	case "md", "lock", "audit", "history", quarantineDir, purgedDir:
+		return true
+	}
+	return false
+}
+
+// IsCaddyfile returns true if key is a Caddyfile, a per-site key, or a signature.  They are written through History
+// and SignKey, which validate and sign them, and not copied, moved, or written as plain values.
+func IsCaddyfile(key string) bool {
+	return isCaddyfile(strings.Trim(path.Clean("/"+key), "/"))
+}
+
+// isCaddyfile returns true if key is the Caddyfile of a server type, the legacy Caddyfile, a key in the sites
+// directories, or a signature of any key
+func isCaddyfile(key string) bool {
+	if key == legacyCaddyfileKey || isSignature(key) {
+		return true
+	}
+	switch strings.SplitN(key, "/", 2)[0] {
+	case caddyfilesDir, legacySitesDir:
+		return true
+	}
+	return false
 }
 
 // Metadata will load the metadata associated with the data at node key.  If the
 // node does not exist, a `NotExist` error is returned and the metadata will be nil.
-func (e *etcdsrv) Metadata(key string) (*Metadata, error) {
+func (e *etcdsrv) Metadata(key string) (md *Metadata, err error) {
+	o := e.begin("metadata", key)
+	defer o.end(&err)
 	cli, err := getClient(e.cfg)
 	if err != nil {
 		return nil, errors.Wrap(err, "load: failed to get client")
 	}
 	storageKeyMD := path.Join(e.mdPrefix, key)
 	ex := new(bool)
-	if err := e.execute(exists(cli, storageKeyMD, ex)); err != nil {
+	if err := e.execute(o, "exists", storageKeyMD, exists(cli, storageKeyMD, ex)); err != nil {
 		return nil, errors.Wrap(err, "load: could not get existence of key")
 	}
 	switch *ex {
@@ -283,8 +652,8 @@ func (e *etcdsrv) Metadata(key string) (*Metadata, error) {
 		return nil, NotExist{key}
 	default:
 	}
-	md := new(Metadata)
-	if err := e.execute(getMD(cli, storageKeyMD, md)); err != nil {
+	md = new(Metadata)
+	if err := e.execute(o, "getMD", storageKeyMD, getMD(cli, storageKeyMD, md)); err != nil {
 		return nil, errors.Wrap(err, "load: could not get metadata")
 	}
 	// directory virtual nodes need to remove the MD prefix
@@ -294,17 +663,20 @@ func (e *etcdsrv) Metadata(key string) (*Metadata, error) {
 	return md, nil
 }
 
-func (e *etcdsrv) List(key string, filters ...func(client.Node) bool) ([]string, error) {
+func (e *etcdsrv) List(key string, filters ...func(client.Node) bool) (out []string, err error) {
+	o := e.begin("list", key)
+	defer o.end(&err)
 	cli, err := getClient(e.cfg)
 	if err != nil {
 		return nil, errors.Wrap(err, "list: failed to get client")
 	}
 	k := path.Join(e.cfg.KeyPrefix, key)
+	s := o.span.child("list", F(FieldKey, k))
 	nodes, err := list(cli, k)
+	s.end(err)
 	if err != nil {
 		return nil, errors.Wrap(err, "List: could not get keys")
 	}
-	var out []string
 	for _, f := range filters {
 		nodes = filter(nodes, f)
 	}
@@ -1,13 +1,25 @@
 package etcd
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
 	"net/http"
 	"path"
+	"sort"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/client"
+	"golang.org/x/crypto/ocsp"
 )
 
 func shouldRunIntegration() bool {
@@ -18,6 +30,75 @@ func shouldRunIntegration() bool {
 	return true
 }
 
+// testPrefix returns a config for the key prefix `/test<name>` on the local etcd server, and its secrets prefix,
+// along with a client.  Both prefixes are emptied now and by the returned cleanup.  The test is skipped when no etcd
+// server is running.
+func testPrefix(t *testing.T, name string) (*ClusterConfig, client.KeysAPI, func()) {
+	if !shouldRunIntegration() {
+		t.Skip("no etcd server found, skipping")
+	}
+	cfg := &ClusterConfig{
+		KeyPrefix:     "/test" + name,
+		SecretsPrefix: "/test" + name + "-secrets",
+		ServerIP:      []string{"http://127.0.0.1:2379"},
+		LockTimeout:   time.Minute,
+	}
+	cli, err := getClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clean := func() {
+		for _, p := range []string{cfg.KeyPrefix, cfg.SecretsPrefix} {
+			_, _ = cli.Delete(context.Background(), p, &client.DeleteOptions{Recursive: true})
+		}
+	}
+	clean()
+	return cfg, cli, clean
+}
+
+// testCert is a self signed certificate with its private key and an OCSP staple, all PEM encoded except the staple
+type testCert struct {
+	crt    []byte
+	key    []byte
+	staple []byte
+}
+
+// testCertificate returns a self signed certificate for names with serial that expires at notAfter
+func testCertificate(t *testing.T, serial int64, notAfter time.Time, names ...string) testCert {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    notAfter.AddDate(-2, 0, 0),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staple, err := ocsp.CreateResponse(cert, cert, ocsp.Response{Status: ocsp.Good, SerialNumber: cert.SerialNumber, ThisUpdate: time.Now()}, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCert{
+		crt:    pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		key:    pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}),
+		staple: staple,
+	}
+}
+
 func TestLockUnlock(t *testing.T) {
 	if !shouldRunIntegration() {
 		t.Skip("no etcd server found, skipping")
@@ -37,7 +118,7 @@ func TestLockUnlock(t *testing.T) {
 	lock := func(t string, key string) lockFunc {
 		return func(d time.Duration) error {
 			cli.cfg.LockTimeout = d
-			return cli.lock(t, key)
+			return cli.lock(&operation{name: "lock"}, t, key)
 		}
 	}
 	unlock := func(key string) lockFunc {
@@ -132,7 +213,7 @@ func TestMetadata(t *testing.T) {
 		t.Fatal(err)
 	}
 	for k, v := range paths {
-		if err := cli.execute(setMD(cliL, path.Join(cli.mdPrefix, k), v)); err != nil {
+		if err := cli.execute(&operation{name: "test"}, "setMD", k, setMD(cliL, path.Join(cli.mdPrefix, k), v)); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -260,3 +341,164 @@ func TestList(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Empty(t, out6)
 }
+
+func TestListLocks(t *testing.T) {
+	if !shouldRunIntegration() {
+		t.Skip("no etcd server found, skipping")
+	}
+	cfg := &ClusterConfig{
+		KeyPrefix:   "/testlocks",
+		ServerIP:    []string{"http://127.0.0.1:2379"},
+		LockTimeout: time.Minute,
+	}
+	cliL, err := getClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = cliL.Delete(context.Background(), cfg.KeyPrefix, &client.DeleteOptions{Recursive: true})
+	defer cliL.Delete(context.Background(), cfg.KeyPrefix, &client.DeleteOptions{Recursive: true})
+	cli := NewService(cfg).(*etcdsrv)
+	assert.NoError(t, cli.lock(&operation{name: "lock"}, "one", "certs/one"))
+	assert.NoError(t, cli.lock(&operation{name: "lock"}, "two", "certs/sub/two"))
+
+	locks, err := ListLocks(cfg)
+	assert.NoError(t, err)
+	if assert.Len(t, locks, 2) {
+		sort.Slice(locks, func(i, j int) bool { return locks[i].Key < locks[j].Key })
+		assert.Equal(t, "certs/one", locks[0].Key)
+		assert.Equal(t, "one", locks[0].Token)
+		assert.Equal(t, "certs/sub/two", locks[1].Key)
+	}
+	assert.NoError(t, cli.Unlock("certs/one"))
+	locks, err = ListLocks(cfg)
+	assert.NoError(t, err)
+	assert.Len(t, locks, 1)
+}
+
+func TestCopyRename(t *testing.T) {
+	if !shouldRunIntegration() {
+		t.Skip("no etcd server found, skipping")
+	}
+	cfg := &ClusterConfig{
+		KeyPrefix:   "/testmove",
+		ServerIP:    []string{"http://127.0.0.1:2379"},
+		LockTimeout: time.Minute,
+	}
+	cliL, err := getClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = cliL.Delete(context.Background(), cfg.KeyPrefix, &client.DeleteOptions{Recursive: true})
+	defer cliL.Delete(context.Background(), cfg.KeyPrefix, &client.DeleteOptions{Recursive: true})
+	cli := NewService(cfg).(*etcdsrv)
+	modified := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(t, cli.storeAt("acme/one/one.crt", []byte("cert"), modified))
+	assert.NoError(t, cli.storeAt("acme/one/one.key", []byte("key"), modified))
+	assert.NoError(t, cli.storeAt("acme/one/sub/one.json", []byte("{}"), modified))
+
+	assert.NoError(t, cli.Copy("acme/one/one.crt", "copies/one.crt"))
+	value, err := cli.Load("copies/one.crt")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("cert"), value)
+	md, err := cli.Metadata("copies/one.crt")
+	assert.NoError(t, err)
+	assert.Equal(t, "copies/one.crt", md.Path)
+	assert.True(t, modified.Equal(md.Timestamp))
+
+	assert.NoError(t, cli.Rename("/acme/one/", "acme/two"))
+	keys, err := cli.List("acme", FilterRemoveDirectories())
+	assert.NoError(t, err)
+	sort.Strings(keys)
+	assert.Equal(t, []string{"/acme/two/one.crt", "/acme/two/one.key", "/acme/two/sub/one.json"}, keys)
+	_, err = cli.Metadata("acme/one/one.key")
+	assert.True(t, IsNotExistError(err))
+	md, err = cli.Metadata("acme/two/sub/one.json")
+	assert.NoError(t, err)
+	assert.True(t, modified.Equal(md.Timestamp))
+	value, err = cli.Load("acme/two/one.key")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("key"), value)
+
+	// the destination must not exist, and the source must
+	assert.Error(t, cli.Copy("acme/two/one.crt", "copies/one.crt"))
+	assert.Error(t, cli.Rename("acme/two", "copies"))
+	assert.True(t, IsNotExistError(cli.Rename("acme/one", "acme/three")))
+	assert.Error(t, cli.Rename("acme", "acme/two/inner"))
+	assert.Error(t, cli.Rename("acme/two", "lock/two"))
+	assert.Error(t, cli.Rename("acme/two", "purged/two"))
+	// Caddyfiles, sites, and signatures are only written through History and SignKey
+	assert.Error(t, cli.Copy("acme/two/one.crt", "caddyfiles/http"))
+	assert.Error(t, cli.Copy("acme/two/one.crt", "sites/http/one"))
+	assert.Error(t, cli.Copy("acme/two/one.crt", "acme/two/one.crt.sig"))
+	_, err = cli.Metadata("acme/two/one.crt")
+	assert.NoError(t, err)
+
+	// a value that does not match its checksum is not copied
+	_, err = cliL.Set(context.Background(), path.Join(cfg.KeyPrefix, "acme/two/one.key"), base64.StdEncoding.EncodeToString([]byte("changed")), nil)
+	assert.NoError(t, err)
+	assert.True(t, IsFailedChecksumError(cli.Copy("acme/two", "acme/three")))
+	_, err = cli.Metadata("acme/three/one.crt")
+	assert.True(t, IsNotExistError(err))
+
+	// nor is a value without metadata, which would be left behind
+	assert.NoError(t, cli.Store("acme/bare/one.crt", []byte("cert")))
+	_, err = cliL.Set(context.Background(), path.Join(cfg.KeyPrefix, "acme/bare/one.key"), base64.StdEncoding.EncodeToString([]byte("key")), nil)
+	assert.NoError(t, err)
+	assert.Error(t, cli.Rename("acme/bare", "acme/four"))
+	_, err = cli.Metadata("acme/bare/one.crt")
+	assert.NoError(t, err)
+	_, err = cli.Metadata("acme/four/one.crt")
+	assert.True(t, IsNotExistError(err))
+
+	assert.NoError(t, FlushAudit(time.Minute))
+	entries, err := NewAudit(cfg).List()
+	assert.NoError(t, err)
+	var renamed int
+	for _, e := range entries {
+		if e.Operation == AuditRename {
+			renamed++
+		}
+	}
+	assert.Equal(t, 3, renamed)
+}
+
+func TestIsReserved(t *testing.T) {
+	tcs := []struct {
+		Key      string
+		Reserved bool
+	}{
+		{Key: "sites/example.com/example.com.crt", Reserved: false},
+		{Key: "mdx/example.com", Reserved: false},
+		{Key: "md/sites/example.com/example.com.crt", Reserved: true},
+		{Key: "/lock/example.com", Reserved: true},
+		{Key: "./audit/1", Reserved: true},
+		{Key: "sites/../quarantine/example.com", Reserved: true},
+		{Key: "purged", Reserved: true},
+		{Key: "history/caddyfiles/http/0000000001", Reserved: true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Key, func(t *testing.T) {
+			assert.Equal(t, tc.Reserved, IsReserved(tc.Key))
+		})
+	}
+}
+
+func TestIsCaddyfile(t *testing.T) {
+	tcs := []struct {
+		Key       string
+		Caddyfile bool
+	}{
+		{Key: "caddyfile", Caddyfile: true},
+		{Key: "/caddyfiles/http", Caddyfile: true},
+		{Key: "sites/http/example.com", Caddyfile: true},
+		{Key: "snippets/gzip.sig", Caddyfile: true},
+		{Key: "snippets/gzip", Caddyfile: false},
+		{Key: "caddyfile-old", Caddyfile: false},
+		{Key: "acme/acme-v02.api.letsencrypt.org/sites/example.com/example.com.crt", Caddyfile: false},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Key, func(t *testing.T) {
+			assert.Equal(t, tc.Caddyfile, IsCaddyfile(tc.Key))
+		})
+	}
+}
@@ -0,0 +1,283 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// expiryLockKey is the lock held by the instance elected to run the expiry monitor
+const expiryLockKey = "monitor/expiry"
+
+// expiryNotifyTimeout limits how long a command or webhook notifier may take
+var expiryNotifyTimeout = 30 * time.Second
+
+// ExpiryAlert is sent to the expiry notifier after a scan finds certificates that expire within the window.  A
+// certificate that certmagic renews in time never enters the window, as long as the window is shorter than the
+// renewal window, so each one is a renewal that has failed.
+type ExpiryAlert struct {
+	Instance     string              `json:"instance"`
+	Prefix       string              `json:"prefix"`
+	Window       time.Duration       `json:"window_ns"`
+	Time         time.Time           `json:"time"`
+	Certificates []StoredCertificate `json:"certificates"`
+}
+
+// ExpiryNotifier is told about certificates that are about to expire
+type ExpiryNotifier interface {
+	NotifyExpiry(a ExpiryAlert) error
+}
+
+// expiryNotifiers holds the notifiers that can be selected with CADDY_CLUSTERING_ETCD_EXPIRY_NOTIFY
+var expiryNotifiers = struct {
+	sync.Mutex
+	byName map[string]func(c *ClusterConfig, arg string) (ExpiryNotifier, error)
+}{byName: map[string]func(c *ClusterConfig, arg string) (ExpiryNotifier, error){
+	"log":     newLogNotifier,
+	"command": newCommandNotifier,
+	"webhook": newWebhookNotifier,
+}}
+
+// RegisterExpiryNotifier makes a notifier available by name to CADDY_CLUSTERING_ETCD_EXPIRY_NOTIFY, which is set
+// to `name` or `name:arg`.  It is meant to be called from the init function of a plugin that sends alerts to a
+// paging or chat service.  The notifiers `log`, `command`, and `webhook` are always available.
+func RegisterExpiryNotifier(name string, f func(c *ClusterConfig, arg string) (ExpiryNotifier, error)) {
+	expiryNotifiers.Lock()
+	defer expiryNotifiers.Unlock()
+	if _, ok := expiryNotifiers.byName[name]; ok {
+		panic(fmt.Sprintf("expiry notifier %s is already registered", name))
+	}
+	expiryNotifiers.byName[name] = f
+}
+
+func expiryNotifier(name string) (func(c *ClusterConfig, arg string) (ExpiryNotifier, error), error) {
+	expiryNotifiers.Lock()
+	defer expiryNotifiers.Unlock()
+	f, ok := expiryNotifiers.byName[name]
+	if !ok {
+		return nil, errors.Errorf("%s is not a registered expiry notifier", name)
+	}
+	return f, nil
+}
+
+// logNotifier writes an error to the plugin log naming every expiring certificate
+type logNotifier struct {
+	cfg *ClusterConfig
+}
+
+func newLogNotifier(c *ClusterConfig, arg string) (ExpiryNotifier, error) {
+	if len(arg) > 0 {
+		return nil, errors.New("the log notifier takes no argument")
+	}
+	return logNotifier{cfg: c}, nil
+}
+
+func (l logNotifier) NotifyExpiry(a ExpiryAlert) error {
+	domains := make([]string, 0, len(a.Certificates))
+	for _, s := range a.Certificates {
+		domains = append(domains, s.Domain)
+	}
+	l.cfg.log(LevelError, "certificates are about to expire and have not been renewed", F("count", len(domains)), F("domains", strings.Join(domains, ",")), F("window", a.Window))
+	return nil
+}
+
+// commandNotifier runs a command with the alert as JSON on its standard input
+type commandNotifier struct {
+	args []string
+}
+
+func newCommandNotifier(c *ClusterConfig, arg string) (ExpiryNotifier, error) {
+	args := strings.Fields(arg)
+	if len(args) == 0 {
+		return nil, errors.New("the command notifier needs a command, such as command:/usr/local/bin/alert")
+	}
+	return commandNotifier{args: args}, nil
+}
+
+func (n commandNotifier) NotifyExpiry(a ExpiryAlert) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return errors.Wrap(err, "expiry: failed to marshal alert")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), expiryNotifyTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, n.args[0], n.args[1:]...)
+	cmd.Stdin = bytes.NewReader(b)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "expiry: %s failed: %s", n.args[0], strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// webhookNotifier posts the alert as JSON to a URL
+type webhookNotifier struct {
+	url string
+}
+
+func newWebhookNotifier(c *ClusterConfig, arg string) (ExpiryNotifier, error) {
+	if !strings.HasPrefix(arg, "http://") && !strings.HasPrefix(arg, "https://") {
+		return nil, errors.New("the webhook notifier needs an http or https URL, such as webhook:https://alerts.example.com/caddy")
+	}
+	return webhookNotifier{url: arg}, nil
+}
+
+func (n webhookNotifier) NotifyExpiry(a ExpiryAlert) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return errors.Wrap(err, "expiry: failed to marshal alert")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), expiryNotifyTimeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "expiry: failed to create webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "expiry: webhook failed")
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("expiry: webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+var expiryOnce sync.Once
+
+// monitorExpiry starts the expiry monitor in the background, once per process.  Every instance takes part in
+// the election, but only the one holding the monitor lock scans.  Alerts go to the log unless another notifier
+// is configured.
+func monitorExpiry(c *ClusterConfig) {
+	if c.ExpiryInterval <= 0 {
+		return
+	}
+	expiryOnce.Do(func() {
+		if c.ExpiryNotifier == nil {
+			c.ExpiryNotifier = logNotifier{cfg: c}
+		}
+		m := newExpiryMonitor(c, token)
+		go func() {
+			t := time.NewTicker(m.tick)
+			defer t.Stop()
+			for {
+				m.run(time.Now())
+				<-t.C
+			}
+		}()
+	})
+}
+
+// expiryMonitor elects one instance to scan for expiring certificates.  The elected instance holds the lock at
+// expiryLockKey and extends it more often than the lock timeout, so when it stops another instance takes over
+// once the lock is abandoned.
+type expiryMonitor struct {
+	cfg    *ClusterConfig
+	srv    *etcdsrv
+	token  string
+	tick   time.Duration
+	leader bool
+	last   time.Time
+}
+
+func newExpiryMonitor(c *ClusterConfig, tok string) *expiryMonitor {
+	tick := c.LockTimeout / 2
+	if c.ExpiryInterval < tick {
+		tick = c.ExpiryInterval
+	}
+	if tick < time.Second {
+		tick = time.Second
+	}
+	return &expiryMonitor{
+		cfg:   c,
+		srv:   &etcdsrv{lockKey: path.Join(c.KeyPrefix, "lock"), cfg: c, noBackoff: true},
+		token: tok,
+		tick:  tick,
+	}
+}
+
+// run takes or extends the monitor lock and scans when this instance is elected and the interval has passed
+func (m *expiryMonitor) run(now time.Time) {
+	if !m.elect() {
+		return
+	}
+	if now.Sub(m.last) < m.cfg.ExpiryInterval {
+		return
+	}
+	m.last = now
+	if _, err := checkExpiry(m.cfg); err != nil {
+		m.cfg.log(LevelWarn, "expiry check failed", F(FieldError, err))
+	}
+}
+
+// elect returns true while this instance holds the monitor lock.  Losing the lock clears the metrics this
+// instance reported, so only the elected instance reports expiring certificates.
+func (m *expiryMonitor) elect() bool {
+	err := m.srv.lock(&operation{cfg: m.cfg, name: "expiry"}, m.token, expiryLockKey)
+	leader := err == nil
+	switch {
+	case leader && !m.leader:
+		m.cfg.log(LevelInfo, "elected to monitor certificate expiry")
+	case !leader && m.leader:
+		m.cfg.log(LevelInfo, "no longer monitoring certificate expiry", F(FieldError, err))
+		m.last = time.Time{}
+		certificateExpiry.Reset()
+		certificatesExpiring.Set(0)
+	}
+	m.leader = leader
+	if leader {
+		expiryMonitorLeader.Set(1)
+	} else {
+		expiryMonitorLeader.Set(0)
+	}
+	return leader
+}
+
+// checkExpiry scans the stored certificates once and returns those that expire within the window, including
+// those that have expired.  Each one is logged as a warning and the notifier is sent a single alert for all of
+// them.  Certificates that cannot be read are logged, since they cannot be renewed either.
+func checkExpiry(c *ClusterConfig) ([]StoredCertificate, error) {
+	certs, err := Inventory(c, InventoryOptions{})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	deadline := now.Add(c.ExpiryWindow)
+	certificateExpiry.Reset()
+	var expiring []StoredCertificate
+	for _, s := range certs {
+		if s.Err != nil {
+			c.log(LevelWarn, "stored certificate cannot be read", F(FieldKey, s.Key), F(FieldError, s.Err))
+			continue
+		}
+		certificateExpiry.WithLabelValues(s.Domain, s.CA).Set(float64(s.NotAfter.Unix()))
+		if s.NotAfter.After(deadline) {
+			continue
+		}
+		expiring = append(expiring, s)
+		c.log(LevelWarn, "certificate is about to expire and has not been renewed", F("domain", s.Domain), F("not_after", s.NotAfter.Format(time.RFC3339)), F(FieldKey, s.Key))
+	}
+	certificatesExpiring.Set(float64(len(expiring)))
+	c.log(LevelInfo, "expiry check finished", F("certificates", len(certs)), F("expiring", len(expiring)))
+	if len(expiring) == 0 || c.ExpiryNotifier == nil {
+		return expiring, nil
+	}
+	a := ExpiryAlert{Instance: c.InstanceID, Prefix: c.KeyPrefix, Window: c.ExpiryWindow, Time: now, Certificates: expiring}
+	if err := c.ExpiryNotifier.NotifyExpiry(a); err != nil {
+		return expiring, errors.Wrap(err, "expiry: failed to notify")
+	}
+	return expiring, nil
+}
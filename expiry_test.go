@@ -0,0 +1,149 @@
+package etcd
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordNotifier struct {
+	alerts []ExpiryAlert
+}
+
+func (r *recordNotifier) NotifyExpiry(a ExpiryAlert) error {
+	r.alerts = append(r.alerts, a)
+	return nil
+}
+
+func TestExpiryMonitor(t *testing.T) {
+	notifier := &recordNotifier{}
+	cfg, cli, done := testPrefix(t, "expiry")
+	defer done()
+	cfg.ExpiryInterval = time.Hour
+	cfg.ExpiryWindow = 14 * 24 * time.Hour
+	cfg.ExpiryNotifier = notifier
+	srv := NewService(cfg)
+	now := time.Now()
+	for i, tc := range []struct {
+		domain   string
+		notAfter time.Time
+	}{
+		{"fresh.example.com", now.Add(60 * 24 * time.Hour)},
+		{"soon.example.com", now.Add(3 * 24 * time.Hour)},
+		{"expired.example.com", now.Add(-time.Hour)},
+	} {
+		c := testCertificate(t, int64(i+1), tc.notAfter, tc.domain)
+		assert.NoError(t, srv.Store(path.Join("acme/acme-v02.api.letsencrypt.org/sites", tc.domain, tc.domain+".crt"), c.crt))
+	}
+
+	// only one instance is elected, and it scans once per interval
+	one, two := newExpiryMonitor(cfg, "one"), newExpiryMonitor(cfg, "two")
+	one.run(now)
+	two.run(now)
+	assert.True(t, one.leader)
+	assert.False(t, two.leader)
+	one.run(now.Add(time.Minute))
+	if assert.Len(t, notifier.alerts, 1) {
+		a := notifier.alerts[0]
+		assert.Equal(t, cfg.ExpiryWindow, a.Window)
+		var domains []string
+		for _, s := range a.Certificates {
+			domains = append(domains, s.Domain)
+		}
+		assert.Equal(t, []string{"expired.example.com", "soon.example.com"}, domains)
+	}
+	one.run(now.Add(2 * time.Hour))
+	assert.Len(t, notifier.alerts, 2)
+
+	// another instance takes over once the lock is abandoned
+	_, err := cli.Delete(context.Background(), path.Join(cfg.KeyPrefix, "lock", expiryLockKey), nil)
+	assert.NoError(t, err)
+	two.run(now)
+	assert.True(t, two.leader)
+	assert.Len(t, notifier.alerts, 3)
+	one.run(now.Add(3 * time.Hour))
+	assert.False(t, one.leader)
+	assert.Len(t, notifier.alerts, 3)
+
+	// instances electing at the same time, for a free lock or an abandoned one, elect a single leader
+	for _, abandoned := range []bool{false, true} {
+		_, err = cli.Delete(context.Background(), path.Join(cfg.KeyPrefix, "lock", expiryLockKey), nil)
+		assert.NoError(t, err)
+		if abandoned {
+			b, _ := json.Marshal(Lock{Token: "gone", Obtained: now.Add(-time.Hour).UTC().Format(time.RFC3339Nano), Key: expiryLockKey})
+			_, err = cli.Set(context.Background(), path.Join(cfg.KeyPrefix, "lock", expiryLockKey), base64.StdEncoding.EncodeToString(b), nil)
+			assert.NoError(t, err)
+		}
+		var wg sync.WaitGroup
+		var leaders int32
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(m *expiryMonitor) {
+				defer wg.Done()
+				if m.elect() {
+					atomic.AddInt32(&leaders, 1)
+				}
+			}(newExpiryMonitor(cfg, fmt.Sprintf("racer-%d", i)))
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), leaders, "abandoned %v", abandoned)
+	}
+}
+
+func TestExpiryNotifiers(t *testing.T) {
+	alert := ExpiryAlert{Instance: "web-1", Prefix: "/caddy", Window: time.Hour, Certificates: []StoredCertificate{{Domain: "example.com"}}}
+
+	var got ExpiryAlert
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+		if got.Instance != "web-1" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+	c, err := NewClusterConfig(WithExpiryNotifier("webhook:" + ts.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, c.ExpiryNotifier.NotifyExpiry(alert))
+	assert.Equal(t, alert.Certificates[0].Domain, got.Certificates[0].Domain)
+	assert.Error(t, c.ExpiryNotifier.NotifyExpiry(ExpiryAlert{Instance: "web-2"}))
+
+	dir, err := ioutil.TempDir("", "expiry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "notify")
+	out := filepath.Join(dir, "alert.json")
+	assert.NoError(t, ioutil.WriteFile(script, []byte("#!/bin/sh\ncat > \"$1\"\n"), 0700))
+	c, err = NewClusterConfig(WithExpiryNotifier("command:" + script + " " + out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, c.ExpiryNotifier.NotifyExpiry(alert))
+	b, err := ioutil.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), `"domain":"example.com"`)
+
+	for _, s := range []string{"pager", "webhook:ftp://example.com", "command:", "log:extra"} {
+		_, err := NewClusterConfig(WithExpiryNotifier(s))
+		assert.Error(t, err, s)
+	}
+	c, err = NewClusterConfig(WithExpiryNotifier("log"))
+	assert.NoError(t, err)
+	assert.IsType(t, logNotifier{}, c.ExpiryNotifier)
+}
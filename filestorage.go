@@ -0,0 +1,338 @@
+package etcd
+
+import (
+	"crypto/sha1"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mholt/certmagic"
+	"github.com/pkg/errors"
+)
+
+// Policies for keys that already exist at the destination of an import or export
+const (
+	SkipExisting      = "skip"
+	OverwriteExisting = "overwrite"
+)
+
+// Results of copying one key
+const (
+	TransferCopied      = "copied"
+	TransferOverwritten = "overwritten"
+	TransferSkipped     = "skipped"
+	TransferUnchanged   = "unchanged"
+	TransferFailed      = "failed"
+)
+
+// TransferOptions controls an import or export
+type TransferOptions struct {
+	// DryRun reports what would be copied without locking or writing anything
+	DryRun bool
+	// Existing is what to do with a key that exists at the destination with a different value, SkipExisting or
+	// OverwriteExisting.  It defaults to SkipExisting.
+	Existing string
+	// CA is the ACME directory URL of each CA whose certificates are in the file storage, which certmagic names its
+	// site locks after.  It defaults to certmagic.CA.
+	CA []string
+}
+
+// Transfer is the result of copying one key.  Modified is the modification time of the value that was copied.
+type Transfer struct {
+	Key      string
+	Result   string
+	Size     int
+	Modified time.Time
+	Err      error
+}
+
+// ImportFileStorage copies every key of a certmagic `FileStorage` rooted at root, such as `$CADDYPATH`, into etcd,
+// keeping the modification time of each file in its metadata.  Each key is copied under the locks of transferLocks,
+// and reserved keys are reported as skipped.
+func ImportFileStorage(c *ClusterConfig, root string, opts TransferOptions) ([]Transfer, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	fs := &certmagic.FileStorage{Path: root}
+	keys, err := fileStorageKeys(c, root)
+	if err != nil {
+		return nil, err
+	}
+	// the modification time of each file is kept, which only the etcd service can store
+	srv := NewService(c).(*etcdsrv)
+	var out []Transfer
+	for _, key := range keys {
+		t := Transfer{Key: key}
+		t.Result, t.Err = importKey(srv, fs, key, opts, &t)
+		out = append(out, t)
+	}
+	return out, transferErr("import", out)
+}
+
+func importKey(srv *etcdsrv, fs *certmagic.FileStorage, key string, opts TransferOptions, t *Transfer) (string, error) {
+	if isReserved(key) {
+		// a file that would land among the plugin's own nodes is never copied
+		return TransferSkipped, nil
+	}
+	if !opts.DryRun {
+		etcdLocks, fileLocks, err := transferLocks(key, opts.cas())
+		if err != nil {
+			return TransferFailed, errors.Wrap(err, "import")
+		}
+		if err := lockTransfer(srv, fs, etcdLocks, fileLocks); err != nil {
+			return TransferFailed, errors.Wrap(err, "import")
+		}
+		defer unlockTransfer(srv, fs, etcdLocks, fileLocks)
+	}
+	info, err := os.Stat(fs.Filename(key))
+	if err != nil {
+		return TransferFailed, errors.Wrap(err, "import: failed to stat file")
+	}
+	value, err := ioutil.ReadFile(fs.Filename(key))
+	if err != nil {
+		return TransferFailed, errors.Wrap(err, "import: failed to read file")
+	}
+	t.Size, t.Modified = len(value), info.ModTime()
+	var prev *[20]byte
+	md, err := srv.Metadata(key)
+	switch {
+	case err == nil:
+		prev = &md.Hash
+	case !IsNotExistError(err):
+		return TransferFailed, err
+	}
+	result := opts.decide(sha1.Sum(value), prev)
+	if opts.DryRun || result == TransferSkipped || result == TransferUnchanged {
+		return result, nil
+	}
+	if err := srv.storeAt(key, value, info.ModTime()); err != nil {
+		return TransferFailed, err
+	}
+	return result, nil
+}
+
+// ExportFileStorage copies every key stored in etcd into a certmagic `FileStorage` rooted at root, setting the
+// modification time of each file from its metadata.  Values are checked against their checksums before they are
+// written.  Keys are locked the same way as ImportFileStorage, and reserved keys are reported as skipped.
+func ExportFileStorage(c *ClusterConfig, root string, opts TransferOptions) ([]Transfer, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	fs := &certmagic.FileStorage{Path: root}
+	keys, err := storedKeys(c)
+	if err != nil {
+		return nil, err
+	}
+	srv := NewService(c)
+	var out []Transfer
+	for _, key := range keys {
+		t := Transfer{Key: key}
+		t.Result, t.Err = exportKey(srv, fs, key, opts, &t)
+		out = append(out, t)
+	}
+	return out, transferErr("export", out)
+}
+
+func exportKey(srv Service, fs *certmagic.FileStorage, key string, opts TransferOptions, t *Transfer) (string, error) {
+	if isReserved(key) {
+		// metadata, locks, the audit log and quarantined or purged values belong to the plugin, not to certmagic
+		return TransferSkipped, nil
+	}
+	if !opts.DryRun {
+		etcdLocks, fileLocks, err := transferLocks(key, opts.cas())
+		if err != nil {
+			return TransferFailed, errors.Wrap(err, "export")
+		}
+		if err := lockTransfer(srv, fs, etcdLocks, fileLocks); err != nil {
+			return TransferFailed, errors.Wrap(err, "export")
+		}
+		defer unlockTransfer(srv, fs, etcdLocks, fileLocks)
+	}
+	md, err := srv.Metadata(key)
+	if err != nil {
+		return TransferFailed, err
+	}
+	value, err := srv.Load(key)
+	if err != nil {
+		return TransferFailed, err
+	}
+	t.Size, t.Modified = len(value), md.Timestamp
+	var prev *[20]byte
+	existing, err := ioutil.ReadFile(fs.Filename(key))
+	switch {
+	case err == nil:
+		h := sha1.Sum(existing)
+		prev = &h
+	case !os.IsNotExist(err):
+		return TransferFailed, errors.Wrap(err, "export: failed to read existing file")
+	}
+	result := opts.decide(md.Hash, prev)
+	if opts.DryRun || result == TransferSkipped || result == TransferUnchanged {
+		return result, nil
+	}
+	if err := fs.Store(key, value); err != nil {
+		return TransferFailed, errors.Wrap(err, "export: failed to write file")
+	}
+	if err := os.Chtimes(fs.Filename(key), md.Timestamp, md.Timestamp); err != nil {
+		return TransferFailed, errors.Wrap(err, "export: failed to set modification time")
+	}
+	return result, nil
+}
+
+func (o TransferOptions) validate() error {
+	switch o.Existing {
+	case "", SkipExisting, OverwriteExisting:
+	default:
+		return errors.Errorf("%s is not a policy for existing keys, must be one of %s or %s", o.Existing, SkipExisting, OverwriteExisting)
+	}
+	for _, ca := range o.CA {
+		if u, err := url.Parse(ca); err != nil || u.Host == "" {
+			return errors.Errorf("%s is not an ACME directory URL", ca)
+		}
+	}
+	return nil
+}
+
+// cas returns the directory URLs of the CAs, or certmagic.CA if none are given
+func (o TransferOptions) cas() []string {
+	if len(o.CA) == 0 {
+		return []string{certmagic.CA}
+	}
+	return o.CA
+}
+
+// decide returns the result of copying a value with hash h to a destination that holds a value with hash prev,
+// or nil if it holds none
+func (o TransferOptions) decide(h [20]byte, prev *[20]byte) string {
+	switch {
+	case prev == nil:
+		return TransferCopied
+	case *prev == h:
+		return TransferUnchanged
+	case o.Existing == OverwriteExisting:
+		return TransferOverwritten
+	default:
+		return TransferSkipped
+	}
+}
+
+// transferErr summarizes the keys that failed, if any
+func transferErr(op string, ts []Transfer) error {
+	var failed int
+	for _, t := range ts {
+		if t.Err != nil {
+			failed++
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	return errors.Errorf("%s: %d of %d keys failed", op, failed, len(ts))
+}
+
+// fileStorageKeys returns the keys of the files under root, leaving out the lock files of FileStorage and the
+// Caddyfile cache of this plugin
+func fileStorageKeys(c *ClusterConfig, root string) ([]string, error) {
+	root = filepath.Clean(root)
+	skip := map[string]bool{filepath.Join(root, "locks"): true}
+	if len(c.CacheDir) > 0 {
+		skip[filepath.Clean(c.CacheDir)] = true
+	}
+	var keys []string
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir() && skip[p]:
+			return filepath.SkipDir
+		case !info.Mode().IsRegular():
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "import: failed to walk file storage")
+	}
+	return keys, nil
+}
+
+// storedKeys returns the keys of every value stored through the plugin, which are the keys that have metadata
+func storedKeys(c *ClusterConfig) ([]string, error) {
+	cli, err := getClient(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "export: failed to get client")
+	}
+	mdPrefix := path.Join(c.KeyPrefix, "md")
+	nodes, err := list(cli, mdPrefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "export: could not get keys")
+	}
+	var keys []string
+	for _, n := range filter(nodes, FilterRemoveDirectories()) {
+		keys = append(keys, strings.TrimPrefix(n.Key, mdPrefix+"/"))
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// lockTransfer takes etcdLocks and then fileLocks, as returned by transferLocks.  Imports and exports lock in the
+// same order, so that one running alongside the other cannot deadlock.
+func lockTransfer(srv Service, fs *certmagic.FileStorage, etcdLocks []string, fileLocks []string) error {
+	for i, l := range etcdLocks {
+		if err := srv.Lock(l); err != nil {
+			unlockAll(srv, etcdLocks[:i])
+			return err
+		}
+	}
+	for i, l := range fileLocks {
+		if err := fs.Lock(l); err != nil {
+			unlockAll(fs, fileLocks[:i])
+			unlockAll(srv, etcdLocks)
+			return errors.Wrap(err, "failed to lock file")
+		}
+	}
+	return nil
+}
+
+// unlockTransfer releases the locks taken by lockTransfer in reverse order
+func unlockTransfer(srv Service, fs *certmagic.FileStorage, etcdLocks []string, fileLocks []string) {
+	unlockAll(fs, fileLocks)
+	unlockAll(srv, etcdLocks)
+}
+
+// unlockAll releases locks in reverse order
+func unlockAll(l certmagic.Locker, locks []string) {
+	for i := len(locks) - 1; i >= 0; i-- {
+		l.Unlock(locks[i])
+	}
+}
+
+// transferLocks returns the locks taken in etcd and in the file storage to copy key.  For a key under
+// `acme/<ca>/sites/<domain>/`, the lock certmagic holds while it obtains or renews the certificate of the site comes
+// first, so that a copy does not race a renewal: siteLock in etcd, and `cert_acme_<domain>_<CA URL>` in the file
+// storage.  The site directory only keeps the host of its CA, so the CA URL is the one of cas with that host, and a
+// key of a CA that is not in cas is not copied.
+func transferLocks(key string, cas []string) (etcdLocks []string, fileLocks []string, err error) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 5 || parts[0] != "acme" || parts[2] != "sites" {
+		return []string{key}, []string{key}, nil
+	}
+	domain := siteDomain(path.Dir(key))
+	for _, ca := range cas {
+		if certmagic.StorageKeys.CAPrefix(ca) == path.Join(parts[0], parts[1]) {
+			return []string{siteLock(domain), key}, []string{siteLockPrefix + domain + "_" + ca, key}, nil
+		}
+	}
+	return nil, nil, errors.Errorf("no ACME directory URL is given for CA %s, which names the lock of site %s", parts[1], domain)
+}
@@ -0,0 +1,151 @@
+package etcd
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mholt/certmagic"
+	"github.com/stretchr/testify/assert"
+)
+
+// results returns the result of each transfer by key
+func results(ts []Transfer) map[string]string {
+	out := make(map[string]string)
+	for _, t := range ts {
+		out[t.Key] = t.Result
+	}
+	return out
+}
+
+func TestFileStorage(t *testing.T) {
+	cfg, cli, done := testPrefix(t, "filestorage")
+	defer done()
+	src, err := ioutil.TempDir("", "filestorage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	modified := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	files := map[string]string{
+		"acme/ca/sites/example.com/example.com.crt":    "cert",
+		"acme/ca/sites/example.com/example.com.key":    "key",
+		"acme/ca/users/admin@example.com/admin.json":   "user",
+		"locks/example.com.lock":                       "lock",
+		"md/acme/ca/sites/example.com/example.com.crt": "forged",
+	}
+	for k, v := range files {
+		f := filepath.Join(src, filepath.FromSlash(k))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(f), 0700))
+		assert.NoError(t, ioutil.WriteFile(f, []byte(v), 0600))
+		assert.NoError(t, os.Chtimes(f, modified, modified))
+	}
+	srv := NewService(cfg)
+	cert := "acme/ca/sites/example.com/example.com.crt"
+	key := "acme/ca/sites/example.com/example.com.key"
+	user := "acme/ca/users/admin@example.com/admin.json"
+	reserved := "md/acme/ca/sites/example.com/example.com.crt"
+	quarantined := path.Join(quarantineDir, cert)
+	dst, err := ioutil.TempDir("", "filestorage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	renew := func() {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(src, filepath.FromSlash(cert)), []byte("renewed"), 0600))
+	}
+	// the certificates are from a CA whose directory URL names the site locks in the file storage
+	ca := []string{"https://ca/directory"}
+	importFrom := func(opts TransferOptions) ([]Transfer, error) {
+		opts.CA = ca
+		return ImportFileStorage(cfg, src, opts)
+	}
+	exportTo := func(opts TransferOptions) ([]Transfer, error) {
+		opts.CA = ca
+		return ExportFileStorage(cfg, dst, opts)
+	}
+	quarantine := func() {
+		assert.NoError(t, setMD(cli, path.Join(cfg.KeyPrefix, "md", quarantined), Metadata{Path: quarantined})())
+	}
+
+	tcs := []struct {
+		Name      string
+		Before    func()
+		Transfer  func(TransferOptions) ([]Transfer, error)
+		Opts      TransferOptions
+		Results   map[string]string
+		Cert      string
+		ShouldErr bool
+	}{
+		{Name: "dry run writes nothing", Transfer: importFrom, Opts: TransferOptions{DryRun: true}, Results: map[string]string{cert: TransferCopied, key: TransferCopied, user: TransferCopied, reserved: TransferSkipped}},
+		{Name: "import", Transfer: importFrom, Results: map[string]string{cert: TransferCopied, key: TransferCopied, user: TransferCopied, reserved: TransferSkipped}, Cert: "cert"},
+		{Name: "different value is skipped", Before: renew, Transfer: importFrom, Results: map[string]string{cert: TransferSkipped, key: TransferUnchanged, user: TransferUnchanged, reserved: TransferSkipped}, Cert: "cert"},
+		{Name: "different value is overwritten", Transfer: importFrom, Opts: TransferOptions{Existing: OverwriteExisting}, Results: map[string]string{cert: TransferOverwritten, key: TransferUnchanged, user: TransferUnchanged, reserved: TransferSkipped}, Cert: "renewed"},
+		{Name: "unknown policy", Transfer: importFrom, Opts: TransferOptions{Existing: "merge"}, ShouldErr: true},
+		{Name: "export", Transfer: exportTo, Results: map[string]string{cert: TransferCopied, key: TransferCopied, user: TransferCopied}, Cert: "renewed"},
+		{Name: "export again", Transfer: exportTo, Results: map[string]string{cert: TransferUnchanged, key: TransferUnchanged, user: TransferUnchanged}, Cert: "renewed"},
+		{Name: "reserved keys are not exported", Before: quarantine, Transfer: exportTo, Results: map[string]string{cert: TransferUnchanged, key: TransferUnchanged, user: TransferUnchanged, quarantined: TransferSkipped}, Cert: "renewed"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			if tc.Before != nil {
+				tc.Before()
+			}
+			ts, err := tc.Transfer(tc.Opts)
+			if tc.ShouldErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Results, results(ts))
+			value, err := srv.Load(cert)
+			switch tc.Cert {
+			case "":
+				assert.True(t, IsNotExistError(err))
+			default:
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Cert, string(value))
+				md, err := srv.Metadata(key)
+				assert.NoError(t, err)
+				assert.True(t, modified.Equal(md.Timestamp))
+			}
+			locks, err := ListLocks(cfg)
+			assert.NoError(t, err)
+			assert.Empty(t, locks)
+		})
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dst, filepath.FromSlash(key)))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("key"), b)
+	info, err := os.Stat(filepath.Join(dst, filepath.FromSlash(key)))
+	assert.NoError(t, err)
+	assert.True(t, modified.Equal(info.ModTime()))
+	_, err = os.Stat(filepath.Join(dst, filepath.FromSlash(quarantined)))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTransferLocks(t *testing.T) {
+	// certificates are copied under the locks Caddy takes to renew them, in etcd and in the file storage
+	cas := []string{certmagic.LetsEncryptStagingCA, certmagic.LetsEncryptProductionCA}
+	etcdLocks, fileLocks, err := transferLocks("acme/acme-v02.api.letsencrypt.org/sites/wildcard_.example.com/wildcard_.example.com.crt", cas)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{siteLock("*.example.com"), "acme/acme-v02.api.letsencrypt.org/sites/wildcard_.example.com/wildcard_.example.com.crt"}, etcdLocks)
+	assert.Equal(t, []string{"cert_acme_*.example.com_" + certmagic.LetsEncryptProductionCA, "acme/acme-v02.api.letsencrypt.org/sites/wildcard_.example.com/wildcard_.example.com.crt"}, fileLocks)
+	assert.Equal(t, siteLock("*.example.com"), lockName(fileLocks[0]))
+
+	// the CA URL is never guessed from the host of the site directory
+	_, _, err = transferLocks("acme/ca.example.com/sites/example.com/example.com.crt", cas)
+	assert.Error(t, err)
+	_, fileLocks, err = transferLocks("acme/ca.example.com/sites/example.com/example.com.crt", []string{"https://ca.example.com/acme/v2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "cert_acme_example.com_https://ca.example.com/acme/v2", fileLocks[0])
+
+	etcdLocks, fileLocks, err = transferLocks("acme/ca.example.com/users/admin@example.com/admin.json", cas)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"acme/ca.example.com/users/admin@example.com/admin.json"}, etcdLocks)
+	assert.Equal(t, etcdLocks, fileLocks)
+}
@@ -0,0 +1,416 @@
+package etcd
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/client"
+)
+
+// Kinds of problems found by Fsck
+const (
+	// FsckMissingMetadata is a value without metadata, left by a Store that failed part way
+	FsckMissingMetadata = "missing-metadata"
+	// FsckCorruptMetadata is metadata that cannot be decoded
+	FsckCorruptMetadata = "corrupt-metadata"
+	// FsckMissingData is metadata without a value, left by a Delete that failed part way
+	FsckMissingData = "missing-data"
+	// FsckCorruptValue is a value that cannot be decoded
+	FsckCorruptValue = "corrupt-value"
+	// FsckChecksumMismatch is a value that does not match the hash in its metadata, so Load returns FailedChecksum
+	FsckChecksumMismatch = "checksum-mismatch"
+	// FsckStaleLock is a lock held past the lock timeout, or one that cannot be decoded
+	FsckStaleLock = "stale-lock"
+)
+
+// fsckKinds lists every kind of problem, for metrics
+var fsckKinds = []string{FsckMissingMetadata, FsckCorruptMetadata, FsckMissingData, FsckCorruptValue, FsckChecksumMismatch, FsckStaleLock}
+
+// quarantineDir holds corrupt values moved aside by a repair, under the key prefix
+const quarantineDir = "quarantine"
+
+// FsckOptions controls a check
+type FsckOptions struct {
+	// Repair fixes each problem after it is found
+	Repair bool
+}
+
+// FsckProblem is an inconsistency found by Fsck.  When it was repaired, Repair describes what was done, and Err
+// is set if the repair failed.
+type FsckProblem struct {
+	Key    string
+	Kind   string
+	Detail string
+	Repair string
+	Err    error
+}
+
+// Fsck checks the values, metadata, and locks under the key prefix for the inconsistencies that a Store or Delete
+// interrupted part way, or a client that went away while holding a lock, leaves behind.  With opts.Repair set,
+// metadata is recomputed for values that lack it, metadata without a value is removed, corrupt values are moved
+// to `<KeyPrefix>/quarantine` so that they are obtained again, and stale locks are released.  Each key is locked
+// and checked again before it is repaired, a checksum mismatch only after a moment, and is only repaired if
+// neither its value nor its metadata changed since they were listed.  Every repair is conditional on the etcd
+// index that was read, so a Store in progress is never mistaken for a problem.  Repairs are recorded in the audit
+// log.
+func Fsck(c *ClusterConfig, opts FsckOptions) ([]FsckProblem, error) {
+	cli, err := getClient(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "fsck: failed to get client")
+	}
+	nodes, err := list(cli, c.KeyPrefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "fsck: could not get keys")
+	}
+	listed := time.Now()
+	data := make(map[string]*client.Node)
+	mds := make(map[string]*client.Node)
+	locks := make(map[string]string)
+	for _, n := range filter(nodes, FilterRemoveDirectories()) {
+		n := n
+		key := strings.TrimPrefix(n.Key, strings.TrimSuffix(c.KeyPrefix, "/")+"/")
+		dir, rest := splitKey(key)
+		switch dir {
+		case "md":
+			mds[rest] = &n
+		case "lock":
+			locks[rest] = n.Value
+		case "audit", quarantineDir:
+		default:
+			data[key] = &n
+		}
+	}
+	keys := make(map[string]bool)
+	for k := range data {
+		keys[k] = true
+	}
+	for k := range mds {
+		keys[k] = true
+	}
+	var sorted []string
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	f := &fsck{
+		cfg:    c,
+		cli:    cli,
+		srv:    &etcdsrv{mdPrefix: path.Join(c.KeyPrefix, "md"), lockKey: path.Join(c.KeyPrefix, "lock"), cfg: c, noBackoff: true},
+		token:  fmt.Sprintf("fsck:%s:%d", token, listed.UnixNano()),
+		listed: listed,
+	}
+	var out []FsckProblem
+	for _, key := range sorted {
+		p := diagnose(key, data[key], mds[key])
+		if p == nil {
+			continue
+		}
+		if opts.Repair {
+			f.repair(p, data[key], mds[key])
+		}
+		out = append(out, *p)
+	}
+	var lockKeys []string
+	for k := range locks {
+		lockKeys = append(lockKeys, k)
+	}
+	sort.Strings(lockKeys)
+	for _, key := range lockKeys {
+		p := diagnoseLock(key, locks[key], c.LockTimeout)
+		if p == nil {
+			continue
+		}
+		if opts.Repair {
+			f.releaseLock(p, locks[key])
+		}
+		out = append(out, *p)
+	}
+	return out, nil
+}
+
+// diagnose returns the problem with the value and metadata nodes stored for key, either of which may be missing,
+// or nil if they are consistent
+func diagnose(key string, data *client.Node, md *client.Node) *FsckProblem {
+	switch {
+	case data == nil && md == nil:
+		return nil
+	case data == nil:
+		return &FsckProblem{Key: key, Kind: FsckMissingData, Detail: "metadata exists but the value does not"}
+	}
+	value, err := base64.StdEncoding.DecodeString(data.Value)
+	if err != nil {
+		return &FsckProblem{Key: key, Kind: FsckCorruptValue, Detail: fmt.Sprintf("value is not base64 encoded: %s", err)}
+	}
+	if md == nil {
+		return &FsckProblem{Key: key, Kind: FsckMissingMetadata, Detail: "value exists but its metadata does not"}
+	}
+	m, err := decodeMetadata(md.Value)
+	if err != nil {
+		return &FsckProblem{Key: key, Kind: FsckCorruptMetadata, Detail: err.Error()}
+	}
+	if h := sha1.Sum(value); h != m.Hash {
+		return &FsckProblem{Key: key, Kind: FsckChecksumMismatch, Detail: fmt.Sprintf("value has SHA1 %x, metadata has %x", h, m.Hash)}
+	}
+	return nil
+}
+
+// diagnoseLock returns a problem for a lock that is past timeout or cannot be decoded, or nil
+func diagnoseLock(key string, value string, timeout time.Duration) *FsckProblem {
+	var l Lock
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err == nil {
+		err = json.Unmarshal(b, &l)
+	}
+	var obtained time.Time
+	if err == nil {
+		err = obtained.UnmarshalText([]byte(l.Obtained))
+	}
+	switch {
+	case err != nil:
+		return &FsckProblem{Key: key, Kind: FsckStaleLock, Detail: fmt.Sprintf("lock cannot be decoded: %s", err)}
+	case time.Since(obtained) >= timeout:
+		return &FsckProblem{Key: key, Kind: FsckStaleLock, Detail: fmt.Sprintf("lock obtained at %s is past the lock timeout of %s", l.Obtained, timeout)}
+	default:
+		return nil
+	}
+}
+
+// fsckSettle is how long after the keys were listed a checksum mismatch is checked again before it is repaired.
+// A Store writes the value and then its metadata, so a Store in progress looks like a mismatch for a moment.
+const fsckSettle = 2 * time.Second
+
+type fsck struct {
+	cfg *ClusterConfig
+	cli client.KeysAPI
+	srv *etcdsrv
+	// token locks the keys being repaired.  It is not the token of this process, whose locks would be shared with,
+	// and released under, the storage operations of the process.
+	token  string
+	listed time.Time
+}
+
+// repair locks the key of p, reads it again, and fixes it if the problem is still there and neither node changed
+// since it was listed as data and md.  Certmagic does not lock the storage keys it writes, so every repair is a
+// write conditional on the index that was read, and a Store or Delete that runs anyway is never undone.
+func (f *fsck) repair(p *FsckProblem, data *client.Node, md *client.Node) {
+	o := &operation{cfg: f.cfg, name: "fsck", key: p.Key}
+	if err := f.srv.lock(o, f.token, p.Key); err != nil {
+		p.Err = errors.Wrap(err, "fsck: key is locked")
+		return
+	}
+	defer f.unlock(p.Key)
+	if p.Kind == FsckChecksumMismatch {
+		time.Sleep(fsckSettle - time.Since(f.listed))
+	}
+	storageKey := path.Join(f.cfg.KeyPrefix, p.Key)
+	storageKeyMD := path.Join(f.srv.mdPrefix, p.Key)
+	nowData, err := f.raw(storageKey)
+	if err != nil {
+		p.Err = err
+		return
+	}
+	nowMD, err := f.raw(storageKeyMD)
+	if err != nil {
+		p.Err = err
+		return
+	}
+	now := diagnose(p.Key, nowData, nowMD)
+	if now == nil || now.Kind != p.Kind || changed(data, nowData) || changed(md, nowMD) {
+		p.Repair = "none, changed since it was checked"
+		return
+	}
+	var oldHash, newHash [20]byte
+	if md != nil {
+		if m, err := decodeMetadata(md.Value); err == nil {
+			oldHash = m.Hash
+		}
+	}
+	switch p.Kind {
+	case FsckMissingMetadata, FsckCorruptMetadata:
+		value, _ := base64.StdEncoding.DecodeString(data.Value)
+		m := NewMetadata(p.Key, value)
+		b, err := json.Marshal(m)
+		if err != nil {
+			p.Err = errors.Wrap(err, "fsck: failed to marshal metadata")
+			return
+		}
+		p.Repair = "recomputed metadata"
+		p.Err = backoff.Retry(swap(f.cli, storageKeyMD, md, base64.StdEncoding.EncodeToString(b)), backoff.NewExponentialBackOff())
+		newHash = m.Hash
+	case FsckMissingData:
+		p.Repair = "removed metadata"
+		p.Err = backoff.Retry(remove(f.cli, storageKeyMD, md.ModifiedIndex), backoff.NewExponentialBackOff())
+	case FsckCorruptValue, FsckChecksumMismatch:
+		q := path.Join(f.cfg.KeyPrefix, quarantineDir, p.Key)
+		p.Repair = "moved value to " + q
+		p.Err = f.quarantine(o, q, storageKey, data, storageKeyMD, md)
+	}
+	if isChanged(p.Err) {
+		p.Repair, p.Err = "none, changed since it was checked", nil
+		return
+	}
+	if p.Err != nil {
+		return
+	}
+	audit(f.cfg, AuditRepair, p.Key, oldHash, newHash, fmt.Sprintf("%s: %s", p.Kind, p.Repair))
+}
+
+// quarantine copies the value at key to q and removes the value and its metadata, unless either changed since they
+// were read as data and md.  If the metadata changed after the value was removed, the value is put back.
+func (f *fsck) quarantine(o *operation, q string, key string, data *client.Node, keyMD string, md *client.Node) error {
+	copyValue := func() error {
+		_, err := f.cli.Set(context.Background(), q, data.Value, nil)
+		return errors.Wrap(err, "fsck: failed to quarantine value")
+	}
+	// a value stored since it was removed is newer than the one being put back
+	putBack := func() error {
+		if err := swap(f.cli, key, nil, data.Value)(); err != nil && !isChanged(err) {
+			return err
+		}
+		return nil
+	}
+	commits := tx(copyValue, remove(f.cli, key, data.ModifiedIndex))
+	rollbacks := tx(del(f.cli, q), putBack)
+	if md != nil {
+		commits = append(commits, remove(f.cli, keyMD, md.ModifiedIndex))
+	}
+	return pipeline(o, commits, rollbacks, backoff.NewExponentialBackOff())
+}
+
+// unlock releases the lock of a repair, unless it was taken over since it was acquired
+func (f *fsck) unlock(key string) {
+	k := path.Join(f.srv.lockKey, key)
+	n, err := f.raw(k)
+	if err != nil || n == nil {
+		return
+	}
+	var l Lock
+	if b, err := base64.StdEncoding.DecodeString(n.Value); err != nil || json.Unmarshal(b, &l) != nil || l.Token != f.token {
+		return
+	}
+	if err := backoff.Retry(remove(f.cli, k, n.ModifiedIndex), backoff.NewExponentialBackOff()); err != nil && !isChanged(err) {
+		f.cfg.log(LevelWarn, "fsck: failed to release lock", F(FieldKey, key), F(FieldError, err))
+	}
+}
+
+// changed returns true if a node read before was modified or removed since, or created when it did not exist
+func changed(before *client.Node, after *client.Node) bool {
+	switch {
+	case before == nil || after == nil:
+		return before != after
+	default:
+		return before.ModifiedIndex != after.ModifiedIndex
+	}
+}
+
+// releaseLock deletes a stale lock unless it changed since it was read, such as by another client taking it over
+func (f *fsck) releaseLock(p *FsckProblem, value string) {
+	k := path.Join(f.srv.lockKey, p.Key)
+	_, err := f.cli.Delete(context.Background(), k, &client.DeleteOptions{PrevValue: value})
+	switch {
+	case err == nil:
+		p.Repair = "released lock"
+		lockReleased(k)
+		audit(f.cfg, AuditRepair, p.Key, sha1.Sum([]byte(value)), [20]byte{}, fmt.Sprintf("%s: %s", p.Kind, p.Repair))
+	case client.IsKeyNotFound(err):
+		p.Repair = "none, released since it was checked"
+	default:
+		if e, ok := err.(client.Error); ok && e.Code == client.ErrorCodeTestFailed {
+			p.Repair = "none, taken over since it was checked"
+			return
+		}
+		p.Err = errors.Wrap(err, "fsck: failed to release lock")
+	}
+}
+
+// raw returns the node stored at key, or nil if there is none
+func (f *fsck) raw(key string) (*client.Node, error) {
+	var out *client.Node
+	get := func() error {
+		resp, err := f.cli.Get(context.Background(), key, nil)
+		switch {
+		case client.IsKeyNotFound(err):
+			return nil
+		case err != nil:
+			return errors.Wrap(err, "fsck: failed to get key")
+		}
+		out = resp.Node
+		return nil
+	}
+	return out, backoff.Retry(get, backoff.NewExponentialBackOff())
+}
+
+func decodeMetadata(value string) (*Metadata, error) {
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "metadata is not base64 encoded")
+	}
+	m := new(Metadata)
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, errors.Wrap(err, "metadata cannot be unmarshaled")
+	}
+	return m, nil
+}
+
+// splitKey returns the first directory of key and the rest of it
+func splitKey(key string) (string, string) {
+	i := strings.Index(key, "/")
+	if i < 0 {
+		return "", key
+	}
+	return key[:i], key[i+1:]
+}
+
+var scrubOnce sync.Once
+
+// scrub runs Fsck in the background at the configured interval, once per process.  Problems are logged and
+// counted in the fsck_problems metric, and repaired if the scrub is configured to repair them.
+func scrub(c *ClusterConfig) {
+	if c.ScrubInterval <= 0 {
+		return
+	}
+	scrubOnce.Do(func() {
+		go func() {
+			t := time.NewTicker(c.ScrubInterval)
+			defer t.Stop()
+			for range t.C {
+				runScrub(c)
+			}
+		}()
+	})
+}
+
+func runScrub(c *ClusterConfig) {
+	problems, err := Fsck(c, FsckOptions{Repair: c.ScrubRepair})
+	if err != nil {
+		c.log(LevelWarn, "scrub failed", F(FieldError, err))
+		return
+	}
+	counts := make(map[string]int)
+	for _, p := range problems {
+		counts[p.Kind]++
+		fields := []Field{F(FieldKey, p.Key), F("problem", p.Kind), F("detail", p.Detail)}
+		if len(p.Repair) > 0 {
+			fields = append(fields, F("repair", p.Repair))
+		}
+		if p.Err != nil {
+			fields = append(fields, F(FieldError, p.Err))
+		}
+		c.log(LevelWarn, "scrub found a problem", fields...)
+	}
+	for _, kind := range fsckKinds {
+		fsckProblems.WithLabelValues(kind).Set(float64(counts[kind]))
+	}
+	c.log(LevelInfo, "scrub finished", F("problems", len(problems)))
+}
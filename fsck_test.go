@@ -0,0 +1,145 @@
+package etcd
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// kinds returns the kind of each problem by key
+func kinds(problems []FsckProblem) map[string]string {
+	out := make(map[string]string)
+	for _, p := range problems {
+		out[p.Key] = p.Kind
+	}
+	return out
+}
+
+func TestFsck(t *testing.T) {
+	cfg, cli, done := testPrefix(t, "fsck")
+	defer done()
+	srv := NewService(cfg)
+	raw := func(key string, value string) {
+		if _, err := cli.Set(context.Background(), path.Join(cfg.KeyPrefix, key), value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b64 := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	assert.NoError(t, srv.Store("certs/ok", []byte("ok")))
+	raw("certs/nomd", b64("value"))
+	assert.NoError(t, srv.Store("certs/nodata", []byte("gone")))
+	_, err := cli.Delete(context.Background(), path.Join(cfg.KeyPrefix, "certs/nodata"), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, srv.Store("certs/badmd", []byte("value")))
+	raw("md/certs/badmd", "not metadata")
+	raw("certs/notb64", "!!!")
+	assert.NoError(t, srv.Store("certs/mismatch", []byte("value")))
+	raw("certs/mismatch", b64("tampered"))
+	lock, _ := json.Marshal(Lock{Token: "other", Obtained: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano), Key: "certs/stale"})
+	raw("lock/certs/stale", base64.StdEncoding.EncodeToString(lock))
+	assert.NoError(t, srv.Lock("certs/held"))
+	defer srv.Unlock("certs/held")
+
+	expect := map[string]string{
+		"certs/nomd":     FsckMissingMetadata,
+		"certs/nodata":   FsckMissingData,
+		"certs/badmd":    FsckCorruptMetadata,
+		"certs/notb64":   FsckCorruptValue,
+		"certs/mismatch": FsckChecksumMismatch,
+		"certs/stale":    FsckStaleLock,
+	}
+	problems, err := Fsck(cfg, FsckOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, expect, kinds(problems))
+	for _, p := range problems {
+		assert.Empty(t, p.Repair)
+	}
+	_, err = srv.Load("certs/mismatch")
+	assert.True(t, IsFailedChecksumError(err))
+
+	problems, err = Fsck(cfg, FsckOptions{Repair: true})
+	assert.NoError(t, err)
+	assert.Equal(t, expect, kinds(problems))
+	for _, p := range problems {
+		assert.NoError(t, p.Err, p.Key)
+		assert.NotEmpty(t, p.Repair, p.Key)
+	}
+	problems, err = Fsck(cfg, FsckOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, problems)
+
+	value, err := srv.Load("certs/nomd")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), value)
+	_, err = srv.Load("certs/mismatch")
+	assert.True(t, IsNotExistError(err))
+	resp, err := cli.Get(context.Background(), path.Join(cfg.KeyPrefix, "quarantine/certs/mismatch"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, b64("tampered"), resp.Node.Value)
+	locks, err := ListLocks(cfg)
+	assert.NoError(t, err)
+	if assert.Len(t, locks, 1) {
+		assert.Equal(t, "certs/held", locks[0].Key)
+	}
+	assert.NoError(t, FlushAudit(time.Minute))
+	entries, err := NewAudit(cfg).List()
+	assert.NoError(t, err)
+	var repairs int
+	for _, e := range entries {
+		if e.Operation == AuditRepair {
+			repairs++
+		}
+	}
+	assert.Equal(t, len(expect), repairs)
+
+	// a store caught between writing the value and its metadata is left alone
+	assert.NoError(t, srv.Store("certs/racing", []byte("old")))
+	raw("certs/racing", b64("new"))
+	repaired := make(chan []FsckProblem, 1)
+	go func() {
+		problems, _ := Fsck(cfg, FsckOptions{Repair: true})
+		repaired <- problems
+	}()
+	time.Sleep(fsckSettle / 4)
+	assert.NoError(t, setMD(cli, path.Join(cfg.KeyPrefix, "md/certs/racing"), NewMetadata("certs/racing", []byte("new")))())
+	problems = <-repaired
+	if assert.Len(t, problems, 1) {
+		assert.Equal(t, FsckChecksumMismatch, problems[0].Kind)
+		assert.Equal(t, "none, changed since it was checked", problems[0].Repair)
+	}
+	value, err = srv.Load("certs/racing")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), value)
+
+	// a key locked by this process is not repaired under its lock
+	raw("certs/held", b64("value"))
+	problems, err = Fsck(cfg, FsckOptions{Repair: true})
+	assert.NoError(t, err)
+	if assert.Len(t, problems, 1) {
+		assert.Error(t, problems[0].Err)
+	}
+	locks, err = ListLocks(cfg)
+	assert.NoError(t, err)
+	assert.Len(t, locks, 1)
+}
+
+func TestScrub(t *testing.T) {
+	cfg, cli, done := testPrefix(t, "scrub")
+	defer done()
+	_, err := cli.Set(context.Background(), path.Join(cfg.KeyPrefix, "certs/nomd"), "dmFsdWU=", nil)
+	assert.NoError(t, err)
+
+	runScrub(cfg)
+	assert.Equal(t, float64(1), gather(t, "caddy_etcd_fsck_problems", map[string]string{"kind": FsckMissingMetadata}))
+	assert.Equal(t, float64(0), gather(t, "caddy_etcd_fsck_problems", map[string]string{"kind": FsckStaleLock}))
+	cfg.ScrubRepair = true
+	runScrub(cfg)
+	runScrub(cfg)
+	assert.Equal(t, float64(0), gather(t, "caddy_etcd_fsck_problems", map[string]string{"kind": FsckMissingMetadata}))
+}
@@ -0,0 +1,279 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/mholt/caddy/caddyfile"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/client"
+	"golang.org/x/crypto/ocsp"
+)
+
+// Reasons a site is collected
+const (
+	// GCExpired is a site whose certificate expired longer ago than the grace period
+	GCExpired = "expired"
+	// GCAbandoned is a site whose certificate covers no host served by any Caddyfile and has not been written for
+	// longer than the grace period
+	GCAbandoned = "abandoned"
+)
+
+// GCOptions controls a garbage collection
+type GCOptions struct {
+	// DryRun reports the sites that would be collected without locking or deleting anything
+	DryRun bool
+	// Grace is how long a certificate is kept after it expires, and how long a site that is no longer served is
+	// kept after its certificate was last written
+	Grace time.Duration
+}
+
+// GCSite is a certmagic site directory found by CollectGarbage.  Keys are the keys that were deleted, or would be
+// on a dry run: the certificate, private key, and metadata of the site, and the OCSP staples of its certificate.
+// Err is set when the site could not be checked or deleted.
+type GCSite struct {
+	Dir      string
+	Names    []string
+	NotAfter time.Time
+	Modified time.Time
+	Reason   string
+	Keys     []string
+	Err      error
+}
+
+// CollectGarbage deletes the certmagic site directories whose certificate expired longer ago than the grace period,
+// or that no Caddyfile serves any more, see GCAbandoned.  While any Caddyfile serves a catch-all address only expired
+// sites are collected.  Sites that are kept are not returned.
+func CollectGarbage(c *ClusterConfig, opts GCOptions) ([]GCSite, error) {
+	cli, err := getClient(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "gc: failed to get client")
+	}
+	data, mds, err := readPrefix(cli, c.KeyPrefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "gc: could not get keys")
+	}
+	hosts, catchAll, err := servedHosts(c, cli, data)
+	if err != nil {
+		return nil, err
+	}
+	if catchAll {
+		c.log(LevelWarn, "a caddyfile serves a catch-all address, only expired sites will be collected")
+	}
+
+	now := time.Now()
+	var out []GCSite
+	for _, sc := range readSiteCertificates(data, mds) {
+		s := GCSite{Dir: sc.dir, Keys: sc.keys, Err: sc.err}
+		if sc.err != nil {
+			out = append(out, s)
+			continue
+		}
+		s.Names, s.NotAfter, s.Modified = certificateNames(sc.cert), sc.cert.NotAfter, sc.modified()
+		switch {
+		case now.Sub(s.NotAfter) > opts.Grace:
+			s.Reason = GCExpired
+		case !catchAll && !served(s.Names, hosts) && now.Sub(s.Modified) > opts.Grace:
+			s.Reason = GCAbandoned
+		default:
+			continue
+		}
+		s.Keys = append(append([]string(nil), s.Keys...), staples(data, sc.cert.SerialNumber)...)
+		if !opts.DryRun {
+			s.Err = collect(NewService(c).(*etcdsrv), sc, s.Keys)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// collect deletes keys under the site lock, see lockSite, unless the certificate changed since it was read.  The keys
+// are read again under the lock and each is deleted only if it is unchanged since, the certificate first, so a
+// certificate renewed without the lock is kept.  A key that changes after the certificate was deleted is left in place.
+func collect(srv *etcdsrv, s *siteCertificate, keys []string) error {
+	unlock, err := lockSite(srv, siteDomain(s.dir), nil)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	cli, err := getClient(srv.cfg)
+	if err != nil {
+		return errors.Wrap(err, "gc: failed to get client")
+	}
+	keys = append([]string{s.certKey}, keys...)
+	nodes := make(map[string]*client.Node)
+	for _, key := range keys {
+		for _, k := range []string{path.Join(srv.cfg.KeyPrefix, key), path.Join(srv.mdPrefix, key)} {
+			var n *client.Node
+			if err := backoff.Retry(getNode(cli, k, &n), backoff.NewExponentialBackOff()); err != nil {
+				return errors.Wrapf(err, "gc: failed to read %s again", key)
+			}
+			nodes[k] = n
+		}
+	}
+	cert := nodes[path.Join(srv.cfg.KeyPrefix, s.certKey)]
+	if cert == nil {
+		return errors.Errorf("gc: %s was deleted while it was being collected", s.certKey)
+	}
+	if b, err := base64.StdEncoding.DecodeString(cert.Value); err != nil || sha1.Sum(b) != s.hash {
+		return errors.Errorf("gc: %s changed while it was being collected", s.certKey)
+	}
+	deleted := make(map[string]bool)
+	for _, key := range keys {
+		if deleted[key] {
+			continue
+		}
+		deleted[key] = true
+		var prev [20]byte
+		if n := nodes[path.Join(srv.mdPrefix, key)]; n != nil {
+			if md, err := decodeMetadata(n.Value); err == nil {
+				prev = md.Hash
+			}
+		}
+		for _, k := range []string{path.Join(srv.cfg.KeyPrefix, key), path.Join(srv.mdPrefix, key)} {
+			if n := nodes[k]; n != nil {
+				if err := backoff.Retry(remove(cli, k, n.ModifiedIndex), backoff.NewExponentialBackOff()); err != nil {
+					return errors.Wrap(err, "gc")
+				}
+			}
+		}
+		audit(srv.cfg, AuditDelete, key, prev, [20]byte{}, "")
+	}
+	return nil
+}
+
+// siteDomain returns the domain of the certmagic site directory dir, undoing the renaming of a wildcard
+func siteDomain(dir string) string {
+	domain := path.Base(dir)
+	if strings.HasPrefix(domain, "wildcard_") {
+		return "*" + strings.TrimPrefix(domain, "wildcard_")
+	}
+	return domain
+}
+
+// servedHosts returns the hosts of the site addresses in every Caddyfile and per-site key stored in etcd, and in
+// the bootstrap Caddyfile.  catchAll is true when an address has no host, or a host with a placeholder, so any
+// host may be served.  A Caddyfile that cannot be parsed is an error, since the sites it serves are unknown.
+func servedHosts(c *ClusterConfig, cli client.KeysAPI, data map[string]string) (map[string]bool, bool, error) {
+	hosts := make(map[string]bool)
+	catchAll := false
+	add := func(name string, body []byte) error {
+		body, err := expandImports(context.Background(), c, cli, body, name, nil)
+		if err != nil {
+			return errors.Wrapf(err, "gc: unable to resolve imports of %s", name)
+		}
+		blocks, err := caddyfile.Parse(name, bytes.NewReader(body), nil)
+		if err != nil {
+			return errors.Wrapf(err, "gc: unable to parse %s", name)
+		}
+		for _, b := range blocks {
+			for _, addr := range b.Keys {
+				h := siteHost(addr)
+				if len(h) == 0 || strings.Contains(h, "{") {
+					catchAll = true
+					continue
+				}
+				hosts[h] = true
+			}
+		}
+		return nil
+	}
+	var keys []string
+	for key := range data {
+		dir, _ := splitKey(key)
+		if (key == legacyCaddyfileKey || dir == caddyfilesDir || dir == "sites") && !isSignature(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		b, err := base64.StdEncoding.DecodeString(data[key])
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "gc: %s is not base64 encoded", key)
+		}
+		if err := add(path.Join(c.KeyPrefix, key), b); err != nil {
+			return nil, false, err
+		}
+	}
+	if len(c.CaddyFile) > 0 {
+		if err := add(c.CaddyFilePath, c.CaddyFile); err != nil {
+			return nil, false, err
+		}
+	}
+	return hosts, catchAll, nil
+}
+
+// siteHost returns the lower case host of a site address such as `https://example.com:443/path`
+func siteHost(addr string) string {
+	a := strings.ToLower(strings.TrimSpace(addr))
+	if i := strings.Index(a, "://"); i >= 0 {
+		a = a[i+3:]
+	}
+	if i := strings.Index(a, "/"); i >= 0 {
+		a = a[:i]
+	}
+	if h, _, err := net.SplitHostPort(a); err == nil {
+		return h
+	}
+	return strings.Trim(a, "[]")
+}
+
+// served returns true if a Caddyfile serves any of names.  A wildcard certificate is served by any host it
+// covers, and a wildcard host, which obtains a certificate for each subdomain on demand, serves any name it
+// covers.
+func served(names []string, hosts map[string]bool) bool {
+	for _, name := range names {
+		if hosts[name] || hosts[wildcard(name)] {
+			return true
+		}
+		if strings.HasPrefix(name, "*.") {
+			for h := range hosts {
+				if wildcard(h) == name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// wildcard returns the wildcard name that covers name, replacing its first label
+func wildcard(name string) string {
+	i := strings.Index(name, ".")
+	if i < 0 {
+		return ""
+	}
+	return "*" + name[i:]
+}
+
+// staples returns the keys of the OCSP staples stored for the certificate with serial
+func staples(data map[string]string, serial *big.Int) []string {
+	var out []string
+	for key, v := range data {
+		if dir, _ := splitKey(key); dir != "ocsp" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			continue
+		}
+		resp, err := ocsp.ParseResponse(b, nil)
+		if err != nil || resp.SerialNumber == nil {
+			continue
+		}
+		if resp.SerialNumber.Cmp(serial) == 0 {
+			out = append(out, key)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
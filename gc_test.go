@@ -0,0 +1,167 @@
+package etcd
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	cfg, _, done := testPrefix(t, "gc")
+	defer done()
+	srv := NewService(cfg).(*etcdsrv)
+	assert.NoError(t, srv.Store(caddyfileKey("http"), []byte("live.example.com {\n}\nhttps://*.wild.example.com:443 {\n  tls {\n    on_demand\n  }\n}\n")))
+	assert.NoError(t, srv.Store(path.Join(sitesKey("http"), "other"), []byte("other.example.com\n")))
+	assert.NoError(t, srv.Store("acme/acme-v02.api.letsencrypt.org/sites/broken/broken.crt", []byte("not a certificate")))
+
+	now := time.Now()
+	day := 24 * time.Hour
+	tcs := []struct {
+		Name     string
+		Domain   string
+		Expires  time.Duration
+		Modified time.Duration
+		Reason   string
+	}{
+		{Name: "served", Domain: "live.example.com", Expires: 30 * day},
+		{Name: "served from a per-site key", Domain: "other.example.com", Expires: 30 * day, Modified: -60 * day},
+		{Name: "served by a wildcard host", Domain: "a.wild.example.com", Expires: 30 * day, Modified: -60 * day},
+		{Name: "expired", Domain: "expired.example.com", Expires: -10 * day, Modified: -100 * day, Reason: GCExpired},
+		{Name: "expired within the grace period", Domain: "recent.example.com", Expires: -time.Hour, Modified: -time.Hour},
+		{Name: "abandoned", Domain: "gone.example.com", Expires: 30 * day, Modified: -60 * day, Reason: GCAbandoned},
+		{Name: "not served within the grace period", Domain: "moved.example.com", Expires: 30 * day, Modified: -time.Hour},
+	}
+	for i, tc := range tcs {
+		storeSite(t, srv, tc.Domain, int64(i+1), now.Add(tc.Expires), now.Add(tc.Modified))
+	}
+	reasons := func(sites []GCSite) map[string]string {
+		out := make(map[string]string)
+		for _, s := range sites {
+			switch {
+			case s.Err != nil:
+				out[path.Base(s.Dir)] = "error"
+			default:
+				out[path.Base(s.Dir)] = s.Reason
+				assert.Len(t, s.Keys, 4, s.Dir)
+			}
+		}
+		return out
+	}
+
+	opts := GCOptions{DryRun: true, Grace: 7 * day}
+	sites, err := CollectGarbage(cfg, opts)
+	assert.NoError(t, err)
+	dry := reasons(sites)
+	opts.DryRun = false
+	sites, err = CollectGarbage(cfg, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, dry, reasons(sites), "a dry run reports the same sites")
+	assert.Equal(t, "error", dry["broken"])
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			assert.Equal(t, tc.Reason, dry[tc.Domain])
+			keys, err := srv.List(path.Join("acme/acme-v02.api.letsencrypt.org/sites", tc.Domain), FilterRemoveDirectories())
+			assert.NoError(t, err)
+			_, errStaple := srv.Load(path.Join("ocsp", tc.Domain+"-1234abcd"))
+			switch tc.Reason {
+			case "":
+				assert.Len(t, keys, 3)
+				assert.NoError(t, errStaple)
+			default:
+				assert.Empty(t, keys)
+				assert.True(t, IsNotExistError(errStaple))
+			}
+		})
+	}
+
+	// a catch-all address may serve any site, so only expired sites are collected
+	assert.NoError(t, srv.Store(path.Join(sitesKey("http"), "ondemand"), []byte(":443 {\n  tls {\n    on_demand\n  }\n}\n")))
+	storeSite(t, srv, "gone.example.com", 8, now.Add(30*day), now.Add(-60*day))
+	sites, err = CollectGarbage(cfg, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"broken": "error"}, reasons(sites))
+}
+
+// storeSite stores a certificate for domain, its private key and metadata as certmagic does, and an OCSP staple
+func storeSite(t *testing.T, srv *etcdsrv, domain string, serial int64, notAfter time.Time, modified time.Time) {
+	dir := path.Join("acme/acme-v02.api.letsencrypt.org/sites", domain)
+	c := testCertificate(t, serial, notAfter, domain)
+	assert.NoError(t, srv.storeAt(path.Join(dir, domain+".crt"), c.crt, modified))
+	assert.NoError(t, srv.storeAt(path.Join(dir, domain+".key"), c.key, modified))
+	assert.NoError(t, srv.storeAt(path.Join(dir, domain+".json"), []byte("{}"), modified))
+	assert.NoError(t, srv.Store(path.Join("ocsp", domain+"-1234abcd"), c.staple))
+}
+
+func TestServed(t *testing.T) {
+	hosts := map[string]bool{}
+	for _, addr := range []string{"Example.com", "https://www.example.com:443/app", "*.wild.example.com", "[::1]:8443", "http://10.0.0.1"} {
+		hosts[siteHost(addr)] = true
+	}
+	tcs := []struct {
+		names  []string
+		served bool
+	}{
+		{[]string{"example.com"}, true},
+		{[]string{"www.example.com"}, true},
+		{[]string{"other.example.com", "example.com"}, true},
+		{[]string{"a.wild.example.com"}, true},
+		{[]string{"*.wild.example.com"}, true},
+		{[]string{"a.b.wild.example.com"}, false},
+		{[]string{"*.example.com"}, true},
+		{[]string{"::1"}, true},
+		{[]string{"10.0.0.1"}, true},
+		{[]string{"gone.example.org"}, false},
+	}
+	for _, tc := range tcs {
+		assert.Equal(t, tc.served, served(tc.names, hosts), "%v", tc.names)
+	}
+	assert.Equal(t, "", siteHost(":443"))
+	assert.Equal(t, "", siteHost("https://"))
+}
+
+func TestSiteLock(t *testing.T) {
+	assert.Equal(t, "cert_acme_example.com", lockName("cert_acme_Example.com_https://acme-v02.api.letsencrypt.org/directory"))
+	assert.Equal(t, "cert_acme_*.example.com", lockName("cert_acme_*.example.com_https://acme-staging-v02.api.letsencrypt.org/directory"))
+	assert.Equal(t, "caddyfiles/http", lockName("caddyfiles/http"))
+	assert.Equal(t, lockName("cert_acme_*.example.com_https://ca.example.org/dir"), siteLock(siteDomain("acme/ca.example.org/sites/wildcard_.example.com")))
+	assert.Equal(t, siteLock("example.com"), siteLock(siteDomain("acme/ca.example.org/sites/example.com")))
+	assert.Equal(t, []string{"cert_acme_example.com", "cert_acme_example.com_https://ca.example.org/dir"}, lockNames("cert_acme_example.com_https://ca.example.org/dir"))
+	assert.Equal(t, []string{"caddyfiles/http"}, lockNames("caddyfiles/http"))
+	locks := KeyLocks("snippets/gzip", "acme/ca/sites/wildcard_.example.com/wildcard_.example.com.crt", "acme/other/sites/example.com/example.com.crt", "acme/ca/sites/example.com/example.com.key")
+	assert.Equal(t, []string{"cert_acme_*.example.com", "cert_acme_example.com", "acme/ca/sites/example.com/example.com.key", "acme/ca/sites/wildcard_.example.com/wildcard_.example.com.crt", "acme/other/sites/example.com/example.com.crt", "snippets/gzip"}, locks)
+}
+
+func TestClusterSiteLock(t *testing.T) {
+	cfg, _, done := testPrefix(t, "clustersitelock")
+	defer done()
+	c := Cluster{srv: NewService(cfg)}
+	key := "cert_acme_example.com_https://ca.example.org/dir"
+	held := func() []string {
+		locks, err := ListLocks(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, l := range locks {
+			out = append(out, l.Key)
+		}
+		return out
+	}
+
+	// both the site lock and the lock of earlier versions are held
+	assert.NoError(t, c.Lock(key))
+	assert.Len(t, held(), 2)
+	assert.Contains(t, held(), "cert_acme_example.com")
+	assert.NoError(t, c.Unlock(key))
+	assert.Empty(t, held())
+
+	// an instance of an earlier version holding the lock under certmagic's name excludes this one, which does not
+	// keep the site lock when it gives up
+	old := &etcdsrv{lockKey: path.Join(cfg.KeyPrefix, "lock"), cfg: cfg, noBackoff: true}
+	assert.NoError(t, old.lock(&operation{cfg: cfg, name: "lock"}, "old", key))
+	c = Cluster{srv: &etcdsrv{mdPrefix: path.Join(cfg.KeyPrefix, "md"), lockKey: path.Join(cfg.KeyPrefix, "lock"), cfg: cfg, noBackoff: true}}
+	assert.Error(t, c.Lock(key))
+	assert.Len(t, held(), 1)
+}
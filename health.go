@@ -0,0 +1,193 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/client"
+)
+
+// Status of a health check
+const (
+	HealthPass = "pass"
+	HealthWarn = "warn"
+	HealthFail = "fail"
+)
+
+const (
+	// healthTimeout bounds each etcd request made by a health check, so that a probe never hangs on a partitioned
+	// cluster
+	healthTimeout = 5 * time.Second
+	// healthSlow is the round trip to etcd above which the latency check warns
+	healthSlow = 500 * time.Millisecond
+)
+
+// HealthCheck is the result of one check of the storage layer
+type HealthCheck struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	Output   string        `json:"output,omitempty"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// Health is the health of the storage layer of this instance.  Status is the worst status of its checks: fail
+// when etcd cannot be used for storage, and warn when it works but is slow or the instance is running a fallback
+// Caddyfile.
+type Health struct {
+	Status   string        `json:"status"`
+	Instance string        `json:"instance"`
+	Checks   []HealthCheck `json:"checks"`
+}
+
+// CheckHealth checks that etcd is reachable and has a leader, measures the round trip to it, acquires and releases
+// a lock under `<KeyPrefix>/lock`, and reports whether any server type is running a fallback Caddyfile because
+// etcd was unavailable when it started.
+func CheckHealth(c *ClusterConfig) Health {
+	h := Health{Status: HealthPass, Instance: c.InstanceID}
+	add := func(hc HealthCheck) {
+		h.Checks = append(h.Checks, hc)
+		switch {
+		case hc.Status == HealthFail:
+			h.Status = HealthFail
+		case hc.Status == HealthWarn && h.Status == HealthPass:
+			h.Status = HealthWarn
+		}
+	}
+	cli, err := newClient(c)
+	if err != nil {
+		for _, name := range []string{"etcd", "leader", "latency", "lock"} {
+			add(HealthCheck{Name: name, Status: HealthFail, Output: strings.TrimSpace(err.Error())})
+		}
+		add(checkFallback())
+		return h
+	}
+	reach := checkReachable(c, client.NewKeysAPI(cli))
+	add(reach)
+	add(checkLeader(cli))
+	add(checkLatency(reach))
+	add(checkLock(c))
+	add(checkFallback())
+	return h
+}
+
+// checkReachable reads the key prefix.  A missing prefix is still a round trip to etcd.
+func checkReachable(c *ClusterConfig, cli client.KeysAPI) HealthCheck {
+	hc := HealthCheck{Name: "etcd", Status: HealthPass}
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+	start := time.Now()
+	_, err := cli.Get(ctx, c.KeyPrefix, nil)
+	hc.Duration = time.Since(start)
+	if err != nil && !client.IsKeyNotFound(err) {
+		hc.Status = HealthFail
+		hc.Output = strings.TrimSpace(err.Error())
+	}
+	return hc
+}
+
+func checkLeader(cli client.Client) HealthCheck {
+	hc := HealthCheck{Name: "leader", Status: HealthPass}
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+	start := time.Now()
+	leader, err := client.NewMembersAPI(cli).Leader(ctx)
+	hc.Duration = time.Since(start)
+	switch {
+	case err != nil:
+		hc.Status = HealthFail
+		hc.Output = strings.TrimSpace(err.Error())
+	case leader == nil:
+		hc.Status = HealthFail
+		hc.Output = "cluster has no leader"
+	default:
+		hc.Output = leader.Name
+	}
+	return hc
+}
+
+// checkLatency reports the round trip of the reachability check
+func checkLatency(reach HealthCheck) HealthCheck {
+	hc := HealthCheck{Name: "latency", Status: HealthPass, Duration: reach.Duration, Output: reach.Duration.String()}
+	switch {
+	case reach.Status == HealthFail:
+		hc.Status = HealthFail
+		hc.Output = "etcd is unreachable"
+	case reach.Duration > healthSlow:
+		hc.Status = HealthWarn
+		hc.Output = fmt.Sprintf("%s is slower than %s", reach.Duration, healthSlow)
+	}
+	return hc
+}
+
+// checkLock acquires and releases a lock of this instance, without retrying, the same way certificate operations
+// lock their keys
+func checkLock(c *ClusterConfig) HealthCheck {
+	hc := HealthCheck{Name: "lock", Status: HealthPass}
+	e := &etcdsrv{lockKey: path.Join(c.KeyPrefix, "lock"), cfg: c, noBackoff: true}
+	key := path.Join("health", c.InstanceID)
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+	if err := e.lock(&operation{cfg: c, name: "health", ctx: ctx}, token, key); err != nil {
+		hc.Status = HealthFail
+		hc.Output = strings.TrimSpace(err.Error())
+		hc.Duration = time.Since(start)
+		return hc
+	}
+	cli, err := getClient(c)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+		defer cancel()
+		_, err = cli.Delete(ctx, path.Join(e.lockKey, key), nil)
+	}
+	if err != nil {
+		hc.Status = HealthWarn
+		hc.Output = fmt.Sprintf("lock acquired but not released: %s", err)
+	}
+	hc.Duration = time.Since(start)
+	return hc
+}
+
+// checkFallback warns while any server type is running a fallback Caddyfile
+func checkFallback() HealthCheck {
+	hc := HealthCheck{Name: "caddyfile", Status: HealthPass}
+	running := runningFallbacks()
+	if len(running) == 0 {
+		return hc
+	}
+	var out []string
+	for servertype, source := range running {
+		out = append(out, fmt.Sprintf("%s is running the %s caddyfile", servertype, source))
+	}
+	sort.Strings(out)
+	hc.Status = HealthWarn
+	hc.Output = strings.Join(out, ", ")
+	return hc
+}
+
+// healthHandler serves the health of the storage layer as JSON.  It responds with 503 when a check fails, so it
+// can be used as a readiness probe, and with 200 otherwise.
+func healthHandler(c *ClusterConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := CheckHealth(c)
+		for _, hc := range h.Checks {
+			if hc.Status != HealthPass {
+				c.log(LevelWarn, "health check did not pass", F("check", hc.Name), F("status", hc.Status), F("output", hc.Output))
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if h.Status == HealthFail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(h); err != nil {
+			c.log(LevelWarn, "failed to write health response", F(FieldError, err))
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/client"
+)
+
+// statuses returns the status of each check by name
+func statuses(h Health) map[string]string {
+	out := make(map[string]string)
+	for _, hc := range h.Checks {
+		out[hc.Name] = hc.Status
+	}
+	return out
+}
+
+// resetFallbacks forgets fallback Caddyfiles loaded by other tests
+func resetFallbacks() {
+	fallbacks.Lock()
+	defer fallbacks.Unlock()
+	fallbacks.byServerType = make(map[string]string)
+}
+
+func TestHealthUnreachable(t *testing.T) {
+	resetFallbacks()
+	cfg := &ClusterConfig{
+		KeyPrefix:   "/testhealth",
+		ServerIP:    []string{"http://127.0.0.1:1"},
+		LockTimeout: time.Minute,
+		InstanceID:  "web-1",
+	}
+	rec := httptest.NewRecorder()
+	healthHandler(cfg).ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var h Health
+	if err := json.Unmarshal(rec.Body.Bytes(), &h); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, HealthFail, h.Status)
+	assert.Equal(t, "web-1", h.Instance)
+	assert.Equal(t, map[string]string{"etcd": HealthFail, "leader": HealthFail, "latency": HealthFail, "lock": HealthFail, "caddyfile": HealthPass}, statuses(h))
+}
+
+func TestHealthLockTimeout(t *testing.T) {
+	// an etcd member that accepts requests but never answers them
+	hang := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hang:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(hang)
+	cfg := &ClusterConfig{
+		KeyPrefix:   "/testhealth",
+		ServerIP:    []string{ts.URL},
+		LockTimeout: time.Minute,
+		InstanceID:  "web-1",
+	}
+	start := time.Now()
+	hc := checkLock(cfg)
+	assert.Equal(t, HealthFail, hc.Status)
+	assert.True(t, time.Since(start) < 2*healthTimeout)
+}
+
+func TestHealth(t *testing.T) {
+	cfg, cli, done := testPrefix(t, "health")
+	defer done()
+	cfg.InstanceID = "web-1"
+	resetFallbacks()
+
+	h := CheckHealth(cfg)
+	assert.Equal(t, HealthPass, h.Status, "%+v", h.Checks)
+	assert.Equal(t, map[string]string{"etcd": HealthPass, "leader": HealthPass, "latency": HealthPass, "lock": HealthPass, "caddyfile": HealthPass}, statuses(h))
+	// the lock is released after the check
+	_, err := cli.Get(context.Background(), "/testhealth/lock/health/web-1", nil)
+	assert.True(t, client.IsKeyNotFound(err))
+
+	setFallback("http", "cache")
+	defer resetFallbacks()
+	rec := httptest.NewRecorder()
+	healthHandler(cfg).ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	if err := json.Unmarshal(rec.Body.Bytes(), &h); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, HealthWarn, h.Status)
+	assert.Equal(t, "http is running the cache caddyfile", h.Checks[len(h.Checks)-1].Output)
+}
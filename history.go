@@ -0,0 +1,380 @@
+package etcd
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Revision is a single published version of a Caddyfile.  Every publish creates a new revision
+// with an increasing ID, including rollbacks which record the revision they restored.
+type Revision struct {
+	ID           int
+	Author       string
+	Timestamp    time.Time
+	Hash         [20]byte
+	Size         int
+	RollbackFrom int    `json:",omitempty"`
+	Signature    []byte `json:",omitempty"`
+	Body         []byte
+}
+
+// History keeps every published revision of the Caddyfile stored at `<KeyPrefix>/caddyfiles/<servertype>` under
+// `<KeyPrefix>/history/caddyfiles/<servertype>`, pruning the oldest revisions past the configured retention count.
+// It also publishes the per-site keys of the server type.
+type History struct {
+	srv        Service
+	cfg        *ClusterConfig
+	key        string
+	servertype string
+	retention  int
+}
+
+// NewHistory returns the revision history of the cluster Caddyfile for servertype
+func NewHistory(c *ClusterConfig, servertype string) *History {
+	return &History{
+		srv:        NewService(c),
+		cfg:        c,
+		key:        caddyfileKey(servertype),
+		servertype: servertype,
+		retention:  c.HistoryRetention,
+	}
+}
+
+// Publish makes body the current Caddyfile for the cluster and records it as a new revision.  The
+// Caddyfile is validated first, with its imports resolved from etcd, and an `InvalidCaddyfile` error is
+// returned without changing etcd if it fails.
+func (h *History) Publish(body []byte, author string) (*Revision, error) {
+	return h.PublishSigned(body, nil, author)
+}
+
+// PublishSigned publishes body like Publish and stores sig as its detached signature.  Instances that require
+// signatures refuse to load a Caddyfile published without one.
+func (h *History) PublishSigned(body []byte, sig []byte, author string) (*Revision, error) {
+	if err := h.validate(body); err != nil {
+		return nil, err
+	}
+	if err := h.srv.Lock(h.key); err != nil {
+		return nil, errors.Wrap(err, "publish: failed to get lock")
+	}
+	defer h.srv.Unlock(h.key)
+	return h.commit(body, sig, author, 0)
+}
+
+// Rollback atomically makes the body of revision id the current Caddyfile.  The restored
+// body is recorded as a new revision that refers back to id, along with its original signature.
+func (h *History) Rollback(id int, author string) (*Revision, error) {
+	if err := h.srv.Lock(h.key); err != nil {
+		return nil, errors.Wrap(err, "rollback: failed to get lock")
+	}
+	defer h.srv.Unlock(h.key)
+	r, err := h.Get(id)
+	if err != nil {
+		return nil, errors.Wrap(err, "rollback: failed to get revision")
+	}
+	if err := h.validate(r.Body); err != nil {
+		return nil, err
+	}
+	return h.commit(r.Body, r.Signature, author, id)
+}
+
+// PublishSite makes body the per-site key name of the server type, stored at `<KeyPrefix>/sites/<servertype>/<name>`,
+// with sig as its detached signature.  The site is validated appended to the current Caddyfile, as instances load
+// it.  Per-site keys are not kept in the revision history.
+func (h *History) PublishSite(name string, body []byte, sig []byte) error {
+	key, err := h.SiteKey(name)
+	if err != nil {
+		return err
+	}
+	if err := h.validateSite(key, body); err != nil {
+		return err
+	}
+	if err := h.srv.Lock(key); err != nil {
+		return errors.Wrap(err, "publish: failed to get lock")
+	}
+	defer h.srv.Unlock(key)
+	prevSig, err := h.loadSignature(key)
+	if err != nil {
+		return err
+	}
+	if err := h.storeSignature(key, sig); err != nil {
+		h.restoreSignature(key, prevSig)
+		return errors.Wrap(err, "history: failed to store signature")
+	}
+	if err := h.srv.Store(key, body); err != nil {
+		h.restoreSignature(key, prevSig)
+		return errors.Wrap(err, "history: failed to store site")
+	}
+	return nil
+}
+
+// RemoveSite deletes the per-site key name of the server type and its signature.  If the site does not exist, a
+// `NotExist` error is returned.
+func (h *History) RemoveSite(name string) error {
+	key, err := h.SiteKey(name)
+	if err != nil {
+		return err
+	}
+	if err := h.srv.Lock(key); err != nil {
+		return errors.Wrap(err, "remove: failed to get lock")
+	}
+	defer h.srv.Unlock(key)
+	if _, err := h.srv.Metadata(key); err != nil {
+		return err
+	}
+	if err := h.srv.Delete(key); err != nil {
+		return errors.Wrap(err, "history: failed to delete site")
+	}
+	return h.storeSignature(key, nil)
+}
+
+// List returns all retained revisions, oldest first
+func (h *History) List() ([]Revision, error) {
+	keys, err := h.srv.List(h.historyKey(), FilterRemoveDirectories())
+	if err != nil {
+		return nil, errors.Wrap(err, "history: failed to list revisions")
+	}
+	var revs []Revision
+	for _, k := range keys {
+		id, err := strconv.Atoi(path.Base(k))
+		if err != nil {
+			continue
+		}
+		r, err := h.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		revs = append(revs, *r)
+	}
+	sort.Slice(revs, func(i, j int) bool { return revs[i].ID < revs[j].ID })
+	return revs, nil
+}
+
+// Get returns revision id.  If the revision has been pruned or never existed, a `NotExist` error is returned.
+func (h *History) Get(id int) (*Revision, error) {
+	b, err := h.srv.Load(h.revisionKey(id))
+	if err != nil {
+		return nil, err
+	}
+	r := new(Revision)
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, errors.Wrapf(err, "history: failed to unmarshal revision %d", id)
+	}
+	return r, nil
+}
+
+// Diff returns a line diff that transforms revision from into revision to
+func (h *History) Diff(from int, to int) (string, error) {
+	a, err := h.Get(from)
+	if err != nil {
+		return "", err
+	}
+	b, err := h.Get(to)
+	if err != nil {
+		return "", err
+	}
+	return diff(fmt.Sprintf("revision %d", from), fmt.Sprintf("revision %d", to), a.Body, b.Body), nil
+}
+
+// commit stores a new revision and then updates the current Caddyfile and its signature.  If either update fails,
+// the previous signature is put back and the revision removed, so the current Caddyfile keeps its own signature.
+// The caller must hold the lock.
+func (h *History) commit(body []byte, sig []byte, author string, from int) (*Revision, error) {
+	prevSig, err := h.loadSignature(h.key)
+	if err != nil {
+		return nil, err
+	}
+	r := &Revision{
+		Author:       author,
+		Timestamp:    time.Now().UTC(),
+		Hash:         sha1.Sum(body),
+		Size:         len(body),
+		RollbackFrom: from,
+		Signature:    sig,
+		Body:         body,
+	}
+	revs, err := h.createRevision(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.storeSignature(h.key, sig); err != nil {
+		h.undo(r.ID, prevSig)
+		return nil, errors.Wrap(err, "history: failed to store signature")
+	}
+	if err := h.srv.Store(h.key, body); err != nil {
+		h.undo(r.ID, prevSig)
+		return nil, errors.Wrap(err, "history: failed to store caddyfile")
+	}
+	var prev [20]byte
+	if len(revs) > 0 {
+		prev = revs[len(revs)-1].Hash
+	}
+	detail := fmt.Sprintf("revision %d by %s", r.ID, r.Author)
+	if from > 0 {
+		detail += fmt.Sprintf(", rollback to revision %d", from)
+	}
+	audit(h.cfg, AuditPublish, h.key, prev, r.Hash, detail)
+	h.prune(append(revs, *r))
+	return r, nil
+}
+
+// maxRevisionConflicts is how many times createRevision tries the next ID after a concurrent publish took the last
+const maxRevisionConflicts = 5
+
+// createRevision stores r under the next revision ID, which it sets on r, and returns the revisions before it.  The
+// revision key is only created if it does not exist, so a concurrent publish that took the same ID is never
+// overwritten; the revisions are listed again and the next ID is tried instead.
+func (h *History) createRevision(r *Revision) ([]Revision, error) {
+	for attempt := 1; ; attempt++ {
+		revs, err := h.List()
+		if err != nil {
+			return nil, err
+		}
+		r.ID = 1
+		if len(revs) > 0 {
+			r.ID = revs[len(revs)-1].ID + 1
+		}
+		b, err := json.Marshal(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "history: failed to marshal revision")
+		}
+		err = h.srv.create(h.revisionKey(r.ID), b)
+		switch {
+		case err == nil:
+			return revs, nil
+		case isChanged(err) && attempt < maxRevisionConflicts:
+			h.cfg.log(LevelDebug, "caddyfile revision taken by a concurrent publish, retrying", F("revision", r.ID), F(FieldKey, h.key))
+		default:
+			return nil, errors.Wrap(err, "history: failed to store revision")
+		}
+	}
+}
+
+// undo puts back the signature prevSig, or removes the signature if there was none, and removes revision id, which
+// never became current
+func (h *History) undo(id int, prevSig []byte) {
+	h.restoreSignature(h.key, prevSig)
+	if err := h.srv.Delete(h.revisionKey(id)); err != nil {
+		h.cfg.log(LevelWarn, "failed to remove caddyfile revision", F("revision", id), F(FieldKey, h.revisionKey(id)), F(FieldError, err))
+	}
+}
+
+// loadSignature returns the signature stored beside key, or nil if there is none.  A corrupt signature is returned as
+// nil too, as it is not worth restoring and would be refused anyway.
+func (h *History) loadSignature(key string) ([]byte, error) {
+	sig, err := h.srv.Load(key + signatureSuffix)
+	switch {
+	case IsNotExistError(err), IsFailedChecksumError(err):
+		return nil, nil
+	case err != nil:
+		return nil, errors.Wrap(err, "history: failed to load signature")
+	}
+	return sig, nil
+}
+
+// storeSignature replaces the signature of key, removing it for an unsigned publish so that a stale signature is
+// never left beside a new value
+func (h *History) storeSignature(key string, sig []byte) error {
+	if len(sig) > 0 {
+		return h.srv.Store(key+signatureSuffix, sig)
+	}
+	if _, err := h.srv.Metadata(key + signatureSuffix); err != nil {
+		if IsNotExistError(err) {
+			return nil
+		}
+		return err
+	}
+	return h.srv.Delete(key + signatureSuffix)
+}
+
+// restoreSignature puts back the signature prevSig of key after a failed publish, or removes the signature if there
+// was none
+func (h *History) restoreSignature(key string, prevSig []byte) {
+	if err := h.storeSignature(key, prevSig); err != nil {
+		h.cfg.log(LevelError, "failed to restore signature", F(FieldKey, key+signatureSuffix), F(FieldError, err))
+	}
+}
+
+// prune removes the oldest revisions beyond the retention count.  A retention of 0 keeps every revision.
+func (h *History) prune(revs []Revision) {
+	if h.retention <= 0 || len(revs) <= h.retention {
+		return
+	}
+	for _, r := range revs[:len(revs)-h.retention] {
+		if err := h.srv.Delete(h.revisionKey(r.ID)); err != nil {
+			h.cfg.log(LevelWarn, "failed to prune caddyfile revision", F("revision", r.ID), F(FieldKey, h.revisionKey(r.ID)), F(FieldError, err))
+		}
+	}
+}
+
+// validate checks body as it will be loaded, after imports from etcd are resolved.  The server type must be plugged
+// in, so that a Caddyfile is never published without its directives being checked.
+func (h *History) validate(body []byte) error {
+	cli, err := getClient(h.cfg)
+	if err != nil {
+		return errors.Wrap(err, "validate: failed to get client")
+	}
+	expanded, err := expandImports(context.Background(), h.cfg, cli, body, h.Path(), nil)
+	if err != nil {
+		return InvalidCaddyfile{err}
+	}
+	return ValidateCaddyfile(expanded, h.Path(), h.servertype)
+}
+
+// validateSite checks the per-site key at key appended to the current Caddyfile, the same as it is loaded, so that
+// the site can import the snippets defined by the Caddyfile
+func (h *History) validateSite(key string, body []byte) error {
+	cli, err := getClient(h.cfg)
+	if err != nil {
+		return errors.Wrap(err, "validate: failed to get client")
+	}
+	current, err := h.srv.Load(h.key)
+	if err != nil && !IsNotExistError(err) {
+		return errors.Wrap(err, "validate: failed to load caddyfile")
+	}
+	imp := newImporter(context.Background(), h.cfg, cli, nil)
+	current, err = imp.expand(current, h.Path(), nil)
+	if err != nil {
+		return InvalidCaddyfile{err}
+	}
+	p := path.Join(h.srv.prefix(), key)
+	site, err := imp.expand(body, p, nil)
+	if err != nil {
+		return InvalidCaddyfile{err}
+	}
+	return ValidateCaddyfile([]byte(fmt.Sprintf("%s\n# %s\n%s", current, p, site)), h.Path(), h.servertype)
+}
+
+// Key returns the key of the current Caddyfile relative to the key prefix, which is the key its signature covers
+func (h *History) Key() string {
+	return h.key
+}
+
+// Path returns the etcd key of the current Caddyfile
+func (h *History) Path() string {
+	return path.Join(h.srv.prefix(), h.key)
+}
+
+// SiteKey returns the key of the per-site key name relative to the key prefix, which is the key its signature covers
+func (h *History) SiteKey(name string) (string, error) {
+	if len(name) == 0 || name == "." || name == ".." || strings.Contains(name, "/") || isSignature(name) {
+		return "", errors.Errorf("history: %q is not a valid site name", name)
+	}
+	return path.Join(sitesKey(h.servertype), name), nil
+}
+
+func (h *History) historyKey() string {
+	return path.Join("history", h.key)
+}
+
+func (h *History) revisionKey(id int) string {
+	return path.Join(h.historyKey(), fmt.Sprintf("%010d", id))
+}
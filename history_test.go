@@ -0,0 +1,131 @@
+package etcd
+
+import (
+	"context"
+	"crypto/sha1"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/client"
+)
+
+func TestDiff(t *testing.T) {
+	tcs := []struct {
+		Name   string
+		A      string
+		B      string
+		Expect string
+	}{
+		{Name: "identical", A: "one\ntwo\n", B: "one\ntwo\n", Expect: ""},
+		{Name: "change", A: "one\ntwo\nthree", B: "one\n2\nthree", Expect: "--- a\n+++ b\n@@ -1,3 +1,3 @@\n one\n-two\n+2\n three\n"},
+		{Name: "append", A: "one", B: "one\ntwo", Expect: "--- a\n+++ b\n@@ -1,1 +1,2 @@\n one\n+two\n"},
+		{Name: "from empty", A: "", B: "one", Expect: "--- a\n+++ b\n@@ -0,0 +1,1 @@\n+one\n"},
+		{Name: "to empty", A: "one", B: "", Expect: "--- a\n+++ b\n@@ -1,1 +0,0 @@\n-one\n"},
+		{Name: "delete", A: "one\ntwo\nthree", B: "one\nthree", Expect: "--- a\n+++ b\n@@ -1,3 +1,2 @@\n one\n-two\n three\n"},
+		{Name: "separate hunks", A: "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12", B: "0\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n13", Expect: "--- a\n+++ b\n@@ -1,4 +1,4 @@\n-1\n+0\n 2\n 3\n 4\n@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+13\n"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			assert.Equal(t, tc.Expect, diff("a", "b", []byte(tc.A), []byte(tc.B)))
+		})
+	}
+}
+
+func TestHistory(t *testing.T) {
+	if !shouldRunIntegration() {
+		t.Skip("no etcd server found, skipping")
+	}
+	cfg := &ClusterConfig{
+		KeyPrefix:        "/testhistory",
+		ServerIP:         []string{"http://127.0.0.1:2379"},
+		HistoryRetention: 2,
+	}
+	cli, err := getClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = cli.Delete(context.Background(), cfg.KeyPrefix, &client.DeleteOptions{Recursive: true})
+	h := NewHistory(cfg, "http")
+	srv := NewService(cfg)
+	cf1 := []byte("cf1.cluster.local {\n\tproxy test:123\n}")
+	cf2 := []byte("cf2.cluster.local {\n\tproxy test:123\n}")
+	cf3 := []byte("cf3.cluster.local {\n\tproxy test:123\n}")
+
+	r1, err := h.Publish(cf1, "test")
+	assert.NoError(t, err)
+	r2, err := h.Publish(cf2, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, r1.ID+1, r2.ID)
+	assert.Equal(t, sha1.Sum(cf2), r2.Hash)
+	current, err := srv.Load(caddyfileKey("http"))
+	assert.NoError(t, err)
+	assert.Equal(t, cf2, current)
+
+	d, err := h.Diff(r1.ID, r2.ID)
+	assert.NoError(t, err)
+	assert.Contains(t, d, "-cf1.cluster.local {")
+	assert.Contains(t, d, "+cf2.cluster.local {")
+
+	r3, err := h.Rollback(r1.ID, "rollback")
+	assert.NoError(t, err)
+	assert.Equal(t, r1.ID, r3.RollbackFrom)
+	assert.Equal(t, cf1, r3.Body)
+	current, err = srv.Load(caddyfileKey("http"))
+	assert.NoError(t, err)
+	assert.Equal(t, cf1, current)
+
+	// retention of 2 prunes the first revision
+	_, err = h.Publish(cf3, "test")
+	assert.NoError(t, err)
+	revs, err := h.List()
+	assert.NoError(t, err)
+	if assert.Len(t, revs, 2) {
+		assert.Equal(t, r3.ID, revs[0].ID)
+		assert.Equal(t, cf3, revs[1].Body)
+	}
+	_, err = h.Get(r1.ID)
+	assert.True(t, IsNotExistError(err))
+
+	// invalid caddyfiles are never published
+	_, err = h.Publish([]byte("cf4.cluster.local {\n\tproxy test:123\n"), "test")
+	assert.True(t, IsInvalidCaddyfileError(err))
+	current, err = srv.Load(caddyfileKey("http"))
+	assert.NoError(t, err)
+	assert.Equal(t, cf3, current)
+
+	// a server type that is not plugged in cannot check its directives, so nothing is published
+	_, err = NewHistory(cfg, "unknown").Publish(cf1, "test")
+	assert.Error(t, err)
+	_, err = srv.Load(caddyfileKey("unknown"))
+	assert.True(t, IsNotExistError(err))
+}
+
+func TestPublishSite(t *testing.T) {
+	cfg, _, done := testPrefix(t, "publishsite")
+	defer done()
+	h := NewHistory(cfg, "http")
+	srv := NewService(cfg)
+	_, err := h.Publish([]byte("(common) {\n\tgzip\n}\ncf.cluster.local {\n\timport common\n}"), "test")
+	assert.NoError(t, err)
+
+	// a site can import the snippets of the caddyfile
+	assert.NoError(t, h.PublishSite("api", []byte("api.cluster.local {\n\timport common\n}"), []byte("sig")))
+	value, err := srv.Load("sites/http/api")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("api.cluster.local {\n\timport common\n}"), value)
+	sig, err := srv.Load("sites/http/api.sig")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("sig"), sig)
+
+	err = h.PublishSite("api", []byte("api.cluster.local {\n\tproxxy test:123\n}"), nil)
+	assert.True(t, IsInvalidCaddyfileError(err))
+	_, err = h.SiteKey("../caddyfiles/http")
+	assert.Error(t, err)
+
+	assert.NoError(t, h.RemoveSite("api"))
+	_, err = srv.Metadata("sites/http/api")
+	assert.True(t, IsNotExistError(err))
+	_, err = srv.Metadata("sites/http/api.sig")
+	assert.True(t, IsNotExistError(err))
+	assert.True(t, IsNotExistError(h.RemoveSite("api")))
+}
@@ -0,0 +1,199 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cenkalti/backoff"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/client"
+)
+
+var (
+	importLine  = regexp.MustCompile(`^\s*import\s+(\S+)\s*$`)
+	snippetLine = regexp.MustCompile(`^\s*\(([^)\s]+)\)`)
+)
+
+// importer resolves `import` directives in Caddyfiles stored in etcd against other keys under the key prefix
+type importer struct {
+	ctx    context.Context
+	cfg    *ClusterConfig
+	cli    client.KeysAPI
+	prefix string
+	// snippets defined with `(name) { ... }` anywhere in the expansion so far are imported by the caddyfile parser,
+	// not from etcd
+	snippets map[string]bool
+	// verifier checks the signature of each imported key when signatures are required
+	verifier *verifier
+}
+
+// expandImports replaces each `import <pattern>` line in body with the contents of the etcd keys that match
+// pattern.  Relative patterns are resolved against the directory of key, and absolute patterns against the key
+// prefix, except in Caddyfiles, which resolve relative patterns against the key prefix.  Patterns may contain the
+// wildcards supported by path.Match.  Imported keys may import other keys, but an import cycle is an error.  Each
+// imported key is wrapped in comments naming it, since line numbers in errors will refer to the expanded
+// Caddyfile.  An import of a snippet defined earlier in body or in a key it imports is left for the Caddyfile
+// parser.  When v is not nil, every imported key must carry a valid signature.  Reading from etcd stops when ctx
+// is done.
+func expandImports(ctx context.Context, c *ClusterConfig, cli client.KeysAPI, body []byte, key string, v *verifier) ([]byte, error) {
+	return newImporter(ctx, c, cli, v).expand(body, key, nil)
+}
+
+// newImporter returns an importer that knows no snippets yet.  Bodies expanded one after the other by the same
+// importer share their snippets, the same as Caddy does once they are joined into one Caddyfile.
+func newImporter(ctx context.Context, c *ClusterConfig, cli client.KeysAPI, v *verifier) *importer {
+	return &importer{
+		ctx:      ctx,
+		cfg:      c,
+		cli:      cli,
+		prefix:   c.KeyPrefix,
+		snippets: make(map[string]bool),
+		verifier: v,
+	}
+}
+
+// define records the snippets defined in body, so that the bodies expanded after it can import them
+func (i *importer) define(body []byte) {
+	for _, line := range strings.Split(string(body), "\n") {
+		if m := snippetLine.FindStringSubmatch(line); m != nil {
+			i.snippets[m[1]] = true
+		}
+	}
+}
+
+func (i *importer) expand(body []byte, key string, stack []string) ([]byte, error) {
+	for _, k := range stack {
+		if k == key {
+			return nil, errors.Errorf("import cycle: %s -> %s", strings.Join(stack, " -> "), key)
+		}
+	}
+	stack = append(stack, key)
+	i.define(body)
+	lines := strings.Split(string(body), "\n")
+	var out bytes.Buffer
+	for n, line := range lines {
+		if n > 0 {
+			out.WriteString("\n")
+		}
+		m := importLine.FindStringSubmatch(line)
+		if m == nil || i.snippets[m[1]] {
+			out.WriteString(line)
+			continue
+		}
+		keys, err := i.match(key, m[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", key, n+1)
+		}
+		var parts []string
+		for _, k := range keys {
+			imported, err := i.get(k)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s:%d", key, n+1)
+			}
+			if err := i.verifier.verify(i.ctx, k, imported); err != nil {
+				return nil, err
+			}
+			expanded, err := i.expand(imported, k, stack)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, fmt.Sprintf("# begin import %s\n%s\n# end import %s", k, bytes.TrimRight(expanded, "\n"), k))
+		}
+		out.WriteString(strings.Join(parts, "\n"))
+	}
+	return out.Bytes(), nil
+}
+
+// match returns the sorted etcd keys that match an import pattern
+func (i *importer) match(key string, pattern string) ([]string, error) {
+	var full string
+	switch {
+	case path.IsAbs(pattern):
+		full = path.Join(i.prefix, pattern)
+	default:
+		full = path.Join(i.dir(key), pattern)
+	}
+	if !strings.HasPrefix(full, i.prefix+"/") {
+		return nil, errors.Errorf("import %s is outside of %s", pattern, i.prefix)
+	}
+	// metadata, locks, and the audit log are not Caddyfile snippets, so a pattern never matches them
+	if isReserved(strings.TrimPrefix(full, i.prefix+"/")) {
+		return nil, errors.Errorf("import %s is in a directory used by the plugin", pattern)
+	}
+	if !strings.ContainsAny(full, "*?[") {
+		return []string{full}, nil
+	}
+	if _, err := path.Match(full, ""); err != nil {
+		return nil, errors.Wrapf(err, "import %s is an invalid pattern", pattern)
+	}
+	// list from the deepest directory that has no wildcards
+	segments := strings.Split(full, "/")
+	var root []string
+	for _, s := range segments {
+		if strings.ContainsAny(s, "*?[") {
+			break
+		}
+		root = append(root, s)
+	}
+	nodes, err := listContext(i.ctx, i.cli, strings.Join(root, "/"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "import %s", pattern)
+	}
+	var keys []string
+	for _, n := range nodes {
+		if n.Dir || isSignature(n.Key) || isReserved(strings.TrimPrefix(n.Key, i.prefix+"/")) {
+			continue
+		}
+		if ok, _ := path.Match(full, n.Key); ok {
+			keys = append(keys, n.Key)
+		}
+	}
+	if len(keys) == 0 {
+		i.cfg.log(LevelWarn, "no keys match import pattern", F("pattern", pattern), F(FieldKey, key))
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// dir returns the directory that relative imports in key are resolved against.  Caddyfiles stored per server type
+// resolve imports against the key prefix, the same as the legacy caddyfile key.
+func (i *importer) dir(key string) string {
+	dir := path.Dir(key)
+	if dir == path.Join(i.prefix, caddyfilesDir) {
+		return i.prefix
+	}
+	return dir
+}
+
+func (i *importer) get(key string) ([]byte, error) {
+	var body []byte
+	getImport := func() error {
+		resp, err := i.cli.Get(i.ctx, key, nil)
+		if err != nil {
+			switch {
+			case client.IsKeyNotFound(err):
+				return backoff.Permanent(NotExist{key})
+			default:
+				return errors.Wrap(err, "import: error retrieving value")
+			}
+		}
+		if resp.Node.Dir {
+			return backoff.Permanent(errors.Errorf("import: %s is a directory", key))
+		}
+		body, err = base64.StdEncoding.DecodeString(resp.Node.Value)
+		if err != nil {
+			return backoff.Permanent(errors.Wrap(err, "import: error decoding base64 value"))
+		}
+		return nil
+	}
+	if err := backoff.Retry(getImport, backoff.WithContext(backoff.NewExponentialBackOff(), i.ctx)); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
@@ -0,0 +1,86 @@
+package etcd
+
+import (
+	"context"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/client"
+)
+
+func TestExpandImports(t *testing.T) {
+	if !shouldRunIntegration() {
+		t.Skip("no etcd server found, skipping")
+	}
+	cfg := &ClusterConfig{
+		KeyPrefix: "/testimports",
+		ServerIP:  []string{"http://127.0.0.1:2379"},
+	}
+	cli, err := getClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = cli.Delete(context.Background(), cfg.KeyPrefix, &client.DeleteOptions{Recursive: true})
+	keys := map[string]string{
+		"snippets/gzip":     "gzip",
+		"snippets/log":      "log stdout",
+		"snippets/nested":   "import ../snippets/gzip",
+		"snippets/common":   "(common) {\n\tgzip\n}",
+		"cycle/one":         "import two",
+		"cycle/two":         "import one",
+		"sites/example.com": "example.com {\n\timport /snippets/log\n}",
+		"md/snippets/gzip":  `{"hash":""}`,
+	}
+	for k, v := range keys {
+		if err := set(cli, path.Join(cfg.KeyPrefix, k), []byte(v))(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	main := path.Join(cfg.KeyPrefix, "caddyfile")
+	tcs := []struct {
+		Name      string
+		Key       string
+		Body      string
+		Expect    string
+		ShouldErr bool
+	}{
+		{Name: "no imports", Key: main, Body: "example.com {\n\tgzip\n}", Expect: "example.com {\n\tgzip\n}"},
+		{Name: "single", Key: main, Body: "example.com {\n\timport snippets/gzip\n}", Expect: "example.com {\n# begin import /testimports/snippets/gzip\ngzip\n# end import /testimports/snippets/gzip\n}"},
+		{Name: "glob", Key: main, Body: "example.com {\n\timport snippets/[gl]*\n}", Expect: "example.com {\n# begin import /testimports/snippets/gzip\ngzip\n# end import /testimports/snippets/gzip\n# begin import /testimports/snippets/log\nlog stdout\n# end import /testimports/snippets/log\n}"},
+		{Name: "nested", Key: main, Body: "import snippets/nested", Expect: "# begin import /testimports/snippets/nested\n# begin import /testimports/snippets/gzip\ngzip\n# end import /testimports/snippets/gzip\n# end import /testimports/snippets/nested"},
+		{Name: "relative from server type caddyfile", Key: path.Join(cfg.KeyPrefix, caddyfileKey("http")), Body: "import snippets/log", Expect: "# begin import /testimports/snippets/log\nlog stdout\n# end import /testimports/snippets/log"},
+		{Name: "absolute from site key", Key: path.Join(cfg.KeyPrefix, "sites/example.com"), Body: keys["sites/example.com"], Expect: "example.com {\n# begin import /testimports/snippets/log\nlog stdout\n# end import /testimports/snippets/log\n}"},
+		{Name: "caddyfile snippet", Key: main, Body: "(common) {\n\tgzip\n}\nexample.com {\n\timport common\n}", Expect: "(common) {\n\tgzip\n}\nexample.com {\n\timport common\n}"},
+		{Name: "imported snippet", Key: main, Body: "import snippets/common\nexample.com {\n\timport common\n}", Expect: "# begin import /testimports/snippets/common\n(common) {\n\tgzip\n}\n# end import /testimports/snippets/common\nexample.com {\n\timport common\n}"},
+		{Name: "glob no match", Key: main, Body: "import nothing/*", Expect: ""},
+		{Name: "glob skips metadata", Key: main, Body: "import [ms]*/gzip", Expect: "# begin import /testimports/snippets/gzip\ngzip\n# end import /testimports/snippets/gzip"},
+		{Name: "metadata", Key: main, Body: "import md/snippets/gzip", ShouldErr: true},
+		{Name: "missing", Key: main, Body: "import snippets/missing", ShouldErr: true},
+		{Name: "cycle", Key: main, Body: "import cycle/one", ShouldErr: true},
+		{Name: "outside prefix", Key: main, Body: "import ../other", ShouldErr: true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			out, err := expandImports(context.Background(), cfg, cli, []byte(tc.Body), tc.Key, nil)
+			switch tc.ShouldErr {
+			case true:
+				assert.Error(t, err)
+			default:
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Expect, string(out))
+			}
+		})
+	}
+
+	// a site key can import the snippets defined in the caddyfile it is appended to, and in the sites before it
+	imp := newImporter(context.Background(), cfg, cli, nil)
+	_, err = imp.expand([]byte("import snippets/common"), main, nil)
+	assert.NoError(t, err)
+	out, err := imp.expand([]byte("a.example.com {\n\timport common\n}\n(site) {\n\tlog stdout\n}"), path.Join(cfg.KeyPrefix, "sites/a.example.com"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "a.example.com {\n\timport common\n}\n(site) {\n\tlog stdout\n}", string(out))
+	out, err = imp.expand([]byte("b.example.com {\n\timport site\n}"), path.Join(cfg.KeyPrefix, "sites/b.example.com"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "b.example.com {\n\timport site\n}", string(out))
+}
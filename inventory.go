@@ -0,0 +1,225 @@
+package etcd
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/client"
+)
+
+// StoredCertificate describes a certificate that certmagic stored under `<KeyPrefix>/acme/<ca>/sites/<domain>`.
+// Modified is the time the certificate was last written, from its metadata.  Err is set when the certificate could
+// not be read, in which case only Domain, CA, and Key are set.
+type StoredCertificate struct {
+	Domain    string    `json:"domain"`
+	Names     []string  `json:"names"`
+	Issuer    string    `json:"issuer"`
+	CA        string    `json:"ca"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	KeyType   string    `json:"key_type"`
+	Modified  time.Time `json:"modified"`
+	Key       string    `json:"key"`
+	Err       error     `json:"-"`
+}
+
+// InventoryOptions controls which certificates are listed
+type InventoryOptions struct {
+	// ExpiresWithin lists only the certificates that expire within this duration, including those that have
+	// expired.  All certificates are listed when it is zero.
+	ExpiresWithin time.Duration
+}
+
+// Inventory lists the certificates stored under the key prefix, the one expiring soonest first.  Certificates that
+// cannot be read are always listed, first.
+func Inventory(c *ClusterConfig, opts InventoryOptions) ([]StoredCertificate, error) {
+	cli, err := getClient(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "inventory: failed to get client")
+	}
+	data, mds, err := readPrefix(cli, c.KeyPrefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "inventory: could not get keys")
+	}
+	deadline := time.Now().Add(opts.ExpiresWithin)
+	var out []StoredCertificate
+	for _, sc := range readSiteCertificates(data, mds) {
+		parts := strings.Split(sc.dir, "/")
+		s := StoredCertificate{Domain: parts[3], CA: parts[1], Key: sc.certKey, Err: sc.err}
+		if sc.err != nil {
+			out = append(out, s)
+			continue
+		}
+		if opts.ExpiresWithin > 0 && sc.cert.NotAfter.After(deadline) {
+			continue
+		}
+		if names := certificateNames(sc.cert); len(names) > 0 {
+			s.Domain = names[0]
+		}
+		s.Names = append(append([]string(nil), sc.cert.DNSNames...), ipNames(sc.cert)...)
+		s.Issuer = sc.cert.Issuer.CommonName
+		if len(s.Issuer) == 0 {
+			s.Issuer = sc.cert.Issuer.String()
+		}
+		s.Serial = fmt.Sprintf("%x", sc.cert.SerialNumber)
+		s.NotBefore, s.NotAfter = sc.cert.NotBefore, sc.cert.NotAfter
+		s.KeyType = keyType(sc.cert)
+		if sc.md != nil {
+			s.Modified = sc.md.Timestamp
+		}
+		out = append(out, s)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].NotAfter.Before(out[j].NotAfter) })
+	return out, nil
+}
+
+// siteCertificate is the certificate of a certmagic site directory as it was read, with the keys of the directory
+type siteCertificate struct {
+	dir     string
+	certKey string
+	keys    []string
+	cert    *x509.Certificate
+	hash    [20]byte
+	md      *Metadata
+	err     error
+}
+
+// modified returns the time the certificate was last written.  A certificate without metadata was never written
+// through the plugin, so it is as old as the certificate.
+func (s *siteCertificate) modified() time.Time {
+	if s.md != nil {
+		return s.md.Timestamp
+	}
+	return s.cert.NotBefore
+}
+
+// readPrefix reads the values and metadata stored under prefix, by key relative to it, leaving out the other keys
+// reserved by the plugin, such as locks, the audit log, and quarantined values or tombstones
+func readPrefix(cli client.KeysAPI, prefix string) (map[string]string, map[string]string, error) {
+	nodes, err := list(cli, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	data := make(map[string]string)
+	mds := make(map[string]string)
+	for _, n := range filter(nodes, FilterRemoveDirectories()) {
+		key := strings.TrimPrefix(n.Key, strings.TrimSuffix(prefix, "/")+"/")
+		dir, rest := splitKey(key)
+		switch {
+		case dir == "md":
+			mds[rest] = n.Value
+		case isReserved(key):
+		default:
+			data[key] = n.Value
+		}
+	}
+	return data, mds, nil
+}
+
+// readSiteCertificates groups the keys under every site directory and parses the certificate of each
+func readSiteCertificates(data map[string]string, mds map[string]string) []*siteCertificate {
+	byDir := make(map[string]*siteCertificate)
+	for key := range data {
+		parts := strings.Split(key, "/")
+		if len(parts) != 5 || parts[0] != "acme" || parts[2] != "sites" {
+			continue
+		}
+		dir := path.Dir(key)
+		s, ok := byDir[dir]
+		if !ok {
+			s = &siteCertificate{dir: dir, certKey: path.Join(dir, parts[3]+".crt")}
+			byDir[dir] = s
+		}
+		s.keys = append(s.keys, key)
+	}
+	var dirs []string
+	for dir := range byDir {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	var out []*siteCertificate
+	for _, dir := range dirs {
+		s := byDir[dir]
+		sort.Strings(s.keys)
+		out = append(out, s)
+		v, ok := data[s.certKey]
+		if !ok {
+			s.err = errors.Errorf("%s has no certificate", dir)
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			s.err = errors.Wrapf(err, "%s is not base64 encoded", s.certKey)
+			continue
+		}
+		if s.cert, err = parseCertificate(b); err != nil {
+			s.err = errors.Wrapf(err, "failed to parse %s", s.certKey)
+			continue
+		}
+		s.hash = sha1.Sum(b)
+		if md, ok := mds[s.certKey]; ok {
+			s.md, _ = decodeMetadata(md)
+		}
+	}
+	return out
+}
+
+// parseCertificate parses the leaf certificate of a PEM bundle
+func parseCertificate(b []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return nil, errors.New("no certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// certificateNames returns the lower case names of a certificate, the common name first, the same names certmagic
+// uses for it
+func certificateNames(cert *x509.Certificate) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, n := range append([]string{cert.Subject.CommonName}, cert.DNSNames...) {
+		n = strings.ToLower(n)
+		if len(n) > 0 && !seen[n] {
+			seen[n] = true
+			names = append(names, n)
+		}
+	}
+	return append(names, ipNames(cert)...)
+}
+
+func ipNames(cert *x509.Certificate) []string {
+	var names []string
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// keyType describes the public key of a certificate, such as `ECDSA P-256` or `RSA 2048`
+func keyType(cert *x509.Certificate) string {
+	switch k := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	default:
+		return cert.PublicKeyAlgorithm.String()
+	}
+}
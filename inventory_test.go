@@ -0,0 +1,66 @@
+package etcd
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInventory(t *testing.T) {
+	cfg, _, done := testPrefix(t, "inventory")
+	defer done()
+	srv := NewService(cfg).(*etcdsrv)
+
+	now := time.Now().Truncate(time.Second)
+	modified := now.Add(-time.Hour)
+	store := func(domain string, serial int64, notAfter time.Time, names ...string) {
+		dir := path.Join("acme/acme-v02.api.letsencrypt.org/sites", domain)
+		c := testCertificate(t, serial, notAfter, append([]string{domain}, names...)...)
+		assert.NoError(t, srv.storeAt(path.Join(dir, domain+".crt"), c.crt, modified))
+		assert.NoError(t, srv.storeAt(path.Join(dir, domain+".key"), c.key, modified))
+	}
+	store("later.example.com", 0x1f, now.Add(60*24*time.Hour))
+	store("soon.example.com", 0x2a, now.Add(5*24*time.Hour), "www.soon.example.com")
+	store("expired.example.com", 3, now.Add(-24*time.Hour))
+	assert.NoError(t, srv.Store("acme/acme-v02.api.letsencrypt.org/sites/broken/broken.crt", []byte("not a certificate")))
+
+	tcs := []struct {
+		Name    string
+		Opts    InventoryOptions
+		Domains []string
+	}{
+		{Name: "all, by expiry", Opts: InventoryOptions{}, Domains: []string{"broken", "expired.example.com", "soon.example.com", "later.example.com"}},
+		{Name: "expiring within 30 days", Opts: InventoryOptions{ExpiresWithin: 30 * 24 * time.Hour}, Domains: []string{"broken", "expired.example.com", "soon.example.com"}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			certs, err := Inventory(cfg, tc.Opts)
+			assert.NoError(t, err)
+			var domains []string
+			for _, c := range certs {
+				domains = append(domains, c.Domain)
+				if c.Domain == "broken" {
+					assert.Error(t, c.Err)
+				}
+			}
+			assert.Equal(t, tc.Domains, domains)
+		})
+	}
+
+	certs, err := Inventory(cfg, InventoryOptions{})
+	assert.NoError(t, err)
+	if assert.Len(t, certs, 4) {
+		soon := certs[2]
+		assert.NoError(t, soon.Err)
+		assert.Equal(t, []string{"soon.example.com", "www.soon.example.com"}, soon.Names)
+		assert.Equal(t, "soon.example.com", soon.Issuer)
+		assert.Equal(t, "acme-v02.api.letsencrypt.org", soon.CA)
+		assert.Equal(t, "2a", soon.Serial)
+		assert.Equal(t, "ECDSA P-256", soon.KeyType)
+		assert.True(t, soon.NotAfter.Equal(now.Add(5*24*time.Hour)))
+		assert.True(t, soon.Modified.Equal(modified))
+		assert.Equal(t, "acme/acme-v02.api.letsencrypt.org/sites/soon.example.com/soon.example.com.crt", soon.Key)
+	}
+}
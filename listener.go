@@ -0,0 +1,47 @@
+package etcd
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var listenOnce sync.Once
+
+const (
+	// listenReadTimeout bounds reading a request, so that a slow client cannot hold a connection open
+	listenReadTimeout = 10 * time.Second
+	// listenWriteTimeout bounds serving a request.  It is longer than the etcd requests a scrape or a health check
+	// makes, so that their own timeouts are reported rather than cut off.
+	listenWriteTimeout = 30 * time.Second
+	// listenIdleTimeout closes keep-alive connections that are not reused
+	listenIdleTimeout = 2 * time.Minute
+)
+
+// listen starts the built-in HTTP listener on the configured address, once per process.  It serves the metrics
+// of the plugin at /metrics and the health of the storage layer at /health.
+func listen(c *ClusterConfig) {
+	if len(c.ListenAddr) == 0 {
+		return
+	}
+	listenOnce.Do(func() {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+		mux.Handle("/health", healthHandler(c))
+		srv := &http.Server{
+			Addr:         c.ListenAddr,
+			Handler:      mux,
+			ReadTimeout:  listenReadTimeout,
+			WriteTimeout: listenWriteTimeout,
+			IdleTimeout:  listenIdleTimeout,
+		}
+		go func() {
+			c.log(LevelInfo, "serving metrics and health checks", F("listen", c.ListenAddr))
+			if err := srv.ListenAndServe(); err != nil {
+				c.log(LevelError, "listener stopped", F("listen", c.ListenAddr), F(FieldError, err))
+			}
+		}()
+	})
+}
@@ -2,19 +2,46 @@ package etcd
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
 	"path"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/cenkalti/backoff"
 	"github.com/mholt/caddy"
 	"github.com/pkg/errors"
+	"go.etcd.io/etcd/client"
 )
 
 var _ caddy.Input = loader{}
 
+// legacyServerType is the server type that falls back to the single Caddyfile key used before Caddyfiles were
+// stored per server type
+const legacyServerType = "http"
+
 // Load satisfies the caddy.Input interface to return the contents of a Caddyfile in the following order:
-// (1) any caddy files that are loaded in etcd at key: /<keyprefix>/caddyfile
-// (2) a caddyfile that is set using CADDY_CLUSTERING_ETCD_CADDYFILE
-// (3) other configured caddyfile loaders, including the default loader
+// (1) any caddy files that are loaded in etcd at key: /<keyprefix>/caddyfiles/<servertype>
+// (2) for the http server type only, a caddyfile loaded in etcd at the legacy key: /<keyprefix>/caddyfile
+// (3) a caddyfile that is set using CADDY_CLUSTERING_ETCD_CADDYFILE, which is stored at (1)
+// (4) other configured caddyfile loaders, including the default loader
+// If the caddyfile from (3) differs from (1) or (2), CADDY_CLUSTERING_ETCD_BOOTSTRAP_POLICY decides which is used.
+// Site blocks stored as individual keys under /<keyprefix>/sites/<servertype> are appended to the Caddyfile
+// from (1) or (3), and those under /<keyprefix>/sites to the legacy Caddyfile from (2).
+// Imports in Caddyfiles stored in etcd are resolved against other keys under /<keyprefix>.  Finally, any
+// `{etcd.secret:name}` placeholders are replaced with secrets stored under the secrets prefix.
+// Site blocks that declare a label selector are only kept when it matches the labels of this instance.
+// When trusted keys are configured, every Caddyfile, site, and import read from etcd must carry a valid
+// signature from one of them, otherwise an `InvalidSignature` error is returned and nothing is loaded.
+// The Caddyfile that is loaded is cached on disk.  If etcd cannot be reached within the loader timeout, Caddy
+// starts from the cached Caddyfile, or the bootstrap Caddyfile if there is no cache, and is reloaded with the
+// Caddyfile from etcd once it becomes reachable.  A fallback whose secrets cannot be resolved before the loader
+// timeout is an error.
 func Load(servertype string) (caddy.Input, error) {
 	opts := ConfigOptsFromEnvironment()
 	c, err := NewClusterConfig(opts...)
@@ -26,32 +53,142 @@ func Load(servertype string) (caddy.Input, error) {
 	if c.DisableCaddyLoad {
 		return nil, nil
 	}
+	type result struct {
+		input caddy.Input
+		err   error
+	}
+	// the load is cancelled after a timeout, so that it cannot publish the bootstrap caddyfile while Caddy starts
+	// from a fallback, and done is buffered to let it finish.  The fallback shares the same deadline, so that
+	// starting never takes longer than the loader timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), c.LoaderTimeout)
+	defer cancel()
+	done := make(chan result, 1)
+	go func() {
+		input, err := load(ctx, c, servertype)
+		done <- result{input, err}
+	}()
+	select {
+	case r := <-done:
+		switch {
+		case r.err == nil:
+			setFallback(servertype, "")
+			if l, ok := r.input.(loader); ok {
+				if err := writeCache(c, servertype, l.path, l.body, l.unresolved); err != nil {
+					c.log(LevelWarn, "unable to cache caddyfile", F(FieldKey, l.path), F(FieldError, err))
+				}
+			}
+			return r.input, nil
+		// a caddyfile that was refused, or a missing secret or import, must not be replaced by an older caddyfile
+		// without anyone noticing
+		case !unavailable(r.err):
+			return nil, r.err
+		default:
+			return loadFallback(ctx, c, servertype, r.err)
+		}
+	case <-ctx.Done():
+		return loadFallback(ctx, c, servertype, errors.Errorf("timed out after %s", c.LoaderTimeout))
+	}
+}
+
+// unavailable returns true if err means that etcd could not be reached, rather than that the Caddyfile in etcd
+// cannot be loaded.  Only these errors are worth a fallback Caddyfile or a retry.
+func unavailable(err error) bool {
+	cause := errors.Cause(err)
+	switch e := cause.(type) {
+	case client.Error:
+		return e.Code == client.ErrorCodeRaftInternal || e.Code == client.ErrorCodeLeaderElect
+	case net.Error:
+		return true
+	}
+	switch errorType(err) {
+	case "unavailable", "timeout":
+		return true
+	}
+	return cause == client.ErrNoEndpoints || cause == client.ErrClusterUnavailable || cause == context.Canceled
+}
+
+// load reads the Caddyfile for servertype from etcd, bootstrapping it from disk if etcd has none.  It stops
+// retrying when ctx is done, and never publishes the bootstrap Caddyfile after that.
+func load(ctx context.Context, c *ClusterConfig, servertype string) (caddy.Input, error) {
 	cli, err := getClient(c)
 	if err != nil {
 		return nil, errors.Wrap(err, "caddyfile loader: unable to get etcd client")
 	}
-	dst := new(bytes.Buffer)
-	if err := backoff.Retry(get(cli, path.Join(c.KeyPrefix, "caddyfile"), dst), backoff.NewExponentialBackOff()); err != nil {
-		return nil, errors.Wrap(err, "caddyfile loader: unable to load caddyfile from etcd")
+	v := newVerifier(c, cli)
+	p := path.Join(c.KeyPrefix, caddyfileKey(servertype))
+	sites := path.Join(c.KeyPrefix, sitesKey(servertype))
+	body, err := loadCaddyfile(ctx, cli, v, p)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 && servertype == legacyServerType {
+		legacy := path.Join(c.KeyPrefix, legacyCaddyfileKey)
+		if body, err = loadCaddyfile(ctx, cli, v, legacy); err != nil {
+			return nil, err
+		}
+		if len(body) > 0 {
+			c.log(LevelInfo, "no caddyfile found for server type, loading legacy caddyfile", F(FieldKey, legacy), F("servertype", servertype))
+			p = legacy
+			sites = path.Join(c.KeyPrefix, legacySitesDir)
+		}
+	}
+	// the caddyfile in etcd that the bootstrap caddyfile replaces, which is loaded if it cannot be published
+	var replaced []byte
+	replacedPath, replacedSites := p, sites
+	if len(body) > 0 && len(c.CaddyFile) > 0 {
+		useDisk, err := resolveBootstrap(c, p, body)
+		if err != nil {
+			return nil, err
+		}
+		if useDisk {
+			replaced, body = body, nil
+			sites = path.Join(c.KeyPrefix, sitesKey(servertype))
+		}
 	}
 	switch {
 	// prioritize data loaded in etcd for caddyfile
-	case len(dst.Bytes()) > 0:
-		return newLoader(dst.Bytes(), path.Join(c.KeyPrefix, "caddyfile"), servertype)
+	case len(body) > 0:
+		return loadFromEtcd(ctx, c, cli, v, body, p, sites, servertype)
 	// fall back to the data in the read from the configured caddyfile, save to etcd for other cluster members
 	case len(c.CaddyFile) > 0:
-		p := path.Join(c.KeyPrefix, "caddyfile")
+		// refuse to start or share a broken caddyfile with the rest of the cluster
+		if err := ValidateCaddyfile(c.CaddyFile, c.CaddyFilePath, servertype); err != nil {
+			return nil, err
+		}
+		// an unsigned caddyfile would be refused by the rest of the cluster, so only use it on this instance
+		if len(c.TrustedKeys) > 0 {
+			// the unsigned bootstrap caddyfile must not silently replace the signed caddyfile in etcd
+			if len(replaced) > 0 {
+				c.log(LevelError, "signatures are required, unable to publish unsigned bootstrap caddyfile, loading caddyfile from etcd", F("path", c.CaddyFilePath), F(FieldKey, replacedPath), F("policy", c.BootstrapPolicy))
+				return loadFromEtcd(ctx, c, cli, v, replaced, replacedPath, replacedSites, servertype)
+			}
+			c.log(LevelWarn, "signatures are required, not publishing unsigned bootstrap caddyfile to etcd", F("path", c.CaddyFilePath))
+			return newInstanceLoader(ctx, c, cli, v, c.CaddyFile, c.CaddyFilePath, sites, servertype)
+		}
 		srv := NewService(c)
-		if err := srv.Lock("caddyfile"); err != nil {
+		key := caddyfileKey(servertype)
+		if err := srv.Lock(key); err != nil {
+			// the bootstrap caddyfile would be served as if it were the current caddyfile without being published,
+			// so keep the caddyfile that is in etcd
+			if len(replaced) > 0 {
+				c.log(LevelWarn, "unable to lock caddyfile to publish bootstrap caddyfile, loading caddyfile from etcd", F(FieldKey, key), F("path", c.CaddyFilePath), F(FieldError, err))
+				return loadFromEtcd(ctx, c, cli, v, replaced, replacedPath, replacedSites, servertype)
+			}
 			// cant get lock, might be race by other clustered etcd instances saving a caddyfile so give up saving it
 			// and assume that it should start with the existing configured caddyfile
-			return newLoader(c.CaddyFile, c.CaddyFilePath, servertype)
+			c.log(LevelWarn, "unable to lock caddyfile, loading bootstrap caddyfile without publishing it to etcd", F(FieldKey, key), F("path", c.CaddyFilePath), F("sha1", sha1.Sum(c.CaddyFile)), F(FieldError, err))
+			return newInstanceLoader(ctx, c, cli, v, c.CaddyFile, c.CaddyFilePath, sites, servertype)
+		}
+		defer srv.Unlock(key)
+		if err := ctx.Err(); err != nil {
+			return nil, errors.Wrap(err, "caddyfile loader: not publishing bootstrap caddyfile")
 		}
-		defer srv.Unlock("caddyfile")
-		if err := pipeline(tx(set(cli, p, c.CaddyFile)), nil, backoff.NewExponentialBackOff()); err != nil {
+		r, err := NewHistory(c, servertype).commit(c.CaddyFile, nil, bootstrapAuthor(c), 0)
+		if err != nil {
 			return nil, errors.Wrap(err, "caddyfile loader: unable to store caddyfile data in etcd")
 		}
-		return newLoader(c.CaddyFile, c.CaddyFilePath, servertype)
+		c.log(LevelInfo, "loading bootstrap caddyfile, published to etcd", F("path", c.CaddyFilePath), F("sha1", r.Hash), F("revision", r.ID))
+		return newInstanceLoader(ctx, c, cli, v, c.CaddyFile, c.CaddyFilePath, sites, servertype)
 	// pass to the next caddyfile loader
 	default:
 		return nil, nil
@@ -59,18 +196,283 @@ func Load(servertype string) (caddy.Input, error) {
 
 }
 
+// loadFromEtcd builds the Caddyfile for this instance from body, the Caddyfile stored in etcd at key p
+func loadFromEtcd(ctx context.Context, c *ClusterConfig, cli client.KeysAPI, v *verifier, body []byte, p string, sites string, servertype string) (caddy.Input, error) {
+	c.log(LevelInfo, "loading caddyfile from etcd", F(FieldKey, p), F("sha1", sha1.Sum(body)))
+	body, err := expandImports(ctx, c, cli, body, p, v)
+	if err != nil {
+		return nil, errors.Wrap(err, "caddyfile loader: unable to resolve imports")
+	}
+	return newInstanceLoader(ctx, c, cli, v, body, p, sites, servertype)
+}
+
+// resolveBootstrap applies the bootstrap policy when a bootstrap Caddyfile is configured and etcd already has a
+// Caddyfile at p.  It returns true if the bootstrap Caddyfile should be loaded and published instead.
+func resolveBootstrap(c *ClusterConfig, p string, body []byte) (bool, error) {
+	etcdHash, diskHash := sha1.Sum(body), sha1.Sum(c.CaddyFile)
+	if etcdHash == diskHash {
+		return false, nil
+	}
+	switch c.BootstrapPolicy {
+	case PreferDiskAndPublish:
+		c.log(LevelWarn, "bootstrap caddyfile differs from caddyfile in etcd, using bootstrap caddyfile", F("path", c.CaddyFilePath), F("sha1", diskHash), F(FieldKey, p), F("etcd_sha1", etcdHash), F("policy", c.BootstrapPolicy))
+		return true, nil
+	case FailOnDivergence:
+		return false, DivergentCaddyfile{EtcdKey: p, EtcdHash: etcdHash, DiskPath: c.CaddyFilePath, DiskHash: diskHash}
+	default:
+		c.log(LevelWarn, "bootstrap caddyfile differs from caddyfile in etcd, using caddyfile in etcd", F("path", c.CaddyFilePath), F("sha1", diskHash), F(FieldKey, p), F("etcd_sha1", etcdHash), F("policy", PreferEtcd))
+		return false, nil
+	}
+}
+
+// loadCaddyfile returns the Caddyfile stored at key p, or nil if there is none, after verifying its signature
+func loadCaddyfile(ctx context.Context, cli client.KeysAPI, v *verifier, p string) ([]byte, error) {
+	dst := new(bytes.Buffer)
+	load := func() error {
+		dst.Reset()
+		if err := backoff.Retry(get(cli, p, dst), backoff.WithContext(backoff.NewExponentialBackOff(), ctx)); err != nil {
+			return backoff.Permanent(errors.Wrap(err, "caddyfile loader: unable to load caddyfile from etcd"))
+		}
+		if dst.Len() == 0 {
+			return nil
+		}
+		return v.verify(ctx, p, dst.Bytes())
+	}
+	// the caddyfile and its signature are separate keys, so a publish in progress can briefly leave them
+	// mismatched; retry a few times before refusing the caddyfile
+	if err := backoff.Retry(load, backoff.WithContext(backoff.WithMaxRetries(backoff.NewConstantBackOff(time.Second), 3), ctx)); err != nil {
+		return nil, err
+	}
+	return dst.Bytes(), nil
+}
+
+// newInstanceLoader builds the Caddyfile for this instance from body and the per-site keys under sites, keeping only
+// the site blocks whose selectors match the instance labels.  Each per-site key is preceded by a comment
+// with its etcd key so that errors reported at a line number can be traced back to it.  Per-site keys must carry
+// a valid signature when signatures are required.  Reading from etcd stops when ctx is done.
+func newInstanceLoader(ctx context.Context, c *ClusterConfig, cli client.KeysAPI, v *verifier, body []byte, p string, sites string, servertype string) (caddy.Input, error) {
+	body, err := selectSites(c, body, p)
+	if err != nil {
+		return nil, errors.Wrap(err, "caddyfile loader: unable to select sites")
+	}
+	nodes, err := listContext(ctx, cli, sites)
+	if err != nil {
+		return nil, errors.Wrap(err, "caddyfile loader: unable to list sites")
+	}
+	nodes = filter(nodes, FilterRemoveDirectories())
+	// the legacy directory holds the per-site directories of every server type, which are not legacy sites
+	if sites == path.Join(c.KeyPrefix, legacySitesDir) {
+		nodes = filter(nodes, FilterExactPrefix(sites, ""))
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Key < nodes[j].Key })
+	// the sites are appended to body, so they can import the snippets defined in it or in the sites before them
+	imp := newImporter(ctx, c, cli, v)
+	imp.define(body)
+	buf := bytes.NewBuffer(body)
+	for _, n := range nodes {
+		if isSignature(n.Key) {
+			continue
+		}
+		site, err := base64.StdEncoding.DecodeString(n.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "caddyfile loader: unable to decode site %s", n.Key)
+		}
+		if err := v.verify(ctx, n.Key, site); err != nil {
+			return nil, err
+		}
+		site, err = imp.expand(site, n.Key, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "caddyfile loader: unable to resolve imports")
+		}
+		site, err = selectSites(c, site, n.Key)
+		if err != nil {
+			return nil, errors.Wrap(err, "caddyfile loader: unable to select sites")
+		}
+		fmt.Fprintf(buf, "\n# %s\n%s", n.Key, site)
+	}
+	body, err = NewSecrets(c).resolve(ctx, cli, buf.Bytes(), p)
+	if err != nil {
+		return nil, errors.Wrap(err, "caddyfile loader")
+	}
+	return loader{body: body, path: p, servertype: servertype, unresolved: buf.Bytes()}, nil
+}
+
+// loadFallback returns the cached Caddyfile for servertype, or the bootstrap Caddyfile if there is no cache, when
+// etcd cannot be reached.  Secrets in either Caddyfile are resolved until ctx is done, and a Caddyfile whose secrets
+// cannot be resolved is an error rather than a reason to start with its placeholders.
+func loadFallback(ctx context.Context, c *ClusterConfig, servertype string, cause error) (caddy.Input, error) {
+	cf, err := readCache(c, servertype)
+	if err == nil && cf.Unresolved {
+		// a cache that cannot be used is an error, not a reason to start from the older bootstrap caddyfile
+		if cf, err = resolveCache(ctx, c, cf); err != nil {
+			return nil, errors.Wrapf(err, "caddyfile loader: unable to load caddyfile from etcd (%s)", cause)
+		}
+	}
+	switch {
+	case err == nil:
+		setFallback(servertype, "cache")
+		c.log(LevelWarn, "unable to load caddyfile from etcd, starting from last known good caddyfile", F(FieldKey, cf.Path), F("sha1", cf.Hash), F("loaded", cf.Timestamp), F(FieldError, cause))
+		return loader{body: cf.Body, path: cf.Path, servertype: servertype, fallback: true}, nil
+	case len(c.CaddyFile) > 0:
+		body, berr := resolveBootstrapFallback(ctx, c, servertype)
+		if berr != nil {
+			return nil, errors.Wrapf(berr, "caddyfile loader: unable to load caddyfile from etcd (%s) and no cached caddyfile is available (%s)", cause, err)
+		}
+		setFallback(servertype, "bootstrap")
+		c.log(LevelWarn, "unable to load caddyfile from etcd and no cached caddyfile is available, starting from bootstrap caddyfile", F("path", c.CaddyFilePath), F("sha1", sha1.Sum(c.CaddyFile)), F(FieldError, cause), F("cache_error", err))
+		return loader{body: body, path: c.CaddyFilePath, servertype: servertype, fallback: true}, nil
+	default:
+		return nil, errors.Wrapf(cause, "caddyfile loader: unable to load caddyfile from etcd and no cached caddyfile is available (%s)", err)
+	}
+}
+
+// resolveBootstrapFallback validates the bootstrap Caddyfile and resolves its secrets, the same as when it is
+// published, so that it is never started from with placeholders in place of its secrets
+func resolveBootstrapFallback(ctx context.Context, c *ClusterConfig, servertype string) ([]byte, error) {
+	if err := ValidateCaddyfile(c.CaddyFile, c.CaddyFilePath, servertype); err != nil {
+		return nil, err
+	}
+	if !secretPlaceholder.Match(c.CaddyFile) {
+		return c.CaddyFile, nil
+	}
+	cli, err := getClient(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get etcd client")
+	}
+	return NewSecrets(c).resolve(ctx, cli, c.CaddyFile, c.CaddyFilePath)
+}
+
+// reloadFromEtcd is an event hook that watches instances started from a fallback Caddyfile and restarts them with
+// the Caddyfile from etcd as soon as it can be loaded
+func reloadFromEtcd(event caddy.EventName, info interface{}) error {
+	if event != caddy.InstanceStartupEvent {
+		return nil
+	}
+	inst, ok := info.(*caddy.Instance)
+	if !ok {
+		return nil
+	}
+	l, ok := inst.Caddyfile().(loader)
+	if !ok || !l.fallback {
+		return nil
+	}
+	go func() {
+		c, err := NewClusterConfig(ConfigOptsFromEnvironment()...)
+		if err != nil {
+			c.log(LevelError, "unable to replace fallback caddyfile", F(FieldKey, l.path), F(FieldError, err))
+			return
+		}
+		var input caddy.Input
+		reload := func() error {
+			in, err := load(context.Background(), c, l.servertype)
+			switch {
+			case err != nil && !unavailable(err):
+				return backoff.Permanent(err)
+			case err != nil:
+				return err
+			case in == nil:
+				return backoff.Permanent(errors.New("etcd has no caddyfile"))
+			}
+			var unresolved []byte
+			if l, ok := in.(loader); ok {
+				unresolved = l.unresolved
+			}
+			if err := writeCache(c, l.servertype, in.Path(), in.Body(), unresolved); err != nil {
+				c.log(LevelWarn, "unable to cache caddyfile", F(FieldKey, in.Path()), F(FieldError, err))
+			}
+			input = in
+			return nil
+		}
+		b := backoff.NewExponentialBackOff()
+		b.MaxInterval = time.Minute
+		b.MaxElapsedTime = 0
+		attempt := 0
+		notify := func(err error, d time.Duration) {
+			attempt++
+			c.log(LevelWarn, "still running fallback caddyfile, retrying etcd", F(FieldKey, l.path), F(FieldAttempt, attempt), F("wait", d), F(FieldError, err))
+		}
+		if err := backoff.RetryNotify(reload, b, notify); err != nil {
+			c.log(LevelError, "unable to replace fallback caddyfile", F(FieldKey, l.path), F(FieldError, err))
+			return
+		}
+		c.log(LevelInfo, "etcd is reachable, replacing fallback caddyfile", F(FieldKey, input.Path()), F("fallback", l.path))
+		if _, err := inst.Restart(input); err != nil {
+			c.log(LevelError, "unable to reload caddyfile from etcd", F(FieldKey, input.Path()), F(FieldError, err))
+			return
+		}
+		setFallback(l.servertype, "")
+	}()
+	return nil
+}
+
+// fallbacks holds the source of the fallback Caddyfile, cache or bootstrap, of each server type that is running
+// one, for health checks
+var fallbacks = struct {
+	sync.Mutex
+	byServerType map[string]string
+}{byServerType: make(map[string]string)}
+
+// setFallback records that servertype is running a fallback Caddyfile from source, or clears it when source is
+// empty
+func setFallback(servertype string, source string) {
+	fallbacks.Lock()
+	defer fallbacks.Unlock()
+	if len(source) == 0 {
+		delete(fallbacks.byServerType, servertype)
+		return
+	}
+	fallbacks.byServerType[servertype] = source
+}
+
+// runningFallbacks returns the source of the fallback Caddyfile of each server type that is running one
+func runningFallbacks() map[string]string {
+	fallbacks.Lock()
+	defer fallbacks.Unlock()
+	out := make(map[string]string, len(fallbacks.byServerType))
+	for k, v := range fallbacks.byServerType {
+		out[k] = v
+	}
+	return out
+}
+
+// caddyfileKey returns the key of the Caddyfile for servertype, relative to the key prefix.  Caddyfiles are kept
+// under caddyfiles/ rather than caddyfile/ because etcd v2 cannot hold the legacy caddyfile key and a directory of
+// the same name, and both have to exist while instances are upgraded.
+func caddyfileKey(servertype string) string {
+	return path.Join(caddyfilesDir, servertype)
+}
+
+// caddyfilesDir holds one Caddyfile per server type, relative to the key prefix
+const caddyfilesDir = "caddyfiles"
+
+// legacyCaddyfileKey is the single Caddyfile key shared by every server type in earlier versions
+const legacyCaddyfileKey = "caddyfile"
+
+// legacySitesDir holds the per-site keys of the legacy Caddyfile, relative to the key prefix
+const legacySitesDir = "sites"
+
+// sitesKey returns the directory of per-site keys for servertype, relative to the key prefix
+func sitesKey(servertype string) string {
+	return path.Join(legacySitesDir, servertype)
+}
+
+// bootstrapAuthor records which instance published the bootstrap Caddyfile in the revision history
+func bootstrapAuthor(c *ClusterConfig) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("bootstrap:%s:%s", host, c.CaddyFilePath)
+}
+
 type loader struct {
 	body       []byte
 	path       string
 	servertype string
-}
-
-func newLoader(body []byte, path string, servertype string) (caddy.Input, error) {
-	return loader{
-		body:       body,
-		path:       path,
-		servertype: servertype,
-	}, nil
+	// fallback is set when the Caddyfile did not come from etcd because etcd was unavailable
+	fallback bool
+	// unresolved is body before secrets were substituted, which is cached instead of body when it has secrets
+	unresolved []byte
 }
 
 func (l loader) Body() []byte {
@@ -2,12 +2,17 @@ package etcd
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"os"
 	"path"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/client"
+	"golang.org/x/crypto/ed25519"
 )
 
 func TestLoad(t *testing.T) {
@@ -26,17 +31,26 @@ func TestLoad(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	if err := os.Setenv("CADDY_CLUSTERING_ETCD_CACHE_DIR", "disable"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("CADDY_CLUSTERING_ETCD_CACHE_DIR")
 	type testFunc func() error
-	setCF := func(val []byte) testFunc {
+	legacy := path.Join(cfg.KeyPrefix, legacyCaddyfileKey)
+	setCF := func(key string, val []byte) testFunc {
 		return func() error {
-			return set(cliL, path.Join(cfg.KeyPrefix, "caddyfile"), val)()
+			return set(cliL, path.Join(cfg.KeyPrefix, key), val)()
 		}
 	}
 	reset := func() error {
 		if err := os.Unsetenv("CADDY_CLUSTERING_ETCD_CADDYFILE"); err != nil {
 			return err
 		}
-		del(cliL, path.Join(cfg.KeyPrefix, "caddyfile"))()
+		if err := os.Unsetenv("CADDY_CLUSTERING_ETCD_BOOTSTRAP_POLICY"); err != nil {
+			return err
+		}
+		del(cliL, legacy)()
+		_, _ = cliL.Delete(context.Background(), path.Join(cfg.KeyPrefix, caddyfilesDir), &client.DeleteOptions{Recursive: true})
 		return nil
 	}
 	createCF := func(val []byte) testFunc {
@@ -56,18 +70,34 @@ func TestLoad(t *testing.T) {
 			return nil
 		}
 	}
+	policy := func(p BootstrapPolicy) testFunc {
+		return func() error {
+			return os.Setenv("CADDY_CLUSTERING_ETCD_BOOTSTRAP_POLICY", string(p))
+		}
+	}
 	disableLoad := func() error {
 		return os.Setenv("CADDY_CLUSTERING_ETCD_CADDYFILE_LOADER", "disable")
 	}
 	tcs := []struct {
-		Name   string
-		Funcs  []testFunc
-		Expect []byte
+		Name       string
+		ServerType string
+		Funcs      []testFunc
+		Key        string
+		Expect     []byte
+		ShouldErr  bool
 	}{
-		{Name: "from etcd", Funcs: []testFunc{setCF(cf1)}, Expect: cf1},
-		{Name: "from file", Funcs: []testFunc{createCF(cf1)}, Expect: cf1},
-		{Name: "prefer etcd over file", Funcs: []testFunc{setCF(cf1), createCF(cf2)}, Expect: cf1},
-		{Name: "disable", Funcs: []testFunc{disableLoad}, Expect: nil},
+		{Name: "from etcd", ServerType: "http", Funcs: []testFunc{setCF(caddyfileKey("http"), cf1)}, Key: caddyfileKey("http"), Expect: cf1},
+		{Name: "from legacy etcd", ServerType: "http", Funcs: []testFunc{setCF(legacyCaddyfileKey, cf1)}, Key: legacyCaddyfileKey, Expect: cf1},
+		{Name: "prefer server type over legacy", ServerType: "http", Funcs: []testFunc{setCF(legacyCaddyfileKey, cf2), setCF(caddyfileKey("http"), cf1)}, Key: caddyfileKey("http"), Expect: cf1},
+		{Name: "legacy only for http", ServerType: "dns", Funcs: []testFunc{setCF(legacyCaddyfileKey, cf1)}, Key: caddyfileKey("dns"), Expect: nil},
+		{Name: "from file", ServerType: "http", Funcs: []testFunc{createCF(cf1)}, Key: caddyfileKey("http"), Expect: cf1},
+		{Name: "from file for server type", ServerType: "dns", Funcs: []testFunc{setCF(caddyfileKey("http"), cf2), createCF(cf1)}, Key: caddyfileKey("dns"), Expect: cf1},
+		{Name: "prefer etcd over file", ServerType: "http", Funcs: []testFunc{setCF(legacyCaddyfileKey, cf1), createCF(cf2)}, Key: legacyCaddyfileKey, Expect: cf1},
+		{Name: "prefer disk and publish", ServerType: "http", Funcs: []testFunc{setCF(caddyfileKey("http"), cf1), createCF(cf2), policy(PreferDiskAndPublish)}, Key: caddyfileKey("http"), Expect: cf2},
+		{Name: "prefer disk over legacy", ServerType: "http", Funcs: []testFunc{setCF(legacyCaddyfileKey, cf1), createCF(cf2), policy(PreferDiskAndPublish)}, Key: caddyfileKey("http"), Expect: cf2},
+		{Name: "fail on divergence", ServerType: "http", Funcs: []testFunc{setCF(caddyfileKey("http"), cf1), createCF(cf2), policy(FailOnDivergence)}, Key: caddyfileKey("http"), Expect: cf1, ShouldErr: true},
+		{Name: "same caddyfile does not diverge", ServerType: "http", Funcs: []testFunc{setCF(caddyfileKey("http"), cf1), createCF(cf1), policy(FailOnDivergence)}, Key: caddyfileKey("http"), Expect: cf1},
+		{Name: "disable", ServerType: "http", Funcs: []testFunc{disableLoad}, Key: caddyfileKey("http"), Expect: nil},
 	}
 	for _, tc := range tcs {
 		t.Run(tc.Name, func(t *testing.T) {
@@ -80,18 +110,22 @@ func TestLoad(t *testing.T) {
 				}
 			}
 
-			l, err := Load("http")
-			assert.NoError(t, err)
-			switch tc.Expect {
-			case nil:
+			l, err := Load(tc.ServerType)
+			switch {
+			case tc.ShouldErr:
+				assert.True(t, IsDivergentCaddyfileError(errors.Cause(err)))
+				assert.Nil(t, l)
+			case tc.Expect == nil:
+				assert.NoError(t, err)
 				assert.Nil(t, l)
 			default:
+				assert.NoError(t, err)
 				assert.Equal(t, tc.Expect, l.Body())
 			}
 
 			// check etcd persists caddyfile
 			var actualEtcd bytes.Buffer
-			if err := get(cliL, path.Join(cfg.KeyPrefix, "caddyfile"), &actualEtcd)(); err != nil {
+			if err := get(cliL, path.Join(cfg.KeyPrefix, tc.Key), &actualEtcd)(); err != nil {
 				t.Fatal(err)
 			}
 			assert.Equal(t, tc.Expect, actualEtcd.Bytes())
@@ -99,3 +133,166 @@ func TestLoad(t *testing.T) {
 
 	}
 }
+
+func TestLoadSignedBootstrap(t *testing.T) {
+	cfg, cli, done := testPrefix(t, "signedbootstrap")
+	defer done()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf1 := []byte("cf1.cluster.local {\n\tproxy / test:123\n}")
+	cf2 := []byte("cf2.cluster.local {\n\tproxy / test:123\n}")
+	p := path.Join(cfg.KeyPrefix, caddyfileKey("http"))
+	tcs := []struct {
+		Name   string
+		Etcd   []byte
+		Expect []byte
+	}{
+		{Name: "keeps signed caddyfile in etcd", Etcd: cf1, Expect: cf1},
+		{Name: "same caddyfile", Etcd: cf2, Expect: cf2},
+		{Name: "bootstrap without caddyfile in etcd", Etcd: nil, Expect: cf2},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			_, _ = cli.Delete(context.Background(), cfg.KeyPrefix, &client.DeleteOptions{Recursive: true})
+			cfg.TrustedKeys = nil
+			if tc.Etcd != nil {
+				if _, err := NewHistory(cfg, "http").PublishSigned(tc.Etcd, Sign(priv, caddyfileKey("http"), tc.Etcd), "test"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg.TrustedKeys = []ed25519.PublicKey{pub}
+			cfg.CaddyFile, cfg.CaddyFilePath, cfg.BootstrapPolicy = cf2, "Caddyfile", PreferDiskAndPublish
+
+			l, err := load(context.Background(), cfg, "http")
+			assert.NoError(t, err)
+			if assert.NotNil(t, l) {
+				assert.Equal(t, tc.Expect, l.Body())
+			}
+
+			// the unsigned bootstrap caddyfile is never published
+			var actualEtcd bytes.Buffer
+			if err := get(cli, p, &actualEtcd)(); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tc.Etcd, actualEtcd.Bytes())
+		})
+	}
+}
+
+func TestLoadContext(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ClusterConfig{
+		KeyPrefix:     "/caddy",
+		SecretsPrefix: "/caddy-secrets",
+		ServerIP:      []string{"http://127.0.0.1:1"},
+		TrustedKeys:   []ed25519.PublicKey{pub},
+	}
+	cli, err := getClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := newVerifier(cfg, cli)
+	p := path.Join(cfg.KeyPrefix, caddyfileKey("http"))
+	tcs := []struct {
+		Name string
+		Load func(ctx context.Context) error
+	}{
+		{Name: "sites", Load: func(ctx context.Context) error {
+			_, err := newInstanceLoader(ctx, cfg, cli, v, []byte("example.com"), p, path.Join(cfg.KeyPrefix, sitesKey("http")), "http")
+			return err
+		}},
+		{Name: "imports", Load: func(ctx context.Context) error {
+			_, err := expandImports(ctx, cfg, cli, []byte("import snippets/*"), p, v)
+			return err
+		}},
+		{Name: "secrets", Load: func(ctx context.Context) error {
+			_, err := NewSecrets(cfg).resolve(ctx, cli, []byte("basicauth / admin {etcd.secret:password}"), p)
+			return err
+		}},
+		{Name: "signature", Load: func(ctx context.Context) error {
+			return v.verify(ctx, p, []byte("example.com"))
+		}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			assert.Error(t, tc.Load(ctx))
+			assert.True(t, time.Since(start) < 5*time.Second)
+		})
+	}
+}
+
+func TestLoadSites(t *testing.T) {
+	if !shouldRunIntegration() {
+		t.Skip("no etcd server found, skipping")
+	}
+	cfg := &ClusterConfig{
+		KeyPrefix: "/caddy",
+		ServerIP:  []string{"http://127.0.0.1:2379"},
+	}
+	cliL, err := getClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf := []byte("cf.cluster.local {\n\tproxy / test:123\n}\n")
+	eu := []byte("# etcd.selector: region=eu\neu.cluster.local {\n\tproxy / test:123\n}\n")
+	us := []byte("# etcd.selector: region=us\nus.cluster.local {\n\tproxy / test:123\n}\n")
+	assert.NoError(t, set(cliL, path.Join(cfg.KeyPrefix, legacyCaddyfileKey), cf)())
+	assert.NoError(t, set(cliL, path.Join(cfg.KeyPrefix, "sites", "eu"), eu)())
+	assert.NoError(t, set(cliL, path.Join(cfg.KeyPrefix, "sites", "us"), us)())
+	defer func() {
+		_, _ = cliL.Delete(context.Background(), path.Join(cfg.KeyPrefix, "sites"), &client.DeleteOptions{Recursive: true})
+		_ = del(cliL, path.Join(cfg.KeyPrefix, legacyCaddyfileKey))()
+	}()
+	if err := os.Unsetenv("CADDY_CLUSTERING_ETCD_CADDYFILE_LOADER"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Setenv("CADDY_CLUSTERING_ETCD_LABELS", "region=eu"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("CADDY_CLUSTERING_ETCD_LABELS")
+	if err := os.Setenv("CADDY_CLUSTERING_ETCD_CACHE_DIR", "disable"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("CADDY_CLUSTERING_ETCD_CACHE_DIR")
+
+	l, err := Load("http")
+	if !assert.NoError(t, err) || !assert.NotNil(t, l) {
+		return
+	}
+	body := string(l.Body())
+	assert.Contains(t, body, "cf.cluster.local")
+	assert.Contains(t, body, "eu.cluster.local")
+	assert.Contains(t, body, "# /caddy/sites/eu")
+	assert.NotContains(t, body, "us.cluster.local")
+
+	// sites for other server types are kept under their own directory
+	assert.NoError(t, set(cliL, path.Join(cfg.KeyPrefix, caddyfileKey("dns")), []byte(". {\n\twhoami\n}\n"))())
+	assert.NoError(t, set(cliL, path.Join(cfg.KeyPrefix, sitesKey("dns"), "example"), []byte("example.com {\n\twhoami\n}\n"))())
+	defer func() {
+		_ = del(cliL, path.Join(cfg.KeyPrefix, caddyfileKey("dns")))()
+	}()
+	l, err = Load("dns")
+	if !assert.NoError(t, err) || !assert.NotNil(t, l) {
+		return
+	}
+	body = string(l.Body())
+	assert.Contains(t, body, "# /caddy/sites/dns/example")
+	assert.NotContains(t, body, "eu.cluster.local")
+
+	// the legacy caddyfile only gets the keys directly under sites/
+	l, err = Load("http")
+	if !assert.NoError(t, err) || !assert.NotNil(t, l) {
+		return
+	}
+	body = string(l.Body())
+	assert.Contains(t, body, "eu.cluster.local")
+	assert.NotContains(t, body, "example.com")
+}
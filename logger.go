@@ -0,0 +1,244 @@
+package etcd
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+const (
+	// LevelDebug logs every storage operation and retry
+	LevelDebug Level = iota - 1
+	// LevelInfo logs Caddyfile loads and other changes of state.  This is the default and the zero value.
+	LevelInfo
+	// LevelWarn logs problems the plugin recovered from
+	LevelWarn
+	// LevelError logs problems the plugin could not recover from
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// Names of the fields attached to log entries by the plugin
+const (
+	FieldOperation = "operation"
+	FieldKey       = "key"
+	FieldInstance  = "instance"
+	FieldAttempt   = "attempt"
+	FieldDuration  = "duration"
+	FieldError     = "error"
+)
+
+// Field is a named value attached to a log entry
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns a field with key and value
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Logger receives the log entries of the plugin.  Fields are redacted before they are passed to the logger, so
+// implementations do not have to handle secrets.  Implementations must be safe for concurrent use.
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+// LogFormat is the output format of the default logger
+type LogFormat string
+
+const (
+	// LogfmtFormat writes each entry as space separated key=value pairs.  This is the default.
+	LogfmtFormat LogFormat = "logfmt"
+	// JSONFormat writes each entry as a JSON object
+	JSONFormat LogFormat = "json"
+)
+
+// NewLogger returns the default logger, which writes each entry in format through the standard library logger so
+// that entries go to the same place as the rest of the Caddy log.  Every entry carries the host name as the
+// instance field.
+func NewLogger(format LogFormat) Logger {
+	host, _ := os.Hostname()
+	return stdLogger{format: format, instance: host}
+}
+
+type stdLogger struct {
+	format   LogFormat
+	instance string
+}
+
+func (l stdLogger) Log(level Level, msg string, fields ...Field) {
+	entry := []Field{F("level", level.String()), F("component", "etcd"), F("msg", msg)}
+	if len(l.instance) > 0 {
+		entry = append(entry, F(FieldInstance, l.instance))
+	}
+	entry = append(entry, fields...)
+	switch l.format {
+	case JSONFormat:
+		log.Print(encodeJSON(entry))
+	default:
+		log.Print(encodeLogfmt(entry))
+	}
+}
+
+func encodeLogfmt(fields []Field) string {
+	var b bytes.Buffer
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(f.Key)
+		b.WriteByte('=')
+		v := formatValue(f.Value)
+		switch {
+		case len(v) == 0, strings.ContainsAny(v, " =\"\\"), strings.IndexFunc(v, notPrintable) >= 0:
+			b.WriteString(strconv.Quote(v))
+		default:
+			b.WriteString(v)
+		}
+	}
+	return b.String()
+}
+
+func notPrintable(r rune) bool {
+	return !strconv.IsPrint(r)
+}
+
+// encodeJSON writes fields as a JSON object in the order they were given.  Numbers and booleans keep their type
+// and everything else is written as a string.
+func encodeJSON(fields []Field) string {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(f.Key)
+		b.Write(k)
+		b.WriteByte(':')
+		var v []byte
+		switch f.Value.(type) {
+		case int, int64, uint64, float64, bool:
+			v, _ = json.Marshal(f.Value)
+		default:
+			v, _ = json.Marshal(formatValue(f.Value))
+		}
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case error:
+		return t.Error()
+	case time.Duration:
+		return t.String()
+	case time.Time:
+		return t.Format(time.RFC3339)
+	case [20]byte:
+		return fmt.Sprintf("%x", t)
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// redacted replaces sensitive values in log entries
+const redacted = "[REDACTED]"
+
+// sensitiveFields are fields whose values are never logged
+var sensitiveFields = map[string]bool{
+	"value":         true,
+	"body":          true,
+	"secret":        true,
+	"password":      true,
+	"token":         true,
+	"credentials":   true,
+	"authorization": true,
+}
+
+var (
+	// privateKeyPath matches storage keys of private keys, such as the site and account keys stored by certmagic
+	privateKeyPath = regexp.MustCompile(`[^\s"'()\[\]]*\.key\b`)
+	// compareFailed matches the values etcd reports when a compare and swap fails
+	compareFailed = regexp.MustCompile(`\[[^\]]* != [^\]]*\]`)
+)
+
+// redact returns a copy of fields and msg with values and credentials removed.  When keys is true, storage keys of
+// private keys are replaced by a short hash so that entries about the same key can still be correlated.
+func redact(msg string, fields []Field, keys bool) (string, []Field) {
+	out := make([]Field, 0, len(fields))
+	for _, f := range fields {
+		switch v := f.Value.(type) {
+		case []byte:
+			f.Value = redacted
+		case string:
+			f.Value = redactString(v, keys)
+		case error:
+			f.Value = redactString(v.Error(), keys)
+		}
+		if sensitiveFields[strings.ToLower(f.Key)] {
+			f.Value = redacted
+		}
+		out = append(out, f)
+	}
+	return redactString(msg, keys), out
+}
+
+func redactString(s string, keys bool) string {
+	s = compareFailed.ReplaceAllString(s, redacted)
+	if keys {
+		s = privateKeyPath.ReplaceAllStringFunc(s, func(k string) string {
+			h := sha1.Sum([]byte(k))
+			return fmt.Sprintf("[REDACTED:%x]", h[:4])
+		})
+	}
+	return s
+}
+
+// defaultLogger is used when there is no configuration to take a logger from
+var defaultLogger = NewLogger(LogfmtFormat)
+
+// log sends an entry to the configured logger if level is at or above the configured level, after redacting it
+func (c *ClusterConfig) log(level Level, msg string, fields ...Field) {
+	l, min, keys := defaultLogger, LevelInfo, false
+	if c != nil {
+		min, keys = c.LogLevel, c.RedactKeyNames
+		if c.Logger != nil {
+			l = c.Logger
+		}
+	}
+	if level < min {
+		return
+	}
+	msg, fields = redact(msg, fields, keys)
+	l.Log(level, msg, fields...)
+}
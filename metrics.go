@@ -0,0 +1,243 @@
+package etcd
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.etcd.io/etcd/client"
+)
+
+// Registry holds the Prometheus collectors of the plugin.  The same collectors are registered with the Prometheus
+// default registerer so that Caddy plugins serving it also expose them.
+var Registry = prometheus.NewRegistry()
+
+var (
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "caddy",
+		Subsystem: "etcd",
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of storage operations, including retries.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"operation"})
+	operationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "etcd",
+		Name:      "operation_errors_total",
+		Help:      "Storage operations that returned an error, by error type.",
+	}, []string{"operation", "type"})
+	retryCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "etcd",
+		Name:      "retries_total",
+		Help:      "etcd requests retried after a failed attempt.",
+	}, []string{"operation"})
+	rollbackCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "etcd",
+		Name:      "rollbacks_total",
+		Help:      "Transactions that failed part way and were rolled back.",
+	}, []string{"operation"})
+	rollbackFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "etcd",
+		Name:      "rollback_failures_total",
+		Help:      "Rollback steps that failed, leaving a transaction partly applied.",
+	}, []string{"operation"})
+	lockWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "caddy",
+		Subsystem: "etcd",
+		Name:      "lock_wait_seconds",
+		Help:      "Time spent waiting to acquire a lock.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+	lockHold = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "caddy",
+		Subsystem: "etcd",
+		Name:      "lock_hold_seconds",
+		Help:      "Time a lock was held before it was released.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+	checksumFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "etcd",
+		Name:      "checksum_failures_total",
+		Help:      "Loads whose value did not match the SHA1 hash in its metadata.",
+	})
+	fsckProblems = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "etcd",
+		Name:      "fsck_problems",
+		Help:      "Problems found by the last background scrub, by kind.",
+	}, []string{"kind"})
+	certificateExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "etcd",
+		Name:      "certificate_expiry_timestamp_seconds",
+		Help:      "Time each stored certificate expires, as of the last expiry check on the elected instance.",
+	}, []string{"domain", "ca"})
+	certificatesExpiring = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "etcd",
+		Name:      "certificates_expiring",
+		Help:      "Stored certificates within the expiry window at the last expiry check on the elected instance.",
+	})
+	expiryMonitorLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "etcd",
+		Name:      "expiry_monitor_leader",
+		Help:      "1 if this instance is elected to run the expiry monitor.",
+	})
+)
+
+func init() {
+	for _, c := range []prometheus.Collector{operationDuration, operationErrors, retryCount, rollbackCount, rollbackFailures, lockWait, lockHold, checksumFailures, fsckProblems, certificateExpiry, certificatesExpiring, expiryMonitorLeader} {
+		register(c)
+	}
+}
+
+// register adds c to the plugin registry and the default registerer
+func register(c prometheus.Collector) {
+	Registry.MustRegister(c)
+	if err := prometheus.DefaultRegisterer.Register(c); err != nil {
+		defaultLogger.Log(LevelWarn, "unable to register metrics with the default prometheus registry", F(FieldError, err))
+	}
+}
+
+// observe records the duration of a storage operation that started at start and the type of its error, if any
+func observe(op string, start time.Time, err *error) {
+	operationDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		operationErrors.WithLabelValues(op, errorType(*err)).Inc()
+	}
+}
+
+// errorType classifies an error for the type label of the error counter
+func errorType(err error) string {
+	switch e := errors.Cause(err).(type) {
+	case NotExist:
+		return "not_exist"
+	case FailedChecksum:
+		return "failed_checksum"
+	case client.Error:
+		return "etcd"
+	case *client.ClusterError:
+		return "unavailable"
+	default:
+		if e == context.DeadlineExceeded {
+			return "timeout"
+		}
+		return "other"
+	}
+}
+
+// locks records when each lock held by this process was acquired, to measure how long it is held
+var locks = struct {
+	sync.Mutex
+	acquired map[string]time.Time
+}{acquired: make(map[string]time.Time)}
+
+// lockHeld records that the lock at key was acquired at t.  Extending a lock that is already held keeps the
+// original time.
+func lockHeld(key string, t time.Time) {
+	locks.Lock()
+	defer locks.Unlock()
+	if _, ok := locks.acquired[key]; !ok {
+		locks.acquired[key] = t
+	}
+}
+
+// lockReleased observes how long the lock at key was held
+func lockReleased(key string) {
+	locks.Lock()
+	defer locks.Unlock()
+	if t, ok := locks.acquired[key]; ok {
+		lockHold.Observe(time.Since(t).Seconds())
+		delete(locks.acquired, key)
+	}
+}
+
+// storageCollector reports the number of keys and bytes stored under a key prefix each time metrics are collected.
+// Only keys with metadata are counted, and the nodes the plugin keeps for itself are not.
+type storageCollector struct {
+	cfg   *ClusterConfig
+	keys  *prometheus.Desc
+	bytes *prometheus.Desc
+}
+
+// storageCollectors tracks the prefixes that already have a collector registered
+var storageCollectors = struct {
+	sync.Mutex
+	prefixes map[string]bool
+}{prefixes: make(map[string]bool)}
+
+// registerStorageMetrics registers a storage collector for the key prefix of c, once per prefix
+func registerStorageMetrics(c *ClusterConfig) {
+	storageCollectors.Lock()
+	defer storageCollectors.Unlock()
+	if storageCollectors.prefixes[c.KeyPrefix] {
+		return
+	}
+	storageCollectors.prefixes[c.KeyPrefix] = true
+	labels := prometheus.Labels{"prefix": c.KeyPrefix}
+	register(storageCollector{
+		cfg:   c,
+		keys:  prometheus.NewDesc("caddy_etcd_keys", "Keys stored under the key prefix.", nil, labels),
+		bytes: prometheus.NewDesc("caddy_etcd_bytes", "Bytes of values stored under the key prefix.", nil, labels),
+	})
+}
+
+func (s storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.keys
+	ch <- s.bytes
+}
+
+func (s storageCollector) Collect(ch chan<- prometheus.Metric) {
+	keys, size, err := s.usage()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(s.keys, err)
+		ch <- prometheus.NewInvalidMetric(s.bytes, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(s.keys, prometheus.GaugeValue, float64(keys))
+	ch <- prometheus.MustNewConstMetric(s.bytes, prometheus.GaugeValue, float64(size))
+}
+
+// usage lists the metadata under the key prefix once, without retries, so that a scrape never waits on an
+// unavailable cluster.  Sizes are read from the metadata, so the values themselves, which may be large, are never
+// fetched.  A value without metadata is not counted.
+func (s storageCollector) usage() (keys int, size int, err error) {
+	cli, err := getClient(s.cfg)
+	if err != nil {
+		return 0, 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mdPrefix := path.Join(s.cfg.KeyPrefix, "md")
+	resp, err := cli.Get(ctx, mdPrefix, &client.GetOptions{Recursive: true})
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return 0, 0, nil
+		}
+		return 0, 0, errors.Wrap(err, "metrics: unable to list metadata")
+	}
+	var nodes []client.Node
+	walkNodes(resp.Node, &nodes)
+	for _, n := range nodes {
+		if n.Dir || isReserved(strings.TrimPrefix(n.Key, mdPrefix+"/")) {
+			continue
+		}
+		// metadata that cannot be decoded is reported by fsck, not here
+		var md Metadata
+		if err := unmarshalMD(&n, &md); err != nil {
+			continue
+		}
+		keys++
+		size += md.Size
+	}
+	return keys, size, nil
+}
@@ -0,0 +1,116 @@
+package etcd
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/client"
+)
+
+// gather returns the value of the metric name with the label values in labels from the plugin registry
+func gather(t *testing.T, name string, labels map[string]string) float64 {
+	families, err := Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if v, ok := labels[l.GetName()]; ok && v != l.GetValue() {
+					continue metrics
+				}
+			}
+			switch {
+			case m.GetCounter() != nil:
+				return m.GetCounter().GetValue()
+			case m.GetGauge() != nil:
+				return m.GetGauge().GetValue()
+			case m.GetHistogram() != nil:
+				return float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return 0
+}
+
+func TestErrorType(t *testing.T) {
+	tcs := []struct {
+		Name   string
+		Err    error
+		Expect string
+	}{
+		{Name: "not exist", Err: NotExist{"key"}, Expect: "not_exist"},
+		{Name: "wrapped checksum", Err: errors.Wrap(FailedChecksum{"key"}, "load"), Expect: "failed_checksum"},
+		{Name: "etcd", Err: errors.Wrap(client.Error{Code: client.ErrorCodeNodeExist}, "set"), Expect: "etcd"},
+		{Name: "unavailable", Err: &client.ClusterError{}, Expect: "unavailable"},
+		{Name: "timeout", Err: context.DeadlineExceeded, Expect: "timeout"},
+		{Name: "other", Err: errors.New("lock: failed to obtain lock, already exists"), Expect: "other"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			assert.Equal(t, tc.Expect, errorType(tc.Err))
+		})
+	}
+}
+
+func TestPipelineMetrics(t *testing.T) {
+	fail := func() error { return errors.New("fail") }
+	ok := func() error { return nil }
+	b := func() backoff.BackOff { return backoff.WithMaxRetries(backoff.NewConstantBackOff(0), 1) }
+	retries := gather(t, "caddy_etcd_retries_total", map[string]string{"operation": "metricstest"})
+	rollbacks := gather(t, "caddy_etcd_rollbacks_total", map[string]string{"operation": "metricstest"})
+	failures := gather(t, "caddy_etcd_rollback_failures_total", map[string]string{"operation": "metricstest"})
+
+	assert.Error(t, pipeline(&operation{name: "metricstest"}, tx(ok, fail), tx(ok, ok), b()))
+	assert.Equal(t, retries+1, gather(t, "caddy_etcd_retries_total", map[string]string{"operation": "metricstest"}))
+	assert.Equal(t, rollbacks+1, gather(t, "caddy_etcd_rollbacks_total", map[string]string{"operation": "metricstest"}))
+
+	assert.Error(t, pipeline(&operation{name: "metricstest"}, tx(ok, fail), tx(fail, ok), b()))
+	assert.Equal(t, failures+1, gather(t, "caddy_etcd_rollback_failures_total", map[string]string{"operation": "metricstest"}))
+}
+
+func TestStorageMetrics(t *testing.T) {
+	if !shouldRunIntegration() {
+		t.Skip("no etcd server found, skipping")
+	}
+	cfg := &ClusterConfig{
+		KeyPrefix:   "/testmetrics",
+		ServerIP:    []string{"http://127.0.0.1:2379"},
+		LockTimeout: time.Minute,
+	}
+	cli, err := getClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = cli.Delete(context.Background(), cfg.KeyPrefix, &client.DeleteOptions{Recursive: true})
+	registerStorageMetrics(cfg)
+	srv := NewService(cfg)
+	labels := map[string]string{"prefix": cfg.KeyPrefix}
+	stores := gather(t, "caddy_etcd_operation_duration_seconds", map[string]string{"operation": "store"})
+	holds := gather(t, "caddy_etcd_lock_hold_seconds", nil)
+
+	assert.NoError(t, srv.Lock("certs/one"))
+	assert.NoError(t, srv.Store("certs/one", []byte("12345")))
+	assert.NoError(t, srv.Store("certs/two", []byte("123")))
+	assert.NoError(t, srv.Unlock("certs/one"))
+	_, err = srv.Load("certs/three")
+	assert.True(t, IsNotExistError(err))
+	// a value without metadata is not counted
+	_, err = cli.Set(context.Background(), path.Join(cfg.KeyPrefix, "certs/bare"), "MTIzNDU2Nzg=", nil)
+	assert.NoError(t, err)
+
+	assert.Equal(t, float64(2), gather(t, "caddy_etcd_keys", labels))
+	assert.Equal(t, float64(8), gather(t, "caddy_etcd_bytes", labels))
+	assert.Equal(t, stores+2, gather(t, "caddy_etcd_operation_duration_seconds", map[string]string{"operation": "store"}))
+	assert.Equal(t, holds+1, gather(t, "caddy_etcd_lock_hold_seconds", nil))
+	assert.True(t, gather(t, "caddy_etcd_operation_errors_total", map[string]string{"operation": "load", "type": "not_exist"}) >= 1)
+}
@@ -0,0 +1,438 @@
+package etcd
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/client"
+)
+
+// Phases of a migration
+const (
+	// MigrateCopy copies every key of the source to the destination
+	MigrateCopy = "copy"
+	// MigrateFollow applies each change made to the source to the destination as it happens
+	MigrateFollow = "follow"
+)
+
+// migrateVerifyInterval is how often a migration that follows the source verifies the destination by default
+const migrateVerifyInterval = 30 * time.Second
+
+// MigrateOptions controls a migration
+type MigrateOptions struct {
+	// Overwrite allows migrating to a prefix that already holds keys, such as one left by an earlier migration that
+	// was stopped.  Keys that differ are overwritten and keys that are not in the source are deleted.
+	Overwrite bool
+	// Follow keeps applying changes made to the source until the context is done
+	Follow bool
+	// VerifyInterval is how often the destination is verified while following, 30s by default
+	VerifyInterval time.Duration
+	// Progress is called after each verification
+	Progress func(MigrationStatus)
+}
+
+// MigrationStatus reports the progress of a migration.  Index is the etcd index of the source that has been
+// applied to the destination.  Differences lists the keys whose values did not match at the last verification,
+// relative to the key prefix, or the full key of a secret, and InSync is set when there were none, which is when
+// instances can be repointed to the destination.
+type MigrationStatus struct {
+	Phase       string
+	Index       uint64
+	Copied      int
+	Deleted     int
+	Resyncs     int
+	Verified    time.Time
+	Keys        int
+	Differences []string
+	InSync      bool
+}
+
+// Migrate copies every key under the key prefix of src, except locks and the audit log, and every secret under its
+// secrets prefix to dst, which may be on another etcd cluster.  With opts.Follow set it then keeps applying changes
+// made to the source until ctx is done, so instances can be repointed one at a time.
+func Migrate(ctx context.Context, src *ClusterConfig, dst *ClusterConfig, opts MigrateOptions) (*MigrationStatus, error) {
+	namespaces, err := migrated(src, dst)
+	if err != nil {
+		return nil, err
+	}
+	if opts.VerifyInterval <= 0 {
+		opts.VerifyInterval = migrateVerifyInterval
+	}
+	m := &migration{src: src, dst: dst, namespaces: namespaces, opts: opts, status: &MigrationStatus{Phase: MigrateCopy}}
+	if m.srcCli, err = getClient(src); err != nil {
+		return nil, errors.Wrap(err, "migrate: failed to get source client")
+	}
+	if m.dstCli, err = getClient(dst); err != nil {
+		return nil, errors.Wrap(err, "migrate: failed to get destination client")
+	}
+	if err := m.copy(ctx, false); err != nil {
+		return m.status, err
+	}
+	audit(src, AuditMigrate, "", [20]byte{}, [20]byte{}, fmt.Sprintf("to %s%s", strings.Join(dst.ServerIP, ","), dst.KeyPrefix))
+	if err := m.verify(ctx); err != nil {
+		return m.status, err
+	}
+	if !opts.Follow {
+		return m.status, nil
+	}
+	watchCli, release, err := getWatchClient(src)
+	if err != nil {
+		return m.status, errors.Wrap(err, "migrate: failed to get watch client")
+	}
+	defer release()
+	m.watchCli = watchCli
+	m.status.Phase = MigrateFollow
+	return m.status, m.follow(ctx)
+}
+
+type migration struct {
+	src        *ClusterConfig
+	dst        *ClusterConfig
+	namespaces []namespace
+	srcCli     client.KeysAPI
+	dstCli     client.KeysAPI
+	// watchCli has connections of its own, since a watch cancelled when the migration ends can leave a shared
+	// connection unusable for later requests
+	watchCli client.KeysAPI
+	opts     MigrateOptions
+	status   *MigrationStatus
+}
+
+// namespace is a prefix of the source that is copied to a prefix of the destination.  Keys for which copied
+// returns false are left out on both sides.
+type namespace struct {
+	src    string
+	dst    string
+	copied func(key string) bool
+}
+
+// name returns the key reported for key of the namespace: relative to the key prefix, or the full key of a secret
+func (n namespace) name(key string, c *ClusterConfig) string {
+	if n.src == c.KeyPrefix {
+		return key
+	}
+	return path.Join(n.src, key)
+}
+
+// migrated returns the namespaces copied from src to dst: the key prefix, leaving out locks and the audit log,
+// and the secrets prefix.  Secrets are not copied when both use the same secrets prefix on the same etcd cluster.
+// A namespace of the source that holds one of the destination, or the other way around, is an error, since
+// following the source would follow the writes to the destination.
+func migrated(src *ClusterConfig, dst *ClusterConfig) ([]namespace, error) {
+	out := []namespace{{src: src.KeyPrefix, dst: dst.KeyPrefix, copied: backedUp}}
+	shared := sharesServer(src, dst)
+	if len(src.SecretsPrefix) > 0 && len(dst.SecretsPrefix) > 0 && !(shared && src.SecretsPrefix == dst.SecretsPrefix) {
+		out = append(out, namespace{src: src.SecretsPrefix, dst: dst.SecretsPrefix, copied: func(string) bool { return true }})
+	}
+	if !shared {
+		return out, nil
+	}
+	for _, a := range out {
+		for _, b := range out {
+			if nested(a.src, b.dst) {
+				return nil, errors.Errorf("migrate: %s and %s overlap on the same etcd cluster", a.src, b.dst)
+			}
+		}
+	}
+	return out, nil
+}
+
+// copy makes the destination a copy of the source at the current index of the source.  The first copy requires an
+// empty destination unless Overwrite is set, and deletes the keys that only the destination holds.  A resync while
+// following leaves those keys in place, since they may have been written to the destination by instances that
+// were already repointed, and verify reports them as differences instead.
+func (m *migration) copy(ctx context.Context, resync bool) error {
+	requireEmpty := !resync && !m.opts.Overwrite
+	values := make([]map[string]string, len(m.namespaces))
+	existing := make([]map[string]string, len(m.namespaces))
+	var index uint64
+	for i, ns := range m.namespaces {
+		v, idx, err := snapshot(ctx, m.srcCli, ns.src, ns.copied)
+		if err != nil {
+			return errors.Wrap(err, "migrate: failed to read source")
+		}
+		e, _, err := snapshot(ctx, m.dstCli, ns.dst, ns.copied)
+		if err != nil {
+			return errors.Wrap(err, "migrate: failed to read destination")
+		}
+		if requireEmpty && len(e) > 0 {
+			return errors.Errorf("migrate: %s already holds keys, use Overwrite to replace them", ns.dst)
+		}
+		// changes are followed from the oldest index read, since a change already copied is copied again harmlessly
+		if i == 0 || idx < index {
+			index = idx
+		}
+		values[i], existing[i] = v, e
+	}
+	count := 0
+	for i, ns := range m.namespaces {
+		var keys []string
+		for key := range values[i] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if v, ok := existing[i][key]; ok && v == values[i][key] {
+				continue
+			}
+			if err := m.set(ctx, path.Join(ns.dst, key), values[i][key]); err != nil {
+				return err
+			}
+		}
+		for key := range existing[i] {
+			if _, ok := values[i][key]; ok {
+				continue
+			}
+			if resync {
+				m.src.log(LevelWarn, "key is only in the destination, leaving it in place", F(FieldKey, path.Join(ns.dst, key)))
+				continue
+			}
+			if err := m.delete(ctx, path.Join(ns.dst, key), false); err != nil {
+				return err
+			}
+		}
+		count += len(values[i])
+	}
+	m.status.Index = index
+	m.src.log(LevelInfo, "copied key prefix", F("to", m.dst.KeyPrefix), F("keys", count), F("index", index))
+	return nil
+}
+
+// verify compares the hash of every value on both sides
+func (m *migration) verify(ctx context.Context) error {
+	var diff []string
+	count := 0
+	for _, ns := range m.namespaces {
+		values, _, err := snapshot(ctx, m.srcCli, ns.src, ns.copied)
+		if err != nil {
+			return errors.Wrap(err, "migrate: failed to read source")
+		}
+		copied, _, err := snapshot(ctx, m.dstCli, ns.dst, ns.copied)
+		if err != nil {
+			return errors.Wrap(err, "migrate: failed to read destination")
+		}
+		for key, v := range values {
+			c, ok := copied[key]
+			if !ok || sha256.Sum256([]byte(c)) != sha256.Sum256([]byte(v)) {
+				diff = append(diff, ns.name(key, m.src))
+			}
+		}
+		for key := range copied {
+			if _, ok := values[key]; !ok {
+				diff = append(diff, ns.name(key, m.src))
+			}
+		}
+		count += len(values)
+	}
+	sort.Strings(diff)
+	m.status.Verified = time.Now()
+	m.status.Keys = count
+	m.status.Differences = diff
+	m.status.InSync = len(diff) == 0
+	if m.opts.Progress != nil {
+		m.opts.Progress(*m.status)
+	}
+	return nil
+}
+
+// follow applies changes made to the source after the copy, verifying the destination every VerifyInterval.  Changes
+// are followed from the index the copy was read at, so none are missed, and the destination is copied again when the
+// source no longer holds that index.
+func (m *migration) follow(ctx context.Context) error {
+	ticker := time.NewTicker(m.opts.VerifyInterval)
+	defer ticker.Stop()
+	for {
+		resync, err := m.followFrom(ctx, ticker.C)
+		if err != nil || !resync {
+			return err
+		}
+		m.src.log(LevelWarn, "changes to follow were cleared from the source, copying again", F("index", m.status.Index))
+		m.status.Resyncs++
+		if err := m.copy(ctx, true); err != nil {
+			return err
+		}
+		if err := m.verify(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// followFrom applies changes made to the source after the applied index until ctx is done, or returns resync when
+// the source no longer holds the changes since then.  The watches it starts end when it returns.
+func (m *migration) followFrom(ctx context.Context, verify <-chan time.Time) (resync bool, err error) {
+	watchCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	events, errs := m.watch(watchCtx)
+	for {
+		select {
+		case <-ctx.Done():
+			return false, nil
+		case resp := <-events:
+			if err := m.apply(ctx, resp); err != nil {
+				return false, err
+			}
+		case err := <-errs:
+			if e, ok := errors.Cause(err).(client.Error); !ok || e.Code != client.ErrorCodeEventIndexCleared {
+				return false, errors.Wrap(err, "migrate: failed to watch source")
+			}
+			return true, nil
+		case <-verify:
+			if err := m.verify(ctx); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+// watch sends each change to the namespaces of the source after the applied index, until ctx is done or a watch
+// fails
+func (m *migration) watch(ctx context.Context) (<-chan *client.Response, <-chan error) {
+	events := make(chan *client.Response)
+	errs := make(chan error, len(m.namespaces))
+	for _, ns := range m.namespaces {
+		w := m.watchCli.Watcher(ns.src, &client.WatcherOptions{AfterIndex: m.status.Index, Recursive: true})
+		go func() {
+			b := backoff.NewExponentialBackOff()
+			b.MaxElapsedTime = 0
+			for {
+				resp, err := w.Next(ctx)
+				switch {
+				case ctx.Err() != nil:
+					return
+				case err == nil:
+					b.Reset()
+					select {
+					case events <- resp:
+					case <-ctx.Done():
+						return
+					}
+				default:
+					if e, ok := err.(client.Error); ok {
+						errs <- e
+						return
+					}
+					// the connection to the source failed, so wait and watch again from the same index
+					time.Sleep(b.NextBackOff())
+				}
+			}
+		}()
+	}
+	return events, errs
+}
+
+// apply copies one change to the source to the destination
+func (m *migration) apply(ctx context.Context, resp *client.Response) error {
+	for _, ns := range m.namespaces {
+		prefix := strings.TrimSuffix(ns.src, "/")
+		if resp.Node.Key != prefix && !strings.HasPrefix(resp.Node.Key, prefix+"/") {
+			continue
+		}
+		key := strings.TrimPrefix(strings.TrimPrefix(resp.Node.Key, prefix), "/")
+		var err error
+		switch {
+		case len(key) == 0:
+			// deleting the namespace itself would delete everything in the destination, including keys written by
+			// instances that were already repointed
+			m.src.log(LevelWarn, "ignoring change to the source prefix itself", F(FieldKey, resp.Node.Key), F(FieldOperation, resp.Action))
+		case !ns.copied(key):
+			// locks and the audit log are not copied
+		case resp.Action == "delete" || resp.Action == "compareAndDelete" || resp.Action == "expire":
+			err = m.delete(ctx, path.Join(ns.dst, key), resp.Node.Dir)
+		case !resp.Node.Dir:
+			err = m.set(ctx, path.Join(ns.dst, key), resp.Node.Value)
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+	if resp.Node.ModifiedIndex > m.status.Index {
+		m.status.Index = resp.Node.ModifiedIndex
+	}
+	return nil
+}
+
+// set sets k in the destination
+func (m *migration) set(ctx context.Context, k string, value string) error {
+	set := func() error {
+		_, err := m.dstCli.Set(ctx, k, value, nil)
+		return errors.Wrapf(err, "migrate: failed to set %s", k)
+	}
+	if err := backoff.Retry(set, backoff.WithContext(backoff.NewExponentialBackOff(), ctx)); err != nil {
+		return err
+	}
+	m.status.Copied++
+	return nil
+}
+
+// delete deletes k from the destination
+func (m *migration) delete(ctx context.Context, k string, dir bool) error {
+	del := func() error {
+		_, err := m.dstCli.Delete(ctx, k, &client.DeleteOptions{Recursive: dir, Dir: dir})
+		if err != nil && client.IsKeyNotFound(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "migrate: failed to delete %s", k)
+	}
+	if err := backoff.Retry(del, backoff.WithContext(backoff.NewExponentialBackOff(), ctx)); err != nil {
+		return err
+	}
+	m.status.Deleted++
+	return nil
+}
+
+// snapshot reads every value under prefix for which copied returns true in a single quorum request, by key
+// relative to prefix, along with the etcd index it was read at
+func snapshot(ctx context.Context, cli client.KeysAPI, prefix string, copied func(key string) bool) (map[string]string, uint64, error) {
+	values := make(map[string]string)
+	var index uint64
+	read := func() error {
+		resp, err := cli.Get(ctx, prefix, &client.GetOptions{Recursive: true, Quorum: true})
+		if err != nil {
+			if e, ok := err.(client.Error); ok && e.Code == client.ErrorCodeKeyNotFound {
+				index = e.Index
+				return nil
+			}
+			return err
+		}
+		index = resp.Index
+		var nodes []client.Node
+		walkNodes(resp.Node, &nodes)
+		for _, n := range filter(nodes, FilterRemoveDirectories()) {
+			if key := strings.TrimPrefix(n.Key, strings.TrimSuffix(prefix, "/")+"/"); copied(key) {
+				values[key] = n.Value
+			}
+		}
+		return nil
+	}
+	if err := backoff.Retry(read, backoff.WithContext(backoff.NewExponentialBackOff(), ctx)); err != nil {
+		return nil, 0, err
+	}
+	return values, index, nil
+}
+
+// sharesServer returns true if src and dst share an etcd server
+func sharesServer(src *ClusterConfig, dst *ClusterConfig) bool {
+	for _, a := range src.ServerIP {
+		for _, b := range dst.ServerIP {
+			if strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nested returns true if one of the key prefixes a and b holds the other
+func nested(a string, b string) bool {
+	a = strings.TrimSuffix(a, "/") + "/"
+	b = strings.TrimSuffix(b, "/") + "/"
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
@@ -0,0 +1,146 @@
+package etcd
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/client"
+)
+
+func TestMigrate(t *testing.T) {
+	src, _, doneSrc := testPrefix(t, "migrate")
+	defer doneSrc()
+	dst, _, doneDst := testPrefix(t, "migrate-dst")
+	defer doneDst()
+	src.AuditRetention = 100
+	srcSrv, dstSrv := NewService(src), NewService(dst)
+	assert.NoError(t, srcSrv.Store("acme/sites/example.com/example.com.crt", []byte("cert")))
+	assert.NoError(t, srcSrv.Store("acme/sites/example.com/example.com.key", []byte("key")))
+	assert.NoError(t, srcSrv.Lock("acme/sites/example.com/example.com.crt"))
+	assert.NoError(t, NewSecrets(src).Put("db/password", []byte("hunter2")))
+
+	nested := *src
+	nested.KeyPrefix = "/testmigrate/nested"
+	_, err := Migrate(context.Background(), src, &nested, MigrateOptions{})
+	assert.Error(t, err)
+	nested = *dst
+	nested.SecretsPrefix = "/testmigrate/secrets"
+	_, err = Migrate(context.Background(), src, &nested, MigrateOptions{})
+	assert.Error(t, err)
+
+	status, err := Migrate(context.Background(), src, dst, MigrateOptions{})
+	assert.NoError(t, err)
+	assert.True(t, status.InSync)
+	assert.Empty(t, status.Differences)
+	value, err := dstSrv.Load("acme/sites/example.com/example.com.crt")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("cert"), value)
+	secret, err := NewSecrets(dst).Get("db/password")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hunter2"), secret)
+	// locks and the audit log stay with the source, which records the migration
+	locks, err := ListLocks(dst)
+	assert.NoError(t, err)
+	assert.Empty(t, locks)
+	assert.NoError(t, FlushAudit(time.Minute))
+	entries, err := NewAudit(dst).List()
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	entries, err = NewAudit(src).List()
+	assert.NoError(t, err)
+	if assert.NotEmpty(t, entries) {
+		assert.Equal(t, AuditMigrate, entries[len(entries)-1].Operation)
+	}
+
+	// the destination now holds keys
+	_, err = Migrate(context.Background(), src, dst, MigrateOptions{})
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	synced := make(chan MigrationStatus, 100)
+	done := make(chan error, 1)
+	go func() {
+		_, err := Migrate(ctx, src, dst, MigrateOptions{
+			Overwrite:      true,
+			Follow:         true,
+			VerifyInterval: 100 * time.Millisecond,
+			Progress:       func(s MigrationStatus) { synced <- s },
+		})
+		done <- err
+	}()
+	<-synced
+	assert.NoError(t, srcSrv.Store("acme/sites/example.com/example.com.crt", []byte("renewed")))
+	assert.NoError(t, srcSrv.Delete("acme/sites/example.com/example.com.key"))
+	assert.NoError(t, srcSrv.Unlock("acme/sites/example.com/example.com.crt"))
+	assert.NoError(t, NewSecrets(src).Put("db/password", []byte("rotated")))
+	timeout := time.After(10 * time.Second)
+	for {
+		var s MigrationStatus
+		select {
+		case s = <-synced:
+		case <-timeout:
+			t.Fatal("destination did not catch up with the source")
+		}
+		value, err := dstSrv.Load("acme/sites/example.com/example.com.crt")
+		secret, _ := NewSecrets(dst).Get("db/password")
+		if s.InSync && err == nil && string(value) == "renewed" && string(secret) == "rotated" {
+			assert.Equal(t, MigrateFollow, s.Phase)
+			break
+		}
+	}
+	_, err = dstSrv.Load("acme/sites/example.com/example.com.key")
+	assert.True(t, IsNotExistError(err))
+	entries, err = NewAudit(dst).List()
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestMigrateKeepsDestinationKeys(t *testing.T) {
+	src, srcCli, doneSrc := testPrefix(t, "migratekeep")
+	defer doneSrc()
+	dst, dstCli, doneDst := testPrefix(t, "migratekeep-dst")
+	defer doneDst()
+	srcSrv, dstSrv := NewService(src), NewService(dst)
+	assert.NoError(t, srcSrv.Store("certs/one", []byte("one")))
+	assert.NoError(t, dstSrv.Store("certs/repointed", []byte("written by a repointed instance")))
+	namespaces, err := migrated(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &migration{src: src, dst: dst, namespaces: namespaces, srcCli: srcCli, dstCli: dstCli, opts: MigrateOptions{Overwrite: true}, status: &MigrationStatus{}}
+
+	// a resync copies the source but reports keys that only the destination holds
+	assert.NoError(t, m.copy(context.Background(), true))
+	assert.NoError(t, m.verify(context.Background()))
+	assert.False(t, m.status.InSync)
+	assert.Equal(t, []string{"certs/repointed", "md/certs/repointed"}, m.status.Differences)
+	value, err := dstSrv.Load("certs/one")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("one"), value)
+
+	tcs := []struct {
+		Name    string
+		Change  *client.Response
+		Deleted string
+	}{
+		{Name: "source prefix deleted", Change: &client.Response{Action: "delete", Node: &client.Node{Key: src.KeyPrefix, Dir: true}}},
+		{Name: "source prefix expired", Change: &client.Response{Action: "expire", Node: &client.Node{Key: src.KeyPrefix + "/", Dir: true}}},
+		{Name: "key deleted", Change: &client.Response{Action: "delete", Node: &client.Node{Key: src.KeyPrefix + "/certs/one"}}, Deleted: "certs/one"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			assert.NoError(t, m.apply(context.Background(), tc.Change))
+			for _, key := range []string{"certs/one", "certs/repointed"} {
+				var ok bool
+				assert.NoError(t, exists(dstCli, path.Join(dst.KeyPrefix, key), &ok)())
+				assert.Equal(t, key != tc.Deleted, ok, key)
+			}
+		})
+	}
+}
@@ -5,23 +5,34 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"net"
+	"net/http"
+	"time"
 
 	"github.com/cenkalti/backoff"
 	"github.com/pkg/errors"
 	"go.etcd.io/etcd/client"
 )
 
-func pipeline(commits []backoff.Operation, rollbacks []backoff.Operation, b backoff.BackOff) error {
+// pipeline commits each operation in turn.  If one fails, the operations already committed are undone by running
+// their rollbacks in reverse order.  Retries and rollbacks are counted and logged against o.
+func pipeline(o *operation, commits []backoff.Operation, rollbacks []backoff.Operation, b backoff.BackOff) error {
 	var err error
 	for idx, commit := range commits {
-		err = backoff.Retry(commit, b)
+		err = backoff.RetryNotify(commit, b, o.retry())
 		if err != nil {
+			if idx > 0 && len(rollbacks) > 0 {
+				rollbackCount.WithLabelValues(o.name).Inc()
+				o.cfg.log(LevelWarn, "rolling back failed transaction", F(FieldOperation, o.name), F(FieldKey, o.key), F(FieldError, err))
+			}
 			for i := idx - 1; i >= 0; i-- {
 				switch {
 				case i >= len(rollbacks):
 					continue
 				default:
-					if errR := backoff.Retry(rollbacks[i], b); errR != nil {
+					if errR := backoff.RetryNotify(rollbacks[i], b, o.retry()); errR != nil {
+						rollbackFailures.WithLabelValues(o.name).Inc()
+						o.cfg.log(LevelError, "rollback failed, transaction is partly applied", F(FieldOperation, o.name), F(FieldKey, o.key), F(FieldError, errR))
 						err = errors.Wrapf(err, "error on rollback: %s", errR)
 					}
 				}
@@ -33,13 +44,36 @@ func pipeline(commits []backoff.Operation, rollbacks []backoff.Operation, b back
 }
 
 func getClient(c *ClusterConfig) (client.KeysAPI, error) {
+	cli, err := newClient(c)
+	if err != nil {
+		return nil, err
+	}
+	return client.NewKeysAPI(cli), nil
+}
+
+func newClient(c *ClusterConfig) (client.Client, error) {
 	cli, err := client.New(client.Config{
 		Endpoints: c.ServerIP,
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to instantiate etcd client")
 	}
-	return client.NewKeysAPI(cli), nil
+	return cli, nil
+}
+
+// getWatchClient returns a client for a long running watch.  It has its own connections, so cancelling the watch
+// does not leave a broken connection for other requests to reuse.  release closes its connections.
+func getWatchClient(c *ClusterConfig) (cli client.KeysAPI, release func(), err error) {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	cl, err := client.New(client.Config{Endpoints: c.ServerIP, Transport: transport})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to instantiate etcd client")
+	}
+	return client.NewKeysAPI(cl), transport.CloseIdleConnections, nil
 }
 
 func tx(txs ...backoff.Operation) []backoff.Operation {
@@ -68,6 +102,23 @@ func get(cli client.KeysAPI, key string, dst *bytes.Buffer) backoff.Operation {
 	}
 }
 
+// getNode reads the node at key into dst, so that a later write can be made conditional on it.  dst is set to nil
+// if key does not exist.
+func getNode(cli client.KeysAPI, key string, dst **client.Node) backoff.Operation {
+	return func() error {
+		resp, err := cli.Get(context.Background(), key, nil)
+		switch {
+		case client.IsKeyNotFound(err):
+			*dst = nil
+			return nil
+		case err != nil:
+			return errors.Wrap(err, "get: error retrieving node")
+		}
+		*dst = resp.Node
+		return nil
+	}
+}
+
 func set(cli client.KeysAPI, key string, value []byte) backoff.Operation {
 	return func() error {
 		if _, err := cli.Set(context.Background(), key, base64.StdEncoding.EncodeToString(value), nil); err != nil {
@@ -77,6 +128,32 @@ func set(cli client.KeysAPI, key string, value []byte) backoff.Operation {
 	}
 }
 
+// create sets key only if it does not exist.  A key that exists is a permanent error, see isChanged, so it is not
+// retried.
+func create(cli client.KeysAPI, key string, value []byte) backoff.Operation {
+	return func() error {
+		_, err := cli.Set(context.Background(), key, base64.StdEncoding.EncodeToString(value), &client.SetOptions{PrevExist: client.PrevNoExist})
+		if e, ok := err.(client.Error); ok && e.Code == client.ErrorCodeNodeExist {
+			return backoff.Permanent(errors.Wrapf(err, "create: %s already exists", key))
+		}
+		if err != nil {
+			return errors.Wrap(err, "create: failed to set key value")
+		}
+		return nil
+	}
+}
+
+// createMD sets the metadata at key only if it does not exist
+func createMD(cli client.KeysAPI, key string, m Metadata) backoff.Operation {
+	return func() error {
+		jsdata, err := json.Marshal(m)
+		if err != nil {
+			return errors.Wrap(err, "createmd: failed to marshal metadata")
+		}
+		return create(cli, key, jsdata)()
+	}
+}
+
 func del(cli client.KeysAPI, key string) backoff.Operation {
 	return func() error {
 		if _, err := cli.Delete(context.Background(), key, nil); err != nil {
@@ -86,6 +163,53 @@ func del(cli client.KeysAPI, key string) backoff.Operation {
 	}
 }
 
+// swap sets key to value, as it is stored, only if key is unchanged since it was read as prev, or still does not
+// exist when prev is nil.  A key that changed is a permanent error, see isChanged.
+func swap(cli client.KeysAPI, key string, prev *client.Node, value string) backoff.Operation {
+	return func() error {
+		opts := &client.SetOptions{PrevExist: client.PrevNoExist}
+		if prev != nil {
+			opts = &client.SetOptions{PrevIndex: prev.ModifiedIndex}
+		}
+		_, err := cli.Set(context.Background(), key, value, opts)
+		switch {
+		case isChanged(err):
+			return backoff.Permanent(errors.Wrapf(err, "swap: %s changed since it was read", key))
+		case err != nil:
+			return errors.Wrapf(err, "swap: failed to set key: %s", key)
+		}
+		return nil
+	}
+}
+
+// remove deletes key only if it is unchanged since it was read at index.  A key that changed or was deleted is a
+// permanent error, see isChanged.
+func remove(cli client.KeysAPI, key string, index uint64) backoff.Operation {
+	return func() error {
+		_, err := cli.Delete(context.Background(), key, &client.DeleteOptions{PrevIndex: index})
+		switch {
+		case isChanged(err):
+			return backoff.Permanent(errors.Wrapf(err, "remove: %s changed since it was read", key))
+		case err != nil:
+			return errors.Wrapf(err, "remove: failed to delete key: %s", key)
+		}
+		return nil
+	}
+}
+
+// isChanged returns true if err is a conditional write that failed because the key changed since it was read
+func isChanged(err error) bool {
+	e, ok := errors.Cause(err).(client.Error)
+	if !ok {
+		return false
+	}
+	switch e.Code {
+	case client.ErrorCodeTestFailed, client.ErrorCodeNodeExist, client.ErrorCodeKeyNotFound:
+		return true
+	}
+	return false
+}
+
 func setMD(cli client.KeysAPI, key string, m Metadata) backoff.Operation {
 	return func() error {
 		jsdata, err := json.Marshal(m)
@@ -177,12 +301,16 @@ func exists(cli client.KeysAPI, key string, out *bool) backoff.Operation {
 }
 
 func list(cli client.KeysAPI, key string) ([]client.Node, error) {
+	return listContext(context.Background(), cli, key)
+}
 
+// listContext is list, giving up when ctx is done
+func listContext(ctx context.Context, cli client.KeysAPI, key string) ([]client.Node, error) {
 	var out []client.Node
 	resp := new(client.Response)
 	getRecursive := func() error {
 		var err error
-		resp, err = cli.Get(context.Background(), key, &client.GetOptions{
+		resp, err = cli.Get(ctx, key, &client.GetOptions{
 			Recursive: true,
 		})
 		if err != nil {
@@ -195,7 +323,7 @@ func list(cli client.KeysAPI, key string) ([]client.Node, error) {
 		}
 		return nil
 	}
-	if err := backoff.Retry(getRecursive, backoff.NewExponentialBackOff()); err != nil {
+	if err := backoff.Retry(getRecursive, backoff.WithContext(backoff.NewExponentialBackOff(), ctx)); err != nil {
 		return nil, err
 	}
 	if resp == nil {
@@ -56,7 +56,7 @@ func TestPipeline(t *testing.T) {
 	}
 	for _, tc := range tcs {
 		arr = []int{}
-		err := pipeline(tc.Commit, tc.Rollback, backoff.WithMaxRetries(backoff.NewExponentialBackOff(), 1))
+		err := pipeline(&operation{name: "test"}, tc.Commit, tc.Rollback, backoff.WithMaxRetries(backoff.NewExponentialBackOff(), 1))
 		switch tc.ShouldErr {
 		case true:
 			assert.Error(t, err)
@@ -0,0 +1,204 @@
+package etcd
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/mholt/caddy"
+	"github.com/mholt/certmagic"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/client"
+)
+
+// purgedDir holds a tombstone for each domain whose certificate was purged
+const purgedDir = "purged"
+
+// PurgeOptions controls a purge
+type PurgeOptions struct {
+	// Reason is recorded in the tombstone and the audit log, such as "key compromise"
+	Reason string
+}
+
+// Tombstone records a certificate purged by PurgeCertificate.  It is stored at `<KeyPrefix>/purged/<domain>` and
+// replaced when the domain is purged again.
+type Tombstone struct {
+	Domain   string    `json:"domain"`
+	Serials  []string  `json:"serials"`
+	Keys     []string  `json:"keys"`
+	Reason   string    `json:"reason"`
+	Instance string    `json:"instance"`
+	Time     time.Time `json:"time"`
+}
+
+// PurgeCertificate deletes every certificate stored for domain, under any CA, and writes a tombstone that makes every
+// running instance restart and obtain a new one, see watchPurges.  It is meant for a certificate whose private key is
+// compromised, after it is revoked with the CA, and writes the tombstone even if no certificate is stored.
+func PurgeCertificate(c *ClusterConfig, domain string, opts PurgeOptions) (*Tombstone, error) {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if len(domain) == 0 {
+		return nil, errors.New("purge: no domain")
+	}
+	cli, err := getClient(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "purge: failed to get client")
+	}
+	srv := NewService(c)
+	// a renewal in progress reuses the compromised key, so it is waited for and cannot write after the purge
+	unlock, err := lockSite(srv, domain, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	data, mds, err := readPrefix(cli, c.KeyPrefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "purge: could not get keys")
+	}
+	t := &Tombstone{Domain: domain, Reason: opts.Reason, Instance: c.InstanceID, Time: time.Now().UTC()}
+	safe := certmagic.StorageKeys.Safe(domain)
+	for _, sc := range readSiteCertificates(data, mds) {
+		if path.Base(sc.dir) != safe {
+			continue
+		}
+		t.Keys = append(t.Keys, sc.keys...)
+		if sc.err == nil {
+			t.Serials = append(t.Serials, fmt.Sprintf("%x", sc.cert.SerialNumber))
+			t.Keys = append(t.Keys, staples(data, sc.cert.SerialNumber)...)
+		}
+	}
+	sort.Strings(t.Keys)
+
+	for _, key := range t.Keys {
+		if err := srv.Lock(key); err != nil {
+			return nil, err
+		}
+		defer srv.Unlock(key)
+	}
+	for _, key := range t.Keys {
+		if err := srv.Delete(key); err != nil && !IsNotExistError(err) {
+			return nil, errors.Wrapf(err, "purge: failed to delete %s", key)
+		}
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return nil, errors.Wrap(err, "purge: failed to marshal tombstone")
+	}
+	key := path.Join(purgedDir, safe)
+	if err := srv.Store(key, b); err != nil {
+		return nil, errors.Wrap(err, "purge: failed to store tombstone")
+	}
+	detail := fmt.Sprintf("%d keys, serials %s", len(t.Keys), strings.Join(t.Serials, ","))
+	if len(opts.Reason) > 0 {
+		detail += ": " + opts.Reason
+	}
+	audit(c, AuditPurge, key, [20]byte{}, sha1.Sum(b), detail)
+	return t, nil
+}
+
+var purgeOnce sync.Once
+
+// watchPurges restarts the running Caddy instances whenever a certificate is purged, once per process.  A restarted
+// instance starts with an empty certificate cache, so it loads its certificates from etcd again and obtains one for
+// the purged domain.
+func watchPurges(c *ClusterConfig) {
+	purgeOnce.Do(func() {
+		go func() {
+			var w *purgeWatch
+			b := backoff.NewExponentialBackOff()
+			b.MaxElapsedTime = 0
+			for {
+				var err error
+				if w == nil {
+					w, err = newPurgeWatch(c)
+				}
+				if err == nil {
+					index := w.index
+					err = w.follow(context.Background(), restartInstances(c))
+					if w.index > index {
+						b.Reset()
+					}
+				}
+				if e, ok := err.(client.Error); ok && e.Code == client.ErrorCodeEventIndexCleared {
+					// tombstones written while the watch was behind are lost, so watch again from now
+					w.release()
+					w = nil
+				}
+				c.log(LevelWarn, "watch for purged certificates failed", F(FieldError, err))
+				time.Sleep(b.NextBackOff())
+			}
+		}()
+	})
+}
+
+// restartInstances returns a function that restarts every running Caddy instance with its current Caddyfile
+func restartInstances(c *ClusterConfig) func(t Tombstone) {
+	return func(t Tombstone) {
+		c.log(LevelWarn, "certificate was purged, restarting to drop it from memory", F("domain", t.Domain), F("serials", strings.Join(t.Serials, ",")), F("instance", t.Instance), F("reason", t.Reason))
+		for _, inst := range caddy.Instances() {
+			if _, err := inst.Restart(nil); err != nil {
+				c.log(LevelError, "unable to restart after a certificate was purged", F("domain", t.Domain), F(FieldError, err))
+			}
+		}
+	}
+}
+
+// purgeWatch follows the tombstones written after index.  release closes its connections.
+type purgeWatch struct {
+	cfg     *ClusterConfig
+	cli     client.KeysAPI
+	release func()
+	index   uint64
+}
+
+// newPurgeWatch returns a watch that starts from the current etcd index
+func newPurgeWatch(c *ClusterConfig) (*purgeWatch, error) {
+	cli, release, err := getWatchClient(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "purge: failed to get watch client")
+	}
+	w := &purgeWatch{cfg: c, cli: cli, release: release}
+	resp, err := cli.Get(context.Background(), path.Join(c.KeyPrefix, purgedDir), nil)
+	switch {
+	case err == nil:
+		w.index = resp.Index
+	case client.IsKeyNotFound(err):
+		w.index = err.(client.Error).Index
+	default:
+		release()
+		return nil, errors.Wrap(err, "purge: failed to get index")
+	}
+	return w, nil
+}
+
+// follow calls f with each tombstone written until ctx is done or the watch fails
+func (w *purgeWatch) follow(ctx context.Context, f func(t Tombstone)) error {
+	watcher := w.cli.Watcher(path.Join(w.cfg.KeyPrefix, purgedDir), &client.WatcherOptions{AfterIndex: w.index, Recursive: true})
+	for {
+		resp, err := watcher.Next(ctx)
+		if err != nil {
+			return err
+		}
+		w.index = resp.Node.ModifiedIndex
+		if resp.Node.Dir || resp.Node.Value == "" {
+			continue
+		}
+		var t Tombstone
+		b, err := base64.StdEncoding.DecodeString(resp.Node.Value)
+		if err == nil {
+			err = json.Unmarshal(b, &t)
+		}
+		if err != nil {
+			w.cfg.log(LevelWarn, "unable to read tombstone", F(FieldKey, resp.Node.Key), F(FieldError, err))
+			continue
+		}
+		f(t)
+	}
+}
@@ -0,0 +1,116 @@
+package etcd
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPurgeCertificate(t *testing.T) {
+	cfg, _, done := testPrefix(t, "purge")
+	defer done()
+	cfg.InstanceID = "web-1"
+	srv := NewService(cfg)
+	now := time.Now()
+	site := func(ca string, domain string, serial int64) {
+		dir := path.Join("acme", ca, "sites", domain)
+		c := testCertificate(t, serial, now.Add(30*24*time.Hour), domain)
+		assert.NoError(t, srv.Store(path.Join(dir, domain+".crt"), c.crt))
+		assert.NoError(t, srv.Store(path.Join(dir, domain+".key"), c.key))
+		assert.NoError(t, srv.Store(path.Join(dir, domain+".json"), []byte("{}")))
+		assert.NoError(t, srv.Store(path.Join("ocsp", domain+"-"+ca), c.staple))
+	}
+	site("acme-v02.api.letsencrypt.org", "leaked.example.com", 1)
+	site("acme-staging-v02.api.letsencrypt.org", "leaked.example.com", 2)
+	site("acme-v02.api.letsencrypt.org", "safe.example.com", 3)
+
+	w, err := newPurgeWatch(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.release()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	purged := make(chan Tombstone, 10)
+	go w.follow(ctx, func(t Tombstone) { purged <- t })
+
+	tcs := []struct {
+		Name    string
+		Domain  string
+		Reason  string
+		Keys    int
+		Serials []string
+		Left    int
+	}{
+		{Name: "every CA and staple", Domain: "Leaked.example.com", Reason: "key compromise", Keys: 8, Serials: []string{"2", "1"}, Left: 4},
+		{Name: "nothing stored is still announced", Domain: "gone.example.com", Left: 4},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			ts, err := PurgeCertificate(cfg, tc.Domain, PurgeOptions{Reason: tc.Reason})
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Len(t, ts.Keys, tc.Keys)
+			assert.Equal(t, tc.Serials, ts.Serials)
+			var left int
+			for _, dir := range []string{"acme", "ocsp"} {
+				keys, err := srv.List(dir, FilterRemoveDirectories())
+				assert.NoError(t, err)
+				left += len(keys)
+			}
+			assert.Equal(t, tc.Left, left, "the keys of other domains are kept")
+			locks, err := ListLocks(cfg)
+			assert.NoError(t, err)
+			assert.Empty(t, locks)
+
+			select {
+			case got := <-purged:
+				assert.Equal(t, ts.Domain, got.Domain)
+				assert.Equal(t, tc.Reason, got.Reason)
+				assert.Equal(t, "web-1", got.Instance)
+			case <-time.After(5 * time.Second):
+				t.Fatal("the watch did not see the tombstone")
+			}
+			assert.NoError(t, FlushAudit(time.Minute))
+			entries, err := NewAudit(cfg).List()
+			assert.NoError(t, err)
+			if assert.NotEmpty(t, entries) {
+				assert.Equal(t, AuditPurge, entries[len(entries)-1].Operation)
+				assert.Equal(t, path.Join(purgedDir, ts.Domain), entries[len(entries)-1].Key)
+			}
+		})
+	}
+
+	// a renewal holding the site lock is waited for, so it cannot write a certificate for the compromised key back
+	site("acme-v02.api.letsencrypt.org", "renewing.example.com", 4)
+	renewal := NewService(cfg).(*etcdsrv)
+	assert.NoError(t, renewal.lock(&operation{cfg: cfg, name: "lock"}, "renewal", siteLock("renewing.example.com")))
+	purging := make(chan error, 1)
+	go func() {
+		_, err := PurgeCertificate(cfg, "renewing.example.com", PurgeOptions{})
+		purging <- err
+	}()
+	time.Sleep(time.Second)
+	crt := "acme/acme-v02.api.letsencrypt.org/sites/renewing.example.com/renewing.example.com.crt"
+	assert.NoError(t, srv.Store(crt, testCertificate(t, 5, now.Add(90*24*time.Hour), "renewing.example.com").crt))
+	select {
+	case <-purging:
+		t.Fatal("purged while the site lock was held")
+	default:
+	}
+	assert.NoError(t, renewal.Unlock(siteLock("renewing.example.com")))
+	assert.NoError(t, <-purging)
+	_, err = srv.Load(crt)
+	assert.True(t, IsNotExistError(err))
+	select {
+	case got := <-purged:
+		assert.Equal(t, []string{"5"}, got.Serials)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the watch did not see the tombstone")
+	}
+	cancel()
+}
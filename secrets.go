@@ -0,0 +1,329 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/cenkalti/backoff"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/client"
+)
+
+// secretPlaceholder matches `{etcd.secret:name}` in a Caddyfile
+var secretPlaceholder = regexp.MustCompile(`\{etcd\.secret:([^{}\s]+)\}`)
+
+// Secrets stores values referenced by `{etcd.secret:name}` placeholders in Caddyfiles.  Secrets are kept
+// under their own prefix, outside of the key prefix, so that access to them can be restricted separately
+// from the Caddyfile.  When a secrets key is configured, values are encrypted with AES-GCM before they are
+// written to etcd.
+type Secrets struct {
+	cfg *ClusterConfig
+}
+
+// NewSecrets returns the secrets store for the cluster
+func NewSecrets(c *ClusterConfig) *Secrets {
+	return &Secrets{cfg: c}
+}
+
+// Put stores value as the secret name
+func (s *Secrets) Put(name string, value []byte) error {
+	cli, err := getClient(s.cfg)
+	if err != nil {
+		return errors.Wrap(err, "secrets: failed to get client")
+	}
+	key, err := s.key(name)
+	if err != nil {
+		return err
+	}
+	val, err := s.seal(value)
+	if err != nil {
+		return err
+	}
+	return backoff.Retry(set(cli, key, val), backoff.NewExponentialBackOff())
+}
+
+// Get returns the secret name.  If the secret does not exist, a `NotExist` error is returned.
+func (s *Secrets) Get(name string) ([]byte, error) {
+	cli, err := getClient(s.cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "secrets: failed to get client")
+	}
+	return s.get(context.Background(), cli, name)
+}
+
+// Delete removes the secret name
+func (s *Secrets) Delete(name string) error {
+	cli, err := getClient(s.cfg)
+	if err != nil {
+		return errors.Wrap(err, "secrets: failed to get client")
+	}
+	key, err := s.key(name)
+	if err != nil {
+		return err
+	}
+	return backoff.Retry(del(cli, key), backoff.NewExponentialBackOff())
+}
+
+// List returns the names of all secrets
+func (s *Secrets) List() ([]string, error) {
+	cli, err := getClient(s.cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "secrets: failed to get client")
+	}
+	nodes, err := list(cli, s.cfg.SecretsPrefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "secrets: failed to list secrets")
+	}
+	var out []string
+	for _, n := range filter(nodes, FilterRemoveDirectories()) {
+		out = append(out, strings.TrimPrefix(n.Key, s.cfg.SecretsPrefix+"/"))
+	}
+	return out, nil
+}
+
+// Resolve replaces every `{etcd.secret:name}` placeholder in body with the value of the secret.  A placeholder
+// that refers to a secret that does not exist is an error rather than an empty value, so that a Caddyfile is
+// never loaded with missing credentials.
+func (s *Secrets) Resolve(body []byte, filename string) ([]byte, error) {
+	if !secretPlaceholder.Match(body) {
+		return body, nil
+	}
+	cli, err := getClient(s.cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "secrets: failed to get client")
+	}
+	return s.resolve(context.Background(), cli, body, filename)
+}
+
+// resolve substitutes secrets so that each value is read by Caddy as the placeholder's token, or part of it, and
+// cannot add tokens, blocks, or comments.  A value that must be a whole token is quoted when it contains spaces or
+// special characters, and one inside a quoted token has its quotes escaped.  A value that cannot be substituted
+// safely is an error.  Placeholders in comments are left as they are.  Reading secrets stops when ctx is done.
+func (s *Secrets) resolve(ctx context.Context, cli client.KeysAPI, body []byte, filename string) ([]byte, error) {
+	var out bytes.Buffer
+	sc := &caddyfileScanner{body: body, between: true}
+	last := 0
+	for _, m := range secretPlaceholder.FindAllSubmatchIndex(body, -1) {
+		sc.advance(m[0])
+		if sc.comment {
+			continue
+		}
+		name := string(body[m[2]:m[3]])
+		line := bytes.Count(body[:m[0]], []byte("\n")) + 1
+		val, err := s.get(ctx, cli, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d - unable to resolve secret %s", filename, line, name)
+		}
+		val, err = sc.substitute(val, m[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d - unable to substitute secret %s", filename, line, name)
+		}
+		out.Write(body[last:m[0]])
+		out.Write(val)
+		last = m[1]
+		sc.skip(m[1])
+	}
+	out.Write(body[last:])
+	return out.Bytes(), nil
+}
+
+// caddyfileScanner follows a Caddyfile the way Caddy's lexer reads it, to tell whether an offset is inside a
+// quoted token, a comment, or between tokens
+type caddyfileScanner struct {
+	body    []byte
+	pos     int
+	quoted  bool
+	escaped bool
+	comment bool
+	between bool
+}
+
+// advance reads the Caddyfile up to offset to
+func (c *caddyfileScanner) advance(to int) {
+	for ; c.pos < to; c.pos++ {
+		ch := c.body[c.pos]
+		switch {
+		case c.quoted && c.escaped:
+			c.escaped = false
+		case c.quoted && ch == '\\':
+			c.escaped = true
+		case c.quoted && ch == '"':
+			c.quoted, c.between = false, true
+		case c.quoted:
+		case isSpace(ch):
+			c.between = true
+			if ch == '\n' {
+				c.comment = false
+			}
+		case c.comment:
+		case ch == '#':
+			c.comment = true
+		case ch == '"' && c.between:
+			c.quoted, c.between = true, false
+		default:
+			c.between = false
+		}
+	}
+}
+
+// skip moves past a substituted placeholder that ends at offset to.  The substituted value leaves the scanner in
+// the same state, except that it is now inside a token.
+func (c *caddyfileScanner) skip(to int) {
+	c.pos = to
+	if !c.quoted {
+		c.between = false
+	}
+}
+
+// substitute returns val escaped for the position of the scanner, for a placeholder that ends at offset end
+func (c *caddyfileScanner) substitute(val []byte, end int) ([]byte, error) {
+	if s := string(val); s == "{" || s == "}" {
+		return nil, errors.New("a brace would open or close a block")
+	}
+	token := c.between && (end == len(c.body) || isSpace(c.body[end]))
+	plain := bytes.IndexFunc(val, unicode.IsSpace) < 0 && bytes.IndexAny(val, "\"#{}") < 0
+	switch {
+	case !c.quoted && token && plain && len(val) > 0:
+		return val, nil
+	case !c.quoted && !token && !plain:
+		return nil, errors.New("the value has spaces or special characters and is part of a larger token, quote the token")
+	case !c.quoted && !token:
+		return val, nil
+	}
+	// Caddy's lexer only unescapes a quote, so a backslash before a quote or the end of the token cannot be kept
+	if bytes.Contains(val, []byte("\\\"")) || bytes.HasSuffix(val, []byte("\\")) || (c.escaped && bytes.HasPrefix(val, []byte("\""))) {
+		return nil, errors.New("the value has a backslash before a quote")
+	}
+	escaped := bytes.Replace(val, []byte("\""), []byte("\\\""), -1)
+	if c.quoted {
+		return escaped, nil
+	}
+	return append(append([]byte("\""), escaped...), '"'), nil
+}
+
+// isSpace returns true for the ASCII whitespace Caddy's lexer separates tokens with
+func isSpace(ch byte) bool {
+	switch ch {
+	case ' ', '\t', '\n', '\r', '\v', '\f':
+		return true
+	}
+	return false
+}
+
+func (s *Secrets) get(ctx context.Context, cli client.KeysAPI, name string) ([]byte, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+	var val []byte
+	getSecret := func() error {
+		resp, err := cli.Get(ctx, key, nil)
+		if err != nil {
+			switch {
+			case client.IsKeyNotFound(err):
+				return backoff.Permanent(NotExist{name})
+			default:
+				return errors.Wrap(err, "secrets: error retrieving value")
+			}
+		}
+		val, err = base64.StdEncoding.DecodeString(resp.Node.Value)
+		if err != nil {
+			return backoff.Permanent(errors.Wrap(err, "secrets: error decoding base64 value"))
+		}
+		return nil
+	}
+	if err := backoff.Retry(getSecret, backoff.WithContext(backoff.NewExponentialBackOff(), ctx)); err != nil {
+		return nil, err
+	}
+	return s.open(val)
+}
+
+// key returns the etcd key of the secret name.  Names are relative to the secrets prefix, so a name with empty or
+// `..` segments, which could refer to a key outside of it, is an error.
+func (s *Secrets) key(name string) (string, error) {
+	for _, seg := range strings.Split(name, "/") {
+		if len(seg) == 0 || seg == "." || seg == ".." {
+			return "", errors.Errorf("secrets: invalid name %q", name)
+		}
+	}
+	return path.Join(s.cfg.SecretsPrefix, name), nil
+}
+
+// sealedVersion marks a value encrypted by seal.  It is followed by the nonce and the ciphertext.
+var sealedVersion = []byte("\x00aesgcm1:")
+
+// seal encrypts value when a secrets key is configured.  The nonce is stored in front of the ciphertext.
+func (s *Secrets) seal(value []byte) ([]byte, error) {
+	if len(s.cfg.SecretsKey) == 0 {
+		if bytes.HasPrefix(value, sealedVersion) {
+			return nil, errors.New("secrets: value looks encrypted, configure a secrets key to store it")
+		}
+		return value, nil
+	}
+	gcm, err := newGCM(s.cfg.SecretsKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "secrets: failed to generate nonce")
+	}
+	out := append(append([]byte{}, sealedVersion...), nonce...)
+	return gcm.Seal(out, nonce, value, nil), nil
+}
+
+// open decrypts a value written by seal.  An encrypted value is an error when no secrets key is configured, so that
+// ciphertext is never substituted for the secret.  Values encrypted before the version marker was written are
+// decrypted when a key is configured.
+func (s *Secrets) open(value []byte) ([]byte, error) {
+	sealed := bytes.HasPrefix(value, sealedVersion)
+	switch {
+	case sealed && len(s.cfg.SecretsKey) == 0:
+		return nil, errors.New("secrets: value is encrypted but no secrets key is configured")
+	case len(s.cfg.SecretsKey) == 0:
+		return value, nil
+	case sealed:
+		value = value[len(sealedVersion):]
+	}
+	gcm, err := newGCM(s.cfg.SecretsKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(value) < gcm.NonceSize() {
+		return nil, errors.New("secrets: encrypted value is too short")
+	}
+	out, err := gcm.Open(nil, value[:gcm.NonceSize()], value[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "secrets: failed to decrypt value")
+	}
+	return out, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "secrets: invalid key")
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "secrets: failed to create cipher")
+	}
+	return gcm, nil
+}
+
+// NewSecretsKey returns a random key suitable for CADDY_CLUSTERING_ETCD_SECRETS_KEYFILE, base64 encoded
+func NewSecretsKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", errors.Wrap(err, "secrets: failed to generate key")
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
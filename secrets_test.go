@@ -0,0 +1,127 @@
+package etcd
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/client"
+)
+
+func TestSecretsEncryption(t *testing.T) {
+	key, err := NewSecretsKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, _ := base64.StdEncoding.DecodeString(key)
+	s := NewSecrets(&ClusterConfig{SecretsKey: k})
+	sealed, err := s.seal([]byte("hunter2"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(sealed), "hunter2")
+	opened, err := s.open(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hunter2"), opened)
+
+	k2, _ := base64.StdEncoding.DecodeString(key)
+	k2[0] ^= 0xff
+	_, err = NewSecrets(&ClusterConfig{SecretsKey: k2}).open(sealed)
+	assert.Error(t, err)
+
+	// ciphertext is never returned as the secret without a key
+	_, err = NewSecrets(&ClusterConfig{}).open(sealed)
+	assert.Error(t, err)
+	_, err = NewSecrets(&ClusterConfig{}).seal(sealed)
+	assert.Error(t, err)
+	// values sealed before the version marker are still opened
+	opened, err = s.open(sealed[len(sealedVersion):])
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hunter2"), opened)
+
+	for _, name := range []string{"", "/etc", "../caddy/caddyfile", "api//token", "api/", "api/./token"} {
+		_, err := s.key(name)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	if !shouldRunIntegration() {
+		t.Skip("no etcd server found, skipping")
+	}
+	key, err := NewSecretsKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, _ := base64.StdEncoding.DecodeString(key)
+	tcs := []struct {
+		Name string
+		Key  []byte
+	}{
+		{Name: "plaintext", Key: nil},
+		{Name: "encrypted", Key: k},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			cfg := &ClusterConfig{
+				KeyPrefix:     "/caddy",
+				SecretsPrefix: "/testsecrets",
+				SecretsKey:    tc.Key,
+				ServerIP:      []string{"http://127.0.0.1:2379"},
+			}
+			cli, err := getClient(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = cli.Delete(context.Background(), cfg.SecretsPrefix, &client.DeleteOptions{Recursive: true})
+			s := NewSecrets(cfg)
+			assert.NoError(t, s.Put("api/token", []byte("s3cr3t")))
+			assert.NoError(t, s.Put("password", []byte("hunter2")))
+			names, err := s.List()
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, []string{"api/token", "password"}, names)
+
+			out, err := s.Resolve([]byte("example.com {\n\tbasicauth / admin {etcd.secret:password}\n\theader / X-Token {etcd.secret:api/token}\n}"), "Caddyfile")
+			assert.NoError(t, err)
+			assert.Equal(t, "example.com {\n\tbasicauth / admin hunter2\n\theader / X-Token s3cr3t\n}", string(out))
+
+			_, err = s.Resolve([]byte("example.com {\n\tbasicauth / admin {etcd.secret:missing}\n}"), "Caddyfile")
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "Caddyfile:2")
+
+			assert.NoError(t, s.Put("spaced", []byte("a b }\nimport /etc")))
+			assert.NoError(t, s.Put("quoted", []byte(`say "hi"`)))
+			assert.NoError(t, s.Put("brace", []byte("}")))
+			assert.NoError(t, s.Put("slash", []byte(`a\"b`)))
+			subs := []struct {
+				Body      string
+				Expect    string
+				ShouldErr bool
+			}{
+				{Body: "header / X {etcd.secret:spaced}", Expect: "header / X \"a b }\nimport /etc\""},
+				{Body: "header / X \"Bearer {etcd.secret:quoted}\"", Expect: "header / X \"Bearer say \\\"hi\\\"\""},
+				{Body: "header / X {etcd.secret:quoted}", Expect: "header / X \"say \\\"hi\\\"\""},
+				{Body: "header / X \"{etcd.secret:password}\" {etcd.secret:password}", Expect: "header / X \"hunter2\" hunter2"},
+				{Body: "# {etcd.secret:missing}\nlog {etcd.secret:password}", Expect: "# {etcd.secret:missing}\nlog hunter2"},
+				{Body: "header / X Bearer-{etcd.secret:password}", Expect: "header / X Bearer-hunter2"},
+				{Body: "header / X Bearer-{etcd.secret:spaced}", ShouldErr: true},
+				{Body: "header / X {etcd.secret:brace}", ShouldErr: true},
+				{Body: "header / X {etcd.secret:slash}", ShouldErr: true},
+				{Body: "header / X {etcd.secret:../caddy}", ShouldErr: true},
+			}
+			for _, sub := range subs {
+				out, err := s.Resolve([]byte(sub.Body), "Caddyfile")
+				switch sub.ShouldErr {
+				case true:
+					assert.Error(t, err, sub.Body)
+				default:
+					assert.NoError(t, err, sub.Body)
+					assert.Equal(t, sub.Expect, string(out))
+				}
+			}
+
+			assert.NoError(t, s.Delete("password"))
+			_, err = s.Get("password")
+			assert.True(t, IsNotExistError(err))
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package etcd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mholt/caddy/caddyfile"
+	"github.com/pkg/errors"
+)
+
+// selectorAnnotation marks a comment line that declares the label selector for the site block that follows it
+const selectorAnnotation = "etcd.selector:"
+
+// Selector is a comma separated list of label requirements that must all be satisfied by the labels of an
+// instance for a site to be served by it.  Requirements take the form `key=value`, `key=value1|value2`,
+// `key!=value`, `key` (label is present), or `!key` (label is absent).
+type Selector []requirement
+
+type requirement struct {
+	key    string
+	values []string
+	negate bool
+}
+
+// ParseSelector parses a label selector such as `region=eu,pool!=api`
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		var r requirement
+		switch {
+		case strings.Contains(part, "!="):
+			kv := strings.SplitN(part, "!=", 2)
+			r = requirement{key: kv[0], values: strings.Split(kv[1], "|"), negate: true}
+		case strings.Contains(part, "="):
+			kv := strings.SplitN(strings.Replace(part, "==", "=", 1), "=", 2)
+			r = requirement{key: kv[0], values: strings.Split(kv[1], "|")}
+		case strings.HasPrefix(part, "!"):
+			r = requirement{key: part[1:], negate: true}
+		default:
+			r = requirement{key: part}
+		}
+		r.key = strings.TrimSpace(r.key)
+		if len(r.key) == 0 {
+			return nil, errors.Errorf("selector %s is an invalid format: requirement %s has no label name", s, part)
+		}
+		for i := range r.values {
+			r.values[i] = strings.TrimSpace(r.values[i])
+		}
+		sel = append(sel, r)
+	}
+	return sel, nil
+}
+
+// Matches returns true if labels satisfy every requirement of the selector.  An empty selector matches everything.
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		val, ok := labels[r.key]
+		switch {
+		case len(r.values) == 0:
+			if ok == r.negate {
+				return false
+			}
+		default:
+			if (ok && contains(r.values, val)) == r.negate {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func contains(values []string, v string) bool {
+	for _, val := range values {
+		if val == v {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseLabels parses comma separated `key=value` pairs into a set of instance labels
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || len(key) == 0 {
+			return nil, errors.Errorf("label %s is an invalid format: must be key=value", part)
+		}
+		labels[key] = strings.TrimSpace(kv[1])
+	}
+	return labels, nil
+}
+
+// siteBlock is the range of lines, starting at 1, occupied by a top level block of a Caddyfile
+type siteBlock struct {
+	start int
+	end   int
+}
+
+// selectSites blanks out every site block whose selector does not match the labels of c.  A selector is declared in a
+// comment line, `# etcd.selector: <selector>`, that appears between the previous block and the block it applies
+// to.  Blocks without a selector are always kept.  Removed lines are left empty so that line numbers in errors
+// still point to the published Caddyfile.
+func selectSites(c *ClusterConfig, body []byte, filename string) ([]byte, error) {
+	var lines []string
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	sc.Buffer(make([]byte, 0, 64*1024), len(body)+1)
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	if err := sc.Err(); err != nil {
+		return nil, errors.Wrap(err, "select sites: failed to read caddyfile")
+	}
+	blocks := siteBlocks(body, filename)
+	prev := 0
+	removed := 0
+	for i, b := range blocks {
+		var sel string
+		for n := prev + 1; n < b.start; n++ {
+			if s, ok := selectorComment(lines[n-1]); ok {
+				sel = s
+			}
+		}
+		prev = b.end
+		if len(sel) == 0 {
+			continue
+		}
+		selector, err := ParseSelector(sel)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", filename, b.start)
+		}
+		if selector.Matches(c.Labels) {
+			continue
+		}
+		if (i > 0 && blocks[i-1].end == b.start) || (i < len(blocks)-1 && blocks[i+1].start == b.end) {
+			return nil, errors.Errorf("%s:%d - site blocks with a selector must start and end on their own lines", filename, b.start)
+		}
+		for n := b.start; n <= b.end; n++ {
+			lines[n-1] = ""
+		}
+		removed++
+	}
+	switch {
+	case removed == 0:
+		return body, nil
+	case removed == len(blocks):
+		c.log(LevelWarn, "no site blocks match the labels of this instance", F(FieldKey, filename), F("labels", formatLabels(c.Labels)))
+	}
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
+
+// siteBlocks finds the line ranges of the top level blocks in a Caddyfile by tracking brace nesting
+func siteBlocks(body []byte, filename string) []siteBlock {
+	var blocks []siteBlock
+	d := caddyfile.NewDispenser(filename, bytes.NewReader(body))
+	depth := 0
+	current := siteBlock{}
+	for d.Next() {
+		if depth == 0 && current.start == 0 {
+			current.start = d.Line()
+		}
+		current.end = d.Line()
+		switch d.Val() {
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth <= 0 {
+				blocks = append(blocks, current)
+				current = siteBlock{}
+				depth = 0
+			}
+		}
+	}
+	// a single site without braces
+	if current.start > 0 {
+		blocks = append(blocks, current)
+	}
+	return blocks
+}
+
+func selectorComment(line string) (string, bool) {
+	l := strings.TrimSpace(line)
+	if !strings.HasPrefix(l, "#") {
+		return "", false
+	}
+	l = strings.TrimSpace(strings.TrimPrefix(l, "#"))
+	if !strings.HasPrefix(l, selectorAnnotation) {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(l, selectorAnnotation)), true
+}
+
+// formatLabels returns labels in the same format accepted by ParseLabels
+func formatLabels(labels map[string]string) string {
+	var out []string
+	for k, v := range labels {
+		out = append(out, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(out)
+	return strings.Join(out, ",")
+}
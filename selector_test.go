@@ -0,0 +1,109 @@
+package etcd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelector(t *testing.T) {
+	labels := map[string]string{"region": "eu", "pool": "api"}
+	tcs := []struct {
+		Selector  string
+		Expect    bool
+		ShouldErr bool
+	}{
+		{Selector: "", Expect: true},
+		{Selector: "region=eu", Expect: true},
+		{Selector: "region==eu", Expect: true},
+		{Selector: "region=us", Expect: false},
+		{Selector: "region=us|eu", Expect: true},
+		{Selector: "region=eu, pool=api", Expect: true},
+		{Selector: "region=eu,pool=web", Expect: false},
+		{Selector: "pool!=web", Expect: true},
+		{Selector: "pool!=api", Expect: false},
+		{Selector: "canary!=true", Expect: true},
+		{Selector: "region", Expect: true},
+		{Selector: "canary", Expect: false},
+		{Selector: "!canary", Expect: true},
+		{Selector: "!region", Expect: false},
+		{Selector: "=eu", ShouldErr: true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Selector, func(t *testing.T) {
+			sel, err := ParseSelector(tc.Selector)
+			switch tc.ShouldErr {
+			case true:
+				assert.Error(t, err)
+			default:
+				assert.NoError(t, err)
+				assert.Equal(t, tc.Expect, sel.Matches(labels))
+			}
+		})
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	l, err := ParseLabels("region=eu, pool=api")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"region": "eu", "pool": "api"}, l)
+	_, err = ParseLabels("region")
+	assert.Error(t, err)
+}
+
+func TestSelectSites(t *testing.T) {
+	cf := `(common) {
+	gzip
+}
+
+# etcd.selector: region=eu
+eu.example.com {
+	import common
+	proxy / http://127.0.0.1:8080 {
+		transparent
+	}
+}
+
+# etcd.selector: region=us
+us.example.com {
+	import common
+}
+
+all.example.com {
+	import common
+}
+`
+	tcs := []struct {
+		Name     string
+		Labels   map[string]string
+		Contains []string
+		Missing  []string
+	}{
+		{Name: "eu", Labels: map[string]string{"region": "eu"}, Contains: []string{"(common)", "eu.example.com", "transparent", "all.example.com"}, Missing: []string{"us.example.com"}},
+		{Name: "us", Labels: map[string]string{"region": "us"}, Contains: []string{"(common)", "us.example.com", "all.example.com"}, Missing: []string{"eu.example.com", "transparent"}},
+		{Name: "no labels", Labels: nil, Contains: []string{"(common)", "all.example.com"}, Missing: []string{"eu.example.com", "us.example.com"}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			out, err := selectSites(&ClusterConfig{Labels: tc.Labels}, []byte(cf), "Caddyfile")
+			assert.NoError(t, err)
+			for _, c := range tc.Contains {
+				assert.Contains(t, string(out), c)
+			}
+			for _, m := range tc.Missing {
+				assert.NotContains(t, string(out), m)
+			}
+			// line numbers are preserved for error messages
+			assert.Equal(t, countLines([]byte(cf)), countLines(out))
+			assert.NoError(t, ValidateCaddyfile(out, "Caddyfile", "http"))
+		})
+	}
+
+	// removed blocks must not share a line with a kept block
+	_, err := selectSites(&ClusterConfig{}, []byte("a.example.com {\n}\n# etcd.selector: region=us\nb.example.com {\n} c.example.com {\n}"), "Caddyfile")
+	assert.Error(t, err)
+}
+
+func countLines(b []byte) int {
+	return len(splitLines(b))
+}
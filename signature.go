@@ -0,0 +1,149 @@
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/cenkalti/backoff"
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/client"
+	"golang.org/x/crypto/ed25519"
+)
+
+// signatureSuffix is appended to a key to find the detached signature of its value
+const signatureSuffix = ".sig"
+
+// Sign returns a detached Ed25519 signature of a Caddyfile to be stored beside it at key, relative to the key
+// prefix.  The signature covers the key as well as the body, so it is refused if it is copied to another key.
+func Sign(priv ed25519.PrivateKey, key string, body []byte) []byte {
+	return ed25519.Sign(priv, signedMessage(key, body))
+}
+
+// signedMessage returns the message that is signed for body stored at key, relative to the key prefix.  The key is
+// relative so that signatures remain valid when keys are restored or migrated under another prefix.
+func signedMessage(key string, body []byte) []byte {
+	return append([]byte(key+"\n"), body...)
+}
+
+// SignKey signs the value currently stored at key, such as a per-site key or an imported snippet, and stores the
+// signature beside it.  Key is relative to the key prefix.
+func SignKey(c *ClusterConfig, priv ed25519.PrivateKey, key string) error {
+	srv := NewService(c)
+	if err := srv.Lock(key); err != nil {
+		return errors.Wrap(err, "sign: failed to get lock")
+	}
+	defer srv.Unlock(key)
+	cli, err := getClient(c)
+	if err != nil {
+		return errors.Wrap(err, "sign: failed to get client")
+	}
+	dst := new(bytes.Buffer)
+	if err := backoff.Retry(get(cli, path.Join(c.KeyPrefix, key), dst), backoff.NewExponentialBackOff()); err != nil {
+		return errors.Wrap(err, "sign: failed to get value")
+	}
+	if dst.Len() == 0 {
+		return NotExist{key}
+	}
+	return srv.Store(key+signatureSuffix, Sign(priv, key, dst.Bytes()))
+}
+
+// NewSigningKey returns a random Ed25519 key pair, base64 encoded.  The public key is added to the trusted keys
+// of each instance and the private key is kept by whoever publishes Caddyfiles.
+func NewSigningKey() (pub string, priv string, err error) {
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", errors.Wrap(err, "sign: failed to generate key")
+	}
+	return base64.StdEncoding.EncodeToString(pubKey), base64.StdEncoding.EncodeToString(privKey), nil
+}
+
+// ReadPrivateKey reads a base64 encoded Ed25519 private key from a file
+func ReadPrivateKey(p string) (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read private key")
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, errors.Errorf("%s is not a base64 encoded Ed25519 private key", p)
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+// ParsePublicKeys parses base64 encoded Ed25519 public keys, one per line.  Empty lines and lines starting
+// with # are ignored.
+func ParsePublicKeys(b []byte) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.Errorf("%s is not a base64 encoded Ed25519 public key", line)
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+	return keys, nil
+}
+
+// verifier checks the detached signatures of Caddyfiles loaded from etcd against the trusted public keys.  With
+// no trusted keys configured, signatures are not checked.
+type verifier struct {
+	cli    client.KeysAPI
+	prefix string
+	keys   []ed25519.PublicKey
+}
+
+func newVerifier(c *ClusterConfig, cli client.KeysAPI) *verifier {
+	return &verifier{cli: cli, prefix: c.KeyPrefix, keys: c.TrustedKeys}
+}
+
+// verify returns an `InvalidSignature` error unless the signature stored beside key is a valid signature of key
+// and body by one of the trusted keys.  Reading the signature stops when ctx is done.
+func (v *verifier) verify(ctx context.Context, key string, body []byte) error {
+	if v == nil || len(v.keys) == 0 {
+		return nil
+	}
+	var sig []byte
+	getSig := func() error {
+		resp, err := v.cli.Get(ctx, key+signatureSuffix, nil)
+		if err != nil {
+			switch {
+			case client.IsKeyNotFound(err):
+				return nil
+			default:
+				return errors.Wrap(err, "verify: error retrieving signature")
+			}
+		}
+		sig, err = base64.StdEncoding.DecodeString(resp.Node.Value)
+		if err != nil {
+			return backoff.Permanent(errors.Wrap(err, "verify: error decoding base64 signature"))
+		}
+		return nil
+	}
+	if err := backoff.Retry(getSig, backoff.WithContext(backoff.NewExponentialBackOff(), ctx)); err != nil {
+		return err
+	}
+	if len(sig) == 0 {
+		return InvalidSignature{Key: key, Reason: "no signature found"}
+	}
+	msg := signedMessage(strings.TrimPrefix(key, v.prefix+"/"), body)
+	for _, pub := range v.keys {
+		if ed25519.Verify(pub, msg, sig) {
+			return nil
+		}
+	}
+	return InvalidSignature{Key: key, Reason: "signature does not match any trusted key"}
+}
+
+// isSignature returns true for keys that hold a detached signature
+func isSignature(key string) bool {
+	return strings.HasSuffix(key, signatureSuffix)
+}
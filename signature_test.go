@@ -0,0 +1,114 @@
+package etcd
+
+import (
+	"context"
+	"encoding/base64"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/client"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestParsePublicKeys(t *testing.T) {
+	pub, _, err := NewSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcs := []struct {
+		Name   string
+		Input  string
+		Expect int
+		Err    bool
+	}{
+		{Name: "single", Input: pub, Expect: 1},
+		{Name: "comments", Input: "# ops\n" + pub + "\n\n# ci\n" + pub + "\n", Expect: 2},
+		{Name: "empty", Input: "", Expect: 0},
+		{Name: "not base64", Input: "not a key", Err: true},
+		{Name: "wrong size", Input: base64.StdEncoding.EncodeToString([]byte("short")), Err: true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			keys, err := ParsePublicKeys([]byte(tc.Input))
+			switch {
+			case tc.Err:
+				assert.Error(t, err)
+			default:
+				assert.NoError(t, err)
+				assert.Len(t, keys, tc.Expect)
+			}
+		})
+	}
+}
+
+func TestSignatures(t *testing.T) {
+	if !shouldRunIntegration() {
+		t.Skip("no etcd server found, skipping")
+	}
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ClusterConfig{
+		KeyPrefix:   "/testsignature",
+		ServerIP:    []string{"http://127.0.0.1:2379"},
+		TrustedKeys: []ed25519.PublicKey{pub},
+	}
+	cli, err := getClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = cli.Delete(context.Background(), cfg.KeyPrefix, &client.DeleteOptions{Recursive: true})
+	h := NewHistory(cfg, "http")
+	srv := NewService(cfg)
+	v := newVerifier(cfg, cli)
+	p := path.Join(cfg.KeyPrefix, caddyfileKey("http"))
+	cf1 := []byte("cf1.cluster.local {\n\timport snippets/*\n}")
+	cf2 := []byte("cf2.cluster.local {\n\tproxy / test:123\n}")
+
+	// unsigned imports are refused
+	assert.NoError(t, srv.Store("snippets/gzip", []byte("gzip")))
+	_, err = expandImports(context.Background(), cfg, cli, cf1, p, v)
+	assert.True(t, IsInvalidSignatureError(err))
+	assert.NoError(t, SignKey(cfg, priv, "snippets/gzip"))
+	out, err := expandImports(context.Background(), cfg, cli, cf1, p, v)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(out), signatureSuffix)
+
+	// a signature copied to another key with the same value is refused
+	sig, err := srv.Load("snippets/gzip" + signatureSuffix)
+	assert.NoError(t, err)
+	assert.NoError(t, srv.Store("snippets/compress", []byte("gzip")))
+	assert.NoError(t, srv.Store("snippets/compress"+signatureSuffix, sig))
+	assert.Equal(t, InvalidSignature{Key: path.Join(cfg.KeyPrefix, "snippets/compress"), Reason: "signature does not match any trusted key"}, v.verify(context.Background(), path.Join(cfg.KeyPrefix, "snippets/compress"), []byte("gzip")))
+	assert.NoError(t, srv.Delete("snippets/compress"+signatureSuffix))
+	assert.NoError(t, srv.Delete("snippets/compress"))
+
+	r1, err := h.PublishSigned(cf1, Sign(priv, h.Key(), cf1), "test")
+	assert.NoError(t, err)
+	assert.NoError(t, v.verify(context.Background(), p, cf1))
+	assert.True(t, IsInvalidSignatureError(v.verify(context.Background(), p, cf2)))
+
+	// an unsigned publish removes the previous signature
+	_, err = h.Publish(cf2, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, InvalidSignature{Key: p, Reason: "no signature found"}, v.verify(context.Background(), p, cf2))
+
+	// signed by a key that is not trusted
+	_, err = h.PublishSigned(cf2, Sign(other, h.Key(), cf2), "test")
+	assert.NoError(t, err)
+	assert.True(t, IsInvalidSignatureError(v.verify(context.Background(), p, cf2)))
+
+	// rollback restores the original signature
+	_, err = h.Rollback(r1.ID, "test")
+	assert.NoError(t, err)
+	assert.NoError(t, v.verify(context.Background(), p, cf1))
+
+	// no trusted keys disables verification
+	assert.NoError(t, newVerifier(&ClusterConfig{}, cli).verify(context.Background(), p, cf2))
+}
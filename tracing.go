@@ -0,0 +1,217 @@
+package etcd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SpanData is a finished span.  Each storage operation is a root span, with a child span for every etcd round
+// trip it makes, one per attempt, and for every backoff between attempts.
+type SpanData struct {
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]interface{}
+	Error      string
+}
+
+// Duration returns how long the span took
+func (s SpanData) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// Exporter receives spans as they end.  Implementations must be safe for concurrent use and should not block,
+// since spans are exported from the storage operation that produced them.
+type Exporter interface {
+	Export(s SpanData)
+}
+
+// Tracer creates spans for storage operations and passes them to its exporter when they end.  A nil Tracer does
+// not trace.
+type Tracer struct {
+	exporter Exporter
+}
+
+// NewTracer returns a tracer that exports spans to e
+func NewTracer(e Exporter) *Tracer {
+	return &Tracer{exporter: e}
+}
+
+// span is a span in progress.  Methods on a nil span do nothing, so code paths do not need to check whether
+// tracing is enabled.
+type span struct {
+	tracer *Tracer
+	// redactKeys replaces storage keys of private keys in attributes and errors, see ClusterConfig.RedactKeyNames
+	redactKeys bool
+	mu         sync.Mutex
+	data       SpanData
+}
+
+// start begins a root span
+func (t *Tracer) start(name string, redactKeys bool, attrs ...Field) *span {
+	if t == nil || t.exporter == nil {
+		return nil
+	}
+	return t.newSpan(randomID(16), "", name, redactKeys, attrs)
+}
+
+func (t *Tracer) newSpan(trace string, parent string, name string, redactKeys bool, attrs []Field) *span {
+	s := &span{tracer: t, redactKeys: redactKeys, data: SpanData{
+		TraceID:    trace,
+		SpanID:     randomID(8),
+		ParentID:   parent,
+		Name:       name,
+		Start:      time.Now(),
+		Attributes: make(map[string]interface{}),
+	}}
+	s.set(attrs...)
+	return s
+}
+
+// child begins a span whose parent is s
+func (s *span) child(name string, attrs ...Field) *span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.newSpan(s.data.TraceID, s.data.SpanID, name, s.redactKeys, attrs)
+}
+
+// set adds attributes to the span.  Attributes are redacted the same way as log fields.
+func (s *span) set(attrs ...Field) {
+	if s == nil {
+		return
+	}
+	_, attrs = redact("", attrs, s.redactKeys)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range attrs {
+		s.data.Attributes[a.Key] = a.Value
+	}
+}
+
+// end finishes the span with err, if any, and exports it
+func (s *span) end(err error) {
+	s.finish(func(start time.Time) time.Time { return time.Now() }, err)
+}
+
+// endAfter finishes the span d after it started, which is used for backoff spans whose end is known when they start
+func (s *span) endAfter(d time.Duration, err error) {
+	s.finish(func(start time.Time) time.Time { return start.Add(d) }, err)
+}
+
+func (s *span) finish(end func(start time.Time) time.Time, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.data.End = end(s.data.Start)
+	if err != nil {
+		s.data.Error = redactString(err.Error(), s.redactKeys)
+	}
+	d := s.data
+	s.mu.Unlock()
+	s.tracer.exporter.Export(d)
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return strings.Repeat("0", 2*n)
+	}
+	return hex.EncodeToString(b)
+}
+
+// MemoryExporter keeps every span it receives in memory, for tests
+type MemoryExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+// NewMemoryExporter returns an empty in-memory exporter
+func NewMemoryExporter() *MemoryExporter {
+	return new(MemoryExporter)
+}
+
+// Export fulfills the Exporter interface
+func (m *MemoryExporter) Export(s SpanData) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.spans = append(m.spans, s)
+}
+
+// Spans returns the spans exported so far, in the order they ended
+func (m *MemoryExporter) Spans() []SpanData {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]SpanData, len(m.spans))
+	copy(out, m.spans)
+	return out
+}
+
+// Reset removes every span
+func (m *MemoryExporter) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.spans = nil
+}
+
+// logExporter writes each span to the log of the configuration it was created for
+type logExporter struct {
+	cfg *ClusterConfig
+}
+
+func (l logExporter) Export(s SpanData) {
+	fields := []Field{F("trace_id", s.TraceID), F("span_id", s.SpanID), F("parent_id", s.ParentID), F("span", s.Name), F(FieldDuration, s.Duration())}
+	keys := make([]string, 0, len(s.Attributes))
+	for k := range s.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fields = append(fields, F(k, s.Attributes[k]))
+	}
+	if len(s.Error) > 0 {
+		fields = append(fields, F(FieldError, s.Error))
+	}
+	l.cfg.log(LevelInfo, "span", fields...)
+}
+
+// traceExporters holds the exporters that can be selected with CADDY_CLUSTERING_ETCD_TRACE
+var traceExporters = struct {
+	sync.Mutex
+	byName map[string]func(c *ClusterConfig) (Exporter, error)
+}{byName: map[string]func(c *ClusterConfig) (Exporter, error){
+	"log": func(c *ClusterConfig) (Exporter, error) { return logExporter{cfg: c}, nil },
+}}
+
+// RegisterTraceExporter makes an exporter available by name to CADDY_CLUSTERING_ETCD_TRACE.  It is meant to be
+// called from the init function of a plugin that sends spans to a tracing backend.  The exporter `log`, which
+// writes each span to the plugin log, is always available.
+func RegisterTraceExporter(name string, f func(c *ClusterConfig) (Exporter, error)) {
+	traceExporters.Lock()
+	defer traceExporters.Unlock()
+	if _, ok := traceExporters.byName[name]; ok {
+		panic(fmt.Sprintf("trace exporter %s is already registered", name))
+	}
+	traceExporters.byName[name] = f
+}
+
+func traceExporter(name string) (func(c *ClusterConfig) (Exporter, error), error) {
+	traceExporters.Lock()
+	defer traceExporters.Unlock()
+	f, ok := traceExporters.byName[name]
+	if !ok {
+		return nil, errors.Errorf("%s is not a registered trace exporter", name)
+	}
+	return f, nil
+}
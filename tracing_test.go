@@ -0,0 +1,102 @@
+package etcd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// names returns the names of spans in the order they ended
+func names(spans []SpanData) []string {
+	var out []string
+	for _, s := range spans {
+		out = append(out, s.Name)
+	}
+	return out
+}
+
+func TestRetrySpans(t *testing.T) {
+	mem := NewMemoryExporter()
+	o := &operation{name: "tracetest", key: "certs/one", span: NewTracer(mem).start("tracetest", false, F("value", []byte("secret")))}
+	calls := 0
+	flaky := func() error {
+		calls++
+		if calls == 1 {
+			return errors.New("etcd cluster is unavailable")
+		}
+		return nil
+	}
+	b := backoff.WithMaxRetries(backoff.NewConstantBackOff(time.Millisecond), 2)
+	assert.NoError(t, pipeline(o, tx(o.step("set", "/caddy/certs/one", flaky)), nil, b))
+	var err error
+	o.end(&err)
+
+	spans := mem.Spans()
+	assert.Equal(t, []string{"set", "backoff", "set", "tracetest"}, names(spans))
+	root := spans[3]
+	assert.Empty(t, root.ParentID)
+	assert.Equal(t, redacted, root.Attributes["value"])
+	for _, s := range spans[:3] {
+		assert.Equal(t, root.TraceID, s.TraceID)
+		assert.Equal(t, root.SpanID, s.ParentID)
+	}
+	assert.Equal(t, 1, spans[0].Attributes[FieldAttempt])
+	assert.Equal(t, "/caddy/certs/one", spans[0].Attributes[FieldKey])
+	assert.Equal(t, "etcd cluster is unavailable", spans[0].Error)
+	assert.Equal(t, time.Millisecond, spans[1].Duration())
+	assert.Equal(t, 2, spans[2].Attributes[FieldAttempt])
+	assert.Empty(t, spans[2].Error)
+}
+
+func TestTraceExporter(t *testing.T) {
+	c, err := NewClusterConfig(WithTraceExporter("log"))
+	assert.NoError(t, err)
+	assert.NotNil(t, c.Tracer)
+	_, err = NewClusterConfig(WithTraceExporter("zipkin"))
+	assert.Error(t, err)
+
+	c, err = NewClusterConfig()
+	assert.NoError(t, err)
+	assert.Nil(t, c.Tracer)
+	assert.Nil(t, c.Tracer.start("store", false))
+}
+
+func TestStorageSpans(t *testing.T) {
+	mem := NewMemoryExporter()
+	cfg, _, done := testPrefix(t, "tracing")
+	defer done()
+	cfg.Tracer = NewTracer(mem)
+	srv := NewService(cfg)
+
+	tcs := []struct {
+		Name   string
+		Call   func() error
+		Expect []string
+	}{
+		{Name: "lock", Call: func() error { return srv.Lock("certs/one") }, Expect: []string{"acquire", "lock"}},
+		{Name: "store new", Call: func() error { return srv.Store("certs/one", []byte("12345")) }, Expect: []string{"exists", "set", "setMD", "store"}},
+		{Name: "store existing", Call: func() error { return srv.Store("certs/one", []byte("123")) }, Expect: []string{"exists", "get", "getMD", "set", "setMD", "store"}},
+		{Name: "load", Call: func() error { _, err := srv.Load("certs/one"); return err }, Expect: []string{"exists", "getMD", "get", "load"}},
+		{Name: "list", Call: func() error { _, err := srv.List("certs"); return err }, Expect: []string{"list", "list"}},
+		{Name: "delete", Call: func() error { return srv.Delete("certs/one") }, Expect: []string{"getMD", "del", "del", "delete"}},
+		{Name: "unlock", Call: func() error { return srv.Unlock("certs/one") }, Expect: []string{"release", "unlock"}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			mem.Reset()
+			assert.NoError(t, tc.Call())
+			spans := mem.Spans()
+			assert.Equal(t, tc.Expect, names(spans))
+			root := spans[len(spans)-1]
+			assert.Equal(t, tc.Name[:len(root.Name)], root.Name)
+			for _, s := range spans[:len(spans)-1] {
+				assert.Equal(t, root.SpanID, s.ParentID)
+				assert.False(t, s.Start.Before(root.Start))
+				assert.False(t, s.End.After(root.End))
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package etcd
+
+import (
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mholt/certmagic"
+	"github.com/pkg/errors"
+)
+
+// UploadOptions controls where an uploaded certificate is stored
+type UploadOptions struct {
+	// CA is the ACME directory URL Caddy is configured with, since certmagic looks for the certificates of a site
+	// under the CA it uses.  It defaults to certmagic.CA, Let's Encrypt.
+	CA string
+	// Domain is the site the certificate is stored for.  It defaults to the first name on the certificate and must
+	// be covered by the certificate.
+	Domain string
+	// Force overwrites a certificate that Caddy obtained from the CA
+	Force bool
+}
+
+// Upload describes a certificate stored by UploadCertificate.  Replaced is true when a certificate was already
+// stored for the site.
+type Upload struct {
+	Domain   string
+	Names    []string
+	NotAfter time.Time
+	Keys     []string
+	Replaced bool
+}
+
+// siteMeta is the metadata certmagic stores next to a certificate.  A certificate obtained from the CA has its
+// URL, an uploaded certificate has none.
+type siteMeta struct {
+	Domain        string `json:"domain"`
+	CertURL       string `json:"certUrl"`
+	CertStableURL string `json:"certStableUrl"`
+}
+
+// UploadCertificate stores a PEM encoded certificate chain and private key obtained outside of Caddy where certmagic
+// looks for the certificate of the site, so every instance serves it until Caddy renews it from the CA.  The keys are
+// written under the site lock, see lockSite, and put back as they were if a write fails.
+func UploadCertificate(c *ClusterConfig, chain []byte, key []byte, opts UploadOptions) (*Upload, error) {
+	leaf, err := parseUpload(chain, key)
+	if err != nil {
+		return nil, err
+	}
+	names := certificateNames(leaf)
+	domain := strings.ToLower(strings.TrimSpace(opts.Domain))
+	switch {
+	case len(domain) == 0 && len(names) == 0:
+		return nil, errors.New("upload: the certificate has no names, set the domain")
+	case len(domain) == 0:
+		domain = names[0]
+	case !covers(names, domain):
+		return nil, errors.Errorf("upload: the certificate does not cover %s", domain)
+	}
+	ca := opts.CA
+	if len(ca) == 0 {
+		ca = certmagic.CA
+	}
+	meta, err := json.MarshalIndent(siteMeta{Domain: domain}, "", "\t")
+	if err != nil {
+		return nil, errors.Wrap(err, "upload: failed to encode metadata")
+	}
+	u := &Upload{
+		Domain:   domain,
+		Names:    names,
+		NotAfter: leaf.NotAfter,
+		Keys: []string{
+			certmagic.StorageKeys.SiteCert(ca, domain),
+			certmagic.StorageKeys.SitePrivateKey(ca, domain),
+			certmagic.StorageKeys.SiteMeta(ca, domain),
+		},
+	}
+	values := [][]byte{chain, key, meta}
+
+	srv := NewService(c)
+	unlock, err := lockSite(srv, domain, u.Keys)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	prev := make([][]byte, len(u.Keys))
+	for i, k := range u.Keys {
+		v, err := srv.Load(k)
+		switch {
+		case err == nil:
+			prev[i] = v
+		case !IsNotExistError(err):
+			return nil, errors.Wrapf(err, "upload: failed to read %s", k)
+		}
+	}
+	u.Replaced = prev[0] != nil
+	if u.Replaced && !opts.Force {
+		var m siteMeta
+		if prev[2] == nil || json.Unmarshal(prev[2], &m) != nil || len(m.CertURL) > 0 {
+			return nil, errors.Errorf("upload: %s holds a certificate obtained by Caddy, use force to overwrite it", u.Keys[0])
+		}
+	}
+	for i, k := range u.Keys {
+		if err := srv.Store(k, values[i]); err != nil {
+			restoreUpload(c, srv, u.Keys[:i], prev)
+			return nil, errors.Wrapf(err, "upload: failed to store %s", k)
+		}
+	}
+	detail := fmt.Sprintf("serial %x expiring %s", leaf.SerialNumber, leaf.NotAfter.Format(time.RFC3339))
+	if u.Replaced && opts.Force {
+		detail += ", forced"
+	}
+	var oldHash [20]byte
+	if u.Replaced {
+		oldHash = sha1.Sum(prev[0])
+	}
+	audit(c, AuditUpload, u.Keys[0], oldHash, sha1.Sum(chain), detail)
+	return u, nil
+}
+
+// restoreUpload puts back the values of keys that were written before an upload failed
+func restoreUpload(c *ClusterConfig, srv Service, keys []string, prev [][]byte) {
+	for i, k := range keys {
+		var err error
+		if prev[i] == nil {
+			err = srv.Delete(k)
+		} else {
+			err = srv.Store(k, prev[i])
+		}
+		if err != nil {
+			c.log(LevelError, "failed to restore key after a failed upload", F(FieldKey, k), F(FieldError, err))
+		}
+	}
+}
+
+// covers returns true if a certificate for names is valid for domain
+func covers(names []string, domain string) bool {
+	for _, name := range names {
+		if name == domain || (strings.HasPrefix(name, "*.") && wildcard(domain) == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseUpload checks that key matches the first certificate of chain and that it is valid now, and returns it
+func parseUpload(chain []byte, key []byte) (*x509.Certificate, error) {
+	pair, err := tls.X509KeyPair(chain, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "upload: invalid certificate or key")
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "upload: invalid certificate")
+	}
+	now := time.Now()
+	switch {
+	case now.After(leaf.NotAfter):
+		return nil, errors.Errorf("upload: the certificate expired at %s", leaf.NotAfter.Format(time.RFC3339))
+	case now.Before(leaf.NotBefore):
+		return nil, errors.Errorf("upload: the certificate is not valid until %s", leaf.NotBefore.Format(time.RFC3339))
+	}
+	return leaf, nil
+}
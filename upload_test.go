@@ -0,0 +1,85 @@
+package etcd
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadCertificate(t *testing.T) {
+	cfg, _, done := testPrefix(t, "upload")
+	defer done()
+	srv := NewService(cfg)
+	now := time.Now()
+	day := 24 * time.Hour
+	staging := "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+	// a certificate obtained by Caddy, which is only overwritten with force
+	acme := testCertificate(t, 1, now.Add(60*day), "api.example.com")
+	assert.NoError(t, srv.Store("acme/acme-staging-v02.api.letsencrypt.org/sites/api.example.com/api.example.com.crt", acme.crt))
+	assert.NoError(t, srv.Store("acme/acme-staging-v02.api.letsencrypt.org/sites/api.example.com/api.example.com.json", []byte(`{"domain":"api.example.com","certUrl":"https://acme-staging-v02.api.letsencrypt.org/acme/cert/1"}`)))
+
+	shop := testCertificate(t, 2, now.Add(365*day), "shop.example.com", "www.shop.example.com")
+	renewed := testCertificate(t, 3, now.Add(400*day), "shop.example.com")
+	wild := testCertificate(t, 4, now.Add(365*day), "*.example.com")
+	expired := testCertificate(t, 5, now.Add(-time.Hour), "old.example.com")
+	tcs := []struct {
+		Name      string
+		Crt       []byte
+		Key       []byte
+		Opts      UploadOptions
+		Domain    string
+		Dir       string
+		Replaced  bool
+		ShouldErr bool
+	}{
+		{Name: "new site", Crt: shop.crt, Key: shop.key, Domain: "shop.example.com", Dir: "acme/acme-v02.api.letsencrypt.org/sites/shop.example.com"},
+		{Name: "replace an uploaded certificate", Crt: renewed.crt, Key: renewed.key, Domain: "shop.example.com", Dir: "acme/acme-v02.api.letsencrypt.org/sites/shop.example.com", Replaced: true},
+		{Name: "certificate obtained by Caddy", Crt: wild.crt, Key: wild.key, Opts: UploadOptions{CA: staging, Domain: "api.example.com"}, ShouldErr: true},
+		{Name: "certificate obtained by Caddy with force", Crt: wild.crt, Key: wild.key, Opts: UploadOptions{CA: staging, Domain: "API.example.com", Force: true}, Domain: "api.example.com", Dir: "acme/acme-staging-v02.api.letsencrypt.org/sites/api.example.com", Replaced: true},
+		{Name: "key does not match", Crt: shop.crt, Key: renewed.key, ShouldErr: true},
+		{Name: "domain not covered", Crt: shop.crt, Key: shop.key, Opts: UploadOptions{Domain: "other.example.com"}, ShouldErr: true},
+		{Name: "wildcard covers one label", Crt: wild.crt, Key: wild.key, Opts: UploadOptions{Domain: "a.b.example.com"}, ShouldErr: true},
+		{Name: "expired", Crt: expired.crt, Key: expired.key, ShouldErr: true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			u, err := UploadCertificate(cfg, tc.Crt, tc.Key, tc.Opts)
+			if tc.ShouldErr {
+				assert.Error(t, err)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tc.Domain, u.Domain)
+			assert.Equal(t, tc.Replaced, u.Replaced)
+			assert.Equal(t, []string{path.Join(tc.Dir, tc.Domain+".crt"), path.Join(tc.Dir, tc.Domain+".key"), path.Join(tc.Dir, tc.Domain+".json")}, u.Keys)
+			for i, want := range [][]byte{tc.Crt, tc.Key} {
+				value, err := srv.Load(u.Keys[i])
+				assert.NoError(t, err)
+				assert.Equal(t, want, value)
+			}
+			locks, err := ListLocks(cfg)
+			assert.NoError(t, err)
+			assert.Empty(t, locks, "the site lock and key locks are released")
+		})
+	}
+
+	value, err := srv.Load("acme/acme-staging-v02.api.letsencrypt.org/sites/api.example.com/api.example.com.crt")
+	assert.NoError(t, err)
+	assert.Equal(t, wild.crt, value)
+	assert.NoError(t, FlushAudit(time.Minute))
+	entries, err := NewAudit(cfg).List()
+	assert.NoError(t, err)
+	var forced int
+	for _, e := range entries {
+		if e.Operation == AuditUpload && e.Detail != "" && e.Key == "acme/acme-staging-v02.api.letsencrypt.org/sites/api.example.com/api.example.com.crt" {
+			assert.Contains(t, e.Detail, "forced")
+			forced++
+		}
+	}
+	assert.Equal(t, 1, forced)
+}
@@ -0,0 +1,34 @@
+package etcd
+
+import (
+	"bytes"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyfile"
+	"github.com/pkg/errors"
+)
+
+// ValidateCaddyfile checks body before it is published to etcd or loaded.  The Caddyfile is parsed and each
+// directive name is checked against the directives of servertype, which must be plugged in to Caddy, otherwise an
+// error is returned rather than a Caddyfile that was never really checked.  The directives are not set up, as the
+// http server type would start this plugin to do so.  Failures are returned as an `InvalidCaddyfile` error with a
+// line-numbered message.
+func ValidateCaddyfile(body []byte, filename string, servertype string) error {
+	directives := caddy.ValidDirectives(servertype)
+	if len(directives) == 0 {
+		return errors.Errorf("validate: server type %s is not plugged in to Caddy", servertype)
+	}
+	if _, err := caddyfile.Parse(filename, bytes.NewReader(body), directives); err != nil {
+		return InvalidCaddyfile{err}
+	}
+	return nil
+}
+
+// ValidateCaddyfileSyntax checks only the syntax of body, without knowing the directives of its server type.
+// Failures are returned as an `InvalidCaddyfile` error with a line-numbered message.
+func ValidateCaddyfileSyntax(body []byte, filename string) error {
+	if _, err := caddyfile.Parse(filename, bytes.NewReader(body), nil); err != nil {
+		return InvalidCaddyfile{err}
+	}
+	return nil
+}
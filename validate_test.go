@@ -0,0 +1,61 @@
+package etcd
+
+import (
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/stretchr/testify/assert"
+)
+
+// Caddy's http and dns server types are not dependencies of the plugin, so the tests plug in stand-ins with the
+// directives they use
+func init() {
+	directives := []string{"basicauth", "gzip", "header", "proxy", "whoami"}
+	for _, servertype := range []string{"http", "dns"} {
+		caddy.RegisterServerType(servertype, caddy.ServerType{
+			Directives:   func() []string { return directives },
+			DefaultInput: func() caddy.Input { return nil },
+		})
+	}
+}
+
+func TestValidateCaddyfile(t *testing.T) {
+	tcs := []struct {
+		Name      string
+		Body      string
+		Line      string
+		ShouldErr bool
+	}{
+		{Name: "ok", Body: "example.com {\n\tproxy / http://127.0.0.1:8080\n}", ShouldErr: false},
+		{Name: "snippet", Body: "(common) {\n\tgzip\n}\nexample.com {\n\timport common\n}", ShouldErr: false},
+		{Name: "unclosed block", Body: "example.com {\n\tproxy / http://127.0.0.1:8080\n", Line: "/caddy/caddyfile:2", ShouldErr: true},
+		{Name: "missing import argument", Body: "example.com {\n\tgzip\n\timport\n}", Line: "/caddy/caddyfile:3", ShouldErr: true},
+		{Name: "unknown directive", Body: "example.com {\n\tgzip\n\tproxxy / http://127.0.0.1:8080\n}", Line: "/caddy/caddyfile:3", ShouldErr: true},
+		{Name: "directive arguments are not checked", Body: "example.com {\n\tgzip\n\tproxy\n}", ShouldErr: false},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := ValidateCaddyfile([]byte(tc.Body), "/caddy/caddyfile", "http")
+			switch tc.ShouldErr {
+			case true:
+				assert.Error(t, err)
+				assert.True(t, IsInvalidCaddyfileError(err))
+				assert.Contains(t, err.Error(), tc.Line)
+			default:
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateCaddyfileSyntax(t *testing.T) {
+	body := []byte("example.com {\n\tproxxy /\n}")
+	// a server type that is not plugged in is an error, not a Caddyfile that passes
+	err := ValidateCaddyfile(body, "/caddy/caddyfile", "nope")
+	assert.Error(t, err)
+	assert.False(t, IsInvalidCaddyfileError(err))
+	assert.NoError(t, ValidateCaddyfileSyntax(body, "/caddy/caddyfile"))
+	err = ValidateCaddyfileSyntax([]byte("example.com {\n\tproxy /\n"), "/caddy/caddyfile")
+	assert.True(t, IsInvalidCaddyfileError(err))
+	assert.Contains(t, err.Error(), "/caddy/caddyfile:2")
+}